@@ -17,6 +17,9 @@ type Application interface {
   // If the perma blob belongs to the local user, then this signal comes directly after Signal_AcceptedInvitation.
   Signal_ProcessedKeep(perma grapher.PermaNode, keep grapher.KeepNode)
   Blob(perma grapher.PermaNode, blob grapher.OTNode)
+  // This function is called when opening a perma blob for which a snapshot exists.
+  // The blobs covered by the snapshot are not passed to Blob.
+  Snapshot(perma grapher.PermaNode, snapshot grapher.SnapshotNode)
 }
 
 // The API layer as seen by the application.
@@ -25,6 +28,9 @@ type API interface {
   SetApplication(app Application)
   Open(perma_blobref string, startWithSeqNumber int64) os.Error
   Close(perma_blobref string)
+  // Stores the state of the application after processing all blobs with a sequence number smaller than seqNumber.
+  // When the perma blob is opened the next time, the application receives the snapshot instead of these blobs.
+  StoreSnapshot(perma_blobref string, seqNumber int64, content []byte) os.Error
 }
 
 type uniAPI struct {
@@ -68,6 +74,10 @@ func (self *uniAPI) Close(perma_blobref string) {
   return
 }
 
+func (self *uniAPI) StoreSnapshot(perma_blobref string, seqNumber int64, content []byte) os.Error {
+  return self.grapher.StoreSnapshot(perma_blobref, seqNumber, content)
+}
+
 func (self* uniAPI) Signal_ReceivedInvitation(perma grapher.PermaNode, permission grapher.PermissionNode) {
   self.app.Signal_ReceivedInvitation(perma, permission)
 }
@@ -91,6 +101,19 @@ func (self* uniAPI) Blob_Permission(perma grapher.PermaNode, permission grapher.
   self.blob(perma, permission)
 }
 
+func (self* uniAPI) Blob_Snapshot(perma grapher.PermaNode, snapshot grapher.SnapshotNode) {
+  self.mutex.Lock()
+  nextSeqNumber, ok := self.open[perma.BlobRef()]
+  // Ignore the snapshot if the perma blob is not open or if the application has seen these blobs already
+  if !ok || nextSeqNumber >= snapshot.SequenceNumber() {
+    self.mutex.Unlock()
+    return
+  }
+  self.open[perma.BlobRef()] = snapshot.SequenceNumber()
+  self.mutex.Unlock()
+  self.app.Snapshot(perma, snapshot)
+}
+
 func (self* uniAPI) blob(perma grapher.PermaNode, blob grapher.OTNode) {
   log.Printf("API blob %v", blob.SequenceNumber())
   self.mutex.Lock()
@@ -0,0 +1,303 @@
+package lightwavefed
+
+import (
+  "bytes"
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "fmt"
+  "http"
+  "json"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Servers authenticate each other by signing their requests with the RSA key of their domain (PKCS #1 v1.5 over SHA-256).
+// The signature covers the method, the host and path of the recipient, the query, the domain of the sender,
+// the date, a random nonce and a hash of the body. Hence, a request cannot be replayed against another server or endpoint.
+// The receiver remembers the nonces it has seen while their date is acceptable. Hence, a request cannot be replayed at all.
+// The receiver obtains the public key of the sender's domain from the NameService.
+// Authentication is turned on by SetServerKey. Until then, requests are not signed and incoming requests
+// are rejected, unless DisableAuthentication has been called.
+const (
+  headerDomain = "X-Lightwave-Domain"
+  headerDate = "X-Lightwave-Date"
+  headerNonce = "X-Lightwave-Nonce"
+  headerSignature = "X-Lightwave-Signature"
+  // Seconds by which the date of a request may differ from the local clock
+  maxClockSkew = 300
+  // The maximum number of nonces which are remembered. Further requests are rejected until old nonces expire.
+  maxSeenNonces = 100000
+  // The number of public keys which are looked up per second for domains which are not cached
+  keyLookupRate = 10
+  keyLookupBurst = 20
+  // The maximum number of cached public keys
+  maxCachedKeys = 1000
+)
+
+// A public key obtained from the NameService
+type keyEntry struct {
+  key *rsa.PublicKey
+  err os.Error
+  // Time in nanoseconds when the entry becomes stale
+  expires int64
+}
+
+// Caches the public keys of remote domains. The sender's domain is taken from a request header
+// before the request has been authenticated. Therefore, lookups of domains which are not cached are rate limited.
+type keyCache struct {
+  entries map[string]*keyEntry
+  lookups bucket
+  mutex sync.Mutex
+}
+
+// The nonces of authenticated requests. The value is the date of the request in seconds.
+// A nonce is forgotten when its date is outside the clock skew, because then the request is rejected anyway.
+type nonceCache struct {
+  seen map[string]int64
+  mutex sync.Mutex
+}
+
+// Turns on server-to-server authentication. 'key' is the private key of the domain of the local user.
+// Its public key must be published via the NameService.
+func (self *Federation) SetServerKey(key *rsa.PrivateKey) {
+  self.key = key
+}
+
+// Accepts all requests without checking who sent them. This is meant for test setups and closed networks only.
+// Without a call to SetServerKey or DisableAuthentication, all incoming requests are rejected.
+func (self *Federation) DisableAuthentication() {
+  self.insecure = true
+}
+
+func requestDigest(method, host, path, query, domain, date, nonce string, body []byte) []byte {
+  // The client sends an empty path as "/"
+  if path == "" {
+    path = "/"
+  }
+  h := sha256.New()
+  h.Write(body)
+  bodyHash := hex.EncodeToString(h.Sum())
+  h = sha256.New()
+  h.Write([]byte(method + "\n" + strings.ToLower(host) + "\n" + path + "\n" + query + "\n" + domain + "\n" + date + "\n" + nonce + "\n" + bodyHash))
+  return h.Sum()
+}
+
+// Returns the host to which the request is addressed. Outgoing requests carry it in the URL,
+// incoming requests in the Host header.
+func requestHost(req *http.Request) string {
+  if req.Host != "" {
+    return req.Host
+  }
+  return req.URL.Host
+}
+
+func (self *Federation) signRequest(req *http.Request, body []byte) {
+  if self.key == nil {
+    return
+  }
+  domain := userDomain(self.userID)
+  date := strconv.Itoa64(time.Seconds())
+  random := make([]byte, 16)
+  if _, err := rand.Read(random); err != nil {
+    log.Printf("Err: Creating a nonce failed: %v\n", err)
+    return
+  }
+  nonce := hex.EncodeToString(random)
+  sig, err := rsa.SignPKCS1v15(rand.Reader, self.key, crypto.SHA256, requestDigest(req.Method, requestHost(req), req.URL.Path, req.URL.RawQuery, domain, date, nonce, body))
+  if err != nil {
+    log.Printf("Err: Signing the request failed: %v\n", err)
+    return
+  }
+  req.Header.Set(headerDomain, domain)
+  req.Header.Set(headerDate, date)
+  req.Header.Set(headerNonce, nonce)
+  req.Header.Set(headerSignature, base64.StdEncoding.EncodeToString(sig))
+}
+
+// Returns the domain of the server which sent the request.
+// If authentication has been disabled, the domain is empty and no error is returned.
+func (self *Federation) authenticate(req *http.Request, body []byte) (domain string, err os.Error) {
+  if self.key == nil {
+    if self.insecure {
+      return "", nil
+    }
+    return "", os.NewError("Authentication has not been configured")
+  }
+  domain = req.Header.Get(headerDomain)
+  date := req.Header.Get(headerDate)
+  nonce := req.Header.Get(headerNonce)
+  if domain == "" || date == "" || nonce == "" {
+    return "", os.NewError("Request is not signed")
+  }
+  t, err := strconv.Atoi64(date)
+  if err != nil {
+    return "", os.NewError("Malformed date")
+  }
+  if now := time.Seconds(); t < now - maxClockSkew || t > now + maxClockSkew {
+    return "", os.NewError("Request is too old or from the future")
+  }
+  sig, err := base64.StdEncoding.DecodeString(req.Header.Get(headerSignature))
+  if err != nil || len(sig) == 0 {
+    return "", os.NewError("Malformed signature")
+  }
+  key, err := self.publicKey(domain)
+  if err != nil {
+    return "", err
+  }
+  if rsa.VerifyPKCS1v15(key, crypto.SHA256, requestDigest(req.Method, requestHost(req), req.URL.Path, req.URL.RawQuery, domain, date, nonce, body), sig) != nil {
+    return "", os.NewError("Invalid signature")
+  }
+  // Check the nonce only now, such that forged requests cannot fill the cache
+  if err = self.nonces.check(strings.ToLower(domain) + " " + nonce, t); err != nil {
+    return "", err
+  }
+  return domain, nil
+}
+
+// Returns an error if the nonce has been seen before or if too many nonces are remembered.
+// 'date' is the date of the request in seconds.
+func (c *nonceCache) check(nonce string, date int64) os.Error {
+  now := time.Seconds()
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  if c.seen == nil {
+    c.seen = make(map[string]int64)
+  }
+  if _, ok := c.seen[nonce]; ok {
+    return os.NewError("Request has been replayed")
+  }
+  if len(c.seen) >= maxSeenNonces {
+    for n, t := range c.seen {
+      if t < now - maxClockSkew {
+	c.seen[n] = 0, false
+      }
+    }
+    if len(c.seen) >= maxSeenNonces {
+      return os.NewError("Too many requests")
+    }
+  }
+  c.seen[nonce] = date
+  return nil
+}
+
+// Returns the public key of the domain from the cache or asks the NameService.
+// Successful lookups are cached for nameTTL and failed lookups for nameNegativeTTL nanoseconds.
+func (self *Federation) publicKey(domain string) (key *rsa.PublicKey, err os.Error) {
+  domain = strings.ToLower(domain)
+  c := &self.keys
+  now := time.Nanoseconds()
+  c.mutex.Lock()
+  if c.entries == nil {
+    c.entries = make(map[string]*keyEntry)
+    c.lookups = bucket{tokens: keyLookupBurst, last: now}
+  }
+  if entry, ok := c.entries[domain]; ok && entry.expires > now {
+    c.mutex.Unlock()
+    return entry.key, entry.err
+  }
+  if !c.lookups.take(now, keyLookupRate, keyLookupBurst) {
+    c.mutex.Unlock()
+    return nil, os.NewError("Too many lookups of public keys")
+  }
+  c.mutex.Unlock()
+  key, err = self.ns.PublicKey(domain)
+  entry := &keyEntry{key, err, now + nameTTL}
+  if err != nil {
+    entry.expires = now + nameNegativeTTL
+  } else if key == nil {
+    entry.err = os.NewError("No public key for " + domain)
+  }
+  c.mutex.Lock()
+  if len(c.entries) >= maxCachedKeys {
+    // Remove stale entries first, then failed lookups
+    for d, e := range c.entries {
+      if e.expires <= now {
+	c.entries[d] = nil, false
+      }
+    }
+    for d, e := range c.entries {
+      if len(c.entries) < maxCachedKeys {
+	break
+      }
+      if e.err != nil {
+	c.entries[d] = nil, false
+      }
+    }
+  }
+  if len(c.entries) < maxCachedKeys {
+    c.entries[domain] = entry
+  }
+  c.mutex.Unlock()
+  return entry.key, entry.err
+}
+
+// Returns true if the domain hosts a user who follows the perma node or has been invited to it.
+// Invited users must be able to download the document before they can accept the invitation.
+// If authentication has been disabled, everything is allowed.
+func (self *Federation) authorize(domain string, perma_blobref string) bool {
+  if self.key == nil {
+    return self.insecure
+  }
+  if self.grapher == nil {
+    return false
+  }
+  users, err := self.grapher.Users(perma_blobref)
+  if err != nil {
+    return false
+  }
+  for _, user := range users {
+    if userDomain(user) == domain {
+      return true
+    }
+  }
+  log.Printf("Err: %v is not allowed to access %v\n", domain, perma_blobref)
+  return false
+}
+
+// Returns true if the domain may download the blob.
+func (self *Federation) authorizeBlob(domain string, blobref string, blob []byte) bool {
+  var schema syncSchema
+  if err := json.Unmarshal(blob, &schema); err != nil {
+    return false
+  }
+  // Only the perma node itself does not refer to a perma node
+  if schema.PermaNode == "" {
+    return self.authorize(domain, blobref)
+  }
+  return self.authorize(domain, schema.PermaNode)
+}
+
+func userDomain(userID string) string {
+  return userID[strings.Index(userID, "@") + 1:]
+}
+
+// Sends a signed request and returns the status code and the body of the response.
+// Gives up after 'timeout' nanoseconds.
+func (self *Federation) request(method, rawurl, contentType string, body []byte, timeout int64) (status int, data []byte, err os.Error) {
+  req, err := http.NewRequest(method, rawurl, bytes.NewBuffer(body))
+  if err != nil {
+    return 0, nil, err
+  }
+  if contentType != "" {
+    req.Header.Set("Content-Type", contentType)
+  }
+  self.signRequest(req, body)
+  return sendRequest(req, timeout)
+}
+
+// Like request, but a response other than 200 OK is an error
+func (self *Federation) requestOK(method, rawurl, contentType string, body []byte, timeout int64) (data []byte, err os.Error) {
+  status, data, err := self.request(method, rawurl, contentType, body, timeout)
+  if err == nil && status != 200 {
+    err = os.NewError(fmt.Sprintf("Server responded with %v", status))
+  }
+  return
+}
@@ -0,0 +1,155 @@
+package lightwavefed
+
+import (
+  . "lightwavestore"
+  "bytes"
+  "crypto/rand"
+  "crypto/rsa"
+  "fmt"
+  grapher "lightwavegrapher"
+  "http"
+  "http/httptest"
+  "testing"
+)
+
+func TestAuthentication(t *testing.T) {
+  keys := make(map[string]*rsa.PublicKey)
+  privateKeys := make(map[string]*rsa.PrivateKey)
+  for _, domain := range []string{"alice", "bob", "carol"} {
+    key, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+      t.Fatal(err.String())
+    }
+    privateKeys[domain] = key
+    keys[domain] = &key.PublicKey
+  }
+
+  // The server of bob hosts a document to which a@alice has been invited
+  s := NewSimpleBlobStore()
+  fed := &Federation{userID: "b@bob", store: s, queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    fed.handleRequest(w, req)
+  }))
+  defer server.Close()
+  fed.ns = &urlNameService{url: server.URL, keys: keys}
+  fed.fetcher = newFetcher(fed)
+  fed.SetServerKey(privateKeys["bob"])
+  g := grapher.NewGrapher("b@bob", nil, s, grapher.NewSimpleGraphStore(), fed, grapher.NoVerification)
+  s.AddListener(g)
+  // Listeners are called in order. Thus, the grapher has processed a blob before this listener sees it.
+  l := &orderListener{}
+  s.AddListener(l)
+  perma := []byte(`{"type":"permanode", "signer":"owner@bob", "random":"perma1"}`)
+  permaRef := NewBlobRef(perma)
+  keep := []byte(`{"type":"keep", "signer":"owner@bob", "perma":"` + permaRef + `"}`)
+  permission := []byte(`{"type":"permission", "perma":"` + permaRef + `", "signer":"owner@bob", "action":"invite", "dep":["` + NewBlobRef(keep) + `"], "user":"a@alice", "allow":` + fmt.Sprintf("%v", grapher.Perm_Read) + `, "deny":0}`)
+  for _, b := range [][]byte{perma, keep, permission} {
+    s.StoreBlob(b, "")
+  }
+  l.wait(3)
+  if users, _ := g.Users(permaRef); len(users) != 2 {
+    t.Fatalf("Wrong users: %v", users)
+  }
+
+  // Creates the federation of another server which talks to the server of bob
+  remote := func(userID string, key *rsa.PrivateKey) *Federation {
+    f := &Federation{userID: userID, store: NewSimpleBlobStore(), ns: &urlNameService{url: server.URL, keys: keys}, peers: make(map[string]*peer)}
+    f.SetServerKey(key)
+    return f
+  }
+  alice := remote("a@alice", privateKeys["alice"])
+  if _, err := alice.getBlob(server.URL, NewBlobRef(permission), fetchTimeout); err != nil {
+    t.Fatalf("Invited domain cannot download a blob: %v", err)
+  }
+  if _, err := alice.downloadFrontier(server.URL, permaRef); err != nil {
+    t.Fatalf("Invited domain cannot download the frontier: %v", err)
+  }
+  blob := []byte(`{"type":"keep", "signer":"a@alice", "random":"x"}`)
+  if err := alice.postBlob(server.URL, blob, queueTimeout); err != nil {
+    t.Fatalf("Authenticated domain cannot send a blob: %v", err)
+  }
+  if _, err := s.GetBlob(NewBlobRef(blob)); err != nil {
+    t.Fatal("Blob has not been stored")
+  }
+
+  // Carol is authenticated but not invited
+  carol := remote("c@carol", privateKeys["carol"])
+  if _, err := carol.getBlob(server.URL, permaRef, fetchTimeout); err == nil {
+    t.Fatal("Unrelated domain could download a blob")
+  }
+  if _, err := carol.downloadFrontier(server.URL, permaRef); err == nil {
+    t.Fatal("Unrelated domain could download the frontier")
+  }
+  // Requests which are not signed or signed with the wrong key are rejected
+  for _, f := range []*Federation{remote("a@alice", nil), remote("a@alice", privateKeys["carol"])} {
+    if _, err := f.getBlob(server.URL, permaRef, fetchTimeout); err == nil {
+      t.Fatal("Unauthenticated request has been accepted")
+    }
+    blob := []byte(`{"type":"keep", "signer":"a@alice", "random":"forged"}`)
+    if err := f.postBlob(server.URL, blob, queueTimeout); err == nil {
+      t.Fatal("Unauthenticated blob has been accepted")
+    }
+    if _, err := s.GetBlob(NewBlobRef(blob)); err == nil {
+      t.Fatal("Unauthenticated blob has been stored")
+    }
+  }
+  // A signed request cannot be replayed against another endpoint
+  signed, _ := http.NewRequest("GET", server.URL + "/fed?blobref=" + http.URLEscape(permaRef), nil)
+  alice.signRequest(signed, nil)
+  replayed, _ := http.NewRequest("GET", server.URL + "/other?blobref=" + http.URLEscape(permaRef), nil)
+  replayed.Header = signed.Header
+  if status, _, _ := sendRequest(signed, fetchTimeout); status != 200 {
+    t.Fatalf("Signed request has been rejected: %v", status)
+  }
+  if status, _, _ := sendRequest(replayed, fetchTimeout); status != 401 {
+    t.Fatalf("Replayed request has not been rejected: %v", status)
+  }
+  // Nor can it be replayed against the same endpoint
+  replayed, _ = http.NewRequest("GET", server.URL + "/fed?blobref=" + http.URLEscape(permaRef), nil)
+  replayed.Header = signed.Header
+  if status, _, _ := sendRequest(replayed, fetchTimeout); status != 401 {
+    t.Fatalf("Replayed request has not been rejected: %v", status)
+  }
+
+  // The public keys of claimed domains are cached and looked up at a limited rate
+  ns := fed.ns.(*urlNameService)
+  ns.mutex.Lock()
+  lookups := ns.keyLookups
+  ns.mutex.Unlock()
+  for i := 0; i < 3 * keyLookupBurst; i++ {
+    f := remote(fmt.Sprintf("x@unknown%v", i), privateKeys["carol"])
+    f.getBlob(server.URL, permaRef, fetchTimeout)
+    alice.getBlob(server.URL, permaRef, fetchTimeout)
+  }
+  ns.mutex.Lock()
+  if n := ns.keyLookups - lookups; n > keyLookupBurst + 1 {
+    t.Fatalf("Too many lookups of public keys: %v", n)
+  }
+  ns.mutex.Unlock()
+}
+
+func TestAuthenticationNotConfigured(t *testing.T) {
+  s := NewSimpleBlobStore()
+  fed := &Federation{store: s, ns: &urlNameService{url: "http://unused"}, peers: make(map[string]*peer)}
+  blob := []byte(`{"type":"keep", "signer":"a@alice", "random":"x"}`)
+  send := func() int {
+    req, _ := http.NewRequest("POST", "http://bob/fed", bytes.NewBuffer(blob))
+    w := httptest.NewRecorder()
+    fed.handleRequest(w, req)
+    return w.Code
+  }
+  // Without a server key, requests are rejected unless authentication has been disabled explicitly
+  if code := send(); code != 401 {
+    t.Fatalf("Request has not been rejected: %v", code)
+  }
+  if fed.authorize("", NewBlobRef(blob)) {
+    t.Fatal("Request has been authorized")
+  }
+  fed.DisableAuthentication()
+  if code := send(); code != 200 {
+    t.Fatalf("Request has been rejected: %v", code)
+  }
+  if !fed.authorize("", NewBlobRef(blob)) {
+    t.Fatal("Request has not been authorized")
+  }
+}
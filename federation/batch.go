@@ -0,0 +1,104 @@
+package lightwavefed
+
+import (
+  "http"
+  "json"
+  "log"
+  "os"
+)
+
+// A batch is sent via POST /fed with this content type. The body is a JSON array of blobs,
+// each of them base64 encoded. The response is a JSON array of strings with one entry per blob.
+// An empty string means that the blob has been stored. Otherwise it is an error message.
+// Servers which understand batches list "batch" in the response to GET /fed?features.
+// Older servers answer with an error and receive one blob per request.
+const batchMimeType = "application/x-lightwave-batch"
+
+// Maximum number of blobs in one batch. A variable such that tests can change it.
+var queueBatchSize = 100
+
+// The features supported by this server
+var features = []string{"batch"}
+
+const (
+  batchUnknown = iota
+  batchSupported
+  batchUnsupported
+)
+
+// Passes each blob of the batch to 'receive' and sends the results
+func (self *Federation) handleBatch(w http.ResponseWriter, remote string, body []byte, receive func(blob []byte) os.Error) {
+  var blobs [][]byte
+  if err := json.Unmarshal(body, &blobs); err != nil {
+    log.Printf("Malformed batch: %v\n", err)
+    w.WriteHeader(500)
+    return
+  }
+  if len(blobs) > maxBatchBlobs {
+    self.policy.reject(remote, rejectTooLarge)
+    w.WriteHeader(413)
+    return
+  }
+  log.Printf("Received %v blobs via federation\n", len(blobs))
+  results := make([]string, len(blobs))
+  for i, blob := range blobs {
+    if err := receive(blob); err != nil {
+      results[i] = err.String()
+    }
+  }
+  result, err := json.Marshal(results)
+  if err != nil {
+    log.Printf("Failed marshaling the batch results")
+    w.WriteHeader(500)
+    return
+  }
+  w.Header().Add("Content-type", "application/json")
+  w.Write(result)
+}
+
+// Asks a remote server whether it understands batches via GET /fed?features.
+// Returns an error only if the server could not be reached.
+func (self *Federation) supportsBatch(rawurl string, timeout int64) (ok bool, err os.Error) {
+  status, data, err := self.request("GET", rawurl + "?features=all", "", nil, timeout)
+  // An older server does not know about features
+  if err != nil || status != 200 {
+    return false, err
+  }
+  var list []string
+  if json.Unmarshal(data, &list) != nil {
+    return false, nil
+  }
+  for _, f := range list {
+    if f == "batch" {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+// Sends several blobs in one request. Returns an error if the request as a whole failed.
+// Otherwise, there is one entry in 'results' per blob, which is nil if the remote server stored the blob.
+func (self *Federation) postBatch(rawurl string, blobs [][]byte, timeout int64) (results []os.Error, err os.Error) {
+  body, err := json.Marshal(blobs)
+  if err != nil {
+    return nil, err
+  }
+  data, err := self.requestOK("POST", rawurl, batchMimeType, body, timeout)
+  if err != nil {
+    return nil, err
+  }
+  var list []string
+  if err = json.Unmarshal(data, &list); err != nil {
+    return nil, err
+  }
+  if len(list) != len(blobs) {
+    return nil, os.NewError("Wrong number of results in batch response")
+  }
+  results = make([]os.Error, len(list))
+  for i, msg := range list {
+    if msg != "" {
+      results[i] = os.NewError(msg)
+    }
+  }
+  return results, nil
+}
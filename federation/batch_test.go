@@ -0,0 +1,87 @@
+package lightwavefed
+
+import (
+  . "lightwavestore"
+  "fmt"
+  "http"
+  "http/httptest"
+  "os"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Refuses to store some blobs once
+type refusingStore struct {
+  BlobStore
+  refuse map[string]bool
+  mutex sync.Mutex
+}
+
+func (self *refusingStore) StoreBlob(blob []byte, blobref string) (finalBlobRef string, err os.Error) {
+  self.mutex.Lock()
+  ref := NewBlobRef(blob)
+  refuse := self.refuse[ref]
+  self.refuse[ref] = false, false
+  self.mutex.Unlock()
+  if refuse {
+    return "", os.NewError("Refused")
+  }
+  return self.BlobStore.StoreBlob(blob, blobref)
+}
+
+func TestBatch(t *testing.T) {
+  var blobrefs []string
+  s := NewSimpleBlobStore()
+  for i := 0; i < 10; i++ {
+    blobref, _ := s.StoreBlob([]byte(fmt.Sprintf(`{"type":"keep", "signer":"a@alice", "random":"%v"}`, i)), "")
+    blobrefs = append(blobrefs, blobref)
+  }
+
+  rs := &refusingStore{BlobStore: NewSimpleBlobStore(), refuse: map[string]bool{blobrefs[6]: true}}
+  receiver := &Federation{store: rs, ns: &urlNameService{url: "http://unused"}, peers: make(map[string]*peer)}
+  receiver.DisableAuthentication()
+  var mutex sync.Mutex
+  posts := 0
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if req.Method == "POST" {
+      mutex.Lock()
+      posts++
+      mutex.Unlock()
+    }
+    receiver.handleRequest(w, req)
+  }))
+  defer server.Close()
+
+  fed := &Federation{userID: "a@alice", ns: &urlNameService{url: server.URL}, store: s, queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  q := fed.getQueue(server.URL)
+  q.mutex.Lock()
+  q.entries = append(q.entries, blobrefs...)
+  q.mutex.Unlock()
+  q.signal()
+
+  for i := 0; i < 50; i++ {
+    q.mutex.Lock()
+    n := len(q.entries)
+    q.mutex.Unlock()
+    if n == 0 {
+      break
+    }
+    time.Sleep(100000000)
+  }
+  for _, blobref := range blobrefs {
+    if _, err := rs.GetBlob(blobref); err != nil {
+      t.Fatalf("Blob %v has not been delivered", blobref)
+    }
+  }
+  if len(fed.DeadLetters()) != 0 {
+    t.Fatal("Blobs have become dead letters")
+  }
+  mutex.Lock()
+  defer mutex.Unlock()
+  // One blob until the support for batches is known, then batches of four blobs.
+  // The refused blob is sent again with the last batch.
+  if posts != 4 {
+    t.Fatalf("Wrong number of requests: %v", posts)
+  }
+}
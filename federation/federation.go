@@ -1,13 +1,12 @@
 package lightwavefed
 
 import (
+  "crypto/rsa"
   grapher "lightwavegrapher"
   store "lightwavestore"
   "sync"
   "os"
   "log"
-  vec "container/vector"
-  "strings"
   "http"
   "io/ioutil"
   "io"
@@ -27,6 +26,8 @@ type NameService interface {
   // Real life applications will use DNS A-records + default ports or DNS SRV-records
   // to perform the lookup. For demos we can hardcode it.
   Lookup(userID string) (addr string, err os.Error)
+  // Returns the public key which the servers of the domain use to sign their requests.
+  PublicKey(domain string) (key *rsa.PublicKey, err os.Error)
 }
 
 type Federation struct {
@@ -36,11 +37,40 @@ type Federation struct {
   store store.BlobStore
   ns NameService
   grapher *grapher.Grapher
+  // The key is the URL of a remote server
   queues map[string]*queue
+  // Records the outbound queues if they are durable
+  journal *journal
+  fetcher *fetcher
+  // The key is the URL of a remote server
+  peers map[string]*peer
+  // Signs outgoing requests. Nil if authentication is turned off.
+  key *rsa.PrivateKey
+  // True if incoming requests are accepted without authentication. Only used if key is nil.
+  insecure bool
+  // The public keys of remote domains
+  keys keyCache
+  // The nonces of recently authenticated requests
+  nonces nonceCache
+  // Rate limits, size limits and the domains which may federate
+  policy policyState
+  // The URL of the relay which holds blobs for this server while it is offline. Empty if there is none.
+  relay string
+  // The directory of the mailboxes if this server is a relay
+  mailboxDir string
+  // The domains for which this server holds mailboxes if it is a relay
+  relayDomains map[string]bool
+  // The number of bytes in all mailboxes. Guarded by mailboxMutex.
+  relaySize int64
+  // Serializes the deposits such that the quotas of the mailboxes and of the relay hold
+  mailboxMutex sync.Mutex
 }
 
+// Creates a federation which serves the requests of remote servers on 'mux'.
+// Blobs for remote servers are queued in memory and lost when the server stops unless SetQueueDir is called.
 func NewFederation(userid, domain string, port int, mux *http.ServeMux, ns NameService, store store.BlobStore) *Federation {
-  fed := &Federation{userID: userid, ns: ns, store: store, domain: domain, queues: make(map[string]*queue)}
+  fed := &Federation{userID: userid, ns: ns, store: store, domain: domain, queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  fed.fetcher = newFetcher(fed)
   f := func(w http.ResponseWriter, req *http.Request) {
     fed.handleRequest(w, req)
   }
@@ -53,21 +83,20 @@ func (self *Federation) SetGrapher(grapher *grapher.Grapher) {
   self.grapher = grapher
 }
 
-func (self *Federation) getQueue(domain string) chan<- queueEntry {
+func (self *Federation) getQueue(rawurl string) *queue {
   self.mutex.Lock()
-  q, ok := self.queues[domain]
+  q, ok := self.queues[rawurl]
   if !ok {
-    ch := make(chan queueEntry)
-    q = newQueue(self, domain, ch)
-    self.queues[domain] = q
+    q = newQueue(self, rawurl)
+    self.queues[rawurl] = q
   }
   self.mutex.Unlock()
-  return q.channel
+  return q
 }
 
 func (self *Federation) Forward(blobref string, users []string) {  
-  // Determine the servers that have to be informed
-  urls := make(map[string]vec.StringVector)
+  // Determine the servers that have to be informed and the domains they serve
+  urls := make(map[string]string)
   for _, user := range users {
     if user == self.userID {
       continue
@@ -82,18 +111,17 @@ func (self *Federation) Forward(blobref string, users []string) {
       log.Printf("Malformed URL: %v\n", rawurl)
       continue
     }
-    urlList, _ := urls[rawurl]
-    urlList.Push(user[strings.Index(user, "@") + 1:])
-    urls[rawurl] = urlList
+    urls[rawurl] = userDomain(user)
   }
 
   if len(urls) > 0 {
     log.Printf("Forwarding %v to %v\n", blobref, users)
   }
 
-  for url, urlUsers := range urls {
+  for url, domain := range urls {
     q := self.getQueue(url)
-    q <- queueEntry{urlUsers, blobref}
+    q.setDomain(domain)
+    q.push(blobref)
   }
 }
 
@@ -113,16 +141,87 @@ func (self *Federation) Forward(blobref string, users []string) {
 //}
 
 func (self *Federation) handleRequest(w http.ResponseWriter, req *http.Request) {
+  // Limit the rate per remote host before reading the body and before the potentially expensive authentication.
+  // The domain is not yet authenticated. Hence, these rejections are counted for the remote host.
+  host := remoteName("", req)
+  if !self.policy.takeAddress(host) {
+    req.Body.Close()
+    self.policy.reject(host, rejectRateLimited)
+    w.WriteHeader(429)
+    return
+  }
+  batch := req.Header.Get("Content-Type") == batchMimeType
+  limit := self.policy.maxBodySize(batch)
+  if req.ContentLength > limit {
+    req.Body.Close()
+    self.policy.reject(host, rejectTooLarge)
+    w.WriteHeader(413)
+    return
+  }
+  body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit + 1))
+  req.Body.Close()
+  if err != nil {
+    log.Printf("Error reading request body")
+    return
+  }
+  if int64(len(body)) > limit {
+    self.policy.reject(host, rejectTooLarge)
+    w.WriteHeader(413)
+    return
+  }
+  domain, err := self.authenticate(req, body)
+  if err != nil {
+    log.Printf("Err: Rejected request: %v\n", err)
+    self.policy.reject(host, rejectUnauthenticated)
+    w.WriteHeader(401)
+    return
+  }
+  remote := remoteName(domain, req)
+  if !self.policy.allowed(remote) {
+    self.policy.reject(remote, rejectDenied)
+    w.WriteHeader(403)
+    return
+  }
+  if !self.policy.take(remote) {
+    self.policy.reject(remote, rejectRateLimited)
+    w.WriteHeader(429)
+    return
+  }
   switch req.Method {
   case "POST", "PUT":
-    blob, err := ioutil.ReadAll(req.Body)
-    if err != nil {
-      log.Printf("Error reading request body")
+    values := req.URL.Query()
+    //
+    // POST /fed?relay=domain
+    //
+    if dest := values.Get("relay"); dest != "" {
+      self.handleRelay(w, remote, dest, batch, body)
+      return
+    }
+    //
+    // POST /fed?mailbox=domain
+    //
+    if mailbox := values.Get("mailbox"); mailbox != "" {
+      self.handleAck(w, domain, mailbox, body)
+      return
+    }
+    if batch {
+      self.handleBatch(w, remote, body, func(blob []byte) os.Error {
+	return self.receiveBlob(remote, blob)
+      })
+      return
+    }
+    log.Printf("Received blob via federation: %v\n", string(body))
+    if err = self.receiveBlob(remote, body); err != nil {
+      switch err {
+      case errBlobTooLarge:
+	w.WriteHeader(413)
+      case errSignerDenied:
+	w.WriteHeader(403)
+      default:
+	w.WriteHeader(500)
+      }
       return
     }
-    req.Body.Close()
-    log.Printf("Received blob via federation: %v\n", string(blob))
-    self.store.StoreBlob(blob, "")
     w.WriteHeader(200)
   case "GET":
     values := req.URL.Query()
@@ -137,6 +236,10 @@ func (self *Federation) handleRequest(w http.ResponseWriter, req *http.Request)
 	w.WriteHeader(500)
 	return
       }
+      if !self.authorizeBlob(domain, blobref, blob) {
+	w.WriteHeader(403)
+	return
+      }
       w.Header().Add("Content-type", "application/octet-stream")
       buf := bytes.NewBuffer(blob)
       written, err := io.Copy(w, buf)
@@ -148,6 +251,10 @@ func (self *Federation) handleRequest(w http.ResponseWriter, req *http.Request)
     // GET /fed?frontier=xyz
     //
     } else if blobref = values.Get("frontier"); blobref != "" {
+      if !self.authorize(domain, blobref) {
+	w.WriteHeader(403)
+	return
+      }
       frontier, err := self.grapher.Frontier(blobref)
       if err != nil {
 	log.Printf("Failed retrieving the frontier")
@@ -165,6 +272,22 @@ func (self *Federation) handleRequest(w http.ResponseWriter, req *http.Request)
 	log.Printf("Failed sending result\n")
 	return
       }
+    //
+    // GET /fed?mailbox=domain
+    //
+    } else if mailbox := values.Get("mailbox"); mailbox != "" {
+      self.handleMailbox(w, domain, mailbox)
+    //
+    // GET /fed?features
+    //
+    } else if _, ok := values["features"]; ok {
+      result, err := json.Marshal(features)
+      if err != nil {
+	log.Printf("Failed marshaling the features")
+	return
+      }
+      w.Header().Add("Content-type", "application/json")
+      w.Write(result)
     } else {
       log.Printf("Malformed get request\n")
       // TODO: Better error message
@@ -176,6 +299,35 @@ func (self *Federation) handleRequest(w http.ResponseWriter, req *http.Request)
   }
 }
 
+// Stores a blob received from the remote server 'remote' unless the policy rejects it.
+// Storing a blob twice has no effect. Hence, the sender can safely repeat a delivery.
+func (self *Federation) receiveBlob(remote string, blob []byte) (err os.Error) {
+  var schema syncSchema
+  json.Unmarshal(blob, &schema)
+  if err = self.policy.checkBlob(remote, blob, schema.Signer); err != nil {
+    return err
+  }
+  if _, err = self.store.StoreBlob(blob, ""); err != nil {
+    log.Printf("Err: Storing blob failed: %v\n", err)
+    return err
+  }
+  // The server of the signer is obviously online if it has delivered the blob itself.
+  // This requires authentication, because otherwise any sender could claim to be any server.
+  // The document is associated with the peer only if it is known locally.
+  if self.key != nil && schema.Signer != "" && userDomain(schema.Signer) == remote {
+    perma_blobref := schema.PermaNode
+    if perma_blobref != "" {
+      if _, e := self.store.GetBlob(perma_blobref); e != nil {
+	perma_blobref = ""
+      }
+    }
+    if rawurl, err := self.ns.Lookup(schema.Signer); err == nil {
+      self.peerOnline(rawurl, perma_blobref, schema.Signer)
+    }
+  }
+  return nil
+}
+
 // TODO: Use the permanode blobref instead
 func (self *Federation) DownloadPermaNode(permission_blobref string) os.Error {
   // Load the invitation from the store
@@ -237,19 +389,12 @@ type depSchema struct {
 
 func (self *Federation) downloadBlob(rawurl, blobref string) (dependencies []string, err os.Error) {
   // Get the blob
-  var client http.Client
-  req, err := client.Get(rawurl + "?blobref=" + http.URLEscape(blobref))
-  if err != nil {
-    return nil, err
-  }
   // TODO: Improve for large files
-  blob, err := ioutil.ReadAll(req.Body)
+  blob, err := self.getBlob(rawurl, blobref, fetchTimeout)
   if err != nil {
-    log.Printf("Error reading request body")
     return nil, err
   }
   log.Printf("Downloaded %v\n", string(blob))
-  req.Body.Close()
   self.store.StoreBlob(blob, "")
   // Check whether the retrieved blob is a schema blob
   mimetype := grapher.MimeType(blob)
@@ -266,19 +411,11 @@ func (self *Federation) downloadBlob(rawurl, blobref string) (dependencies []str
 }
 
 func (self *Federation) downloadFrontier(rawurl string, blobref string) (frontier []string, err os.Error) {
-  // Get the blob
-  var client http.Client
-  req, err := client.Get(rawurl + "?frontier=" + http.URLEscape(blobref))
+  blob, err := self.requestOK("GET", rawurl + "?frontier=" + http.URLEscape(blobref), "", nil, fetchTimeout)
   if err != nil {
     return nil, err
   }
   // Process the returned value
-  blob, err := ioutil.ReadAll(req.Body)
-  if err != nil {
-    log.Printf("Error reading request body")
-    return nil, err
-  }
-  req.Body.Close()
   err = json.Unmarshal(blob, &frontier)
   if err != nil {
     log.Printf("Malformed frontier response: %v\n", err)
@@ -0,0 +1,166 @@
+package lightwavefed
+
+import (
+  store "lightwavestore"
+  "http"
+  "io"
+  "io/ioutil"
+  "log"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+const (
+  // Nanoseconds until a request for a blob is abandoned
+  fetchTimeout = 30 * 1000000000
+  // Number of attempts to fetch a blob
+  fetchRetries = 5
+  // Nanoseconds to wait before the first retry. The delay doubles with each retry.
+  fetchBackoff = 1000000000
+  // Maximum number of requests which are in flight at the same time
+  maxOutstandingFetches = 8
+  // Maximum size of a response body in bytes
+  maxResponseSize = 64 * 1024 * 1024
+)
+
+// The fetcher downloads blobs which the grapher is missing to process other blobs.
+// Downloaded blobs are put in the blob store which passes them on to the grapher.
+// The grapher in turn dequeues all blobs that have been waiting for them.
+// If a downloaded blob has missing dependencies itself, the grapher asks for them as well.
+type fetcher struct {
+  fed *Federation
+  // The blobrefs which are currently being fetched
+  pending map[string]bool
+  // Each request in flight holds one token. This bounds the number of outstanding requests.
+  tokens chan bool
+  mutex sync.Mutex
+}
+
+func newFetcher(fed *Federation) *fetcher {
+  return &fetcher{fed: fed, pending: make(map[string]bool), tokens: make(chan bool, maxOutstandingFetches)}
+}
+
+// Interface towards the Grapher
+func (self *Federation) Fetch(userID string, blobrefs []string) {
+  self.fetcher.fetch(userID, blobrefs)
+}
+
+func (self *fetcher) fetch(userID string, blobrefs []string) {
+  rawurl, err := self.fed.ns.Lookup(userID)
+  if err != nil {
+    log.Printf("Err: Cannot fetch blobs from unknown user %v: %v\n", userID, err)
+    return
+  }
+  for _, blobref := range blobrefs {
+    // The blob is already in the store, i.e. it is waiting for its own dependencies?
+    if _, err := self.fed.store.GetBlob(blobref); err == nil {
+      continue
+    }
+    self.mutex.Lock()
+    if self.pending[blobref] {
+      self.mutex.Unlock()
+      continue
+    }
+    self.pending[blobref] = true
+    self.mutex.Unlock()
+    go self.run(rawurl, blobref)
+  }
+}
+
+func (self *fetcher) run(rawurl, blobref string) {
+  backoff := int64(fetchBackoff)
+  for i := 0; i < fetchRetries; i++ {
+    if i > 0 {
+      time.Sleep(backoff)
+      backoff *= 2
+    }
+    self.tokens <- true
+    blob, err := self.fed.getBlob(rawurl, blobref, fetchTimeout)
+    <-self.tokens
+    if err == nil && store.NewBlobRef(blob) != blobref {
+      err = os.NewError("Received blob does not match its blobref")
+    }
+    if err != nil {
+      log.Printf("Err: Fetching %v from %v failed: %v\n", blobref, rawurl, err)
+      self.fed.peerOffline(rawurl)
+      continue
+    }
+    self.fed.peerOnline(rawurl, "", "")
+    // Processing the blob may trigger fetching its dependencies. Hence, it is no longer pending.
+    self.done(blobref)
+    if _, err = self.fed.store.StoreBlob(blob, blobref); err != nil {
+      log.Printf("Err: Storing fetched blob %v failed: %v\n", blobref, err)
+    }
+    return
+  }
+  self.done(blobref)
+  log.Printf("Err: Giving up on fetching %v from %v\n", blobref, rawurl)
+}
+
+func (self *fetcher) done(blobref string) {
+  self.mutex.Lock()
+  self.pending[blobref] = false, false
+  self.mutex.Unlock()
+}
+
+// Downloads a blob via GET /fed?blobref=xyz. Gives up after 'timeout' nanoseconds.
+func (self *Federation) getBlob(rawurl, blobref string, timeout int64) (blob []byte, err os.Error) {
+  return self.requestOK("GET", rawurl + "?blobref=" + http.URLEscape(blobref), "", nil, timeout)
+}
+
+// Sends the request and returns the status code and the body of the response.
+// Gives up after 'timeout' nanoseconds. The connection is closed at that time, such that the request
+// does not continue in the background. Responses larger than maxResponseSize are an error.
+func sendRequest(req *http.Request, timeout int64) (status int, data []byte, err os.Error) {
+  return sendLimitedRequest(req, timeout, maxResponseSize)
+}
+
+// Like sendRequest, but responses larger than 'maxSize' bytes are an error.
+func sendLimitedRequest(req *http.Request, timeout int64, maxSize int64) (status int, data []byte, err os.Error) {
+  type result struct {
+    status int
+    data []byte
+    err os.Error
+  }
+  deadline := time.Nanoseconds() + timeout
+  dial := func(network, addr string) (conn net.Conn, err os.Error) {
+    if conn, err = net.Dial(network, addr); err != nil {
+      return nil, err
+    }
+    remaining := deadline - time.Nanoseconds()
+    if remaining <= 0 {
+      conn.Close()
+      return nil, os.NewError("Request timed out")
+    }
+    // Abort reading and writing at the deadline
+    time.AfterFunc(remaining, func() {
+      conn.Close()
+    })
+    return conn, nil
+  }
+  // Buffered, such that the goroutine can finish even after a timeout
+  ch := make(chan result, 1)
+  go func() {
+    client := http.Client{Transport: &http.Transport{Dial: dial, DisableKeepAlives: true}}
+    resp, err := client.Do(req)
+    if err != nil {
+      ch <- result{0, nil, err}
+      return
+    }
+    defer resp.Body.Close()
+    b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize + 1))
+    if err == nil && int64(len(b)) > maxSize {
+      err = os.NewError("Response is too large")
+    }
+    ch <- result{resp.StatusCode, b, err}
+  }()
+  // Dialing cannot be aborted. Hence, the caller does not wait for the connection to be closed.
+  select {
+  case r := <-ch:
+    return r.status, r.data, r.err
+  case <-time.After(timeout):
+  }
+  return 0, nil, os.NewError("Request timed out")
+}
@@ -0,0 +1,160 @@
+package lightwavefed
+
+import (
+  "crypto/rsa"
+  . "lightwavestore"
+  "fmt"
+  "http"
+  "http/httptest"
+  "os"
+  "sync"
+  "testing"
+  "time"
+)
+
+type urlNameService struct {
+  url string
+  keys map[string]*rsa.PublicKey
+  // The number of public keys which have been looked up
+  keyLookups int
+  mutex sync.Mutex
+}
+
+func (self *urlNameService) Lookup(identity string) (url string, err os.Error) {
+  return self.url, nil
+}
+
+func (self *urlNameService) PublicKey(domain string) (key *rsa.PublicKey, err os.Error) {
+  self.mutex.Lock()
+  self.keyLookups++
+  self.mutex.Unlock()
+  key, ok := self.keys[domain]
+  if !ok {
+    return nil, os.NewError("Unknown domain")
+  }
+  return key, nil
+}
+
+func TestFetcher(t *testing.T) {
+  blobs := make(map[string][]byte)
+  var blobrefs []string
+  for i := 0; i < 3 * maxOutstandingFetches; i++ {
+    blob := []byte(fmt.Sprintf(`{"type":"keep", "signer":"a@alice", "random":"%v"}`, i))
+    blobref := NewBlobRef(blob)
+    blobs[blobref] = blob
+    blobrefs = append(blobrefs, blobref)
+  }
+  // A server which sends garbage for this blobref
+  forged := NewBlobRef([]byte("forged"))
+  var mutex sync.Mutex
+  inflight, maxInflight, requests := 0, 0, 0
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    mutex.Lock()
+    inflight++
+    requests++
+    if inflight > maxInflight {
+      maxInflight = inflight
+    }
+    // The first request fails to test the retry
+    fail := requests == 1
+    mutex.Unlock()
+    time.Sleep(10000000)
+    blobref := req.URL.Query().Get("blobref")
+    if blob, ok := blobs[blobref]; ok && !fail {
+      w.Write(blob)
+    } else if blobref == forged {
+      w.Write([]byte("garbage"))
+    } else {
+      w.WriteHeader(500)
+    }
+    mutex.Lock()
+    inflight--
+    mutex.Unlock()
+  }))
+  defer server.Close()
+
+  s := NewSimpleBlobStore()
+  fed := &Federation{ns: &urlNameService{url: server.URL}, store: s, peers: make(map[string]*peer)}
+  fed.fetcher = newFetcher(fed)
+  fed.Fetch("a@alice", append(blobrefs, forged))
+  // Asking twice does not send more requests
+  fed.Fetch("a@alice", blobrefs)
+
+  for i := 0; i < 50; i++ {
+    time.Sleep(100000000)
+    missing := 0
+    for _, blobref := range blobrefs {
+      if _, err := s.GetBlob(blobref); err != nil {
+        missing++
+      }
+    }
+    if missing == 0 {
+      break
+    }
+  }
+  for _, blobref := range blobrefs {
+    if _, err := s.GetBlob(blobref); err != nil {
+      t.Fatalf("Blob %v has not been fetched", blobref)
+    }
+  }
+  if _, err := s.GetBlob(forged); err == nil {
+    t.Fatal("Forged blob has been stored")
+  }
+  mutex.Lock()
+  defer mutex.Unlock()
+  if maxInflight > maxOutstandingFetches {
+    t.Fatalf("Too many outstanding requests: %v", maxInflight)
+  }
+  // One request per blob plus the failed one plus at least one for the forged blob
+  if requests > len(blobrefs) + 1 + fetchRetries {
+    t.Fatalf("Too many requests: %v", requests)
+  }
+}
+
+func TestSendRequestTimeout(t *testing.T) {
+  // The server sends the response very slowly and notes when the client has closed the connection
+  closed := make(chan bool, 1)
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.WriteHeader(200)
+    for i := 0; i < 500; i++ {
+      if _, err := w.Write([]byte("x")); err != nil {
+        closed <- true
+        return
+      }
+      w.(http.Flusher).Flush()
+      time.Sleep(10000000)
+    }
+    closed <- false
+  }))
+  defer server.Close()
+  req, err := http.NewRequest("GET", server.URL, nil)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if _, _, err = sendRequest(req, 200000000); err == nil {
+    t.Fatal("Request has not timed out")
+  }
+  select {
+  case ok := <-closed:
+    if !ok {
+      t.Fatal("The connection has not been closed")
+    }
+  case <-time.After(2000000000):
+    t.Fatal("The request continues after the timeout")
+  }
+}
+
+func TestSendRequestSizeLimit(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.Write(make([]byte, 100))
+  }))
+  defer server.Close()
+  req, _ := http.NewRequest("GET", server.URL, nil)
+  if _, data, err := sendLimitedRequest(req, fetchTimeout, 100); err != nil || len(data) != 100 {
+    t.Fatalf("Response within the limit has been rejected: %v", err)
+  }
+  req, _ = http.NewRequest("GET", server.URL, nil)
+  if _, _, err := sendLimitedRequest(req, fetchTimeout, 99); err == nil {
+    t.Fatal("Response beyond the limit has been accepted")
+  }
+}
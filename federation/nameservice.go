@@ -0,0 +1,271 @@
+package lightwavefed
+
+import (
+  "big"
+  "crypto/rsa"
+  "encoding/base64"
+  "fmt"
+  "http"
+  "io/ioutil"
+  "json"
+  "log"
+  "net"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // Nanoseconds for which a successful lookup is cached unless the well-known document says otherwise
+  nameTTL = 3600 * 1000000000
+  // Nanoseconds for which a failed lookup is cached
+  nameNegativeTTL = 300 * 1000000000
+  // Maximum number of domains in the cache
+  maxCachedNames = 1000
+  // Maximum size of the well-known document in bytes
+  maxWellKnownSize = 64 * 1024
+)
+
+// The Resolver performs the network lookups on behalf of DNSNameService.
+// Tests can use a fake implementation.
+type Resolver interface {
+  // Returns the SRV records of _lightwave._tcp.<domain>
+  LookupSRV(domain string) (addrs []*net.SRV, err os.Error)
+  // Returns the document served at https://<domain>/.well-known/lightwave
+  WellKnown(domain string) (doc []byte, err os.Error)
+}
+
+// The document served at https://<domain>/.well-known/lightwave
+type wellKnownDoc struct {
+  // The URL of the federation endpoint, e.g. "https://lightwave.example.com/fed"
+  Fed string "fed"
+  // Seconds for which the document can be cached. Zero means the default.
+  TTL int64 "ttl"
+  // The base64 encoded modulus of the RSA public key with which the servers of the domain sign their requests
+  Key string "key"
+  // The public exponent of the RSA key. Zero means 65537.
+  Exp int "exp"
+}
+
+type nameEntry struct {
+  url string
+  key *rsa.PublicKey
+  err os.Error
+  // Time in nanoseconds when the entry becomes stale
+  expires int64
+}
+
+// DNSNameService resolves user IDs of the form "user@domain" to the URL of a federation endpoint.
+// The lookup consults
+//   1) the static overrides, which map either a user ID or a domain to a URL,
+//   2) the document https://<domain>/.well-known/lightwave,
+//   3) the SRV record _lightwave._tcp.<domain>, which yields https://<target>:<port>/fed.
+// Results are cached per domain. Failures are cached for a shorter time.
+// At most maxCachedNames domains are cached.
+// The public key of a domain is taken from the well-known document unless it has been added explicitly.
+type DNSNameService struct {
+  resolver Resolver
+  overrides map[string]string
+  keys map[string]*rsa.PublicKey
+  cache map[string]*nameEntry
+  mutex sync.Mutex
+}
+
+// A nil resolver uses DNS and HTTPS.
+func NewDNSNameService(resolver Resolver) *DNSNameService {
+  if resolver == nil {
+    resolver = &netResolver{}
+  }
+  return &DNSNameService{resolver: resolver, overrides: make(map[string]string), keys: make(map[string]*rsa.PublicKey), cache: make(map[string]*nameEntry)}
+}
+
+// Loads static overrides from a JSON file which maps user IDs or domains to URLs, for example
+//   {"example.com": "http://localhost:8080/fed", "bob@example.org": "http://localhost:8181/fed"}
+// The overrides replace those loaded earlier.
+func (self *DNSNameService) LoadOverrides(path string) (err os.Error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+  var overrides map[string]string
+  if err = json.Unmarshal(data, &overrides); err != nil {
+    return err
+  }
+  for key, rawurl := range overrides {
+    if _, err = http.ParseURL(rawurl); err != nil {
+      return os.NewError(fmt.Sprintf("Malformed URL for %v: %v", key, rawurl))
+    }
+  }
+  self.mutex.Lock()
+  self.overrides = overrides
+  self.mutex.Unlock()
+  return nil
+}
+
+// Registers the public key of a domain. This takes precedence over the well-known document.
+func (self *DNSNameService) AddPublicKey(domain string, key *rsa.PublicKey) {
+  self.mutex.Lock()
+  self.keys[strings.ToLower(domain)] = key
+  self.mutex.Unlock()
+}
+
+func (self *DNSNameService) Lookup(userID string) (rawurl string, err os.Error) {
+  i := strings.Index(userID, "@")
+  if i == -1 || i == len(userID) - 1 {
+    return "", os.NewError("Malformed user ID")
+  }
+  domain := strings.ToLower(userID[i+1:])
+  self.mutex.Lock()
+  if rawurl, ok := self.overrides[userID]; ok {
+    self.mutex.Unlock()
+    return rawurl, nil
+  }
+  if rawurl, ok := self.overrides[domain]; ok {
+    self.mutex.Unlock()
+    return rawurl, nil
+  }
+  self.mutex.Unlock()
+  entry := self.entry(domain)
+  return entry.url, entry.err
+}
+
+func (self *DNSNameService) PublicKey(domain string) (key *rsa.PublicKey, err os.Error) {
+  domain = strings.ToLower(domain)
+  self.mutex.Lock()
+  key, ok := self.keys[domain]
+  self.mutex.Unlock()
+  if ok {
+    return key, nil
+  }
+  entry := self.entry(domain)
+  if entry.err != nil {
+    return nil, entry.err
+  }
+  if entry.key == nil {
+    return nil, os.NewError("No public key for " + domain)
+  }
+  return entry.key, nil
+}
+
+// Returns the cached entry of the domain or resolves it
+func (self *DNSNameService) entry(domain string) *nameEntry {
+  self.mutex.Lock()
+  entry, ok := self.cache[domain]
+  self.mutex.Unlock()
+  if ok && entry.expires > time.Nanoseconds() {
+    return entry
+  }
+  rawurl, key, ttl, err := self.resolve(domain)
+  if err != nil {
+    log.Printf("Err: Cannot resolve %v: %v\n", domain, err)
+    ttl = nameNegativeTTL
+  }
+  now := time.Nanoseconds()
+  entry = &nameEntry{rawurl, key, err, now + ttl}
+  self.mutex.Lock()
+  if _, ok := self.cache[domain]; !ok && len(self.cache) >= maxCachedNames {
+    // Remove stale entries first, then failed lookups
+    for d, e := range self.cache {
+      if e.expires <= now {
+	self.cache[d] = nil, false
+      }
+    }
+    for d, e := range self.cache {
+      if len(self.cache) < maxCachedNames {
+	break
+      }
+      if e.err != nil {
+	self.cache[d] = nil, false
+      }
+    }
+  }
+  if _, ok := self.cache[domain]; ok || len(self.cache) < maxCachedNames {
+    self.cache[domain] = entry
+  }
+  self.mutex.Unlock()
+  return entry
+}
+
+// Returns the URL of the federation endpoint of the domain, its public key (if known)
+// and the nanoseconds for which both can be cached.
+func (self *DNSNameService) resolve(domain string) (rawurl string, key *rsa.PublicKey, ttl int64, err os.Error) {
+  if doc, e := self.resolver.WellKnown(domain); e == nil {
+    var wk wellKnownDoc
+    if err = json.Unmarshal(doc, &wk); err != nil {
+      return "", nil, 0, err
+    }
+    if _, err = http.ParseURL(wk.Fed); err != nil || wk.Fed == "" {
+      return "", nil, 0, os.NewError("Malformed URL in well-known document")
+    }
+    if wk.Key != "" {
+      if key, err = decodePublicKey(wk.Key, wk.Exp); err != nil {
+	return "", nil, 0, err
+      }
+    }
+    ttl = nameTTL
+    if wk.TTL > 0 && wk.TTL * 1000000000 < ttl {
+      ttl = wk.TTL * 1000000000
+    }
+    return wk.Fed, key, ttl, nil
+  }
+  addrs, err := self.resolver.LookupSRV(domain)
+  if err != nil {
+    return "", nil, 0, err
+  }
+  if len(addrs) == 0 {
+    return "", nil, 0, os.NewError("No federation endpoint")
+  }
+  // Prefer the lowest priority and among those the highest weight
+  best := addrs[0]
+  for _, a := range addrs[1:] {
+    if a.Priority < best.Priority || (a.Priority == best.Priority && a.Weight > best.Weight) {
+      best = a
+    }
+  }
+  return fmt.Sprintf("https://%v:%v/fed", strings.TrimRight(best.Target, "."), best.Port), nil, nameTTL, nil
+}
+
+// Encodes an RSA public key for the well-known document
+func EncodePublicKey(key *rsa.PublicKey) (modulus string, exp int) {
+  return base64.StdEncoding.EncodeToString(key.N.Bytes()), key.E
+}
+
+func decodePublicKey(modulus string, exp int) (key *rsa.PublicKey, err os.Error) {
+  n, err := base64.StdEncoding.DecodeString(modulus)
+  if err != nil || len(n) < 128 {
+    return nil, os.NewError("Malformed key in well-known document")
+  }
+  if exp == 0 {
+    exp = 65537
+  }
+  if exp < 3 || exp % 2 == 0 {
+    return nil, os.NewError("Malformed key exponent in well-known document")
+  }
+  return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
+
+// Resolves names via DNS and HTTPS
+type netResolver struct {
+}
+
+func (self *netResolver) LookupSRV(domain string) (addrs []*net.SRV, err os.Error) {
+  _, addrs, err = net.LookupSRV("lightwave", "tcp", domain)
+  return
+}
+
+// Gives up after fetchTimeout nanoseconds. Documents larger than maxWellKnownSize are an error.
+func (self *netResolver) WellKnown(domain string) (doc []byte, err os.Error) {
+  req, err := http.NewRequest("GET", "https://" + domain + "/.well-known/lightwave", nil)
+  if err != nil {
+    return nil, err
+  }
+  status, doc, err := sendLimitedRequest(req, fetchTimeout, maxWellKnownSize)
+  if err != nil {
+    return nil, err
+  }
+  if status != 200 {
+    return nil, os.NewError(fmt.Sprintf("Server responded with %v", status))
+  }
+  return doc, nil
+}
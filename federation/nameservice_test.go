@@ -0,0 +1,156 @@
+package lightwavefed
+
+import (
+  "crypto/rand"
+  "crypto/rsa"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+type fakeResolver struct {
+  srv map[string][]*net.SRV
+  wellKnown map[string]string
+  lookups int
+}
+
+func (self *fakeResolver) LookupSRV(domain string) (addrs []*net.SRV, err os.Error) {
+  self.lookups++
+  addrs, ok := self.srv[domain]
+  if !ok {
+    return nil, os.NewError("No such host")
+  }
+  return addrs, nil
+}
+
+func (self *fakeResolver) WellKnown(domain string) (doc []byte, err os.Error) {
+  self.lookups++
+  d, ok := self.wellKnown[domain]
+  if !ok {
+    return nil, os.NewError("Not found")
+  }
+  return []byte(d), nil
+}
+
+func TestDNSNameService(t *testing.T) {
+  privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  wkKey := &privateKey.PublicKey
+  modulus, exp := EncodePublicKey(wkKey)
+  r := &fakeResolver{
+    srv: map[string][]*net.SRV{
+      "srv.org": []*net.SRV{&net.SRV{Target: "b.srv.org.", Port: 7000, Priority: 20, Weight: 5}, &net.SRV{Target: "a.srv.org.", Port: 6000, Priority: 10, Weight: 1}},
+      "wk.org": []*net.SRV{&net.SRV{Target: "ignored.wk.org.", Port: 1, Priority: 10, Weight: 1}}},
+    wellKnown: map[string]string{"wk.org": `{"fed":"https://lw.wk.org/fed", "ttl":60, "key":"` + modulus + `", "exp":` + fmt.Sprintf("%v", exp) + `}`, "bad.org": `{"fed":""}`}}
+  ns := NewDNSNameService(r)
+
+  tests := []struct {
+    user string
+    url string
+  }{
+    {"alice@srv.org", "https://a.srv.org:6000/fed"},
+    {"bob@WK.org", "https://lw.wk.org/fed"},
+  }
+  for _, test := range tests {
+    rawurl, err := ns.Lookup(test.user)
+    if err != nil {
+      t.Fatal(err.String())
+    }
+    if rawurl != test.url {
+      t.Fatalf("Expected %v but got %v for %v", test.url, rawurl, test.user)
+    }
+  }
+  for _, user := range []string{"nobody", "nobody@", "carol@unknown.org", "dave@bad.org"} {
+    if _, err := ns.Lookup(user); err == nil {
+      t.Fatalf("Lookup of %v did not fail", user)
+    }
+  }
+
+  // Successful and failed lookups are cached
+  lookups := r.lookups
+  for _, user := range []string{"x@srv.org", "y@wk.org", "z@unknown.org"} {
+    ns.Lookup(user)
+  }
+  if r.lookups != lookups {
+    t.Fatal("Cache has not been used")
+  }
+  // The TTL of the well-known document is respected
+  if ns.cache["wk.org"].expires > time.Nanoseconds() + 60 * 1000000000 {
+    t.Fatal("The TTL of the well-known document has been ignored")
+  }
+  // Stale entries are resolved again
+  ns.cache["srv.org"].expires = 0
+  r.srv["srv.org"] = []*net.SRV{&net.SRV{Target: "c.srv.org.", Port: 8000}}
+  if rawurl, _ := ns.Lookup("alice@srv.org"); rawurl != "https://c.srv.org:8000/fed" {
+    t.Fatalf("Stale entry has been used: %v", rawurl)
+  }
+
+  // Public keys are taken from the well-known document unless they have been added explicitly
+  if key, err := ns.PublicKey("wk.org"); err != nil || key.N.Cmp(wkKey.N) != 0 || key.E != wkKey.E {
+    t.Fatalf("Wrong public key: %v", err)
+  }
+  if _, err := ns.PublicKey("srv.org"); err == nil {
+    t.Fatal("Domain without well-known document has a public key")
+  }
+  ns.AddPublicKey("srv.org", wkKey)
+  if key, err := ns.PublicKey("SRV.org"); err != nil || key.N.Cmp(wkKey.N) != 0 || key.E != wkKey.E {
+    t.Fatalf("Added public key has not been used: %v", err)
+  }
+
+  // Overrides take precedence
+  dir, err := ioutil.TempDir("", "nameservice")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "overrides.json")
+  if err = ioutil.WriteFile(path, []byte(`{"srv.org": "http://localhost:8080/fed", "bob@wk.org": "http://localhost:8181/fed"}`), 0600); err != nil {
+    t.Fatal(err.String())
+  }
+  if err = ns.LoadOverrides(path); err != nil {
+    t.Fatal(err.String())
+  }
+  tests = []struct {
+    user string
+    url string
+  }{
+    {"alice@srv.org", "http://localhost:8080/fed"},
+    {"bob@wk.org", "http://localhost:8181/fed"},
+    {"carol@wk.org", "https://lw.wk.org/fed"},
+  }
+  for _, test := range tests {
+    if rawurl, _ := ns.Lookup(test.user); rawurl != test.url {
+      t.Fatalf("Expected %v but got %v for %v", test.url, rawurl, test.user)
+    }
+  }
+  if err = ioutil.WriteFile(path, []byte(`{"srv.org": "::"}`), 0600); err != nil {
+    t.Fatal(err.String())
+  }
+  if err = ns.LoadOverrides(path); err == nil {
+    t.Fatal("Malformed override has been accepted")
+  }
+}
+
+func TestDNSNameServiceCacheLimit(t *testing.T) {
+  r := &fakeResolver{srv: map[string][]*net.SRV{"srv.org": []*net.SRV{&net.SRV{Target: "a.srv.org.", Port: 6000}}}}
+  ns := NewDNSNameService(r)
+  if _, err := ns.Lookup("alice@srv.org"); err != nil {
+    t.Fatal(err.String())
+  }
+  // Failed lookups make room for new entries once the cache is full
+  for i := 0; i < 2 * maxCachedNames; i++ {
+    ns.Lookup(fmt.Sprintf("x@unknown%v.org", i))
+  }
+  if len(ns.cache) > maxCachedNames {
+    t.Fatalf("Cache has grown to %v entries", len(ns.cache))
+  }
+  if _, ok := ns.cache["srv.org"]; !ok {
+    t.Fatal("Successful lookup has been evicted")
+  }
+}
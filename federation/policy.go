@@ -0,0 +1,278 @@
+package lightwavefed
+
+import (
+  "expvar"
+  "http"
+  "log"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+const (
+  // Maximum number of blobs accepted in one batch
+  maxBatchBlobs = 1000
+  // Maximum size of a request body in bytes, regardless of the policy. Batches must not be larger either.
+  maxRequestSize = 16 * 1024 * 1024
+  // Maximum number of remote servers for which rate limits and rejections are tracked
+  maxTrackedRemotes = 10000
+  // Rejections of remote servers beyond maxTrackedRemotes are counted under this name
+  otherRemotes = "*"
+)
+
+const (
+  rejectUnauthenticated = "unauthenticated"
+  rejectDenied = "denied"
+  rejectRateLimited = "ratelimited"
+  rejectTooLarge = "toolarge"
+)
+
+var (
+  errBlobTooLarge = os.NewError("Blob is too large")
+  errSignerDenied = os.NewError("The domain of the signer is denied")
+)
+
+// Counts rejected requests and blobs per reason. Published at /debug/vars.
+var rejectedVar = expvar.NewMap("lightwavefed-rejected")
+
+// The Policy limits what remote servers can do. The zero value allows everything.
+// Remote servers are identified by their authenticated domain. If authentication is turned off,
+// the host part of the remote address stands in for the domain.
+// The rate limit applies to the host part of the remote address, too. It is checked before a request
+// is authenticated, such that unauthenticated requests cannot cause unlimited work.
+type Policy struct {
+  // If not empty, only these domains may federate
+  Allow []string
+  // These domains may not federate. Blobs signed by users of these domains are rejected as well.
+  Deny []string
+  // The number of requests a domain may send per second. Zero means no limit.
+  RequestsPerSecond float64
+  // The number of requests a domain may send in a burst. Must be at least one if RequestsPerSecond is set.
+  Burst int
+  // The maximum size of a blob in bytes. Zero means no limit.
+  MaxBlobSize int
+}
+
+// Rejected requests and blobs of one remote domain
+type Rejections struct {
+  Unauthenticated int64
+  Denied int64
+  RateLimited int64
+  TooLarge int64
+}
+
+// A token bucket
+type bucket struct {
+  tokens float64
+  // Time in nanoseconds of the last refill
+  last int64
+}
+
+// The zero value allows everything
+type policyState struct {
+  policy Policy
+  allow map[string]bool
+  deny map[string]bool
+  // The key is a domain or, if authentication is turned off, a host
+  buckets map[string]*bucket
+  // The key is the host part of a remote address
+  addressBuckets map[string]*bucket
+  rejections map[string]*Rejections
+  mutex sync.Mutex
+}
+
+// Replaces the policy. The rate limits start afresh.
+func (self *Federation) SetPolicy(policy Policy) (err os.Error) {
+  if policy.RequestsPerSecond < 0 || (policy.RequestsPerSecond > 0 && policy.Burst < 1) {
+    return os.NewError("Burst must be at least one if RequestsPerSecond is set")
+  }
+  if policy.MaxBlobSize < 0 {
+    return os.NewError("MaxBlobSize must not be negative")
+  }
+  p := &self.policy
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  p.policy = policy
+  p.allow = make(map[string]bool)
+  for _, domain := range policy.Allow {
+    p.allow[domain] = true
+  }
+  p.deny = make(map[string]bool)
+  for _, domain := range policy.Deny {
+    p.deny[domain] = true
+  }
+  p.buckets = make(map[string]*bucket)
+  p.addressBuckets = make(map[string]*bucket)
+  return nil
+}
+
+// Returns the number of rejected requests and blobs. The key is the remote domain.
+// Once maxTrackedRemotes domains have been rejected, the rejections of further domains are counted under "*".
+func (self *Federation) Rejections() map[string]Rejections {
+  p := &self.policy
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  result := make(map[string]Rejections)
+  for domain, r := range p.rejections {
+    result[domain] = *r
+  }
+  return result
+}
+
+// Returns the domain of the remote server or, if authentication is turned off, its host
+func remoteName(domain string, req *http.Request) string {
+  if domain != "" {
+    return domain
+  }
+  host, _, err := net.SplitHostPort(req.RemoteAddr)
+  if err != nil {
+    return req.RemoteAddr
+  }
+  return host
+}
+
+// Returns the maximum size of a request body. This is at most maxRequestSize.
+func (self *policyState) maxBodySize(batch bool) int64 {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  limit := int64(maxRequestSize)
+  if self.policy.MaxBlobSize == 0 {
+    return limit
+  }
+  if batch {
+    // Base64 encoding makes the blobs larger by a third
+    if l := batchSize(maxBatchBlobs, int64(maxBatchBlobs) * int64(self.policy.MaxBlobSize)); l < limit {
+      limit = l
+    }
+  } else if l := int64(self.policy.MaxBlobSize); l < limit {
+    limit = l
+  }
+  return limit
+}
+
+// Returns the maximum size in bytes of a batch of 'count' blobs with a total size of 'size' bytes.
+// Base64 encoding makes the blobs larger by a third. Quotes and commas add a few bytes per blob.
+func batchSize(count int, size int64) int64 {
+  return size * 4 / 3 + int64(count) * 8
+}
+
+// Checks a blob which has been received from 'remote' and counts a rejection
+func (self *policyState) checkBlob(remote string, blob []byte, signer string) (err os.Error) {
+  self.mutex.Lock()
+  if self.policy.MaxBlobSize > 0 && len(blob) > self.policy.MaxBlobSize {
+    err = errBlobTooLarge
+  } else if signer != "" && self.deny[userDomain(signer)] {
+    err = errSignerDenied
+  }
+  self.mutex.Unlock()
+  if err == errBlobTooLarge {
+    self.reject(remote, rejectTooLarge)
+  } else if err == errSignerDenied {
+    self.reject(remote, rejectDenied)
+  }
+  return
+}
+
+// Returns true if the domain may federate
+func (self *policyState) allowed(domain string) bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.deny[domain] {
+    return false
+  }
+  return len(self.allow) == 0 || self.allow[domain]
+}
+
+// Takes a token from the bucket of the domain. Returns false if the bucket is empty.
+func (self *policyState) take(domain string) bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.buckets == nil {
+    self.buckets = make(map[string]*bucket)
+  }
+  return self.takeFrom(self.buckets, domain)
+}
+
+// Takes a token from the bucket of the host part of a remote address. Returns false if the bucket is empty.
+func (self *policyState) takeAddress(host string) bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.addressBuckets == nil {
+    self.addressBuckets = make(map[string]*bucket)
+  }
+  return self.takeFrom(self.addressBuckets, host)
+}
+
+// At most maxTrackedRemotes buckets are kept. Buckets which have been refilled completely are removed first,
+// because they do not differ from new ones. The caller must hold the mutex.
+func (self *policyState) takeFrom(buckets map[string]*bucket, key string) bool {
+  if self.policy.RequestsPerSecond <= 0 {
+    return true
+  }
+  now := time.Nanoseconds()
+  b, ok := buckets[key]
+  if !ok {
+    if len(buckets) >= maxTrackedRemotes {
+      for k, b := range buckets {
+	if b.tokens + float64(now - b.last) / 1e9 * self.policy.RequestsPerSecond >= float64(self.policy.Burst) {
+	  buckets[k] = nil, false
+	}
+      }
+      // Remove arbitrary buckets if all remote servers are busy
+      for k := range buckets {
+	if len(buckets) < maxTrackedRemotes {
+	  break
+	}
+	buckets[k] = nil, false
+      }
+    }
+    b = &bucket{tokens: float64(self.policy.Burst), last: now}
+    buckets[key] = b
+  }
+  return b.take(now, self.policy.RequestsPerSecond, self.policy.Burst)
+}
+
+// Refills the bucket with 'rate' tokens per second up to 'burst' tokens and takes one token.
+// Returns false if the bucket is empty. The caller must synchronize access to the bucket.
+func (self *bucket) take(now int64, rate float64, burst int) bool {
+  self.tokens += float64(now - self.last) / 1e9 * rate
+  if self.tokens > float64(burst) {
+    self.tokens = float64(burst)
+  }
+  self.last = now
+  if self.tokens < 1 {
+    return false
+  }
+  self.tokens--
+  return true
+}
+
+func (self *policyState) reject(domain string, reason string) {
+  log.Printf("Err: Rejected %v from %v\n", reason, domain)
+  rejectedVar.Add(reason, 1)
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.rejections == nil {
+    self.rejections = make(map[string]*Rejections)
+  }
+  r, ok := self.rejections[domain]
+  if !ok && len(self.rejections) >= maxTrackedRemotes {
+    domain = otherRemotes
+    r, ok = self.rejections[domain]
+  }
+  if !ok {
+    r = &Rejections{}
+    self.rejections[domain] = r
+  }
+  switch reason {
+  case rejectUnauthenticated:
+    r.Unauthenticated++
+  case rejectDenied:
+    r.Denied++
+  case rejectRateLimited:
+    r.RateLimited++
+  case rejectTooLarge:
+    r.TooLarge++
+  }
+}
@@ -0,0 +1,165 @@
+package lightwavefed
+
+import (
+  . "lightwavestore"
+  "bytes"
+  "crypto/rand"
+  "crypto/rsa"
+  "fmt"
+  "http"
+  "http/httptest"
+  "json"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestPolicy(t *testing.T) {
+  s := NewSimpleBlobStore()
+  fed := &Federation{store: s, ns: &urlNameService{url: "http://unused"}, peers: make(map[string]*peer)}
+  fed.DisableAuthentication()
+  if err := fed.SetPolicy(Policy{RequestsPerSecond: 1}); err == nil {
+    t.Fatal("Policy without a burst has been accepted")
+  }
+  if err := fed.SetPolicy(Policy{Deny: []string{"10.0.0.2", "evil"}, RequestsPerSecond: 0.001, Burst: 3, MaxBlobSize: 100}); err != nil {
+    t.Fatal(err.String())
+  }
+  send := func(addr string, contentType string, body []byte) *httptest.ResponseRecorder {
+    req, err := http.NewRequest("POST", "http://lightwave/fed", bytes.NewBuffer(body))
+    if err != nil {
+      t.Fatal(err)
+    }
+    if contentType != "" {
+      req.Header.Set("Content-Type", contentType)
+    }
+    req.RemoteAddr = addr
+    w := httptest.NewRecorder()
+    fed.handleRequest(w, req)
+    return w
+  }
+
+  blob := []byte(`{"type":"keep", "signer":"a@alice", "random":"1"}`)
+  if w := send("10.0.0.1:1000", "", blob); w.Code != 200 {
+    t.Fatalf("Blob has been rejected: %v", w.Code)
+  }
+  // Too large
+  large := []byte(`{"type":"keep", "signer":"a@alice", "random":"` + strings.Repeat("x", 100) + `"}`)
+  if w := send("10.0.0.1:1000", "", large); w.Code != 413 {
+    t.Fatalf("Large blob has not been rejected: %v", w.Code)
+  }
+  // Signed by a user of a denied domain. The batch is accepted, but not the blob.
+  evil := []byte(`{"type":"keep", "signer":"e@evil", "random":"2"}`)
+  body, _ := json.Marshal([][]byte{evil})
+  w := send("10.0.0.1:1000", batchMimeType, body)
+  var results []string
+  if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &results) != nil || len(results) != 1 || results[0] == "" {
+    t.Fatalf("Blob of a denied signer has been accepted: %v %v", w.Code, results)
+  }
+  if _, err := s.GetBlob(NewBlobRef(evil)); err == nil {
+    t.Fatal("Blob of a denied signer has been stored")
+  }
+  // The burst is used up
+  if w := send("10.0.0.1:1000", "", blob); w.Code != 429 {
+    t.Fatalf("Request has not been rate limited: %v", w.Code)
+  }
+  // Other hosts have their own limit, unless they are denied
+  if w := send("10.0.0.3:1000", "", blob); w.Code != 200 {
+    t.Fatalf("Blob has been rejected: %v", w.Code)
+  }
+  if w := send("10.0.0.2:1000", "", blob); w.Code != 403 {
+    t.Fatalf("Denied host has not been rejected: %v", w.Code)
+  }
+
+  r := fed.Rejections()
+  if r["10.0.0.1"] != (Rejections{TooLarge: 1, Denied: 1, RateLimited: 1}) {
+    t.Fatalf("Wrong rejections: %v", r["10.0.0.1"])
+  }
+  if r["10.0.0.2"] != (Rejections{Denied: 1}) || len(r) != 2 {
+    t.Fatalf("Wrong rejections: %v", r)
+  }
+
+  // Only allowed domains may federate
+  if err := fed.SetPolicy(Policy{Allow: []string{"10.0.0.3"}}); err != nil {
+    t.Fatal(err.String())
+  }
+  if w := send("10.0.0.1:1000", "", blob); w.Code != 403 {
+    t.Fatalf("Host which is not allowed has not been rejected: %v", w.Code)
+  }
+  if w := send("10.0.0.3:1000", "", large); w.Code != 200 {
+    t.Fatalf("Blob has been rejected: %v", w.Code)
+  }
+
+  // With authentication, the remote address is rate limited before the request is authenticated
+  key, err := rsa.GenerateKey(rand.Reader, 1024)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  fed.SetServerKey(key)
+  if err = fed.SetPolicy(Policy{RequestsPerSecond: 0.001, Burst: 2}); err != nil {
+    t.Fatal(err.String())
+  }
+  for i, code := range []int{401, 401, 429} {
+    if w := send("10.0.0.4:1000", "", blob); w.Code != code {
+      t.Fatalf("Request %v has not been answered with %v: %v", i, code, w.Code)
+    }
+  }
+  if r := fed.Rejections()["10.0.0.4"]; r != (Rejections{Unauthenticated: 2, RateLimited: 1}) {
+    t.Fatalf("Wrong rejections: %v", r)
+  }
+}
+
+// Reads nothing and fails the test if the handler tries to read the body
+type unreadBody struct {
+  t *testing.T
+}
+
+func (self *unreadBody) Read(p []byte) (n int, err os.Error) {
+  self.t.Fatal("The body has been read")
+  return 0, os.EOF
+}
+
+func (self *unreadBody) Close() os.Error {
+  return nil
+}
+
+func TestPolicyLimits(t *testing.T) {
+  fed := &Federation{store: NewSimpleBlobStore(), ns: &urlNameService{url: "http://unused"}, peers: make(map[string]*peer)}
+  fed.DisableAuthentication()
+  if err := fed.SetPolicy(Policy{RequestsPerSecond: 0.001, Burst: 1}); err != nil {
+    t.Fatal(err.String())
+  }
+  // Without MaxBlobSize, the size of a request is limited nevertheless. Its announced length is checked before reading.
+  req, _ := http.NewRequest("POST", "http://lightwave/fed", nil)
+  req.Header.Set("Content-Type", batchMimeType)
+  req.Body = &unreadBody{t}
+  req.ContentLength = maxRequestSize + 1
+  req.RemoteAddr = "10.0.0.1:1000"
+  w := httptest.NewRecorder()
+  fed.handleRequest(w, req)
+  if w.Code != 413 {
+    t.Fatalf("Large request has not been rejected: %v", w.Code)
+  }
+  // The remote host is rate limited before the body is read
+  req.ContentLength = 10
+  w = httptest.NewRecorder()
+  fed.handleRequest(w, req)
+  if w.Code != 429 {
+    t.Fatalf("Request has not been rate limited: %v", w.Code)
+  }
+
+  // The number of tracked remote hosts is bounded
+  req.ContentLength = maxRequestSize + 1
+  for i := 0; i < maxTrackedRemotes + 10; i++ {
+    req.RemoteAddr = fmt.Sprintf("10.%v.%v.%v:1000", i >> 16, (i >> 8) & 255, i & 255)
+    fed.handleRequest(httptest.NewRecorder(), req)
+  }
+  p := &fed.policy
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  if len(p.addressBuckets) > maxTrackedRemotes || len(p.rejections) > maxTrackedRemotes + 1 {
+    t.Fatalf("Too many remote hosts are tracked: %v %v", len(p.addressBuckets), len(p.rejections))
+  }
+  if p.rejections[otherRemotes] == nil {
+    t.Fatal("Rejections of further remote hosts have not been counted")
+  }
+}
@@ -0,0 +1,481 @@
+package lightwavefed
+
+import (
+  "bufio"
+  "bytes"
+  "json"
+  "log"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+// Variables instead of constants, such that tests can shorten them
+var (
+  // Number of attempts to deliver a blob before it is moved to the dead letters
+  queueRetries = 10
+  // Nanoseconds to wait after the first failed delivery. The delay doubles with each failure.
+  queueBackoff int64 = 1000000000
+  // Upper bound for the delay between two deliveries
+  queueMaxBackoff int64 = 600 * 1000000000
+  // Nanoseconds until a delivery is abandoned
+  queueTimeout int64 = 30 * 1000000000
+  // Number of records appended to the journal after which it is compacted
+  journalCompactRecords = 10000
+)
+
+const (
+  entryQueued = iota
+  entryDelivered
+  entryDead
+)
+
+// One record in the journal of the outbound queues
+type journalRecord struct {
+  URL string "u"
+  BlobRef string "b"
+  State int "s"
+  // The domain of the users served by the remote server. It is needed to hand blobs to the relay.
+  Domain string "d"
+}
+
+// The journal is an append-only log which records all changes of the outbound queues.
+// It is replayed and compacted when the federation starts and compacted again
+// whenever journalCompactRecords records have been appended.
+// Each record is one line of JSON. Malformed lines, for example a partial line left behind by a crash, are skipped.
+type journal struct {
+  path string
+  file *os.File
+  // The number of records appended since the last compaction
+  appended int
+  mutex sync.Mutex
+}
+
+// The state of the outbound queues as recorded in the journal
+type journalState struct {
+  // The URLs of the remote servers in the order in which they appear in the journal
+  urls []string
+  // The queued blobrefs. The key is a URL.
+  entries map[string][]string
+  // The blobrefs which could not be delivered. The key is a URL.
+  dead map[string][]string
+  // The domains of the remote servers. The key is a URL.
+  domains map[string]string
+}
+
+// There is one queue per remote server. Blobs are delivered in the order in which they have been queued.
+// A blob is removed from the queue only after the remote server has acknowledged it.
+// Thus, a blob can be delivered more than once, which is fine because storing a blob is idempotent.
+// When a delivery fails, the queue waits before trying again. The delay grows exponentially
+// until a delivery succeeds. After queueRetries failed attempts the blob becomes a dead letter.
+// If the remote server understands batches, all waiting blobs (up to queueBatchSize) are sent in one request.
+// If a relay has been configured, blobs are handed to the relay instead of becoming dead letters.
+type queue struct {
+  fed *Federation
+  rawurl string
+  // The domain of the users served by the remote server. Empty if unknown.
+  domain string
+  // The blobrefs waiting for delivery
+  entries []string
+  // The blobrefs which could not be delivered
+  dead []string
+  // The number of failed attempts to deliver a blob
+  attempts map[string]int
+  // Whether the remote server understands batches
+  batch int
+  // Nanoseconds to wait after the next failure
+  backoff int64
+  wakeup chan bool
+  mutex sync.Mutex
+}
+
+func newQueue(fed *Federation, rawurl string) *queue {
+  q := &queue{fed: fed, rawurl: rawurl, backoff: queueBackoff, attempts: make(map[string]int), wakeup: make(chan bool, 1)}
+  // All relays understand batches
+  if isRelayURL(rawurl) {
+    q.batch = batchSupported
+  }
+  go q.run()
+  return q
+}
+
+// Makes the outbound queues durable by recording them in the directory 'dir'.
+// Blobs which have not been delivered before the last shutdown are queued again.
+// Without a queue directory, the outbound queues are held in memory only and all blobs
+// which have not been delivered yet are lost when the server stops.
+// Durable queues are only useful with a durable blob store, because the journal records blobrefs only.
+// This function must be called before any blob is forwarded.
+func (self *Federation) SetQueueDir(dir string) (err os.Error) {
+  if err = os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  j := &journal{path: filepath.Join(dir, "outbox")}
+  state, err := j.compact()
+  if err != nil {
+    return err
+  }
+  self.mutex.Lock()
+  self.journal = j
+  self.mutex.Unlock()
+  // Resume the delivery
+  for _, rawurl := range state.urls {
+    entries, dead := state.entries[rawurl], state.dead[rawurl]
+    if len(entries) == 0 && len(dead) == 0 {
+      continue
+    }
+    if len(entries) > 0 {
+      log.Printf("Resuming delivery of %v blobs to %v\n", len(entries), rawurl)
+    }
+    q := self.getQueue(rawurl)
+    q.setDomain(state.domains[rawurl])
+    q.mutex.Lock()
+    q.entries = append(entries, q.entries...)
+    q.dead = append(dead, q.dead...)
+    q.mutex.Unlock()
+    q.signal()
+  }
+  return nil
+}
+
+// Replays the journal, replaces it with a journal which contains only the current state of the queues
+// and opens it for appending. The caller must hold the mutex unless the journal is not in use yet.
+func (self *journal) compact() (state *journalState, err os.Error) {
+  var records []journalRecord
+  if f, e := os.Open(self.path); e == nil {
+    records, err = readJournal(f)
+    f.Close()
+    if err != nil {
+      return nil, err
+    }
+  } else if _, e2 := os.Stat(self.path); e2 == nil {
+    return nil, e
+  }
+  state = replayJournal(records)
+  // Write the compacted journal to a temporary file and replace the journal with it
+  var buf bytes.Buffer
+  for _, rawurl := range state.urls {
+    for _, blobref := range state.dead[rawurl] {
+      writeRecord(&buf, journalRecord{rawurl, blobref, entryDead, state.domains[rawurl]})
+    }
+    for _, blobref := range state.entries[rawurl] {
+      writeRecord(&buf, journalRecord{rawurl, blobref, entryQueued, state.domains[rawurl]})
+    }
+  }
+  tmp := self.path + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+  if err != nil {
+    return nil, err
+  }
+  if _, err = f.Write(buf.Bytes()); err == nil {
+    err = f.Sync()
+  }
+  f.Close()
+  if err != nil {
+    return nil, err
+  }
+  if err = os.Rename(tmp, self.path); err != nil {
+    return nil, err
+  }
+  if f, err = os.OpenFile(self.path, os.O_WRONLY | os.O_APPEND, 0600); err != nil {
+    return nil, err
+  }
+  if self.file != nil {
+    self.file.Close()
+  }
+  self.file = f
+  self.appended = 0
+  return state, nil
+}
+
+func replayJournal(records []journalRecord) *journalState {
+  state := &journalState{entries: make(map[string][]string), dead: make(map[string][]string), domains: make(map[string]string)}
+  for _, r := range records {
+    if _, ok := state.entries[r.URL]; !ok {
+      state.entries[r.URL] = []string{}
+      state.urls = append(state.urls, r.URL)
+    }
+    if r.Domain != "" {
+      state.domains[r.URL] = r.Domain
+    }
+    switch r.State {
+    case entryQueued:
+      state.entries[r.URL] = append(state.entries[r.URL], r.BlobRef)
+      state.dead[r.URL] = removeBlobRef(state.dead[r.URL], r.BlobRef)
+    case entryDelivered:
+      state.entries[r.URL] = removeBlobRef(state.entries[r.URL], r.BlobRef)
+    case entryDead:
+      state.entries[r.URL] = removeBlobRef(state.entries[r.URL], r.BlobRef)
+      state.dead[r.URL] = append(state.dead[r.URL], r.BlobRef)
+    }
+  }
+  return state
+}
+
+func readJournal(f *os.File) (records []journalRecord, err os.Error) {
+  r := bufio.NewReader(f)
+  for {
+    line, err := r.ReadBytes('\n')
+    if err == os.EOF {
+      // A partial line is the result of a crash
+      if len(line) > 0 {
+	log.Printf("Err: Ignoring partial record in the federation journal\n")
+      }
+      return records, nil
+    }
+    if err != nil {
+      return nil, err
+    }
+    var record journalRecord
+    if e := json.Unmarshal(line, &record); e != nil || record.URL == "" || record.BlobRef == "" {
+      log.Printf("Err: Skipping malformed record in the federation journal: %v\n", string(line))
+      continue
+    }
+    records = append(records, record)
+  }
+  return
+}
+
+func writeRecord(buf *bytes.Buffer, record journalRecord) {
+  data, err := json.Marshal(record)
+  if err != nil {
+    panic("Cannot marshal journal record")
+  }
+  buf.Write(data)
+  buf.WriteByte('\n')
+}
+
+func removeBlobRef(blobrefs []string, blobref string) []string {
+  for i, b := range blobrefs {
+    if b == blobref {
+      return append(blobrefs[:i], blobrefs[i+1:]...)
+    }
+  }
+  return blobrefs
+}
+
+// Appends a record to the journal. Records of newly queued blobs are synced to disk before the function returns.
+func (self *Federation) record(rawurl, domain, blobref string, state int) {
+  self.mutex.Lock()
+  j := self.journal
+  self.mutex.Unlock()
+  if j == nil {
+    return
+  }
+  var buf bytes.Buffer
+  writeRecord(&buf, journalRecord{rawurl, blobref, state, domain})
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+  _, err := j.file.Write(buf.Bytes())
+  if err == nil && state == entryQueued {
+    err = j.file.Sync()
+  }
+  if err != nil {
+    log.Printf("Err: Writing the federation journal failed: %v\n", err)
+    return
+  }
+  j.appended++
+  if j.appended >= journalCompactRecords {
+    if _, err = j.compact(); err != nil {
+      log.Printf("Err: Compacting the federation journal failed: %v\n", err)
+    }
+  }
+}
+
+// Returns the blobrefs which could not be delivered. The key is the URL of the remote server.
+func (self *Federation) DeadLetters() (result map[string][]string) {
+  self.mutex.Lock()
+  queues := make([]*queue, 0, len(self.queues))
+  for _, q := range self.queues {
+    queues = append(queues, q)
+  }
+  self.mutex.Unlock()
+  result = make(map[string][]string)
+  for _, q := range queues {
+    q.mutex.Lock()
+    if len(q.dead) > 0 {
+      result[q.rawurl] = append([]string{}, q.dead...)
+    }
+    q.mutex.Unlock()
+  }
+  return
+}
+
+// Queues all dead letters of a remote server again. This is useful after an outage has been fixed.
+func (self *Federation) Redeliver(rawurl string) {
+  q := self.getQueue(rawurl)
+  q.mutex.Lock()
+  dead := q.dead
+  q.dead = nil
+  q.mutex.Unlock()
+  for _, blobref := range dead {
+    q.push(blobref)
+  }
+}
+
+func (self *queue) push(blobref string) {
+  self.mutex.Lock()
+  domain := self.domain
+  self.mutex.Unlock()
+  self.fed.record(self.rawurl, domain, blobref, entryQueued)
+  self.mutex.Lock()
+  self.entries = append(self.entries, blobref)
+  self.mutex.Unlock()
+  self.signal()
+}
+
+// Remembers the domain of the users served by the remote server
+func (self *queue) setDomain(domain string) {
+  if domain == "" {
+    return
+  }
+  self.mutex.Lock()
+  self.domain = domain
+  self.mutex.Unlock()
+}
+
+func (self *queue) signal() {
+  select {
+  case self.wakeup <- true:
+  default:
+  }
+}
+
+func (self *queue) run() {
+  for {
+    self.mutex.Lock()
+    if len(self.entries) == 0 {
+      self.mutex.Unlock()
+      <-self.wakeup
+      continue
+    }
+    blobrefs := []string{self.entries[0]}
+    if self.batch == batchSupported {
+      n := len(self.entries)
+      if n > queueBatchSize {
+	n = queueBatchSize
+      }
+      blobrefs = append([]string{}, self.entries[:n]...)
+    }
+    self.mutex.Unlock()
+    var blobs [][]byte
+    var sent []string
+    var size int64
+    for _, blobref := range blobrefs {
+      blob, err := self.fed.store.GetBlob(blobref)
+      if err != nil {
+	// Retrying does not help
+	log.Printf("Err: Cannot forward unknown blob %v\n", blobref)
+	self.remove(blobref, entryDead)
+	continue
+      }
+      // The remaining blobs are sent in the next batch
+      size += int64(len(blob))
+      if len(blobs) > 0 && batchSize(len(blobs) + 1, size) > maxRequestSize {
+	break
+      }
+      blobs = append(blobs, blob)
+      sent = append(sent, blobref)
+    }
+    if len(blobs) == 0 {
+      continue
+    }
+    results, err := self.deliver(blobs)
+    if err != nil {
+      log.Printf("Err: Forwarding to %v failed: %v\n", self.rawurl, err)
+      if !isRelayURL(self.rawurl) {
+	self.fed.peerOffline(self.rawurl)
+      }
+      // The remote server might be replaced by a different version
+      self.batch = batchUnknown
+      for _, blobref := range sent {
+	self.fail(blobref)
+      }
+    } else {
+      if !isRelayURL(self.rawurl) {
+	self.fed.peerOnline(self.rawurl, "", "")
+      }
+      for i, blobref := range sent {
+	if results[i] == nil {
+	  self.remove(blobref, entryDelivered)
+	} else {
+	  log.Printf("Err: Forwarding %v to %v failed: %v\n", blobref, self.rawurl, results[i])
+	  self.fail(blobref)
+	  err = results[i]
+	}
+      }
+    }
+    if err == nil {
+      self.backoff = queueBackoff
+      continue
+    }
+    time.Sleep(self.backoff)
+    self.backoff *= 2
+    if self.backoff > queueMaxBackoff {
+      self.backoff = queueMaxBackoff
+    }
+  }
+}
+
+// Sends the blobs in one batch or, if the remote server does not support batches, sends a single blob.
+func (self *queue) deliver(blobs [][]byte) (results []os.Error, err os.Error) {
+  if self.batch == batchUnknown {
+    ok, err := self.fed.supportsBatch(self.rawurl, queueTimeout)
+    if err != nil {
+      return nil, err
+    }
+    if ok {
+      self.batch = batchSupported
+    } else {
+      self.batch = batchUnsupported
+    }
+  }
+  if self.batch == batchSupported {
+    return self.fed.postBatch(self.rawurl, blobs, queueTimeout)
+  }
+  if err = self.fed.postBlob(self.rawurl, blobs[0], queueTimeout); err != nil {
+    return nil, err
+  }
+  return make([]os.Error, 1), nil
+}
+
+// Counts a failed attempt. After too many failures the blob is handed to the relay
+// or, if there is none, becomes a dead letter.
+func (self *queue) fail(blobref string) {
+  self.mutex.Lock()
+  self.attempts[blobref]++
+  giveUp := self.attempts[blobref] >= queueRetries
+  domain := self.domain
+  self.mutex.Unlock()
+  if !giveUp {
+    return
+  }
+  if relay := self.fed.relayURL(); relay != "" && domain != "" && !isRelayURL(self.rawurl) {
+    log.Printf("Err: Handing %v for %v to the relay\n", blobref, domain)
+    // Queue the blob for the relay first, such that it is not lost in a crash
+    self.fed.getQueue(relayQueueURL(relay, domain)).push(blobref)
+    self.remove(blobref, entryDelivered)
+    return
+  }
+  log.Printf("Err: Giving up on forwarding %v to %v\n", blobref, self.rawurl)
+  self.remove(blobref, entryDead)
+}
+
+// Removes an entry from the queue.
+func (self *queue) remove(blobref string, state int) {
+  self.mutex.Lock()
+  self.entries = removeBlobRef(self.entries, blobref)
+  if state == entryDead {
+    self.dead = append(self.dead, blobref)
+  }
+  self.attempts[blobref] = 0, false
+  domain := self.domain
+  self.mutex.Unlock()
+  self.fed.record(self.rawurl, domain, blobref, state)
+}
+
+// Sends a blob via POST /fed. Gives up after 'timeout' nanoseconds.
+func (self *Federation) postBlob(rawurl string, blob []byte, timeout int64) (err os.Error) {
+  _, err = self.requestOK("POST", rawurl, "application/octet-stream", blob, timeout)
+  return
+}
@@ -0,0 +1,201 @@
+package lightwavefed
+
+import (
+  . "lightwavestore"
+  "fmt"
+  "http"
+  "http/httptest"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+// A remote server which can be switched on and off. It does not understand batches.
+type flakyServer struct {
+  up bool
+  failures int
+  received map[string]int
+  mutex sync.Mutex
+}
+
+func (self *flakyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if req.Method != "POST" {
+    w.WriteHeader(500)
+    return
+  }
+  if !self.up {
+    self.failures++
+    w.WriteHeader(500)
+    return
+  }
+  blob, _ := ioutil.ReadAll(req.Body)
+  self.received[NewBlobRef(blob)]++
+  w.WriteHeader(200)
+}
+
+func (self *flakyServer) setUp(up bool) {
+  self.mutex.Lock()
+  self.up = up
+  self.mutex.Unlock()
+}
+
+// Waits until the server has received all blobs
+func (self *flakyServer) wait(blobrefs []string) bool {
+  for i := 0; i < 50; i++ {
+    self.mutex.Lock()
+    missing := 0
+    for _, blobref := range blobrefs {
+      if self.received[blobref] == 0 {
+	missing++
+      }
+    }
+    self.mutex.Unlock()
+    if missing == 0 {
+      return true
+    }
+    time.Sleep(100000000)
+  }
+  return false
+}
+
+func newQueueFederation(t *testing.T, s BlobStore, rawurl string, dir string) *Federation {
+  fed := &Federation{userID: "a@alice", ns: &urlNameService{url: rawurl}, store: s, queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  fed.fetcher = newFetcher(fed)
+  if err := fed.SetQueueDir(dir); err != nil {
+    t.Fatal(err.String())
+  }
+  return fed
+}
+
+// The queues keep running after a test. Hence, the tests share these settings instead of changing them.
+func init() {
+  queueRetries, queueBackoff, queueBatchSize = 4, 10000000, 4
+  journalCompactRecords = 8
+}
+
+func TestQueue(t *testing.T) {
+  dir, err := ioutil.TempDir("", "fedqueue")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  remote := &flakyServer{received: make(map[string]int)}
+  server := httptest.NewServer(remote)
+  defer server.Close()
+
+  s := NewSimpleBlobStore()
+  var blobrefs []string
+  for i := 0; i < 3; i++ {
+    blobref, _ := s.StoreBlob([]byte(fmt.Sprintf(`{"type":"keep", "signer":"a@alice", "random":"%v"}`, i)), "")
+    blobrefs = append(blobrefs, blobref)
+  }
+
+  // The remote server is down. The first blob becomes a dead letter.
+  fed := newQueueFederation(t, s, server.URL, dir)
+  fed.Forward(blobrefs[0], []string{"b@bob"})
+  for i := 0; i < 50 && len(fed.DeadLetters()[server.URL]) == 0; i++ {
+    time.Sleep(100000000)
+  }
+  if dead := fed.DeadLetters()[server.URL]; len(dead) != 1 || dead[0] != blobrefs[0] {
+    t.Fatalf("Blob has not become a dead letter: %v", dead)
+  }
+  remote.mutex.Lock()
+  if remote.failures != queueRetries {
+    t.Fatalf("Wrong number of attempts: %v", remote.failures)
+  }
+  remote.mutex.Unlock()
+
+  // The server is restarted while more blobs are waiting
+  fed.Forward(blobrefs[1], []string{"b@bob"})
+  fed.Forward(blobrefs[2], []string{"b@bob", "a@alice"})
+  fed2 := newQueueFederation(t, s, server.URL, dir)
+  if dead := fed2.DeadLetters()[server.URL]; len(dead) != 1 || dead[0] != blobrefs[0] {
+    t.Fatalf("Dead letters have not been restored: %v", dead)
+  }
+  fed2.mutex.Lock()
+  if q := fed2.queues[server.URL]; q == nil || len(q.entries) != 2 {
+    t.Fatal("Queued blobs have not been restored")
+  }
+  fed2.mutex.Unlock()
+  remote.setUp(true)
+  if !remote.wait(blobrefs[1:]) {
+    t.Fatal("Queued blobs have not been delivered")
+  }
+  fed2.Redeliver(server.URL)
+  if !remote.wait(blobrefs) {
+    t.Fatal("Dead letter has not been delivered")
+  }
+  if len(fed2.DeadLetters()) != 0 {
+    t.Fatal("Dead letters have not been removed")
+  }
+
+  // Delivered blobs are not queued again after a restart
+  time.Sleep(100000000)
+  fed3 := newQueueFederation(t, s, server.URL, dir)
+  fed3.mutex.Lock()
+  if len(fed3.queues) != 0 {
+    t.Fatal("Delivered blobs have been queued again")
+  }
+  fed3.mutex.Unlock()
+  data, err := ioutil.ReadFile(filepath.Join(dir, "outbox"))
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if len(data) != 0 {
+    t.Fatalf("Journal has not been compacted: %v", string(data))
+  }
+}
+
+func TestJournal(t *testing.T) {
+  dir, err := ioutil.TempDir("", "fedjournal")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "outbox")
+  // A malformed record in the middle of the journal is skipped
+  data := `{"u":"http://b","b":"sha1-1","s":0}` + "\n" + `{"u":"http://b","b` + "\n" + `{"u":"http://b","b":"sha1-2","s":0}` + "\n"
+  if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+    t.Fatal(err.String())
+  }
+  j := &journal{path: path}
+  state, err := j.compact()
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if entries := state.entries["http://b"]; len(entries) != 2 || entries[0] != "sha1-1" || entries[1] != "sha1-2" {
+    t.Fatalf("Wrong entries after replay: %v", entries)
+  }
+
+  // The journal is compacted while records are appended
+  fed := &Federation{journal: j}
+  for i := 0; i < 3 * journalCompactRecords; i++ {
+    blobref := fmt.Sprintf("sha1-x%v", i)
+    fed.record("http://b", "", blobref, entryQueued)
+    fed.record("http://b", "", blobref, entryDelivered)
+  }
+  if j.appended >= journalCompactRecords {
+    t.Fatalf("Journal has not been compacted after %v records", j.appended)
+  }
+  f, err := os.Open(path)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  records, err := readJournal(f)
+  f.Close()
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if len(records) >= journalCompactRecords + 2 {
+    t.Fatalf("Journal is too long: %v records", len(records))
+  }
+  state = replayJournal(records)
+  if entries := state.entries["http://b"]; len(entries) != 2 || entries[0] != "sha1-1" || entries[1] != "sha1-2" {
+    t.Fatalf("Wrong entries after compaction: %v", entries)
+  }
+}
@@ -0,0 +1,359 @@
+package lightwavefed
+
+import (
+  store "lightwavestore"
+  "http"
+  "io/ioutil"
+  "json"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// A relay holds blobs for servers which cannot be reached.
+// When a queue gives up on delivering a blob, it hands the blob to the relay via POST /fed?relay=<domain>,
+// where <domain> is the domain served by the unreachable server. This request always carries a batch.
+// The relay keeps the blob in the mailbox of this domain. It does not put the blob in its own store.
+// The server of the domain pulls its mailbox via GET /fed?mailbox=<domain>, which returns up to
+// maxBatchBlobs blobs and maxRequestSize bytes in the batch format, and acknowledges the blobs it has received
+// via POST /fed?mailbox=<domain> with a JSON array of blobrefs. The relay then deletes them.
+// Only the servers of a domain can pull its mailbox. Therefore, a relay requires authentication.
+// The relay holds mailboxes only for the domains it has been configured to serve. Blobs for other domains are rejected.
+// A mailbox holds at most maxMailboxBlobs blobs and maxMailboxSize bytes. All mailboxes together hold at most
+// maxRelaySize bytes. Further blobs are rejected.
+
+var (
+  // Nanoseconds between two pulls of the mailbox
+  relayPollInterval int64 = 300 * 1000000000
+  // The maximum number of blobs in one mailbox
+  maxMailboxBlobs = 10000
+  // The maximum number of bytes in one mailbox
+  maxMailboxSize int64 = 100 * 1024 * 1024
+  // The maximum number of bytes in all mailboxes together
+  maxRelaySize int64 = 1024 * 1024 * 1024
+)
+
+var (
+  errMailboxFull = os.NewError("The mailbox is full")
+  errRelayFull = os.NewError("The relay is full")
+)
+
+// Turns this server into a relay which keeps the mailboxes of 'domains' in the directory 'dir'.
+// Authentication must have been turned on by SetServerKey before, because otherwise
+// any server could download or delete the blobs in any mailbox.
+func (self *Federation) EnableRelay(dir string, domains []string) (err os.Error) {
+  if self.key == nil {
+    return os.NewError("A relay requires authentication. Call SetServerKey first")
+  }
+  if len(domains) == 0 {
+    return os.NewError("A relay must serve at least one domain")
+  }
+  served := make(map[string]bool)
+  for _, domain := range domains {
+    if !validMailbox(domain) {
+      return os.NewError("Malformed domain: " + domain)
+    }
+    served[domain] = true
+  }
+  if err = os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  // Count the blobs which have been kept before a restart
+  var size int64
+  for domain := range served {
+    mailbox := filepath.Join(dir, domain)
+    if _, e := os.Stat(mailbox); e != nil {
+      continue
+    }
+    _, s, err := mailboxUsage(mailbox)
+    if err != nil {
+      return err
+    }
+    size += s
+  }
+  self.mailboxMutex.Lock()
+  self.relaySize = size
+  self.mailboxMutex.Unlock()
+  self.mutex.Lock()
+  self.mailboxDir = dir
+  self.relayDomains = served
+  self.mutex.Unlock()
+  return nil
+}
+
+// Hands blobs which cannot be delivered to the relay at 'rawurl' and pulls the blobs which the relay holds
+// for the domain of this server. The mailbox is pulled right away and then every relayPollInterval nanoseconds.
+func (self *Federation) SetRelay(rawurl string) {
+  self.mutex.Lock()
+  self.relay = rawurl
+  self.mutex.Unlock()
+  go func() {
+    for {
+      if _, err := self.PullMailbox(); err != nil {
+	log.Printf("Err: Pulling the mailbox from %v failed: %v\n", rawurl, err)
+      }
+      time.Sleep(relayPollInterval)
+    }
+  }()
+}
+
+func (self *Federation) relayURL() string {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.relay
+}
+
+// The URL of the queue which hands blobs for 'domain' to the relay
+func relayQueueURL(relay string, domain string) string {
+  return relay + "?relay=" + http.URLEscape(domain)
+}
+
+func isRelayURL(rawurl string) bool {
+  return strings.Contains(rawurl, "?relay=")
+}
+
+// Returns the directory of the mailbox
+func (self *Federation) mailbox(domain string) (dir string, err os.Error) {
+  self.mutex.Lock()
+  root := self.mailboxDir
+  served := self.relayDomains[domain]
+  self.mutex.Unlock()
+  if root == "" {
+    return "", os.NewError("This server is not a relay")
+  }
+  if !served {
+    return "", os.NewError("This relay does not serve " + domain)
+  }
+  return filepath.Join(root, domain), nil
+}
+
+// Returns true if the name can be used as the directory of a mailbox
+func validMailbox(name string) bool {
+  return name != "" && name[0] != '.' && !strings.Contains(name, "/")
+}
+
+// Puts a blob in the mailbox of 'domain'
+func (self *Federation) deposit(remote string, domain string, blob []byte) (err os.Error) {
+  var schema syncSchema
+  json.Unmarshal(blob, &schema)
+  if err = self.policy.checkBlob(remote, blob, schema.Signer); err != nil {
+    return err
+  }
+  dir, err := self.mailbox(domain)
+  if err != nil {
+    return err
+  }
+  if err = os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  path := filepath.Join(dir, store.NewBlobRef(blob))
+  // The blob is in the mailbox already
+  if _, e := os.Stat(path); e == nil {
+    return nil
+  }
+  self.mailboxMutex.Lock()
+  defer self.mailboxMutex.Unlock()
+  if self.relaySize + int64(len(blob)) > maxRelaySize {
+    log.Printf("Err: Rejected a blob for %v: %v\n", domain, errRelayFull)
+    return errRelayFull
+  }
+  if err = checkMailboxQuota(dir, int64(len(blob))); err != nil {
+    log.Printf("Err: Rejected a blob for %v: %v\n", domain, err)
+    return err
+  }
+  f, err := os.OpenFile(path + ".tmp", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+  if err != nil {
+    return err
+  }
+  if _, err = f.Write(blob); err == nil {
+    err = f.Sync()
+  }
+  f.Close()
+  if err != nil {
+    return err
+  }
+  if err = os.Rename(path + ".tmp", path); err != nil {
+    return err
+  }
+  self.relaySize += int64(len(blob))
+  return nil
+}
+
+// Returns errMailboxFull if a blob of 'size' bytes does not fit into the mailbox in 'dir'
+func checkMailboxQuota(dir string, size int64) (err os.Error) {
+  count, s, err := mailboxUsage(dir)
+  if err != nil {
+    return err
+  }
+  if count >= maxMailboxBlobs || s + size > maxMailboxSize {
+    return errMailboxFull
+  }
+  return nil
+}
+
+// Returns the number of blobs in the mailbox in 'dir' and their total size in bytes
+func mailboxUsage(dir string) (count int, size int64, err os.Error) {
+  f, err := os.Open(dir)
+  if err != nil {
+    return 0, 0, err
+  }
+  infos, err := f.Readdir(-1)
+  f.Close()
+  if err != nil {
+    return 0, 0, err
+  }
+  for _, info := range infos {
+    if strings.HasSuffix(info.Name, ".tmp") {
+      continue
+    }
+    count++
+    size += info.Size
+  }
+  return count, size, nil
+}
+
+func (self *Federation) handleRelay(w http.ResponseWriter, remote string, domain string, batch bool, body []byte) {
+  if _, err := self.mailbox(domain); err != nil {
+    log.Printf("Err: Cannot relay blobs for %v: %v\n", domain, err)
+    w.WriteHeader(404)
+    return
+  }
+  if !batch {
+    w.WriteHeader(400)
+    return
+  }
+  self.handleBatch(w, remote, body, func(blob []byte) os.Error {
+    return self.deposit(remote, domain, blob)
+  })
+}
+
+// Sends the blobs in the mailbox of 'domain'. 'sender' is the authenticated domain of the requesting server.
+func (self *Federation) handleMailbox(w http.ResponseWriter, sender string, domain string) {
+  if self.key == nil || sender != domain {
+    w.WriteHeader(403)
+    return
+  }
+  dir, err := self.mailbox(domain)
+  if err != nil {
+    w.WriteHeader(404)
+    return
+  }
+  var names []string
+  if f, err := os.Open(dir); err == nil {
+    names, err = f.Readdirnames(-1)
+    f.Close()
+  }
+  blobs := [][]byte{}
+  var size int64
+  for _, name := range names {
+    if len(blobs) == maxBatchBlobs {
+      break
+    }
+    if strings.HasSuffix(name, ".tmp") {
+      continue
+    }
+    blob, err := ioutil.ReadFile(filepath.Join(dir, name))
+    if err != nil {
+      log.Printf("Err: Reading the mailbox of %v failed: %v\n", domain, err)
+      continue
+    }
+    // The remaining blobs are sent in response to the next request
+    size += int64(len(blob))
+    if len(blobs) > 0 && batchSize(len(blobs) + 1, size) > maxRequestSize {
+      break
+    }
+    blobs = append(blobs, blob)
+  }
+  result, err := json.Marshal(blobs)
+  if err != nil {
+    log.Printf("Failed marshaling the mailbox")
+    w.WriteHeader(500)
+    return
+  }
+  w.Header().Add("Content-type", batchMimeType)
+  w.Write(result)
+}
+
+// Deletes the acknowledged blobs from the mailbox of 'domain'
+func (self *Federation) handleAck(w http.ResponseWriter, sender string, domain string, body []byte) {
+  if self.key == nil || sender != domain {
+    w.WriteHeader(403)
+    return
+  }
+  dir, err := self.mailbox(domain)
+  if err != nil {
+    w.WriteHeader(404)
+    return
+  }
+  var blobrefs []string
+  if err = json.Unmarshal(body, &blobrefs); err != nil {
+    w.WriteHeader(400)
+    return
+  }
+  self.mailboxMutex.Lock()
+  defer self.mailboxMutex.Unlock()
+  for _, blobref := range blobrefs {
+    if !validMailbox(blobref) {
+      continue
+    }
+    path := filepath.Join(dir, blobref)
+    info, err := os.Stat(path)
+    if err != nil {
+      continue
+    }
+    if os.Remove(path) == nil {
+      self.relaySize -= info.Size
+    }
+  }
+  w.WriteHeader(200)
+}
+
+// Pulls the blobs which the relay holds for the domain of this server and puts them in the store.
+// Returns the number of blobs received.
+func (self *Federation) PullMailbox() (count int, err os.Error) {
+  relay := self.relayURL()
+  if relay == "" {
+    return 0, os.NewError("No relay")
+  }
+  domain := userDomain(self.userID)
+  query := "?mailbox=" + http.URLEscape(domain)
+  for {
+    data, err := self.requestOK("GET", relay + query, "", nil, queueTimeout)
+    if err != nil {
+      return count, err
+    }
+    var blobs [][]byte
+    if err = json.Unmarshal(data, &blobs); err != nil {
+      return count, err
+    }
+    if len(blobs) == 0 {
+      return count, nil
+    }
+    var acks []string
+    for _, blob := range blobs {
+      err := self.receiveBlob(relay, blob)
+      // Blobs rejected by the policy are dropped, because they would be rejected again
+      if err != nil && err != errBlobTooLarge && err != errSignerDenied {
+	continue
+      }
+      if err == nil {
+	count++
+      }
+      acks = append(acks, store.NewBlobRef(blob))
+    }
+    if len(acks) == 0 {
+      return count, os.NewError("Storing the blobs of the mailbox failed")
+    }
+    body, err := json.Marshal(acks)
+    if err != nil {
+      return count, err
+    }
+    if _, err = self.requestOK("POST", relay + query, "application/json", body, queueTimeout); err != nil {
+      return count, err
+    }
+    log.Printf("Received %v blobs from the relay %v\n", len(acks), relay)
+  }
+  return
+}
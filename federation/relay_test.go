@@ -0,0 +1,150 @@
+package lightwavefed
+
+import (
+  . "lightwavestore"
+  "crypto/rand"
+  "crypto/rsa"
+  "fmt"
+  "http"
+  "http/httptest"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// Mailboxes are small in tests
+func init() {
+  maxMailboxBlobs = 3
+}
+
+func TestRelay(t *testing.T) {
+  dir, err := ioutil.TempDir("", "fedrelay")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  keys := make(map[string]*rsa.PublicKey)
+  privateKeys := make(map[string]*rsa.PrivateKey)
+  for _, domain := range []string{"relay", "alice", "bob", "carol"} {
+    key, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+      t.Fatal(err.String())
+    }
+    privateKeys[domain] = key
+    keys[domain] = &key.PublicKey
+  }
+
+  // The relay requires authentication
+  relay := &Federation{userID: "r@relay", store: NewSimpleBlobStore(), ns: &urlNameService{url: "http://unused", keys: keys}, peers: make(map[string]*peer)}
+  if err = relay.EnableRelay(dir, []string{"bob"}); err == nil {
+    t.Fatal("Relay without authentication has been enabled")
+  }
+  relay.SetServerKey(privateKeys["relay"])
+  if err = relay.EnableRelay(dir, nil); err == nil {
+    t.Fatal("Relay without domains has been enabled")
+  }
+  if err = relay.EnableRelay(dir, []string{"bob"}); err != nil {
+    t.Fatal(err.String())
+  }
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    relay.handleRequest(w, req)
+  }))
+  defer server.Close()
+
+  // The server of bob is offline
+  offline := httptest.NewServer(http.NotFoundHandler())
+  offline.Close()
+
+  s := NewSimpleBlobStore()
+  blob := []byte(`{"type":"keep", "signer":"a@alice", "random":"relayed"}`)
+  blobref, _ := s.StoreBlob(blob, "")
+  fed := &Federation{userID: "a@alice", ns: &urlNameService{url: offline.URL}, store: s, queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  fed.fetcher = newFetcher(fed)
+  fed.SetServerKey(privateKeys["alice"])
+  fed.SetRelay(server.URL)
+  fed.Forward(blobref, []string{"b@bob"})
+
+  // The blob ends up in the mailbox of bob
+  path := filepath.Join(dir, "bob", blobref)
+  for i := 0; i < 50; i++ {
+    if _, err = os.Stat(path); err == nil {
+      break
+    }
+    time.Sleep(100000000)
+  }
+  if err != nil {
+    t.Fatal("Blob has not been relayed")
+  }
+  if dead := fed.DeadLetters(); len(dead) != 0 {
+    t.Fatalf("Relayed blob is a dead letter: %v", dead)
+  }
+
+  // Only the server of bob can pull the mailbox of bob
+  carol := &Federation{userID: "c@bob", ns: &urlNameService{url: "http://unused"}, store: NewSimpleBlobStore(), queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  carol.SetServerKey(privateKeys["carol"])
+  carol.relay = server.URL
+  if _, err := carol.PullMailbox(); err == nil {
+    t.Fatal("Mailbox has been pulled with the wrong key")
+  }
+  bs := NewSimpleBlobStore()
+  bob := &Federation{userID: "b@bob", ns: &urlNameService{url: "http://unused"}, store: bs, queues: make(map[string]*queue), peers: make(map[string]*peer)}
+  bob.fetcher = newFetcher(bob)
+  bob.SetServerKey(privateKeys["bob"])
+  bob.relay = server.URL
+  if n, err := bob.PullMailbox(); err != nil || n != 1 {
+    t.Fatalf("Pulling the mailbox failed: %v %v", n, err)
+  }
+  if _, err = bs.GetBlob(blobref); err != nil {
+    t.Fatal("Pulled blob has not been stored")
+  }
+  if _, err = os.Stat(path); err == nil {
+    t.Fatal("Acknowledged blob is still in the mailbox")
+  }
+  if n, err := bob.PullMailbox(); err != nil || n != 0 {
+    t.Fatalf("Mailbox is not empty: %v %v", n, err)
+  }
+  // The relay does not put the blob in its own store
+  if _, err = relay.store.GetBlob(blobref); err == nil {
+    t.Fatal("Relay has stored the blob")
+  }
+
+  // The mailbox does not take more than maxMailboxBlobs blobs
+  for i := 0; i < maxMailboxBlobs; i++ {
+    if err = relay.deposit("alice", "bob", []byte(fmt.Sprintf(`{"type":"keep", "signer":"a@alice", "random":"%v"}`, i))); err != nil {
+      t.Fatal(err.String())
+    }
+  }
+  if err = relay.deposit("alice", "bob", []byte(`{"type":"keep", "signer":"a@alice", "random":"full"}`)); err != errMailboxFull {
+    t.Fatalf("Full mailbox has accepted a blob: %v", err)
+  }
+  // A blob which is in the mailbox already does not count twice
+  if err = relay.deposit("alice", "bob", []byte(`{"type":"keep", "signer":"a@alice", "random":"0"}`)); err != nil {
+    t.Fatal(err.String())
+  }
+  // The relay does not hold blobs for other domains
+  if err = relay.deposit("alice", "carol", []byte(`{"type":"keep", "signer":"a@alice", "random":"carol"}`)); err == nil {
+    t.Fatal("Relay has accepted a blob for a domain it does not serve")
+  }
+  if _, err = os.Stat(filepath.Join(dir, "carol")); err == nil {
+    t.Fatal("Relay has created a mailbox for a domain it does not serve")
+  }
+
+  // The blobs kept in all mailboxes are counted after a restart
+  size := relay.relaySize
+  if err = relay.EnableRelay(dir, []string{"bob", "dave"}); err != nil {
+    t.Fatal(err.String())
+  }
+  if relay.relaySize != size || size == 0 {
+    t.Fatalf("Wrong size of the mailboxes: %v instead of %v", relay.relaySize, size)
+  }
+  // All mailboxes together do not take more than maxRelaySize bytes
+  defer func(old int64) {
+    maxRelaySize = old
+  }(maxRelaySize)
+  maxRelaySize = size + 10
+  if err = relay.deposit("alice", "dave", []byte(`{"type":"keep", "signer":"a@alice", "random":"dave"}`)); err != errRelayFull {
+    t.Fatalf("Full relay has accepted a blob: %v", err)
+  }
+}
@@ -0,0 +1,221 @@
+package lightwavefed
+
+import (
+  store "lightwavestore"
+  "json"
+  "log"
+  "os"
+)
+
+// Each remote server is a peer. A peer is either online or offline.
+// When a peer that has been offline (or unknown since startup) is contacted successfully,
+// all documents shared with users of this peer are synchronized, because
+// blobs might have been lost while the peer was not reachable.
+// The documents shared with a peer are not persisted. After a restart, a peer may be contacted
+// before any document is associated with it. Hence, a document is synchronized as well
+// when it is associated with the peer for the first time.
+// Receiving a blob counts as contact only if the sender has been authenticated as the server of the signer.
+type peer struct {
+  online bool
+  // The perma blobrefs of documents shared with users of this peer.
+  // The value is one such user.
+  permas map[string]string
+}
+
+const (
+  // The maximum number of blobs pulled by one sync
+  maxSyncBlobs = 50000
+  // The maximum number of bytes pulled by one sync
+  maxSyncBytes = 64 * 1024 * 1024
+  // The maximum number of peers which are tracked
+  maxPeers = 1000
+)
+
+type syncSchema struct {
+  Signer string "signer"
+  PermaNode string "perma"
+  Dependencies []string "dep"
+}
+
+type syncBlob struct {
+  blob []byte
+  deps []string
+}
+
+// Pulls all blobs of the document which the server of 'userID' knows and which are missing locally.
+// This can be used by administrators to repair a document after a server has been down.
+func (self *Federation) Sync(perma_blobref string, userID string) (err os.Error) {
+  rawurl, err := self.ns.Lookup(userID)
+  if err != nil {
+    return err
+  }
+  return self.syncWith(rawurl, perma_blobref)
+}
+
+// The blobs are held in memory until all of them have been pulled. Therefore, a sync fails
+// if more than maxSyncBlobs blobs or maxSyncBytes bytes are missing.
+func (self *Federation) syncWith(rawurl string, perma_blobref string) (err os.Error) {
+  remote, err := self.downloadFrontier(rawurl, perma_blobref)
+  if err != nil {
+    return err
+  }
+  if len(remote) > maxSyncBlobs {
+    return os.NewError("Remote frontier is too large")
+  }
+  // Walk the dependency graph backwards starting at the remote frontier
+  // until reaching blobs which are part of the local graph.
+  // Blobs which are stored locally but still wait for their dependencies are walked through.
+  blobs := make(map[string]*syncBlob)
+  count := 0
+  size := 0
+  queue := append([]string{perma_blobref}, remote...)
+  for len(queue) > 0 {
+    blobref := queue[0]
+    queue = queue[1:]
+    if _, ok := blobs[blobref]; ok {
+      continue
+    }
+    if self.inGraph(perma_blobref, blobref) {
+      continue
+    }
+    blob, e := self.store.GetBlob(blobref)
+    local := e == nil
+    if !local {
+      if blob, e = self.getBlob(rawurl, blobref, fetchTimeout); e != nil {
+	return e
+      }
+      if store.NewBlobRef(blob) != blobref {
+	return os.NewError("Received blob does not match its blobref")
+      }
+      count++
+      size += len(blob)
+      if count > maxSyncBlobs || size > maxSyncBytes {
+	return os.NewError("Too many blobs are missing")
+      }
+    }
+    var schema syncSchema
+    if e = json.Unmarshal(blob, &schema); e != nil {
+      return e
+    }
+    // Only the perma node itself does not refer to a perma node
+    if (blobref == perma_blobref && schema.PermaNode != "") || (blobref != perma_blobref && schema.PermaNode != perma_blobref) {
+      return os.NewError("Blob " + blobref + " does not belong to the document")
+    }
+    deps := schema.Dependencies
+    if schema.PermaNode != "" {
+      deps = append(deps, schema.PermaNode)
+    }
+    if local {
+      blob = nil
+    }
+    blobs[blobref] = &syncBlob{blob, deps}
+    queue = append(queue, deps...)
+  }
+  if count == 0 {
+    return nil
+  }
+  log.Printf("Sync of %v with %v: pulling %v blobs\n", perma_blobref, rawurl, count)
+  // Store the blobs in dependency order, such that the grapher does not have to queue them
+  stored := make(map[string]bool)
+  var storeBlob func(blobref string) os.Error
+  storeBlob = func(blobref string) os.Error {
+    b, ok := blobs[blobref]
+    if !ok || stored[blobref] {
+      return nil
+    }
+    stored[blobref] = true
+    for _, dep := range b.deps {
+      if err := storeBlob(dep); err != nil {
+	return err
+      }
+    }
+    if b.blob == nil {
+      return nil
+    }
+    _, err := self.store.StoreBlob(b.blob, blobref)
+    return err
+  }
+  for blobref, _ := range blobs {
+    if err = storeBlob(blobref); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Returns true if the blob has been added to the local graph of the perma node.
+// In this case all blobs it depends on are known locally as well.
+func (self *Federation) inGraph(perma_blobref string, blobref string) bool {
+  if blobref == perma_blobref {
+    _, err := self.store.GetBlob(blobref)
+    return err == nil
+  }
+  if self.grapher == nil {
+    return false
+  }
+  missing, err := self.grapher.MissingBlobs(perma_blobref, []string{blobref})
+  return err == nil && len(missing) == 0
+}
+
+// Called when a peer has been contacted successfully. 'perma_blobref' and 'userID' may be empty.
+// Otherwise, they name a document which is shared with a user of the peer.
+// At most maxPeers peers are tracked.
+func (self *Federation) peerOnline(rawurl string, perma_blobref string, userID string) {
+  self.mutex.Lock()
+  p, ok := self.peers[rawurl]
+  if !ok {
+    if len(self.peers) >= maxPeers {
+      self.mutex.Unlock()
+      log.Printf("Err: Too many peers to track %v\n", rawurl)
+      return
+    }
+    p = &peer{permas: make(map[string]string)}
+    self.peers[rawurl] = p
+  }
+  associated := false
+  if perma_blobref != "" {
+    _, known := p.permas[perma_blobref]
+    associated = !known
+    p.permas[perma_blobref] = userID
+  }
+  reconnect := !p.online
+  p.online = true
+  permas := make(map[string]string)
+  if reconnect {
+    for perma, user := range p.permas {
+      permas[perma] = user
+    }
+  } else if associated {
+    permas[perma_blobref] = userID
+  }
+  self.mutex.Unlock()
+  if reconnect && len(permas) > 0 {
+    log.Printf("Peer %v reconnected\n", rawurl)
+  }
+  if len(permas) > 0 {
+    go self.syncPeer(rawurl, permas)
+  }
+}
+
+// Called when a peer could not be reached
+func (self *Federation) peerOffline(rawurl string) {
+  self.mutex.Lock()
+  if p, ok := self.peers[rawurl]; ok {
+    p.online = false
+  }
+  self.mutex.Unlock()
+}
+
+// Synchronizes all documents shared with a peer which are known locally
+func (self *Federation) syncPeer(rawurl string, permas map[string]string) {
+  for perma, _ := range permas {
+    if _, err := self.store.GetBlob(perma); err != nil {
+      continue
+    }
+    if err := self.syncWith(rawurl, perma); err != nil {
+      log.Printf("Err: Sync of %v with %v failed: %v\n", perma, rawurl, err)
+      self.peerOffline(rawurl)
+      return
+    }
+  }
+}
@@ -0,0 +1,192 @@
+package lightwavefed
+
+import (
+  . "lightwavestore"
+  "bytes"
+  "crypto/rand"
+  "crypto/rsa"
+  "http"
+  "http/httptest"
+  "os"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Records the order in which blobs arrive in the store
+type orderListener struct {
+  blobrefs []string
+  mutex sync.Mutex
+}
+
+func (self *orderListener) HandleBlob(blob []byte, blobref string) os.Error {
+  self.mutex.Lock()
+  self.blobrefs = append(self.blobrefs, blobref)
+  self.mutex.Unlock()
+  return nil
+}
+
+func (self *orderListener) wait(count int) []string {
+  for i := 0; i < 50; i++ {
+    self.mutex.Lock()
+    n := len(self.blobrefs)
+    self.mutex.Unlock()
+    if n >= count {
+      break
+    }
+    time.Sleep(100000000)
+  }
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return append([]string{}, self.blobrefs...)
+}
+
+// A remote server which knows a perma node with a chain of mutations
+type syncServer struct {
+  blobs map[string][]byte
+  frontier string
+}
+
+func (self *syncServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  values := req.URL.Query()
+  if blobref := values.Get("frontier"); blobref != "" {
+    w.Write([]byte(`["` + self.frontier + `"]`))
+  } else if blob, ok := self.blobs[values.Get("blobref")]; ok {
+    w.Write(blob)
+  } else {
+    w.WriteHeader(500)
+  }
+}
+
+func (self *syncServer) add(blob []byte) string {
+  blobref := NewBlobRef(blob)
+  self.blobs[blobref] = blob
+  self.frontier = blobref
+  return blobref
+}
+
+// Creates the local federation of b@bob, which authenticates its peers, and a function
+// which posts a blob to it on behalf of the server of 'userID'
+func newSyncFederation(t *testing.T, s BlobStore, rawurl string) (fed *Federation, post func(userID string, blob []byte)) {
+  keys := make(map[string]*rsa.PublicKey)
+  privateKeys := make(map[string]*rsa.PrivateKey)
+  for _, domain := range []string{"alice", "bob", "carol"} {
+    key, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+      t.Fatal(err.String())
+    }
+    privateKeys[domain] = key
+    keys[domain] = &key.PublicKey
+  }
+  fed = &Federation{userID: "b@bob", ns: &urlNameService{url: rawurl, keys: keys}, store: s, peers: make(map[string]*peer)}
+  fed.fetcher = newFetcher(fed)
+  fed.SetServerKey(privateKeys["bob"])
+  post = func(userID string, blob []byte) {
+    sender := &Federation{userID: userID}
+    sender.SetServerKey(privateKeys[userDomain(userID)])
+    req, _ := http.NewRequest("POST", rawurl, bytes.NewBuffer(blob))
+    sender.signRequest(req, blob)
+    fed.handleRequest(httptest.NewRecorder(), req)
+  }
+  return
+}
+
+func TestSync(t *testing.T) {
+  remote := &syncServer{blobs: make(map[string][]byte)}
+  server := httptest.NewServer(remote)
+  defer server.Close()
+
+  perma := remote.add([]byte(`{"type":"permanode", "signer":"a@alice", "random":"perma1"}`))
+  keep := remote.add([]byte(`{"type":"keep", "signer":"a@alice", "perma":"` + perma + `"}`))
+  entity := remote.add([]byte(`{"type":"entity", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + keep + `"]}`))
+  m1 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + entity + `"], "entity":"` + entity + `"}`))
+  m2 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + m1 + `"], "entity":"` + entity + `"}`))
+  m3 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + m2 + `"], "entity":"` + entity + `"}`))
+
+  // The local server has seen the beginning of the document only
+  s := NewSimpleBlobStore()
+  l := &orderListener{}
+  s.AddListener(l)
+  s.StoreBlob(remote.blobs[perma], perma)
+  s.StoreBlob(remote.blobs[keep], keep)
+  fed, post := newSyncFederation(t, s, server.URL)
+
+  if err := fed.Sync(perma, "a@alice"); err != nil {
+    t.Fatal(err.String())
+  }
+  order := l.wait(6)
+  expected := []string{perma, keep, entity, m1, m2, m3}
+  if len(order) != len(expected) {
+    t.Fatalf("Wrong number of blobs pulled: %v", order)
+  }
+  for i, blobref := range expected {
+    if order[i] != blobref {
+      t.Fatalf("Blobs have not been stored in dependency order: %v", order)
+    }
+  }
+  // Nothing is missing any more
+  if err := fed.Sync(perma, "a@alice"); err != nil {
+    t.Fatal(err.String())
+  }
+  time.Sleep(200000000)
+  if order = l.wait(6); len(order) != 6 {
+    t.Fatalf("Known blobs have been pulled again: %v", order)
+  }
+
+  // The peer goes offline. Meanwhile two mutations are made but only the last one arrives.
+  fed.peerOffline(server.URL)
+  m4 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + m3 + `"], "entity":"` + entity + `"}`))
+  m5 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + m4 + `"], "entity":"` + entity + `"}`))
+  post("a@alice", remote.blobs[m5])
+  // Receiving a blob from the peer triggers a catch-up sync which pulls the missing mutation
+  order = l.wait(8)
+  if len(order) != 8 || order[6] != m5 || order[7] != m4 {
+    t.Fatalf("Reconnecting did not pull the missing blob: %v", order)
+  }
+
+  // Blobs of other documents are not pulled
+  other := remote.add([]byte(`{"type":"permanode", "signer":"a@alice", "random":"perma2"}`))
+  remote.add([]byte(`{"type":"keep", "signer":"a@alice", "perma":"` + other + `", "dep":["` + m5 + `"]}`))
+  if err := fed.Sync(perma, "a@alice"); err == nil {
+    t.Fatal("Blob of another document has been accepted")
+  }
+  time.Sleep(200000000)
+  if order = l.wait(8); len(order) != 8 {
+    t.Fatalf("Blobs of another document have been stored: %v", order)
+  }
+}
+
+func TestSyncAfterRestart(t *testing.T) {
+  remote := &syncServer{blobs: make(map[string][]byte)}
+  server := httptest.NewServer(remote)
+  defer server.Close()
+
+  perma := remote.add([]byte(`{"type":"permanode", "signer":"a@alice", "random":"perma1"}`))
+  keep := remote.add([]byte(`{"type":"keep", "signer":"a@alice", "perma":"` + perma + `"}`))
+  m1 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + keep + `"]}`))
+  m2 := remote.add([]byte(`{"type":"mutation", "signer":"a@alice", "perma":"` + perma + `", "dep":["` + m1 + `"]}`))
+
+  // The local server has been restarted. It knows the beginning of the document but not the peer
+  s := NewSimpleBlobStore()
+  l := &orderListener{}
+  s.AddListener(l)
+  s.StoreBlob(remote.blobs[perma], perma)
+  s.StoreBlob(remote.blobs[keep], keep)
+  fed, post := newSyncFederation(t, s, server.URL)
+
+  // The peer is contacted before any document is associated with it, for example by the queue
+  fed.peerOnline(server.URL, "", "")
+  // A blob which is delivered by the server of another domain does not associate the document with the peer
+  post("c@carol", remote.blobs[m2])
+  time.Sleep(200000000)
+  if order := l.wait(3); len(order) != 3 || order[2] != m2 {
+    t.Fatalf("Blob of another server has triggered a sync: %v", order)
+  }
+  // Receiving a blob from the server of the signer associates the document with the peer.
+  // This pulls the missing mutation
+  post("a@alice", remote.blobs[m2])
+  order := l.wait(4)
+  if len(order) != 4 || order[2] != m2 || order[3] != m1 {
+    t.Fatalf("Associating the document with the peer did not pull the missing blob: %v", order)
+  }
+}
@@ -126,6 +126,24 @@ func (self *channelAPI) Blob_DeleteEntity(perma grapher.PermaNode, entity graphe
   }
 }
 
+func (self *channelAPI) Blob_Snapshot(perma grapher.PermaNode, snapshot grapher.SnapshotNode) {
+  snapJson := map[string]interface{}{ "perma":perma.BlobRef(), "seq": snapshot.SequenceNumber(), "type":"snapshot", "frontier": snapshot.Frontier()}
+  msg := json.RawMessage(snapshot.Content())
+  snapJson["content"] = &msg
+  schema, err := json.Marshal(snapJson)
+  if err != nil {
+    panic(err.String())
+  }
+  if self.bufferOnly {
+    self.messageBuffer = append(self.messageBuffer, string(schema));
+  } else {
+    err = self.forwardToFollowers(perma.BlobRef(), string(schema))
+  }
+  if err != nil {
+    log.Printf("Err Forward: %v", err)
+  }
+}
+
 func (self* channelAPI) Blob_Mutation(perma grapher.PermaNode, mutation grapher.MutationNode) {
   mutJson := map[string]interface{}{ "perma":perma.BlobRef(), "seq": mutation.SequenceNumber(), "type":"mutation", "signer":mutation.Signer(), "entity": mutation.EntityBlobRef(), "field": mutation.Field(), "time": mutation.Time()}
   switch mutation.Operation().(type) {
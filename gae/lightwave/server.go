@@ -42,6 +42,9 @@ type channelStruct struct {
 
 var schema *grapher.Schema
 
+// All blobs are created by this server on behalf of the signed in user. Hence, they carry no signatures to check.
+var keyRegistry = grapher.NoVerification
+
 func init() {
   rand.Seed(time.Nanoseconds())
 
@@ -220,7 +223,7 @@ func handleOpen(w http.ResponseWriter, r *http.Request) {
     }
     // Repeat all blobs from this document.  
     s := newStore(c)
-    g := grapher.NewGrapher(userid, schema, s, s, nil)
+    g := grapher.NewGrapher(userid, schema, s, s, nil, keyRegistry)
     s.SetGrapher(g)
     ch := newChannelAPI(c, s, userid, sessionid, true, g)
     perma, err = g.Repeat(req.Perma, req.From)
@@ -316,7 +319,7 @@ func handleSubmit(w http.ResponseWriter, r *http.Request) {
   r.Body.Close()
 
   s := newStore(c)
-  g := grapher.NewGrapher(userid, schema, s, s, nil)
+  g := grapher.NewGrapher(userid, schema, s, s, nil, keyRegistry)
   s.SetGrapher(g)
   tf.NewTransformer(g)
   tf.NewMapTransformer(g)
@@ -803,7 +806,7 @@ func addUnread(c appengine.Context, userid string, perma_blobref string) os.Erro
 
 func createBook(c appengine.Context, userid string) (perma_blobref string, err os.Error) {
   s := newStore(c)
-  g := grapher.NewGrapher(userid, schema, s, s, nil)
+  g := grapher.NewGrapher(userid, schema, s, s, nil, keyRegistry)
   s.SetGrapher(g)
 
   blob := []byte(`{"type":"permanode", "mimetype":"application/x-lightwave-book"}`) 
@@ -873,7 +876,7 @@ func handleImport(w http.ResponseWriter, r *http.Request) {
   sessionid := fmt.Sprintf("s%v", rand.Int31())
 
   s := newStore(c)
-  g := grapher.NewGrapher(u.Email, schema, s, s, nil)
+  g := grapher.NewGrapher(u.Email, schema, s, s, nil, keyRegistry)
   s.SetGrapher(g)
   _ = newChannelAPI(c, s, sessionid, true, g)
 
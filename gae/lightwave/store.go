@@ -273,6 +273,38 @@ func (self *store) Dequeue(perma_blobref string, blobref string) (blobrefs []str
   return
 }
 
+func (self *store) StoreSnapshot(perma_blobref string, data map[string]interface{}) (err os.Error) {
+  parent := datastore.NewKey("perma", perma_blobref, 0, nil)
+  // Only the latest snapshot is kept. Therefore, the key does not depend on the sequence number
+  _, err = datastore.Put(self.c, datastore.NewKey("snapshot", "latest", 0, parent), datastore.Map(data))
+  return
+}
+
+func (self *store) GetSnapshot(perma_blobref string) (data map[string]interface{}, err os.Error) {
+  parent := datastore.NewKey("perma", perma_blobref, 0, nil)
+  m := make(datastore.Map)
+  if err = datastore.Get(self.c, datastore.NewKey("snapshot", "latest", 0, parent), m); err != nil {
+    if err == datastore.ErrNoSuchEntity {
+      return nil, nil
+    }
+    return nil, err
+  }
+  return m, nil
+}
+
+func (self *store) DeletePermaNode(perma_blobref string) (err os.Error) {
+  parent := datastore.NewKey("perma", perma_blobref, 0, nil)
+  // The OT nodes, the snapshot and the queue of the perma node are its descendants
+  keys, err := datastore.NewQuery("").Ancestor(parent).KeysOnly().GetAll(self.c, nil)
+  if err != nil {
+    return
+  }
+  if err = datastore.DeleteMulti(self.c, keys); err != nil {
+    return
+  }
+  return datastore.Delete(self.c, parent)
+}
+
 func (self *store) ListPermas(userid string, mimeType string) (perma_blobrefs []string, err os.Error) {
   // TODO: Use query GetAll?
   query := datastore.NewQuery("node").Filter("k =", int64(grapher.OTNode_Keep)).Filter("s =", userid).KeysOnly()
@@ -0,0 +1,639 @@
+package lightwavegrapher
+
+import (
+  "bufio"
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "json"
+  "log"
+  "os"
+  "path/filepath"
+  "strconv"
+  "sync"
+  lst "container/list"
+)
+
+// FileGraphStore is a GraphStore that keeps its data in a directory on disk.
+// Each perma node has a subdirectory containing
+//   "perma": The data of the perma node. It is replaced atomically.
+//   "nodes": An append-only log of all OT nodes. The position of a node in the log is its sequence number.
+//            Each record carries the data of the perma node after the node has been stored, too.
+//   "snapshot": The latest snapshot (if any). It is replaced atomically.
+// Blobs waiting for missing dependencies are recorded in the append-only log "queue" in the top-level directory.
+//
+// Each record in a log is one line of JSON. A crash can leave a partial line at the end of a log.
+// Such a line is removed when the log is opened again. Any other malformed line makes opening the log fail.
+// A crash after appending a node but before replacing "perma" leaves an outdated perma node.
+// It is restored from the last record of "nodes" when the log is opened again.
+type FileGraphStore struct {
+  dir string
+  graphs map[string]*fileGraph
+  // The blobrefs of blobs which are missing. The value is a list of strings
+  // which are the blobrefs of pending blobs.
+  waitingLists map[string]*lst.List
+  // The blobrefs of blobs that are in the store but not yet indexed
+  // because they depend on blobs which are not yet indexed.
+  // The value is the number of unsatisfied dependencies.
+  pendingBlobs map[string]int
+  queue *os.File
+  // The size of the queue log
+  queueSize int64
+  mutex sync.Mutex
+}
+
+type fileGraph struct {
+  nodes *os.File
+  // The file offsets of all records in the log of nodes. The last entry is the size of the log.
+  offsets []int64
+  nodesByBlobRef map[string]int
+}
+
+// Opens the store located in the directory 'dir'. The directory is created if required.
+func NewFileGraphStore(dir string) (s *FileGraphStore, err os.Error) {
+  if err = os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  s = &FileGraphStore{dir: dir, graphs: make(map[string]*fileGraph), waitingLists: make(map[string]*lst.List), pendingBlobs: make(map[string]int)}
+  // Replay the queue
+  var offsets []int64
+  s.queue, offsets, err = openLog(filepath.Join(dir, "queue"), func(index int, data map[string]interface{}) {
+    blobref := data["b"].(string)
+    if deps, ok := data["dep"]; ok {
+      s.enqueue(blobref, deps.([]string))
+    } else {
+      s.dequeue(blobref)
+    }
+  })
+  if err != nil {
+    return nil, err
+  }
+  s.queueSize = offsets[len(offsets)-1]
+  return s, nil
+}
+
+// Closes the logs. The store must not be used afterwards.
+func (self *FileGraphStore) Close() (err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  for _, g := range self.graphs {
+    if e := g.nodes.Close(); e != nil && err == nil {
+      err = e
+    }
+  }
+  self.graphs = make(map[string]*fileGraph)
+  if e := self.queue.Close(); e != nil && err == nil {
+    err = e
+  }
+  return
+}
+
+// The perma blobref is used as a directory name and must therefore not contain path separators.
+func (self *FileGraphStore) permaDir(perma_blobref string) (dir string, err os.Error) {
+  if _, e := hex.DecodeString(perma_blobref); e != nil || len(perma_blobref) == 0 {
+    return "", os.NewError("Malformed perma blobref")
+  }
+  return filepath.Join(self.dir, perma_blobref), nil
+}
+
+// Returns the graph of the perma node. The log of OT nodes is opened if required.
+// Returns an error if the perma node is unknown.
+func (self *FileGraphStore) graph(perma_blobref string) (g *fileGraph, err os.Error) {
+  g, ok := self.graphs[perma_blobref]
+  if ok {
+    return g, nil
+  }
+  dir, err := self.permaDir(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if _, e := os.Stat(filepath.Join(dir, "perma")); e != nil {
+    return nil, os.NewError("Unknown perma blob")
+  }
+  g = &fileGraph{nodesByBlobRef: make(map[string]int)}
+  var last map[string]interface{}
+  g.nodes, g.offsets, err = openLog(filepath.Join(dir, "nodes"), func(index int, data map[string]interface{}) {
+    g.nodesByBlobRef[data["b"].(string)] = index
+    last = data
+  })
+  if err != nil {
+    return nil, err
+  }
+  if err = repairPermaNode(dir, last, int64(len(g.offsets) - 1)); err != nil {
+    g.nodes.Close()
+    return nil, err
+  }
+  self.graphs[perma_blobref] = g
+  return g, nil
+}
+
+// Restores the perma node from the last record of the log if the process crashed before the perma node
+// has been replaced. 'count' is the number of nodes in the log.
+func repairPermaNode(dir string, last map[string]interface{}, count int64) (err os.Error) {
+  blob, ok := last[permaKey].([]byte)
+  if !ok {
+    return nil
+  }
+  data, err := readRecordFile(filepath.Join(dir, "perma"))
+  if err != nil {
+    return err
+  }
+  if seq, ok := data["n"].(int64); ok && seq >= count {
+    return nil
+  }
+  if data, err = decodeRecord(blob); err != nil {
+    return err
+  }
+  log.Printf("Restoring perma node in %v", dir)
+  return writeRecordFile(filepath.Join(dir, "perma"), data)
+}
+
+// The key under which a record in the log of nodes carries the perma node
+const permaKey = "_perma"
+
+// Stores the node and the perma node. Appending the node to the log is the atomic step,
+// because the record carries the perma node, too.
+func (self *FileGraphStore) StoreNode(perma_blobref string, blobref string, data map[string]interface{}, perma_data map[string]interface{}) (err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  g, err := self.graph(perma_blobref)
+  if err != nil {
+    return err
+  }
+  pblob, err := encodeRecord(perma_data)
+  if err != nil {
+    return err
+  }
+  record := make(map[string]interface{})
+  for key, value := range data {
+    record[key] = value
+  }
+  record[permaKey] = pblob
+  size, err := appendLog(g.nodes, g.offsets[len(g.offsets)-1], record)
+  if err != nil {
+    return err
+  }
+  g.nodesByBlobRef[blobref] = len(g.offsets) - 1
+  g.offsets = append(g.offsets, size)
+  dir, _ := self.permaDir(perma_blobref)
+  return writeRecordFile(filepath.Join(dir, "perma"), perma_data)
+}
+
+func (self *FileGraphStore) StorePermaNode(perma_blobref string, data map[string]interface{}) (err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  dir, err := self.permaDir(perma_blobref)
+  if err != nil {
+    return err
+  }
+  if err = os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  return writeRecordFile(filepath.Join(dir, "perma"), data)
+}
+
+func (self *FileGraphStore) GetPermaNode(perma_blobref string) (data map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  dir, err := self.permaDir(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  data, err = readRecordFile(filepath.Join(dir, "perma"))
+  if err != nil || data == nil {
+    return
+  }
+  // Opening the log of nodes for the first time restores an outdated perma node
+  if _, ok := self.graphs[perma_blobref]; !ok {
+    if _, err = self.graph(perma_blobref); err != nil {
+      return nil, err
+    }
+    return readRecordFile(filepath.Join(dir, "perma"))
+  }
+  return
+}
+
+func (self *FileGraphStore) HasOTNodes(perma_blobref string, blobrefs []string) (missing_blobrefs []string, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  g, err := self.graph(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  for _, b := range blobrefs {
+    if _, ok := g.nodesByBlobRef[b]; !ok {
+      missing_blobrefs = append(missing_blobrefs, b)
+    }
+  }
+  return
+}
+
+func (self *FileGraphStore) GetOTNodeBySeqNumber(perma_blobref string, seqNumber int64) (data map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  g, err := self.graph(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if seqNumber < 0 || seqNumber >= int64(len(g.offsets) - 1) {
+    return nil, os.NewError("Index out of bounds")
+  }
+  return readNode(g.nodes, g.offsets[seqNumber], g.offsets[seqNumber + 1])
+}
+
+func (self *FileGraphStore) GetOTNodeByBlobRef(perma_blobref string, blobref string) (data map[string]interface{}, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  g, err := self.graph(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  seq, ok := g.nodesByBlobRef[blobref]
+  if !ok {
+    return nil, nil
+  }
+  return readNode(g.nodes, g.offsets[seq], g.offsets[seq + 1])
+}
+
+// Returns the log and the offsets of the nodes in the range. A negative endSeqNumber denotes the end of the log.
+func (self *FileGraphStore) nodeRange(perma_blobref string, startWithSeqNumber int64, endSeqNumber int64) (nodes *os.File, offsets []int64, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  g, err := self.graph(perma_blobref)
+  if err != nil {
+    return nil, nil, err
+  }
+  count := int64(len(g.offsets) - 1)
+  if endSeqNumber < 0 {
+    endSeqNumber = count
+  }
+  if startWithSeqNumber < 0 || startWithSeqNumber > count || endSeqNumber > count || startWithSeqNumber > endSeqNumber {
+    return nil, nil, os.NewError("Index out of bounds")
+  }
+  // Copy the offsets, because nodes might be appended while the caller reads them
+  offsets = make([]int64, endSeqNumber - startWithSeqNumber + 1)
+  copy(offsets, g.offsets[startWithSeqNumber:endSeqNumber + 1])
+  return g.nodes, offsets, nil
+}
+
+func (self *FileGraphStore) GetMutationsAscending(perma_blobref string, entity_blobref string, field string, startWithSeqNumber int64, endSeqNumber int64) (ch <-chan map[string]interface{}, err os.Error) {
+  nodes, offsets, err := self.nodeRange(perma_blobref, startWithSeqNumber, endSeqNumber)
+  if err != nil {
+    return nil, err
+  }
+  c := make(chan map[string]interface{})
+  f := func() {
+    for i := 0; i < len(offsets) - 1; i++ {
+      data, e := readNode(nodes, offsets[i], offsets[i + 1])
+      if e != nil {
+        log.Printf("Err: Reading node: %v", e)
+        break
+      }
+      if data["k"].(int64) == OTNode_Mutation && data["e"].(string) == entity_blobref && data["f"].(string) == field {
+	c <- data
+      }
+    }
+    close(c)
+  }
+  go f()
+  return c, nil
+}
+
+func (self *FileGraphStore) GetOTNodesAscending(perma_blobref string, startWithSeqNumber int64, endSeqNumber int64) (ch <-chan map[string]interface{}, err os.Error) {
+  nodes, offsets, err := self.nodeRange(perma_blobref, startWithSeqNumber, endSeqNumber)
+  if err != nil {
+    return nil, err
+  }
+  c := make(chan map[string]interface{})
+  f := func() {
+    for i := 0; i < len(offsets) - 1; i++ {
+      data, e := readNode(nodes, offsets[i], offsets[i + 1])
+      if e != nil {
+        log.Printf("Err: Reading node: %v", e)
+        break
+      }
+      c <- data
+    }
+    close(c)
+  }
+  go f()
+  return c, nil
+}
+
+func (self *FileGraphStore) GetOTNodesDescending(perma_blobref string) (ch <-chan map[string]interface{}, err os.Error) {
+  nodes, offsets, err := self.nodeRange(perma_blobref, 0, -1)
+  if err != nil {
+    return nil, err
+  }
+  c := make(chan map[string]interface{})
+  f := func() {
+    for i := len(offsets) - 2; i >= 0; i-- {
+      data, e := readNode(nodes, offsets[i], offsets[i + 1])
+      if e != nil {
+        log.Printf("Err: Reading node: %v", e)
+        break
+      }
+      c <- data
+    }
+    close(c)
+  }
+  go f()
+  return c, nil
+}
+
+func (self *FileGraphStore) StoreSnapshot(perma_blobref string, data map[string]interface{}) (err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if _, err = self.graph(perma_blobref); err != nil {
+    return err
+  }
+  dir, _ := self.permaDir(perma_blobref)
+  return writeRecordFile(filepath.Join(dir, "snapshot"), data)
+}
+
+func (self *FileGraphStore) GetSnapshot(perma_blobref string) (data map[string]interface{}, err os.Error) {
+  dir, err := self.permaDir(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  return readRecordFile(filepath.Join(dir, "snapshot"))
+}
+
+// Closes the log of OT nodes and removes the directory of the perma node.
+func (self *FileGraphStore) DeletePermaNode(perma_blobref string) (err os.Error) {
+  dir, err := self.permaDir(perma_blobref)
+  if err != nil {
+    return err
+  }
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if g, ok := self.graphs[perma_blobref]; ok {
+    g.nodes.Close()
+    self.graphs[perma_blobref] = nil, false
+  }
+  return os.RemoveAll(dir)
+}
+
+func (self *FileGraphStore) Enqueue(perma_blobref string, blobref string, dependencies []string) (err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if dependencies == nil {
+    dependencies = []string{}
+  }
+  if self.queueSize, err = appendLog(self.queue, self.queueSize, map[string]interface{}{"b": blobref, "dep": dependencies}); err != nil {
+    return
+  }
+  self.enqueue(blobref, dependencies)
+  return nil
+}
+
+func (self *FileGraphStore) enqueue(blobref string, dependencies []string) {
+  // For which other blob is 'blobref' waiting?
+  for _, dep := range dependencies {
+    // Remember that someone is waiting on 'dep'
+    l, ok := self.waitingLists[dep]
+    if !ok {
+      l = lst.New()
+      self.waitingLists[dep] = l
+    }
+    l.PushBack(blobref)
+  }
+  self.pendingBlobs[blobref] = len(dependencies)
+}
+
+func (self *FileGraphStore) Dequeue(perma_blobref string, waitFor string) (blobrefs []string, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if _, ok := self.waitingLists[waitFor]; !ok {
+    return nil, nil
+  }
+  if self.queueSize, err = appendLog(self.queue, self.queueSize, map[string]interface{}{"b": waitFor}); err != nil {
+    return
+  }
+  blobrefs = self.dequeue(waitFor)
+  // Nothing is waiting anymore? Then the queue log can start from scratch
+  if len(self.pendingBlobs) == 0 {
+    if e := self.queue.Truncate(0); e != nil {
+      log.Printf("Err: Truncating queue: %v", e)
+    } else {
+      self.queueSize = 0
+    }
+  }
+  return
+}
+
+func (self *FileGraphStore) dequeue(waitFor string) (blobrefs []string) {
+  // Is any other blob waiting for 'waitFor'?
+  if l, ok := self.waitingLists[waitFor]; ok {
+    self.waitingLists[waitFor] = nil, false
+    for l.Len() > 0 {
+      waiting_id := l.Remove(l.Front()).(string)
+      self.pendingBlobs[waiting_id]--
+      // The waiting blob is not waiting for anything anymore -> return it
+      if self.pendingBlobs[waiting_id] == 0 {
+        self.pendingBlobs[waiting_id] = 0, false
+        blobrefs = append(blobrefs, waiting_id)
+      }
+    }
+  }
+  return
+}
+
+// ------------------------------------------------------
+// Records
+
+// The node data contains int64, string, []string, []int64 and []byte values.
+// JSON cannot tell these apart. Therefore, each value is stored as a pair of a type tag and the value.
+// Integers are stored as strings because JSON numbers cannot hold all int64 values.
+func encodeRecord(data map[string]interface{}) (blob []byte, err os.Error) {
+  m := make(map[string][]interface{})
+  for key, value := range data {
+    switch v := value.(type) {
+    case int64:
+      m[key] = []interface{}{"i", strconv.Itoa64(v)}
+    case string:
+      m[key] = []interface{}{"s", v}
+    case []string:
+      if v == nil {
+        v = []string{}
+      }
+      m[key] = []interface{}{"ss", v}
+    case []int64:
+      arr := make([]string, len(v))
+      for i, x := range v {
+        arr[i] = strconv.Itoa64(x)
+      }
+      m[key] = []interface{}{"is", arr}
+    case []byte:
+      m[key] = []interface{}{"b", hex.EncodeToString(v)}
+    case nil:
+      // Do nothing by intention
+    default:
+      return nil, os.NewError("Cannot encode value of key " + key)
+    }
+  }
+  return json.Marshal(m)
+}
+
+func decodeRecord(blob []byte) (data map[string]interface{}, err os.Error) {
+  m := make(map[string][]interface{})
+  if err = json.Unmarshal(blob, &m); err != nil {
+    return nil, err
+  }
+  data = make(map[string]interface{})
+  for key, pair := range m {
+    if len(pair) != 2 {
+      return nil, os.NewError("Malformed record")
+    }
+    tag, _ := pair[0].(string)
+    switch tag {
+    case "i":
+      str, _ := pair[1].(string)
+      if data[key], err = strconv.Atoi64(str); err != nil {
+        return nil, err
+      }
+    case "s":
+      str, ok := pair[1].(string)
+      if !ok {
+        return nil, os.NewError("Malformed record")
+      }
+      data[key] = str
+    case "ss", "is":
+      arr, ok := pair[1].([]interface{})
+      if !ok {
+        return nil, os.NewError("Malformed record")
+      }
+      strs := make([]string, len(arr))
+      for i, x := range arr {
+        if strs[i], ok = x.(string); !ok {
+          return nil, os.NewError("Malformed record")
+        }
+      }
+      if tag == "ss" {
+        data[key] = strs
+        continue
+      }
+      ints := make([]int64, len(strs))
+      for i, str := range strs {
+        if ints[i], err = strconv.Atoi64(str); err != nil {
+          return nil, err
+        }
+      }
+      data[key] = ints
+    case "b":
+      str, _ := pair[1].(string)
+      if data[key], err = hex.DecodeString(str); err != nil {
+        return nil, err
+      }
+    default:
+      return nil, os.NewError("Malformed record")
+    }
+  }
+  return
+}
+
+// Writes the record to a temporary file and renames it. Thus, the file contains either the old or the new record.
+func writeRecordFile(filename string, data map[string]interface{}) (err os.Error) {
+  blob, err := encodeRecord(data)
+  if err != nil {
+    return
+  }
+  tmp := filename + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+  if err != nil {
+    return
+  }
+  if _, err = f.Write(blob); err == nil {
+    err = f.Sync()
+  }
+  if e := f.Close(); err == nil {
+    err = e
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return
+  }
+  return os.Rename(tmp, filename)
+}
+
+// Returns nil if the file does not exist
+func readRecordFile(filename string) (data map[string]interface{}, err os.Error) {
+  if _, e := os.Stat(filename); e != nil {
+    return nil, nil
+  }
+  blob, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return nil, err
+  }
+  return decodeRecord(blob)
+}
+
+// Opens a log and calls f for each record. Returns the offsets of all records followed by the size of the log.
+// A partial record at the end of the log (caused by a crash) is removed.
+// A malformed record which is terminated by a newline is an error, because the log is corrupt.
+func openLog(filename string, f func(index int, data map[string]interface{})) (file *os.File, offsets []int64, err os.Error) {
+  file, err = os.OpenFile(filename, os.O_RDWR | os.O_CREATE, 0600)
+  if err != nil {
+    return
+  }
+  r := bufio.NewReader(file)
+  offset := int64(0)
+  for {
+    line, e := r.ReadBytes('\n')
+    if e != nil {
+      // A line without newline is a partial record
+      break
+    }
+    data, e := decodeRecord(line)
+    if e != nil {
+      // The records following a corrupt record are intact. Truncating the log would lose them.
+      file.Close()
+      return nil, nil, os.NewError(fmt.Sprintf("Malformed record in %v at offset %v", filename, offset))
+    }
+    offsets = append(offsets, offset)
+    f(len(offsets) - 1, data)
+    offset += int64(len(line))
+  }
+  offsets = append(offsets, offset)
+  if err = file.Truncate(offset); err != nil {
+    file.Close()
+    return nil, nil, err
+  }
+  return
+}
+
+// Writes a record at the end of the log, i.e. at 'offset', and waits until it is on disk.
+// Returns the offset following the record. If writing fails, the returned offset is unchanged,
+// such that the next record overwrites whatever has been written partially.
+func appendLog(file *os.File, offset int64, data map[string]interface{}) (end int64, err os.Error) {
+  end = offset
+  blob, err := encodeRecord(data)
+  if err != nil {
+    return
+  }
+  blob = append(blob, '\n')
+  if _, err = file.WriteAt(blob, offset); err != nil {
+    return
+  }
+  if err = file.Sync(); err != nil {
+    return
+  }
+  return offset + int64(len(blob)), nil
+}
+
+func readLog(file *os.File, start int64, end int64) (data map[string]interface{}, err os.Error) {
+  blob := make([]byte, end - start)
+  if _, err = file.ReadAt(blob, start); err != nil {
+    return nil, err
+  }
+  return decodeRecord(blob)
+}
+
+// Reads a record from the log of nodes without the perma node it carries
+func readNode(file *os.File, start int64, end int64) (data map[string]interface{}, err os.Error) {
+  if data, err = readLog(file, start, end); err != nil {
+    return nil, err
+  }
+  data[permaKey] = nil, false
+  return
+}
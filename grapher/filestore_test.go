@@ -0,0 +1,222 @@
+package lightwavegrapher
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  ot "lightwaveot"
+)
+
+func TestFileGraphStorePermanode(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavegrapher")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  sg, err := NewFileGraphStore(dir)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer sg.Close()
+  testPermanode3(t, sg)
+}
+
+func TestFileGraphStoreSnapshot(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavegrapher")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  sg, err := NewFileGraphStore(dir)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer sg.Close()
+  testSnapshot(t, sg)
+}
+
+func TestFileGraphStoreDeletePermaNode(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavegrapher")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  sg, err := NewFileGraphStore(dir)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer sg.Close()
+  testDeletePermaNode(t, sg)
+}
+
+func TestFileGraphStore(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavegrapher")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  sg, err := NewFileGraphStore(dir)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  perma := "abcd"
+  p := NewPermaNode(nil)
+  p.blobref = perma
+  p.signer = "a@b"
+  p.mimeType = "application/x-test-file"
+  p.permissions["foo@bar"] = Perm_Read
+  p.updates["foo@bar"] = 1
+  if err = sg.StorePermaNode(perma, p.ToMap()); err != nil {
+    t.Fatal(err.String())
+  }
+  nodes := []OTNode{
+    &keepNode{keepBlobRef: "k1", keepSigner: "a@b", dependencies: []string{}},
+    &mutationNode{mutationBlobRef: "m1", mutationSigner: "a@b", operation: []byte(`{"$t":["Hello"]}`), entityBlobRef: "e1", field: "text", dependencies: []string{"k1"}, time: 1 << 60},
+    &permissionNode{Permission: ot.Permission{ID: "p1", User: "foo@bar", Allow: Perm_Read}, permissionSigner: "a@b", dependencies: []string{"m1"}},
+    &mutationNode{mutationBlobRef: "m2", mutationSigner: "a@b", operation: []byte(`{"$t":[{"$s":5}, "!"]}`), entityBlobRef: "e1", field: "other", dependencies: []string{"m1"}},
+  }
+  var old map[string]interface{}
+  for i, n := range nodes {
+    n.SetSequenceNumber(int64(i))
+    p.seqNumber = int64(i + 1)
+    if i == 2 {
+      old = p.ToMap()
+    }
+    if err = sg.StoreNode(perma, n.BlobRef(), n.ToMap(), p.ToMap()); err != nil {
+      t.Fatal(err.String())
+    }
+  }
+  // Simulate a crash after appending the last node but before replacing the perma node
+  if err = writeRecordFile(filepath.Join(dir, perma, "perma"), old); err != nil {
+    t.Fatal(err.String())
+  }
+  if err = sg.Enqueue(perma, "m4", []string{"m3", "x"}); err != nil {
+    t.Fatal(err.String())
+  }
+  // Simulate a crash while appending a node
+  f, err := os.OpenFile(filepath.Join(dir, perma, "nodes"), os.O_WRONLY | os.O_APPEND, 0600)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  f.Write([]byte(`{"b":["s","m3"],"k":`))
+  f.Close()
+
+  // Reopen the store
+  if err = sg.Close(); err != nil {
+    t.Fatal(err.String())
+  }
+  sg, err = NewFileGraphStore(dir)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  data, err := sg.GetPermaNode(perma)
+  if err != nil || data == nil {
+    t.Fatal("Missing perma node")
+  }
+  p2 := NewPermaNode(nil)
+  p2.FromMap(perma, data)
+  if p2.MimeType() != p.MimeType() || !p2.hasPermission("foo@bar", Perm_Read) || p2.Updates()["foo@bar"] != 1 || p2.SequenceNumber() != 4 {
+    t.Fatal("Perma node has not been restored")
+  }
+  if missing, _ := sg.HasOTNodes(perma, []string{"k1", "m2", "m3"}); len(missing) != 1 || missing[0] != "m3" {
+    t.Fatalf("Wrong missing nodes: %v", missing)
+  }
+  data, err = sg.GetOTNodeByBlobRef(perma, "m1")
+  if err != nil || data == nil {
+    t.Fatal("Missing mutation node")
+  }
+  if _, ok := data[permaKey]; ok {
+    t.Fatal("The node must not carry the perma node")
+  }
+  m := &mutationNode{}
+  m.FromMap(perma, data)
+  if m.Time() != 1 << 60 || string(m.Operation().([]byte)) != `{"$t":["Hello"]}` || m.Dependencies()[0] != "k1" {
+    t.Fatal("Mutation node has not been restored")
+  }
+  ch, err := sg.GetOTNodesAscending(perma, 1, -1)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  count := 0
+  for data := range ch {
+    if data["seq"].(int64) != int64(count + 1) {
+      t.Fatal("Wrong order")
+    }
+    count++
+  }
+  if count != 3 {
+    t.Fatalf("Wrong number of nodes: %v", count)
+  }
+  ch, err = sg.GetMutationsAscending(perma, "e1", "text", 0, 4)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  count = 0
+  for _ = range ch {
+    count++
+  }
+  if count != 1 {
+    t.Fatalf("Wrong number of mutations: %v", count)
+  }
+  // Appending after the crash overwrites the partial node
+  m3 := &mutationNode{mutationBlobRef: "m3", mutationSigner: "a@b", operation: []byte(`{"$t":["x"]}`), entityBlobRef: "e1", field: "text", dependencies: []string{"m2"}, seqNumber: 4}
+  if err = sg.StoreNode(perma, "m3", m3.ToMap(), p.ToMap()); err != nil {
+    t.Fatal(err.String())
+  }
+  if data, err = sg.GetOTNodeBySeqNumber(perma, 4); err != nil || data["b"].(string) != "m3" {
+    t.Fatal("Wrong node")
+  }
+  // The queue has been restored
+  blobrefs, err := sg.Dequeue(perma, "m3")
+  if err != nil || len(blobrefs) != 0 {
+    t.Fatal("m4 is still waiting for x")
+  }
+  blobrefs, err = sg.Dequeue(perma, "x")
+  if err != nil || len(blobrefs) != 1 || blobrefs[0] != "m4" {
+    t.Fatalf("Wrong dequeued blobs: %v", blobrefs)
+  }
+  if err = sg.Close(); err != nil {
+    t.Fatal(err.String())
+  }
+}
+
+func TestFileGraphStoreCorruptLog(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavegrapher")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  defer os.RemoveAll(dir)
+  sg, err := NewFileGraphStore(dir)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  for _, blobref := range []string{"m1", "m2", "m3"} {
+    if err = sg.Enqueue("p1", blobref, []string{"x"}); err != nil {
+      t.Fatal(err.String())
+    }
+  }
+  if err = sg.Close(); err != nil {
+    t.Fatal(err.String())
+  }
+  // Corrupt the record in the middle of the queue
+  path := filepath.Join(dir, "queue")
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  lines := bytes.SplitAfter(data, []byte("\n"))
+  lines[1] = []byte("garbage\n")
+  corrupt := bytes.Join(lines, nil)
+  if err = ioutil.WriteFile(path, corrupt, 0600); err != nil {
+    t.Fatal(err.String())
+  }
+  if _, err = NewFileGraphStore(dir); err == nil {
+    t.Fatal("Corrupt log has been opened")
+  }
+  // The records following the corrupt record are kept
+  if data, err = ioutil.ReadFile(path); err != nil || !bytes.Equal(data, corrupt) {
+    t.Fatal("Corrupt log has been truncated")
+  }
+}
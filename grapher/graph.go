@@ -752,6 +752,8 @@ func (self *permaNode) applyMutation(newnode *mutationNode, transformer Transfor
   h := ot.NewHistoryGraph(self.frontier, newnode.Dependencies())
   prune := map[string]bool{}
   rollback := int64(0)
+  // The nodes which have been rolled back in descending order
+  var nodes []OTNode
   // Need to rollback?
   if !h.Test() {
     // Go back in history until our history is equal to (or earlier than) that of 'mut'.
@@ -765,6 +767,7 @@ func (self *permaNode) applyMutation(newnode *mutationNode, transformer Transfor
       if !h.SubstituteBlob(history_node.BlobRef(), history_node.Dependencies()) {
 	prune[history_node.BlobRef()] = true
       }
+      nodes = append(nodes, history_node)
       rollback++
       if h.Test() {
 	break
@@ -772,6 +775,14 @@ func (self *permaNode) applyMutation(newnode *mutationNode, transformer Transfor
     }
   }
 
+  if bt, ok := transformer.(BranchTransformer); ok {
+    heads, e := self.branchHeads(newnode, nodes, prune)
+    if e != nil {
+      return e
+    }
+    return bt.TransformMutationBranches(newnode, heads)
+  }
+
   concurrent := []string{}
   for c, _ := range prune {
     concurrent = append(concurrent, c)
@@ -787,6 +798,50 @@ func (self *permaNode) applyMutation(newnode *mutationNode, transformer Transfor
   return
 }
 
+// Returns the heads of the concurrent branches which mutate the same field as 'mutation'. See BranchTransformer.
+// 'nodes' are OT nodes in descending order and 'concurrent' contains those which are concurrent to 'mutation'.
+func (self *permaNode) branchHeads(mutation MutationNode, nodes []OTNode, concurrent map[string]bool) (heads []MutationNode, err os.Error) {
+  // The nodes on which a concurrent mutation of the field depends
+  covered := make(map[string]bool)
+  for _, n := range nodes {
+    if !concurrent[n.BlobRef()] {
+      continue
+    }
+    m, ok := n.(*mutationNode)
+    sameField := ok && m.EntityBlobRef() == mutation.EntityBlobRef() && m.Field() == mutation.Field()
+    if sameField && !covered[m.BlobRef()] {
+      original, e := self.grapher.originalMutation(m)
+      if e != nil {
+        return nil, e
+      }
+      heads = append(heads, original)
+    }
+    // Concurrent nodes are rolled back before the nodes they depend on
+    if sameField || covered[n.BlobRef()] {
+      for _, dep := range n.Dependencies() {
+        covered[dep] = true
+      }
+    }
+  }
+  return
+}
+
+// Like branchHeads for a mutation of the local user which has been created after the node
+// with sequence number 'applyAtSeqNumber' has been applied.
+func (self *permaNode) clientBranchHeads(mutation MutationNode, applyAtSeqNumber int64) (heads []MutationNode, err os.Error) {
+  ch, err := self.grapher.getOTNodesAscending(self.BlobRef(), applyAtSeqNumber, self.SequenceNumber())
+  if err != nil {
+    return nil, err
+  }
+  var nodes []OTNode
+  concurrent := make(map[string]bool)
+  for n := range ch {
+    nodes = append([]OTNode{n}, nodes...)
+    concurrent[n.BlobRef()] = true
+  }
+  return self.branchHeads(mutation, nodes, concurrent)
+}
+
 func (self *permaNode) transformLocalPermission(perm *permissionNode, applyAtSeqNumber int64) (tperm *permissionNode, appliedAtSeqNumber int64, err os.Error) {
   var reverse_permissions []*permissionNode
   i := self.SequenceNumber()
@@ -864,3 +919,68 @@ func prunePermissionSeq(nodes []*permissionNode, prune map[string]bool) (result
   }
   return
 }
+
+// -----------------------------------------------------------------
+// snapshotNode
+
+// A snapshot holds the materialized state of a perma node as computed by the application.
+// It covers all OT nodes with a sequence number smaller than SequenceNumber().
+// The grapher does not interpret the content.
+type SnapshotNode interface {
+  PermaBlobRef() string
+  // The sequence number of the first OT node not covered by the snapshot
+  SequenceNumber() int64
+  // The frontier after applying all OT nodes covered by the snapshot
+  Frontier() []string
+  Content() []byte
+}
+
+type snapshotNode struct {
+  permaBlobRef string
+  seqNumber int64
+  frontier []string
+  content []byte
+}
+
+func (self *snapshotNode) PermaBlobRef() string {
+  return self.permaBlobRef
+}
+
+func (self *snapshotNode) SequenceNumber() int64 {
+  return self.seqNumber
+}
+
+func (self *snapshotNode) Frontier() []string {
+  return self.frontier
+}
+
+func (self *snapshotNode) Content() []byte {
+  return self.content
+}
+
+func (self *snapshotNode) ToMap() map[string]interface{} {
+  m := make(map[string]interface{})
+  m["seq"] = self.seqNumber
+  m["f"] = self.frontier
+  m["c"] = self.content
+  return m
+}
+
+// Unlike the OT nodes, a snapshot is not validated before it is stored.
+// Therefore, FromMap reports malformed data instead of panicking.
+func (self *snapshotNode) FromMap(permaBlobRef string, m map[string]interface{}) (err os.Error) {
+  self.permaBlobRef = permaBlobRef
+  var ok bool
+  if self.seqNumber, ok = m["seq"].(int64); !ok {
+    return os.NewError("Malformed snapshot: Missing sequence number")
+  }
+  if f, ok := m["f"]; ok {
+    if self.frontier, ok = f.([]string); !ok {
+      return os.NewError("Malformed snapshot: Malformed frontier")
+    }
+  }
+  if self.content, ok = m["c"].([]byte); !ok {
+    return os.NewError("Malformed snapshot: Missing content")
+  }
+  return nil
+}
@@ -11,6 +11,7 @@ import (
   "strings"
   "strconv"
   "crypto/sha256"
+  "crypto/rsa"
   "encoding/hex"
 )
 
@@ -54,7 +55,7 @@ type superSchema struct {
   
   Permission string `json:"permission"`
   Action string `json:"action"`
-//  Sig    string "sig"
+  Sig    string `json:"sig"`
 
   Dependencies []string `json:"dep"`
   
@@ -94,6 +95,9 @@ type Federation interface {
   SetGrapher(indexer *Grapher)
   Forward(blobref string, users []string)
   DownloadPermaNode(permission_blobref string) os.Error
+  // Fetches the blobs from the server of the user and puts them in the blob store.
+  // This function must not block.
+  Fetch(userID string, blobrefs []string)
 }
 
 // The transformer as seen by the Grapher
@@ -104,6 +108,16 @@ type Transformer interface {
   DataType() int
 }
 
+// Transformers which resolve concurrent mutations by comparing their values, for example
+// TransformationMax, implement this interface in addition to Transformer. The Grapher calls it
+// instead of TransformMutation and TransformClientMutation.
+// 'heads' are the heads of the concurrent branches, i.e. those concurrent mutations of the same field
+// on which no other concurrent mutation of the field depends, directly or via other nodes.
+// The heads carry their original operation, i.e. the one contained in their blob.
+type BranchTransformer interface {
+  TransformMutationBranches(mutation MutationNode, heads []MutationNode) os.Error
+}
+
 // The API layer as seen by the Grapher
 type API interface {
   // This function is called when an invitation has been received.
@@ -120,6 +134,9 @@ type API interface {
   Blob_Permission(perma PermaNode, permission PermissionNode)
   Blob_Entity(perma PermaNode, entity EntityNode)
   Blob_DeleteEntity(perma PermaNode, entity DelEntityNode)
+  // This function is called by Repeat when the application can start from a snapshot
+  // instead of processing all OT nodes covered by the snapshot.
+  Blob_Snapshot(perma PermaNode, snapshot SnapshotNode)
 }
 
 // The blob store as seen by the Grapher
@@ -140,6 +157,12 @@ type GraphStore interface {
   GetMutationsAscending(perma_blobref string, entity_blobref string, field string, startWithSeqNumber int64, endSeqNumber int64) (ch <-chan map[string]interface{}, err os.Error)
   Enqueue(perma_blobref string, blobref string, dependencies []string) os.Error
   Dequeue(perma_blobref string, blobref string) (blobrefs []string, err os.Error)
+  // Stores a snapshot. A store needs to remember the latest snapshot only.
+  StoreSnapshot(perma_blobref string, data map[string]interface{}) os.Error
+  // Returns the latest snapshot or nil if there is none.
+  GetSnapshot(perma_blobref string) (data map[string]interface{}, err os.Error)
+  // Removes the perma node, its OT nodes and its snapshot. Unknown perma nodes are ignored.
+  DeletePermaNode(perma_blobref string) os.Error
 }
 
 // ------------------------------------------------------
@@ -154,13 +177,19 @@ type Grapher struct {
   transformers map[string]Transformer
   api API
   schema *Schema
+  // The public keys of all users. If nil, all schema blobs are rejected.
+  keys KeyRegistry
+  // Used to sign the blobs of the local user. If nil, blobs are not signed.
+  signingKey *rsa.PrivateKey
 }
 
 // Creates a new indexer for the specified user based on the blob store.
 // The indexer calls the federation object to send messages to other users.
 // Federation may be nil as well.
-func NewGrapher(userid string, schema *Schema, store BlobStore, gstore GraphStore, fed Federation) *Grapher {
-  idx := &Grapher{userID: userid, store: store, gstore: gstore, fed: fed, schema: schema, transformers: make(map[string]Transformer)}
+// The indexer rejects all schema blobs which are not signed by their signer according to 'keys'.
+// If 'keys' is nil, all schema blobs are rejected. Pass NoVerification to accept unsigned blobs.
+func NewGrapher(userid string, schema *Schema, store BlobStore, gstore GraphStore, fed Federation, keys KeyRegistry) *Grapher {
+  idx := &Grapher{userID: userid, store: store, gstore: gstore, fed: fed, schema: schema, keys: keys, transformers: make(map[string]Transformer)}
   if fed != nil {
     fed.SetGrapher(idx)
   }
@@ -176,6 +205,18 @@ func (self *Grapher) SetAPI(api API) {
   self.api = api
 }
 
+// Blobs created by the Create* functions are signed with this key.
+func (self *Grapher) SetSigningKey(key *rsa.PrivateKey) {
+  self.signingKey = key
+}
+
+func (self *Grapher) signBlob(blob []byte) (signed []byte, err os.Error) {
+  if self.signingKey == nil {
+    return blob, nil
+  }
+  return SignBlob(blob, self.signingKey)
+}
+
 func (self *Grapher) Frontier(blobref string) (frontier []string, err os.Error) {
   p, err := self.permaNode(blobref)
   if err != nil {
@@ -184,6 +225,12 @@ func (self *Grapher) Frontier(blobref string) (frontier []string, err os.Error)
   return p.frontier.IDs(), nil
 }
 
+// Returns those blobrefs which have not yet been added to the graph of the perma node.
+// Blobs which are waiting for their dependencies are not part of the graph.
+func (self *Grapher) MissingBlobs(perma_blobref string, blobrefs []string) (missing []string, err os.Error) {
+  return self.gstore.HasOTNodes(perma_blobref, blobrefs)
+}
+
 func (self *Grapher) Followers(blobref string) (users []string, err os.Error) {
   p, err := self.permaNode(blobref)
   if err != nil {
@@ -192,6 +239,18 @@ func (self *Grapher) Followers(blobref string) (users []string, err os.Error) {
   return p.Followers(), nil
 }
 
+// Returns all followers and all users who have been invited but do not follow yet
+func (self *Grapher) Users(blobref string) (users []string, err os.Error) {
+  p, err := self.permaNode(blobref)
+  if err != nil {
+    return nil, err
+  }
+  if p == nil {
+    return nil, os.NewError("Unknown perma node")
+  }
+  return p.Users(), nil
+}
+
 func (self *Grapher) permaNode(blobref string) (perma *permaNode, err os.Error) {
   m, err := self.gstore.GetPermaNode(blobref)
   if err != nil || m == nil {
@@ -206,25 +265,14 @@ func (self *Grapher) permaNode(blobref string) (perma *permaNode, err os.Error)
 }
 
 func (self *Grapher) transformer(perma PermaNode, entity EntityNode, field string) (t Transformer, err os.Error) {
-  fileSchema, ok := self.schema.FileSchemas[perma.MimeType()]
-  if !ok {
-    err = os.NewError("Unknown document mime type")
-    return
-  }
-  entitySchema, ok := fileSchema.EntitySchemas[entity.MimeType()]
-  if !ok {
-    err = os.NewError("Unknown entity mime type")
-    return
-  }
-  fieldSchema, ok := entitySchema.FieldSchemas[field]
-  if !ok {
-    err = os.NewError("Unknown field")
-    return
+  fieldSchema, err := self.schema.FieldSchema(perma.MimeType(), entity.MimeType(), field)
+  if err != nil {
+    return nil, err
   }
   if fieldSchema.Transformation == TransformationNone {
     return nil, nil
   }
-  t, ok = self.transformers[strconv.Itoa(fieldSchema.Transformation) + "/" + strconv.Itoa(fieldSchema.Type)]
+  t, ok := self.transformers[strconv.Itoa(fieldSchema.Transformation) + "/" + strconv.Itoa(fieldSchema.Type)]
   if !ok {
     err = os.NewError("Unknown transformer " + strconv.Itoa(fieldSchema.Transformation) + "/" + strconv.Itoa(fieldSchema.Type))
     return
@@ -232,6 +280,36 @@ func (self *Grapher) transformer(perma PermaNode, entity EntityNode, field strin
   return
 }
 
+// Checks the content of entities and the operations of mutations against the schema.
+func (self *Grapher) validate(perma PermaNode, node OTNode) (err os.Error) {
+  switch n := node.(type) {
+  case *entityNode:
+    entitySchema, err := self.schema.EntitySchema(perma.MimeType(), n.MimeType())
+    if err != nil {
+      return err
+    }
+    return entitySchema.ValidateContent(n.Content())
+  case *mutationNode:
+    entity, err := self.entity(perma.BlobRef(), n.EntityBlobRef())
+    if err != nil {
+      return err
+    }
+    if entity == nil {
+      return os.NewError("Unknown entity " + n.EntityBlobRef())
+    }
+    fieldSchema, err := self.schema.FieldSchema(perma.MimeType(), entity.MimeType(), n.Field())
+    if err != nil {
+      return err
+    }
+    op, ok := n.Operation().([]byte)
+    if !ok {
+      return nil
+    }
+    return fieldSchema.ValidateOperation(op)
+  }
+  return nil
+}
+
 func (self *Grapher) entity(perma_blobref string, blobref string) (entity *entityNode, err os.Error) {
   m, err := self.gstore.GetOTNodeByBlobRef(perma_blobref, blobref)
   if err != nil || m == nil {
@@ -258,8 +336,16 @@ func (self *Grapher) permission(perma_blobref string, blobref string) (permissio
   return p, nil  
 }
 
-func (self *Grapher) enqueue(perma_blobref, blobref string, deps []string) os.Error {
-  return self.gstore.Enqueue(perma_blobref, blobref, deps)
+// The blob waits until all its dependencies have been processed.
+// The missing dependencies are fetched from the server of the signer.
+func (self *Grapher) enqueue(perma_blobref, blobref string, deps []string, signer string) os.Error {
+  if err := self.gstore.Enqueue(perma_blobref, blobref, deps); err != nil {
+    return err
+  }
+  if self.fed != nil && signer != self.userID {
+    self.fed.Fetch(signer, deps)
+  }
+  return nil
 }
 
 func (self *Grapher) dequeue(perma_blobref, waitFor string) (blobrefs []string, err os.Error) {
@@ -361,6 +447,16 @@ func (self *Grapher) HandleBlob(blob []byte, blobref string) (err os.Error) {
       log.Printf("Err: Malformed schema blob: %v\n", err)
       return err
     }
+    // Do not accept forged blobs
+    if self.keys == nil {
+      err = os.NewError("No key registry to check the signature")
+    } else if self.keys != NoVerification {
+      err = VerifyBlob(blob, schema.Signer, self.keys)
+    }
+    if err != nil {
+      log.Printf("Err: Rejected blob %v: %v\n", blobref, err)
+      return err
+    }
     var node AbstractNode
     if perma, node, err = self.handleSchemaBlob(&schema, blobref); node == nil || err != nil {
       return err
@@ -386,6 +482,17 @@ func (self *Grapher) HandleBlob(blob []byte, blobref string) (err os.Error) {
   return nil;
 }
 
+// Invoked from the blob store when a blob has been deleted.
+// Deleting a perma blob removes the perma node with all its OT nodes from the graph store.
+// Other blobs are only deleted together with their perma node, hence they are ignored.
+func (self *Grapher) HandleDeletedBlob(blobref string) (err os.Error) {
+  data, err := self.gstore.GetPermaNode(blobref)
+  if err != nil || data == nil {
+    return err
+  }
+  return self.gstore.DeletePermaNode(blobref)
+}
+
 func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perma *permaNode, node AbstractNode, err os.Error) {
   newnode, err := self.decodeNode(schema, blobref)
   if err != nil {
@@ -401,7 +508,7 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
       return nil, nil, err
     }
     if perma == nil {
-      self.enqueue(node.PermaBlobRef(), blobref, []string{node.PermaBlobRef()})
+      self.enqueue(node.PermaBlobRef(), blobref, []string{node.PermaBlobRef()}, node.Signer())
       return nil, nil, nil
     }
   }
@@ -415,6 +522,27 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
       log.Printf("Err: OT node without a permanode: %v", node.PermaBlobRef())
       return nil, nil, os.NewError("OT node without a permanode");
     }
+    var transformer Transformer
+    if mut, ok := newnode.(*mutationNode); ok {
+      entity, err := self.entity(perma.BlobRef(), mut.EntityBlobRef())
+      if err != nil {
+	return nil, nil, err
+      }
+      // A mutation must wait until its entity is known
+      if entity == nil {
+	self.enqueue(perma.BlobRef(), blobref, []string{mut.EntityBlobRef()}, mut.Signer())
+	return nil, nil, nil
+      }
+      transformer, err = self.transformer(perma, entity, mut.Field())
+      if err != nil {
+	return nil, nil, err
+      }
+    }
+    // Reject entities and mutations which do not match the schema
+    if err = self.validate(perma, newnode.(OTNode)); err != nil {
+      log.Printf("Err: Schema violation in blob %v: %v\n", blobref, err)
+      return nil, nil, err
+    }
     // Is this an invitation?
     if inv, ok := newnode.(*permissionNode); ok && inv.action == PermAction_Invite {
       self.handleInvitation(perma, inv)
@@ -427,17 +555,6 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
 	return
       }
     }
-    var transformer Transformer
-    if mut, ok := newnode.(*mutationNode); ok {
-      entity, err := self.entity(perma.BlobRef(), mut.EntityBlobRef())
-      if err != nil {
-	return nil, nil, err
-      }
-      transformer, err = self.transformer(perma, entity, mut.Field())
-      if err != nil {
-	return nil, nil, err
-      }
-    }
     deps, err := perma.apply(newnode.(OTNode), transformer)
     if err != nil {
       log.Printf("Err: applying blob failed: %v\nblobref=%v\n", err, blobref)
@@ -445,7 +562,7 @@ func (self *Grapher) handleSchemaBlob(schema *superSchema, blobref string) (perm
     }
     // The blob could not be applied because of unresolved dependencies?
     if len(deps) > 0 {
-      self.enqueue(perma.BlobRef(), blobref, deps)
+      self.enqueue(perma.BlobRef(), blobref, deps, node.Signer())
       return nil, nil, nil
     }
     
@@ -561,7 +678,7 @@ func (self *Grapher) checkKeep(perma *permaNode, keep *keepNode) bool {
   // Permission has not yet been received or processed? -> enqueue
   if perm == nil {
     log.Printf("Permission %v is not yet applied for the keep", keep.permissionBlobRef)
-    self.enqueue(perma.BlobRef(), keep.BlobRef(), []string{keep.permissionBlobRef})
+    self.enqueue(perma.BlobRef(), keep.BlobRef(), []string{keep.permissionBlobRef}, keep.Signer())
     // The user accepted the invitation?
     if keep.Signer() == self.userID {
       // Both users are on the different domains? -> Download the nodes
@@ -744,6 +861,26 @@ func (self *Grapher) otNodeFromMap(perma_blobref string, data map[string]interfa
   return nil
 }
 
+// Returns a copy of the mutation with the operation contained in its blob, i.e. before it has been transformed.
+// Mutations created by the local user may not be in the blob store. Their blob contains the
+// transformed operation anyway. Hence, the mutation is returned as is.
+func (self *Grapher) originalMutation(mutation *mutationNode) (original *mutationNode, err os.Error) {
+  blob, e := self.store.GetBlob(mutation.BlobRef())
+  if e != nil || blob == nil {
+    return mutation, nil
+  }
+  var schema superSchema
+  if err = json.Unmarshal(blob, &schema); err != nil {
+    return nil, err
+  }
+  if schema.Operation == nil {
+    return nil, os.NewError("Mutation is lacking an operation")
+  }
+  m := *mutation
+  m.operation = []byte(*schema.Operation)
+  return &m, nil
+}
+
 func (self *Grapher) mutationNodeFromMap(perma_blobref string, data map[string]interface{}) MutationNode {
   switch data["k"].(int64) {
   case OTNode_Mutation:
@@ -756,12 +893,77 @@ func (self *Grapher) mutationNodeFromMap(perma_blobref string, data map[string]i
   return nil
 }
 
+// Returns the latest snapshot of the perma node or nil if there is none.
+func (self *Grapher) Snapshot(perma_blobref string) (snapshot SnapshotNode, err os.Error) {
+  data, err := self.gstore.GetSnapshot(perma_blobref)
+  if err != nil || data == nil {
+    return nil, err
+  }
+  s := &snapshotNode{}
+  if err = s.FromMap(perma_blobref, data); err != nil {
+    return nil, err
+  }
+  return s, nil
+}
+
+// Stores the materialized state of a perma node as computed by the application.
+// The content must reflect all OT nodes with a sequence number smaller than seqNumber.
+// Later calls to Repeat can then start with the snapshot instead of repeating all OT nodes.
+func (self *Grapher) StoreSnapshot(perma_blobref string, seqNumber int64, content []byte) (err os.Error) {
+  perma, err := self.permaNode(perma_blobref)
+  if err != nil {
+    return err
+  }
+  if perma == nil || seqNumber < 0 || seqNumber > perma.SequenceNumber() {
+    return os.NewError("Snapshot does not match the perma node")
+  }
+  // Compute the frontier starting with the previous snapshot
+  frontier := make(ot.Frontier)
+  start := int64(0)
+  prev, err := self.Snapshot(perma_blobref)
+  if err != nil {
+    return err
+  }
+  if prev != nil && prev.SequenceNumber() > seqNumber {
+    return os.NewError("A newer snapshot has already been stored")
+  }
+  if prev != nil {
+    frontier.FromIDs(prev.Frontier())
+    start = prev.SequenceNumber()
+  }
+  if start < seqNumber {
+    ch, e := self.getOTNodesAscending(perma_blobref, start, seqNumber)
+    if e != nil {
+      return e
+    }
+    for n := range ch {
+      frontier.AddBlob(n.BlobRef(), n.Dependencies())
+    }
+  }
+  ids := frontier.IDs()
+  if ids == nil {
+    ids = []string{}
+  }
+  s := &snapshotNode{permaBlobRef: perma_blobref, seqNumber: seqNumber, frontier: ids, content: content}
+  return self.gstore.StoreSnapshot(perma_blobref, s.ToMap())
+}
+
 // Interface towards the API
+// If a snapshot covers OT nodes starting at startWithSeqNumber, the snapshot is passed to the API
+// and only the OT nodes following the snapshot are repeated.
 func (self *Grapher) Repeat(perma_blobref string, startWithSeqNumber int64) (perma PermaNode, err os.Error) {
   perma, err = self.permaNode(perma_blobref)
   if err != nil {
     return nil, err
   }  
+  snapshot, err := self.Snapshot(perma_blobref)
+  if err != nil {
+    return nil, err
+  }
+  if snapshot != nil && snapshot.SequenceNumber() > startWithSeqNumber {
+    self.api.Blob_Snapshot(perma, snapshot)
+    startWithSeqNumber = snapshot.SequenceNumber()
+  }
   ch, err := self.getOTNodesAscending(perma_blobref, startWithSeqNumber, -1)
   if err != nil {
     return nil, err
@@ -808,6 +1010,9 @@ func (self *Grapher) CreatePermaBlob(mimeType string) (node AbstractNode, err os
   }
   permaBlob = append([]byte(`{"type":"permanode",`), permaBlob[1:]...)
   log.Printf("Storing perma %v\n", string(permaBlob))
+  if permaBlob, err = self.signBlob(permaBlob); err != nil {
+    return
+  }
   permaBlobRef := newBlobRef(permaBlob)
   // Process it
   var schema superSchema
@@ -833,6 +1038,9 @@ func (self *Grapher) CreateKeepBlob(perma_blobref, permission_blobref string) (n
   }
   keepBlob = append([]byte(`{"type":"keep",`), keepBlob[1:]...)
   log.Printf("Storing keep %v\n", string(keepBlob))
+  if keepBlob, err = self.signBlob(keepBlob); err != nil {
+    return
+  }
   keepBlobRef := newBlobRef(keepBlob)
   // Process it
   var schema superSchema
@@ -862,6 +1070,9 @@ func (self *Grapher) CreateEntityBlob(perma_blobref string, mimeType string, con
   }
   entityBlob = append([]byte(`{"type":"entity",`), entityBlob[1:]...)
   log.Printf("Storing entity %v\n", string(entityBlob))
+  if entityBlob, err = self.signBlob(entityBlob); err != nil {
+    return
+  }
   entityBlobRef := newBlobRef(entityBlob)
   // Process it
   var schema superSchema
@@ -894,6 +1105,9 @@ func (self *Grapher) CreateDeleteEntityBlob(perma_blobref string, entity_blobref
   }
   entityBlob = append([]byte(`{"type":"delentity",`), entityBlob[1:]...)
   log.Printf("Storing entity %v\n", string(entityBlob))
+  if entityBlob, err = self.signBlob(entityBlob); err != nil {
+    return
+  }
   entityBlobRef := newBlobRef(entityBlob)
   // Process it
   var schema superSchema
@@ -944,6 +1158,9 @@ func (self *Grapher) CreatePermissionBlob(perma_blobref string, applyAtSeqNumber
   }
   permBlob = append([]byte(`{"type":"permission",`), permBlob[1:]...)
   log.Printf("Storing perm %v\n", string(permBlob))
+  if permBlob, err = self.signBlob(permBlob); err != nil {
+    return
+  }
   permBlobRef := newBlobRef(permBlob)
   // Process it
   var schema superSchema
@@ -970,6 +1187,10 @@ func (self *Grapher) CreateMutationBlob(perma_blobref string, entity_blobref str
     err = e
     return
   }
+  if entity == nil {
+    err = os.NewError("Unknown entity " + entity_blobref)
+    return
+  }
   transformer, e := self.transformer(perma, entity, field)
   if e != nil {
     err = e
@@ -984,7 +1205,20 @@ func (self *Grapher) CreateMutationBlob(perma_blobref string, entity_blobref str
   m.field = field
   m.operation = operation
   m.time = time.Seconds()
-  if transformer != nil {
+  if err = self.validate(perma, m); err != nil {
+    return
+  }
+  if bt, ok := transformer.(BranchTransformer); ok {
+    // All mutations applied after 'applyAtSeqNumber' are concurrent to the client mutation
+    heads, e := perma.clientBranchHeads(m, applyAtSeqNumber)
+    if e != nil {
+      err = e
+      return
+    }
+    if err = bt.TransformMutationBranches(m, heads); err != nil {
+      return
+    }
+  } else if transformer != nil {
     ch, e := self.getMutationsAscending(perma.BlobRef(), entity_blobref, field, applyAtSeqNumber, perma.SequenceNumber())
     if e != nil {
       err = e
@@ -1020,6 +1254,9 @@ func (self *Grapher) CreateMutationBlob(perma_blobref string, entity_blobref str
   mutBlob := []byte(`{"type":"mutation",`)
   mutBlob = append(mutBlob, schema[1:]...)
   log.Printf("Storing mut %v\n", string(mutBlob))
+  if mutBlob, err = self.signBlob(mutBlob); err != nil {
+    return
+  }
   mutBlobRef := newBlobRef(mutBlob)
   // Process it
   var schema2 superSchema
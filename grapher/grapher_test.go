@@ -56,10 +56,14 @@ func (self *dummyFederation) DownloadPermaNode(permission_blobref string) os.Err
   return nil
 }
 
+func (self *dummyFederation) Fetch(userID string, blobrefs []string) {
+  log.Printf("Fetching %v from %v\n", blobrefs, userID)
+}
+
 func TestPermanode(t *testing.T) {
   s := store.NewSimpleBlobStore()
   sg := NewSimpleGraphStore()
-  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{}, NoVerification)
   s.AddListener(grapher)
   
   blob1 := []byte(`{"type":"permanode", "signer":"a@b", "random":"perma1abc", "mimetype":"application/x-test-file"}`)
@@ -85,7 +89,7 @@ func TestPermanode(t *testing.T) {
 func TestPermanode2(t *testing.T) {
   s := store.NewSimpleBlobStore()
   sg := NewSimpleGraphStore()
-  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{})
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{}, NoVerification)
   s.AddListener(grapher)
 
   blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
@@ -110,10 +114,14 @@ func TestPermanode2(t *testing.T) {
 }
 
 func TestPermanode3(t *testing.T) {
+  testPermanode3(t, NewSimpleGraphStore())
+}
+
+// Shared by the tests of all GraphStore implementations
+func testPermanode3(t *testing.T, sg GraphStore) {
   fed := &dummyFederation{}
   s := store.NewSimpleBlobStore()
-  sg := NewSimpleGraphStore()
-  grapher := NewGrapher("a@b", schema, s, sg, fed)
+  grapher := NewGrapher("a@b", schema, s, sg, fed, NoVerification)
   s.AddListener(grapher)
   newDummyTransformer(grapher)
   
@@ -121,7 +129,7 @@ func TestPermanode3(t *testing.T) {
   blobref1 := store.NewBlobRef(blob1)
   blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
   blobref1b := store.NewBlobRef(blob1b)
-  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":"", "dep":["` + blobref1b + `"]}`)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":{"text":"Hello"}, "dep":["` + blobref1b + `"]}`)
   blobref1c := store.NewBlobRef(blob1c)
   blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello World"]}, "entity":"` + blobref1c + `", "field":"text"}`)
   blobref2 := store.NewBlobRef(blob2)
@@ -202,3 +210,256 @@ func TestPermanode3(t *testing.T) {
     t.Fatal("Wrong users")
   }
 }
+
+// Records the heads of the concurrent branches which the Grapher passes for each mutation
+type branchTransformer struct {
+  heads map[string][]MutationNode
+}
+
+func (self *branchTransformer) Kind() int {
+  return TransformationMax
+}
+
+func (self *branchTransformer) DataType() int {
+  return TypeInt64
+}
+
+func (self *branchTransformer) TransformClientMutation(mutation MutationNode, rollback <-chan MutationNode) (err os.Error) {
+  return os.NewError("TransformMutationBranches must be used")
+}
+
+func (self *branchTransformer) TransformMutation(mutation MutationNode, rollback <-chan MutationNode, concurrent []string) (err os.Error) {
+  return os.NewError("TransformMutationBranches must be used")
+}
+
+func (self *branchTransformer) TransformMutationBranches(mutation MutationNode, heads []MutationNode) (err os.Error) {
+  self.heads[mutation.BlobRef()] = heads
+  // Transform the operation, such that the heads must be passed with their original operation
+  mutation.SetOperation([]byte("0"))
+  return
+}
+
+func TestBranchHeads(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", validationSchema, s, sg, &dummyFederation{}, NoVerification)
+  s.AddListener(grapher)
+  newDummyTransformer(grapher)
+  tr := &branchTransformer{heads: make(map[string][]MutationNode)}
+  grapher.AddTransformer(tr)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob2 := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref2 := store.NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":{"score":1}, "dep":["` + blobref2 + `"]}`)
+  blobref3 := store.NewBlobRef(blob3)
+  mutation := func(op string, dep string, field string) (blob []byte, blobref string) {
+    blob = []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + dep + `"], "op":` + op + `, "entity":"` + blobref3 + `", "field":"` + field + `"}`)
+    return blob, store.NewBlobRef(blob)
+  }
+  // A and B are concurrent. C depends on B via a mutation of another field.
+  // D is concurrent to all of them.
+  blobA, blobrefA := mutation("5", blobref3, "score")
+  blobB, blobrefB := mutation("10", blobref3, "score")
+  blobX, blobrefX := mutation(`{"$t":["Hello"]}`, blobrefB, "text")
+  blobC, blobrefC := mutation("3", blobrefX, "score")
+  blobD, blobrefD := mutation("7", blobref3, "score")
+
+  s.StoreBlob(blob1, blobref1)
+  s.StoreBlob(blob2, blobref2)
+  s.StoreBlob(blob3, blobref3)
+  s.StoreBlob(blobA, blobrefA)
+  s.StoreBlob(blobB, blobrefB)
+  s.StoreBlob(blobX, blobrefX)
+  s.StoreBlob(blobC, blobrefC)
+  s.StoreBlob(blobD, blobrefD)
+
+  time.Sleep(1000000000 * 2)
+
+  expected := map[string]map[string]string{blobrefA: {}, blobrefB: {blobrefA: "5"}, blobrefC: {blobrefA: "5"}, blobrefD: {blobrefA: "5", blobrefC: "3"}}
+  for blobref, exp := range expected {
+    heads, ok := tr.heads[blobref]
+    if !ok {
+      t.Fatalf("Mutation %v has not been transformed", blobref)
+    }
+    if len(heads) != len(exp) {
+      t.Fatalf("Wrong number of heads for %v: %v", blobref, len(heads))
+    }
+    for _, h := range heads {
+      if op, ok := exp[h.BlobRef()]; !ok || string(h.Operation().([]byte)) != op {
+        t.Fatalf("Wrong head %v with operation %v for %v", h.BlobRef(), string(h.Operation().([]byte)), blobref)
+      }
+    }
+  }
+}
+
+// Records what Repeat passes to the API
+type repeatAPI struct {
+  snapshot SnapshotNode
+  mutations []string
+}
+
+func (self *repeatAPI) Signal_ReceivedInvitation(perma PermaNode, permission PermissionNode) {
+}
+
+func (self *repeatAPI) Signal_AcceptedInvitation(perma PermaNode, perm PermissionNode, keep KeepNode) {
+}
+
+func (self *repeatAPI) Blob_Keep(perma PermaNode, perm PermissionNode, keep KeepNode) {
+}
+
+func (self *repeatAPI) Blob_Mutation(perma PermaNode, mut MutationNode) {
+  self.mutations = append(self.mutations, mut.BlobRef())
+}
+
+func (self *repeatAPI) Blob_Permission(perma PermaNode, permission PermissionNode) {
+}
+
+func (self *repeatAPI) Blob_Entity(perma PermaNode, entity EntityNode) {
+}
+
+func (self *repeatAPI) Blob_DeleteEntity(perma PermaNode, entity DelEntityNode) {
+}
+
+func (self *repeatAPI) Blob_Snapshot(perma PermaNode, snapshot SnapshotNode) {
+  self.snapshot = snapshot
+}
+
+func TestSnapshot(t *testing.T) {
+  testSnapshot(t, NewSimpleGraphStore())
+}
+
+// Shared by the tests of all GraphStore implementations
+func testSnapshot(t *testing.T, sg GraphStore) {
+  s := store.NewSimpleBlobStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{}, NoVerification)
+  s.AddListener(grapher)
+  newDummyTransformer(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1snap"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":{"text":"Hello"}, "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["Hello World"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref2 := store.NewBlobRef(blob2)
+  blob3 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref2 + `"], "op":{"$t":[{"$s":11}, "??"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  blobref3 := store.NewBlobRef(blob3)
+
+  s.StoreBlob(blob1, blobref1)
+  s.StoreBlob(blob1b, blobref1b)
+  s.StoreBlob(blob1c, blobref1c)
+  s.StoreBlob(blob2, blobref2)
+  time.Sleep(1000000000 * 2)
+
+  perma, err := grapher.permaNode(blobref1)
+  if perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+  seq := perma.SequenceNumber()
+  if err = grapher.StoreSnapshot(blobref1, seq + 1, []byte("too new")); err == nil {
+    t.Fatal("Snapshot beyond the perma node has been accepted")
+  }
+  if err = grapher.StoreSnapshot(blobref1, seq, []byte("Hello World")); err != nil {
+    t.Fatal(err.String())
+  }
+  if err = grapher.StoreSnapshot(blobref1, seq - 1, []byte("older")); err == nil {
+    t.Fatal("Older snapshot has been accepted")
+  }
+  snapshot, err := grapher.Snapshot(blobref1)
+  if err != nil || snapshot == nil {
+    t.Fatal("Did not find the snapshot")
+  }
+  if snapshot.SequenceNumber() != seq || string(snapshot.Content()) != "Hello World" {
+    t.Fatalf("Wrong snapshot: %v %v", snapshot.SequenceNumber(), string(snapshot.Content()))
+  }
+  found := false
+  for _, id := range snapshot.Frontier() {
+    found = found || id == blobref2
+  }
+  if !found {
+    t.Fatalf("Wrong frontier: %v", snapshot.Frontier())
+  }
+
+  s.StoreBlob(blob3, blobref3)
+  time.Sleep(1000000000 * 2)
+
+  // Repeat starts with the snapshot and continues with the mutation which follows it
+  api := &repeatAPI{}
+  grapher.SetAPI(api)
+  if _, err = grapher.Repeat(blobref1, 0); err != nil {
+    t.Fatal(err.String())
+  }
+  if api.snapshot == nil || api.snapshot.SequenceNumber() != seq {
+    t.Fatal("Repeat did not pass the snapshot")
+  }
+  if len(api.mutations) != 1 || api.mutations[0] != blobref3 {
+    t.Fatalf("Wrong mutations after the snapshot: %v", api.mutations)
+  }
+
+  // The snapshot is skipped if the application has seen all OT nodes it covers
+  api = &repeatAPI{}
+  grapher.SetAPI(api)
+  if _, err = grapher.Repeat(blobref1, seq); err != nil {
+    t.Fatal(err.String())
+  }
+  if api.snapshot != nil || len(api.mutations) != 1 {
+    t.Fatal("Repeat must not pass the snapshot")
+  }
+
+  // Malformed snapshots are reported
+  if err = sg.StoreSnapshot(blobref1, map[string]interface{}{"seq": "x"}); err != nil {
+    t.Fatal(err.String())
+  }
+  if _, err = grapher.Snapshot(blobref1); err == nil {
+    t.Fatal("Malformed snapshot has been accepted")
+  }
+}
+
+func TestDeletePermaNode(t *testing.T) {
+  testDeletePermaNode(t, NewSimpleGraphStore())
+}
+
+// Shared by the tests of all GraphStore implementations
+func testDeletePermaNode(t *testing.T, sg GraphStore) {
+  s := store.NewSimpleBlobStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{}, NoVerification)
+  s.AddListener(grapher)
+  newDummyTransformer(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1del"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob2 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma2del"}`)
+  blobref2 := store.NewBlobRef(blob2)
+  s.StoreBlob(blob1, blobref1)
+  s.StoreBlob(blob1b, blobref1b)
+  s.StoreBlob(blob2, blobref2)
+  time.Sleep(1000000000 * 2)
+  if perma, err := grapher.permaNode(blobref1); perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+
+  // Deleting a blob other than the perma blob keeps the perma node
+  if err := s.DeleteBlob(blobref1b); err != nil {
+    t.Fatal(err)
+  }
+  time.Sleep(1000000000 * 2)
+  if perma, err := grapher.permaNode(blobref1); perma == nil || err != nil {
+    t.Fatal("Perma node has been removed")
+  }
+  // Deleting the perma blob removes the perma node, but no other perma node
+  if err := s.DeleteBlob(blobref1); err != nil {
+    t.Fatal(err)
+  }
+  time.Sleep(1000000000 * 2)
+  if perma, err := grapher.permaNode(blobref1); perma != nil || err != nil {
+    t.Fatalf("Perma node has not been removed: %v", err)
+  }
+  if perma, err := grapher.permaNode(blobref2); perma == nil || err != nil {
+    t.Fatal("Other perma node has been removed")
+  }
+}
@@ -1,5 +1,15 @@
 package lightwavegrapher
 
+import (
+  "encoding/base64"
+  "encoding/hex"
+  "fmt"
+  "json"
+  "os"
+  "strconv"
+  ot "lightwaveot"
+)
+
 const (
   TypeNone = iota
   TypeInt64
@@ -41,3 +51,236 @@ type FieldSchema struct {
   ElementType int
   Transformation int
 }
+
+// Returns the schema of the entity or an error if the schema does not declare such an entity.
+func (self *Schema) EntitySchema(fileMimeType string, entityMimeType string) (entitySchema *EntitySchema, err os.Error) {
+  fileSchema, ok := self.FileSchemas[fileMimeType]
+  if !ok {
+    return nil, os.NewError("Unknown document mime type " + fileMimeType)
+  }
+  entitySchema, ok = fileSchema.EntitySchemas[entityMimeType]
+  if !ok {
+    return nil, os.NewError("Unknown entity mime type " + entityMimeType)
+  }
+  return
+}
+
+// Returns the schema of the field or an error if the schema does not declare such a field.
+func (self *Schema) FieldSchema(fileMimeType string, entityMimeType string, field string) (fieldSchema *FieldSchema, err os.Error) {
+  entitySchema, err := self.EntitySchema(fileMimeType, entityMimeType)
+  if err != nil {
+    return nil, err
+  }
+  fieldSchema, ok := entitySchema.FieldSchemas[field]
+  if !ok {
+    return nil, os.NewError("Unknown field " + field)
+  }
+  return
+}
+
+// The content of an entity must be a JSON object. Each property must be a declared field
+// and its value must match the type of the field. Fields may be missing or null.
+func (self *EntitySchema) ValidateContent(content []byte) (err os.Error) {
+  var data map[string]interface{}
+  if err = json.Unmarshal(content, &data); err != nil {
+    return os.NewError("Entity content must be a JSON object")
+  }
+  for field, value := range data {
+    fieldSchema, ok := self.FieldSchemas[field]
+    if !ok {
+      return os.NewError("Unknown field " + field + " in entity content")
+    }
+    if err = validateValue(value, fieldSchema.Type, fieldSchema.ElementType); err != nil {
+      return os.NewError("Field " + field + ": " + err.String())
+    }
+  }
+  return nil
+}
+
+// Checks that the operation of a mutation matches the type and transformation of the field.
+// Fields with TransformationMerge expect an OT operation, all others expect a new value
+// or null, which is the epsilon operation.
+func (self *FieldSchema) ValidateOperation(operation []byte) (err os.Error) {
+  var value interface{}
+  if err = json.Unmarshal(operation, &value); err != nil {
+    return os.NewError("Operation is not valid JSON")
+  }
+  if self.Transformation != TransformationMerge {
+    return validateValue(value, self.Type, self.ElementType)
+  }
+  switch self.Type {
+  case TypeMap:
+    m, ok := value.(map[string]interface{})
+    if !ok {
+      return os.NewError("Operation on a map must be a JSON object")
+    }
+    // Each property sets the value of a key. null removes the key.
+    for key, v := range m {
+      if err = validateValue(v, self.ElementType, TypeNone); err != nil {
+        return os.NewError("Key " + key + ": " + err.String())
+      }
+    }
+    return nil
+  case TypeString, TypeArray:
+    var op ot.Operation
+    if e := op.UnmarshalJSON(operation); e != nil {
+      return os.NewError(fmt.Sprintf("Malformed operation: %v", e))
+    }
+    if self.Type == TypeString {
+      if op.Kind != ot.StringOp {
+        return os.NewError("Operation on a string must be a string operation")
+      }
+      return validateStringOperations(op.Operations)
+    }
+    if op.Kind != ot.ArrayOp {
+      return os.NewError("Operation on an array must be an array operation")
+    }
+    return validateArrayOperations(op.Operations, self.ElementType)
+  }
+  return os.NewError("Type " + strconv.Itoa(self.Type) + " does not support the merge transformation")
+}
+
+// Checks the values which the operations of an ArrayOp insert or overwrite
+// and the operations which modify elements against the type of the elements.
+func validateArrayOperations(ops []ot.Operation, elementType int) (err os.Error) {
+  for _, o := range ops {
+    switch o.Kind {
+    case ot.SkipOp, ot.DeleteOp:
+    case ot.InsertOp:
+      if len(o.Operations) > 0 {
+        err = validateElementOperation(o.Operations[0], elementType)
+      } else {
+        err = validateValue(o.Value, elementType, TypeNone)
+      }
+      if err != nil {
+        return os.NewError("Inserted element: " + err.String())
+      }
+    case ot.OverwriteOp:
+      if err = validateValue(o.Value, elementType, TypeNone); err != nil {
+        return os.NewError("Overwritten element: " + err.String())
+      }
+    case ot.IncrementOp:
+      if elementType != TypeNone && elementType != TypeInt64 && elementType != TypeFloat64 {
+        return os.NewError("Incremented element must be a number")
+      }
+      if err = validateValue(o.Value, elementType, TypeNone); err != nil {
+        return os.NewError("Incremented element: " + err.String())
+      }
+    case ot.StringOp, ot.ArrayOp, ot.ObjectOp:
+      if err = validateElementOperation(o, elementType); err != nil {
+        return os.NewError("Modified element: " + err.String())
+      }
+    default:
+      return os.NewError("Operation not allowed in an array")
+    }
+  }
+  return nil
+}
+
+// Checks the operations of a StringOp. Strings can only be modified by inserting, skipping and deleting characters.
+// They do not support formatting.
+func validateStringOperations(ops []ot.Operation) (err os.Error) {
+  for _, o := range ops {
+    switch o.Kind {
+    case ot.SkipOp, ot.DeleteOp:
+    case ot.InsertOp:
+      if _, ok := o.Value.(string); !ok || len(o.Operations) > 0 {
+        return os.NewError("Only plain characters can be inserted in a string")
+      }
+    default:
+      return os.NewError("Operation not allowed in a string")
+    }
+  }
+  return nil
+}
+
+// Checks that an operation which creates or modifies an element matches the type of the element.
+func validateElementOperation(op ot.Operation, typ int) os.Error {
+  switch op.Kind {
+  case ot.StringOp:
+    if typ != TypeNone && typ != TypeString {
+      return os.NewError("String operation on an element which is no string")
+    }
+    return validateStringOperations(op.Operations)
+  case ot.ArrayOp:
+    if typ != TypeNone && typ != TypeArray {
+      return os.NewError("Array operation on an element which is no array")
+    }
+    // The schema does not declare the type of nested elements
+    return validateArrayOperations(op.Operations, TypeNone)
+  case ot.ObjectOp:
+    if typ != TypeNone && typ != TypeMap {
+      return os.NewError("Object operation on an element which is no map")
+    }
+    return nil
+  }
+  return os.NewError("Operation not allowed on an element")
+}
+
+// Checks that a JSON-decoded value matches the type. null is accepted for all types.
+func validateValue(value interface{}, typ int, elementType int) os.Error {
+  if value == nil {
+    return nil
+  }
+  switch typ {
+  case TypeNone:
+    return nil
+  case TypeInt64:
+    if f, ok := value.(float64); ok && f == float64(int64(f)) {
+      return nil
+    }
+    return os.NewError("Value must be an integer")
+  case TypeFloat64:
+    if _, ok := value.(float64); ok {
+      return nil
+    }
+    return os.NewError("Value must be a number")
+  case TypeString:
+    if _, ok := value.(string); ok {
+      return nil
+    }
+    return os.NewError("Value must be a string")
+  case TypeBytes:
+    if s, ok := value.(string); ok {
+      if _, e := base64.StdEncoding.DecodeString(s); e == nil {
+        return nil
+      }
+    }
+    return os.NewError("Value must be a base64 encoded string")
+  case TypeBool:
+    if _, ok := value.(bool); ok {
+      return nil
+    }
+    return os.NewError("Value must be a boolean")
+  case TypeEntityBlobRef, TypePermaBlobRef:
+    if s, ok := value.(string); ok && len(s) > 0 {
+      if _, e := hex.DecodeString(s); e == nil {
+        return nil
+      }
+    }
+    return os.NewError("Value must be a blobref")
+  case TypeArray:
+    arr, ok := value.([]interface{})
+    if !ok {
+      return os.NewError("Value must be an array")
+    }
+    for _, v := range arr {
+      if err := validateValue(v, elementType, TypeNone); err != nil {
+        return err
+      }
+    }
+    return nil
+  case TypeMap:
+    m, ok := value.(map[string]interface{})
+    if !ok {
+      return os.NewError("Value must be an object")
+    }
+    for _, v := range m {
+      if err := validateValue(v, elementType, TypeNone); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+  return os.NewError("Unknown type " + strconv.Itoa(typ))
+}
@@ -0,0 +1,138 @@
+package lightwavegrapher
+
+import (
+  store "lightwavestore"
+  "testing"
+)
+
+var validationSchema = &Schema{ FileSchemas: map[string]*FileSchema {
+    "application/x-test-file": &FileSchema{ EntitySchemas: map[string]*EntitySchema {
+	"application/x-test-entity": &EntitySchema { FieldSchemas: map[string]*FieldSchema {
+	    "text": &FieldSchema{ Type: TypeString, ElementType: TypeNone, Transformation: TransformationMerge },
+	    "title": &FieldSchema{ Type: TypeString, ElementType: TypeNone, Transformation: TransformationLatest },
+	    "score": &FieldSchema{ Type: TypeInt64, ElementType: TypeNone, Transformation: TransformationMax },
+	    "after": &FieldSchema{ Type: TypeEntityBlobRef, ElementType: TypeNone, Transformation: TransformationNone },
+	    "tags": &FieldSchema{ Type: TypeArray, ElementType: TypeString, Transformation: TransformationMerge },
+	    "style": &FieldSchema{ Type: TypeMap, ElementType: TypeNone, Transformation: TransformationMerge },
+	    "scores": &FieldSchema{ Type: TypeMap, ElementType: TypeInt64, Transformation: TransformationMerge },
+	    "data": &FieldSchema{ Type: TypeBytes, ElementType: TypeNone, Transformation: TransformationLatest } } } } } } }
+
+func TestValidateContent(t *testing.T) {
+  entitySchema, err := validationSchema.EntitySchema("application/x-test-file", "application/x-test-entity")
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  valid := []string{`{}`, `{"text":"Hello", "title":null, "score":42, "after":"abcd01", "tags":["a","b"], "style":{"color":"red"}, "data":"SGVsbG8="}`}
+  for _, c := range valid {
+    if err := entitySchema.ValidateContent([]byte(c)); err != nil {
+      t.Fatalf("Valid content %v has been rejected: %v", c, err)
+    }
+  }
+  invalid := []string{`""`, `[]`, `{"unknown":1}`, `{"score":"high"}`, `{"score":1.5}`, `{"after":"../x"}`, `{"tags":["a",1]}`, `{"style":[]}`, `{"data":"Hello!"}`}
+  for _, c := range invalid {
+    if err := entitySchema.ValidateContent([]byte(c)); err == nil {
+      t.Fatalf("Invalid content %v has been accepted", c)
+    }
+  }
+  if _, err := validationSchema.FieldSchema("application/x-test-file", "application/x-test-entity", "unknown"); err == nil {
+    t.Fatal("Unknown field has been accepted")
+  }
+}
+
+func TestValidateOperation(t *testing.T) {
+  tests := []struct {
+    field string
+    op string
+    valid bool
+  }{
+    {"text", `{"$t":["Hello", {"$s":3}]}`, true},
+    {"text", `"Hello"`, false},
+    {"text", `{"$a":["x"]}`, false},
+    {"text", `{"$t":[{"$s":1}, {"$d":2}]}`, true},
+    {"text", `{"$t":[{"$s":1}, {"$f":2, "$m":{"bold":true}}]}`, false},
+    {"text", `{"$t":[{"$i":"x", "$m":{"bold":true}}]}`, false},
+    {"text", `{"$t":[{"$a":["x"]}]}`, false},
+    {"title", `"Hello"`, true},
+    {"title", `null`, true},
+    {"title", `{"$t":["Hello"]}`, false},
+    {"score", `17`, true},
+    {"score", `"17"`, false},
+    {"tags", `{"$a":[{"$s":1}, "x"]}`, true},
+    {"tags", `{"$a":[7]}`, false},
+    {"tags", `{"$a":[{"$w":"x"}, {"$s":1}, {"$w":null}]}`, true},
+    {"tags", `{"$a":[{"$w":7}]}`, false},
+    {"tags", `{"$a":[{"$c":1}]}`, false},
+    {"tags", `{"$a":[{"$t":[{"$s":1}, "x"]}]}`, true},
+    {"tags", `{"$a":[{"$a":["x"]}]}`, false},
+    {"tags", `{"$a":[{"$t":[{"$f":1, "$m":{"bold":true}}]}]}`, false},
+    {"tags", `{"$a":[{"$i":{"$t":["x"]}}]}`, true},
+    {"tags", `{"$a":[{"$i":{"$a":["x"]}}]}`, false},
+    {"data", `"SGVsbG8="`, true},
+    {"data", `"Hello!"`, false},
+    {"style", `{"color":"red"}`, true},
+    {"style", `"red"`, false},
+    {"scores", `{"alice":1, "bob":null}`, true},
+    {"scores", `{"alice":"high"}`, false},
+    {"after", `"abcd01"`, true},
+    {"after", `42`, false},
+  }
+  for _, test := range tests {
+    fieldSchema, err := validationSchema.FieldSchema("application/x-test-file", "application/x-test-entity", test.field)
+    if err != nil {
+      t.Fatal(err.String())
+    }
+    err = fieldSchema.ValidateOperation([]byte(test.op))
+    if test.valid && err != nil {
+      t.Fatalf("Valid operation %v on %v has been rejected: %v", test.op, test.field, err)
+    }
+    if !test.valid && err == nil {
+      t.Fatalf("Invalid operation %v on %v has been accepted", test.op, test.field)
+    }
+  }
+}
+
+func TestRejectSchemaViolation(t *testing.T) {
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{}, NoVerification)
+  newDummyTransformer(grapher)
+
+  blob1 := []byte(`{"type":"permanode", "signer":"a@b", "mimetype":"application/x-test-file", "random":"perma1abc"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  blob1b := []byte(`{"type":"keep", "signer":"a@b", "perma":"` + blobref1 + `"}`)
+  blobref1b := store.NewBlobRef(blob1b)
+  blob1c := []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":{"text":"Hello"}, "dep":["` + blobref1b + `"]}`)
+  blobref1c := store.NewBlobRef(blob1c)
+  for _, b := range [][]byte{blob1, blob1b, blob1c} {
+    if err := grapher.HandleBlob(b, store.NewBlobRef(b)); err != nil {
+      t.Fatal(err.String())
+    }
+  }
+  invalid := [][]byte{
+    []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-unknown", "content":{}, "dep":["` + blobref1c + `"]}`),
+    []byte(`{"type":"entity", "signer":"a@b", "perma":"` + blobref1 + `", "mimetype": "application/x-test-entity", "content":{"text":42}, "dep":["` + blobref1c + `"]}`),
+    []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":"garbage", "entity":"` + blobref1c + `", "field":"text"}`),
+    []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":["x"]}, "entity":"` + blobref1c + `", "field":"unknown"}`),
+  }
+  for _, b := range invalid {
+    if err := grapher.HandleBlob(b, store.NewBlobRef(b)); err == nil {
+      t.Fatalf("Invalid blob has been accepted: %v", string(b))
+    }
+  }
+  blob2 := []byte(`{"type":"mutation", "signer":"a@b", "perma":"` + blobref1 + `", "dep":["` + blobref1c + `"], "op":{"$t":[{"$s":5}, " World"]}, "entity":"` + blobref1c + `", "field":"text"}`)
+  if err := grapher.HandleBlob(blob2, store.NewBlobRef(blob2)); err != nil {
+    t.Fatal(err.String())
+  }
+  // Only the valid mutation has been stored
+  refs := []string{store.NewBlobRef(blob2)}
+  for _, b := range invalid {
+    refs = append(refs, store.NewBlobRef(b))
+  }
+  missing, err := sg.HasOTNodes(blobref1, refs)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if len(missing) != len(invalid) || missing[0] == refs[0] {
+    t.Fatalf("Wrong blobs have been stored: %v", missing)
+  }
+}
@@ -0,0 +1,120 @@
+package lightwavegrapher
+
+import (
+  "bytes"
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "os"
+  "sync"
+)
+
+// Schema blobs are signed with RSA (PKCS #1 v1.5 over SHA-256). The signature covers the canonical
+// blob bytes, i.e. the JSON of the blob without the "sig" property. The signature is appended
+// as the last property of the JSON object:
+//
+//   {"type":"keep","perma":"...","signer":"a@b","sig":"<base64 signature>"}
+//
+// The blobref is computed over the signed blob.
+//
+// The Grapher checks the signature of every schema blob against the KeyRegistry passed to NewGrapher.
+// Without a KeyRegistry, it rejects all schema blobs. Checking can only be turned off explicitly
+// by passing NoVerification.
+
+const sigPrefix = `,"sig":"`
+
+// KeyRegistry maps 'user@domain' to the public key of the user.
+type KeyRegistry interface {
+  // Returns nil if the key of the user is unknown.
+  PublicKey(userid string) (key *rsa.PublicKey, err os.Error)
+}
+
+type noVerification struct {
+}
+
+func (self *noVerification) PublicKey(userid string) (key *rsa.PublicKey, err os.Error) {
+  return nil, nil
+}
+
+// A Grapher with this key registry accepts all schema blobs without checking their signatures.
+// Only use it if all blobs come from a trusted source, e.g. in tests.
+var NoVerification KeyRegistry = &noVerification{}
+
+// SimpleKeyRegistry holds the public keys in memory.
+type SimpleKeyRegistry struct {
+  keys map[string]*rsa.PublicKey
+  mutex sync.Mutex
+}
+
+func NewSimpleKeyRegistry() *SimpleKeyRegistry {
+  return &SimpleKeyRegistry{keys: make(map[string]*rsa.PublicKey)}
+}
+
+func (self *SimpleKeyRegistry) AddPublicKey(userid string, key *rsa.PublicKey) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  self.keys[userid] = key
+}
+
+func (self *SimpleKeyRegistry) PublicKey(userid string) (key *rsa.PublicKey, err os.Error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return self.keys[userid], nil
+}
+
+func blobDigest(blob []byte) []byte {
+  h := sha256.New()
+  h.Write(blob)
+  return h.Sum()
+}
+
+// Appends the signature to the JSON of an unsigned schema blob.
+func SignBlob(blob []byte, key *rsa.PrivateKey) (signed []byte, err os.Error) {
+  s, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, blobDigest(blob))
+  if err != nil {
+    return nil, err
+  }
+  sig := base64.StdEncoding.EncodeToString(s)
+  result := make([]byte, 0, len(blob) + len(sigPrefix) + len(sig) + 2)
+  result = append(result, blob[:len(blob) - 1]...)
+  result = append(result, []byte(sigPrefix)...)
+  result = append(result, []byte(sig)...)
+  return append(result, []byte(`"}`)...), nil
+}
+
+// Splits a signed blob into the canonical bytes and the signature.
+func splitSignature(blob []byte) (canonical []byte, sig []byte, err os.Error) {
+  i := bytes.LastIndex(blob, []byte(sigPrefix))
+  if i == -1 || !bytes.HasSuffix(blob, []byte(`"}`)) {
+    return nil, nil, os.NewError("Blob is not signed")
+  }
+  sig, e := base64.StdEncoding.DecodeString(string(blob[i + len(sigPrefix):len(blob) - 2]))
+  if e != nil || len(sig) == 0 {
+    return nil, nil, os.NewError("Malformed signature")
+  }
+  canonical = make([]byte, 0, i + 1)
+  canonical = append(canonical, blob[:i]...)
+  canonical = append(canonical, '}')
+  return canonical, sig, nil
+}
+
+// Checks that the blob has been signed by 'signer'.
+func VerifyBlob(blob []byte, signer string, keys KeyRegistry) (err os.Error) {
+  key, err := keys.PublicKey(signer)
+  if err != nil {
+    return err
+  }
+  if key == nil {
+    return os.NewError("Unknown public key of " + signer)
+  }
+  canonical, sig, err := splitSignature(blob)
+  if err != nil {
+    return err
+  }
+  if rsa.VerifyPKCS1v15(key, crypto.SHA256, blobDigest(canonical), sig) != nil {
+    return os.NewError("Signature of " + signer + " is not valid")
+  }
+  return nil
+}
@@ -0,0 +1,98 @@
+package lightwavegrapher
+
+import (
+  "bytes"
+  "crypto/rand"
+  "crypto/rsa"
+  store "lightwavestore"
+  "testing"
+)
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+  key, err := rsa.GenerateKey(rand.Reader, 1024)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  return key
+}
+
+func TestSignBlob(t *testing.T) {
+  key := newTestKey(t)
+  other := newTestKey(t)
+  keys := NewSimpleKeyRegistry()
+  keys.AddPublicKey("a@b", &key.PublicKey)
+  keys.AddPublicKey("c@d", &other.PublicKey)
+
+  blob := []byte(`{"type":"permanode","signer":"a@b","random":"perma1abc","mimetype":"application/x-test-file"}`)
+  signed, err := SignBlob(blob, key)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if err := VerifyBlob(signed, "a@b", keys); err != nil {
+    t.Fatal(err.String())
+  }
+  // Wrong signer
+  if err := VerifyBlob(signed, "c@d", keys); err == nil {
+    t.Fatal("Signature of another user has been accepted")
+  }
+  // Unknown signer
+  if err := VerifyBlob(signed, "x@y", keys); err == nil {
+    t.Fatal("Signature of an unknown user has been accepted")
+  }
+  // Unsigned blob
+  if err := VerifyBlob(blob, "a@b", keys); err == nil {
+    t.Fatal("Unsigned blob has been accepted")
+  }
+  // Tampered blob
+  tampered := bytes.Replace(signed, []byte("perma1abc"), []byte("perma1abd"), 1)
+  if err := VerifyBlob(tampered, "a@b", keys); err == nil {
+    t.Fatal("Tampered blob has been accepted")
+  }
+  // The signature must be the last property
+  moved := append([]byte(`{"random":"x",`), signed[1:]...)
+  moved = append(moved[:len(moved) - 1], []byte(`,"x":1}`)...)
+  if err := VerifyBlob(moved, "a@b", keys); err == nil {
+    t.Fatal("Blob with trailing properties has been accepted")
+  }
+}
+
+func TestRejectForgedBlob(t *testing.T) {
+  key := newTestKey(t)
+  keys := NewSimpleKeyRegistry()
+  keys.AddPublicKey("a@b", &key.PublicKey)
+  s := store.NewSimpleBlobStore()
+  sg := NewSimpleGraphStore()
+  grapher := NewGrapher("a@b", schema, s, sg, &dummyFederation{}, keys)
+
+  blob1 := []byte(`{"type":"permanode","signer":"a@b","random":"perma1abc","mimetype":"application/x-test-file"}`)
+  blobref1 := store.NewBlobRef(blob1)
+  if err := grapher.HandleBlob(blob1, blobref1); err == nil {
+    t.Fatal("Unsigned blob has been accepted")
+  }
+  if perma, _ := grapher.permaNode(blobref1); perma != nil {
+    t.Fatal("Unsigned blob has been indexed")
+  }
+  blob2, err := SignBlob(blob1, key)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  blobref2 := store.NewBlobRef(blob2)
+  if err := grapher.HandleBlob(blob2, blobref2); err != nil {
+    t.Fatal(err.String())
+  }
+  if perma, err := grapher.permaNode(blobref2); perma == nil || err != nil {
+    t.Fatal("Did not find perma node")
+  }
+}
+
+func TestRejectWithoutKeyRegistry(t *testing.T) {
+  key := newTestKey(t)
+  grapher := NewGrapher("a@b", schema, store.NewSimpleBlobStore(), NewSimpleGraphStore(), &dummyFederation{}, nil)
+  blob, err := SignBlob([]byte(`{"type":"permanode","signer":"a@b","random":"perma2abc","mimetype":"application/x-test-file"}`), key)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  if err = grapher.HandleBlob(blob, store.NewBlobRef(blob)); err == nil {
+    t.Fatal("Blob has been accepted without a key registry")
+  }
+}
@@ -9,6 +9,7 @@ type graph struct {
   data map[string]interface{}
   nodes []map[string]interface{}
   nodesByBlobRef map[string]int
+  snapshot map[string]interface{}
 }
 
 type SimpleGraphStore struct {
@@ -101,10 +102,14 @@ func (self *SimpleGraphStore) GetMutationsAscending(perma_blobref string, entity
     return nil, os.NewError("Unknown perma blob")
   }
   
+  // A negative endSeqNumber denotes the end of the graph
+  if endSeqNumber < 0 {
+    endSeqNumber = int64(len(g.nodes))
+  }
   if startWithSeqNumber < 0 || startWithSeqNumber > int64(len(g.nodes)) {
     return nil, os.NewError("Index out of bounds")
   }
-  if endSeqNumber < 0 || endSeqNumber > int64(len(g.nodes)) {
+  if endSeqNumber > int64(len(g.nodes)) {
     return nil, os.NewError("Index out of bounds")
   }
 
@@ -127,10 +132,14 @@ func (self *SimpleGraphStore) GetOTNodesAscending(perma_blobref string, startWit
     return nil, os.NewError("Unknown perma blob")
   }
   
+  // A negative endSeqNumber denotes the end of the graph
+  if endSeqNumber < 0 {
+    endSeqNumber = int64(len(g.nodes))
+  }
   if startWithSeqNumber < 0 || startWithSeqNumber > int64(len(g.nodes)) {
     return nil, os.NewError("Index out of bounds")
   }
-  if endSeqNumber < 0 || endSeqNumber > int64(len(g.nodes)) {
+  if endSeqNumber > int64(len(g.nodes)) {
     return nil, os.NewError("Index out of bounds")
   }
 
@@ -162,6 +171,28 @@ func (self *SimpleGraphStore) GetOTNodesDescending(perma_blobref string) (ch <-c
   return c, nil
 }
 
+func (self *SimpleGraphStore) StoreSnapshot(perma_blobref string, data map[string]interface{}) os.Error {
+  g, ok := self.graphs[perma_blobref]
+  if !ok {
+    return os.NewError("Unknown perma blob")
+  }
+  g.snapshot = data
+  return nil
+}
+
+func (self *SimpleGraphStore) GetSnapshot(perma_blobref string) (data map[string]interface{}, err os.Error) {
+  g, ok := self.graphs[perma_blobref]
+  if !ok {
+    return nil, os.NewError("Unknown perma blob")
+  }
+  return g.snapshot, nil
+}
+
+func (self *SimpleGraphStore) DeletePermaNode(perma_blobref string) os.Error {
+  self.graphs[perma_blobref] = nil, false
+  return nil
+}
+
 func (self *SimpleGraphStore) Enqueue(perma_blobref string, blobref string, dependencies []string) os.Error {
   // Remember the blob
   self.waitingBlobs[blobref] = true
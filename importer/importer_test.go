@@ -20,7 +20,7 @@ func TestImporter(t *testing.T) {
   fed := &dummyFederation{}
   s := store.NewSimpleBlobStore()
   sg := NewSimpleGraphStore()
-  grapher := NewGrapher("a@b", schema, s, sg, nil)
+  grapher := NewGrapher("a@b", schema, s, sg, nil, NoVerification)
   s.AddListener(grapher)
 
 }
@@ -820,7 +820,9 @@ func transform(node1 otNode, node2 otNode) (tnode1, tnode2 otNode, err os.Error)
 
 func pruneSeq(nodes []otNode, prune map[string]bool) (result []otNode, err os.Error) {
   started := false
-  var u ot.Mutation
+  // The pruned mutations. They are pruned one after the other, because pruning an OverwriteOp
+  // depends on the site of the pruned mutation
+  var pruned []ot.Mutation
   for _, n := range nodes {
     // This mutation/permission is not to be pruned?
     if _, isundo := prune[n.BlobRef()]; !isundo {
@@ -832,7 +834,7 @@ func pruneSeq(nodes []otNode, prune map[string]bool) (result []otNode, err os.Er
 	  result = append(result, &p)
 	case *mutationNode:
 	  m := *(n.(*mutationNode))
-	  m.mutation, u, err = ot.PruneMutation(n.(*mutationNode).mutation, u)
+	  m.mutation, err = pruneMutation(n.(*mutationNode).mutation, pruned)
 	  result = append(result, &m)
 	case *keepNode:
 	  result = append(result, n)
@@ -848,16 +850,26 @@ func pruneSeq(nodes []otNode, prune map[string]bool) (result []otNode, err os.Er
     switch n.(type) {
     case *permissionNode, *keepNode: // Ignore the permission node
       // Do nothing by intention
-    case *mutationNode: // Store in u that the mutation in 'n' are pruned.
-      if !started { // Initialize 'u'
-	started = true
-	u = n.(*mutationNode).mutation
-      } else { // Add the mutation of node 'n' to 'u'
-	u, err = ot.Compose(u, n.(*mutationNode).mutation)
-	if err != nil {
-	  return
-	}
+    case *mutationNode: // Remember that the mutation in 'n' is pruned.
+      started = true
+      var mut ot.Mutation
+      mut, err = pruneMutation(n.(*mutationNode).mutation, pruned)
+      if err != nil {
+	return
       }
+      pruned = append(pruned, mut)
+    }
+  }
+  return
+}
+
+// Prunes all mutations in 'pruned' from 'mut'. The mutations in 'pruned' are transformed such that they follow 'mut'.
+func pruneMutation(mut ot.Mutation, pruned []ot.Mutation) (tmut ot.Mutation, err os.Error) {
+  tmut = mut
+  for i, p := range pruned {
+    tmut, pruned[i], err = ot.PruneMutation(tmut, p)
+    if err != nil {
+      return
     }
   }
   return
@@ -0,0 +1,251 @@
+package ot
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+)
+
+// -------------------------------------------
+// Random array operation generator
+
+const originalElement = "abcdef"
+
+// Creates an array of n mutable strings
+func newTestArray(n int) *SimpleArray {
+  ops := []Operation{}
+  for i := 0; i < n; i++ {
+    ops = append(ops, Operation{Kind: InsertOp, Len: 1, Operations: []Operation{
+      Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+        Operation{Kind: InsertOp, Len: len(originalElement), Value: originalElement}}}}})
+  }
+  arr, err := ExecuteOperation(NewSimpleArray(), Operation{Kind: ArrayOp, Len: 1, Operations: ops})
+  if err != nil {
+    panic(err.Error())
+  }
+  return arr.(*SimpleArray)
+}
+
+// n is the length of the array
+func RandomArrayOperations(n int) (ops []Operation) {
+  i := 0
+  for i <= n {
+    r := rand.Float64()
+    if r < 0.1 { // Insert a tomb?
+      ops = append(ops, Operation{Kind: InsertOp, Len: rand.Intn(3) + 1})
+    } else if r < 0.2 { // Insert a constant?
+      ops = append(ops, Operation{Kind: InsertOp, Len: 1, Value: fmt.Sprintf("_%v_", rand.Intn(100))})
+    } else if r < 0.3 { // Insert a mutable string?
+      data := fmt.Sprintf("_%v_", rand.Intn(100))
+      ops = append(ops, Operation{Kind: InsertOp, Len: 1, Operations: []Operation{
+        Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+          Operation{Kind: InsertOp, Len: len(data), Value: data}}}}})
+    }
+    if i == n { // Allowed inserts at the end, but now it is time to quit the for loop
+      break
+    }
+    r = rand.Float64()
+    if r < 0.3 { // Mutate the next element
+      ops = append(ops, Operation{Kind: StringOp, Len: 1, Operations: randomElementOperations(len(originalElement))})
+      i++
+      continue
+    }
+    incr := rand.Intn(n-i) + 1
+    if r < 0.7 { // Skip?
+      if len(ops) > 0 && ops[len(ops)-1].Kind == SkipOp {
+        ops[len(ops)-1].Len += incr
+      } else {
+        ops = append(ops, Operation{Kind: SkipOp, Len: incr})
+      }
+    } else { // Delete
+      if len(ops) > 0 && ops[len(ops)-1].Kind == DeleteOp {
+        ops[len(ops)-1].Len += incr
+      } else {
+        ops = append(ops, Operation{Kind: DeleteOp, Len: incr})
+      }
+    }
+    i += incr
+  }
+  return
+}
+
+// Like RandomOperations, but works for strings of any length n > 0.
+// RandomOperations calls rand.Intn(0) when it reaches the second to last character.
+func randomElementOperations(n int) (ops []Operation) {
+  i := 0
+  for i <= n {
+    if rand.Float64() < 0.2 { // Insert characters?
+      data := fmt.Sprintf("_%v_", rand.Intn(100))
+      ops = append(ops, Operation{Kind: InsertOp, Len: len(data), Value: data})
+    }
+    if i == n {
+      break
+    }
+    incr := 1
+    if n-i > 1 {
+      incr = rand.Intn(n-i) + 1
+    }
+    kind := SkipOp
+    if rand.Float64() >= 0.6 {
+      kind = DeleteOp
+    }
+    if len(ops) > 0 && ops[len(ops)-1].Kind == kind {
+      ops[len(ops)-1].Len += incr
+    } else {
+      ops = append(ops, Operation{Kind: kind, Len: incr})
+    }
+    i += incr
+  }
+  return
+}
+
+func executeArraySeq(t *testing.T, arr *SimpleArray, muts []Mutation) *SimpleArray {
+  for _, mut := range muts {
+    result, err := Execute(arr, mut)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    arr = result.(*SimpleArray)
+  }
+  return arr
+}
+
+// -------------------------------------------------
+// Tests
+
+func TestArrayExec(t *testing.T) {
+  arr := newTestArray(3)
+  m := Mutation{ID: "m1", Operation: Operation{Kind: ArrayOp, Len: 1, Operations: []Operation{
+    Operation{Kind: InsertOp, Len: 1, Value: 42},
+    Operation{Kind: DeleteOp, Len: 1},
+    Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+      Operation{Kind: SkipOp, Len: 3},
+      Operation{Kind: InsertOp, Len: 1, Value: "X"},
+      Operation{Kind: SkipOp, Len: 3}}},
+    Operation{Kind: InsertOp, Len: 2},
+    Operation{Kind: SkipOp, Len: 1}}}}
+  _, err := Execute(arr, m)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if arr.String() != "[42 abcXdef abcdef]" {
+    t.Fatalf("Wrong array content: %v", arr.String())
+  }
+}
+
+func TestArrayTransform(t *testing.T) {
+  // Try many random operations
+  for test := 0; test < 2000; test++ {
+    original := 5
+    all := []Mutation{}
+    // Create concurrent mutations
+    for i := 0; i < 4; i++ {
+      all = append(all, Mutation{ID: fmt.Sprintf("m%v", i), Operation: Operation{Kind: ArrayOp, Len: 1, Operations: RandomArrayOperations(original)}})
+    }
+
+    // Execute the four operations in any possible order
+    counter := 0
+    prev := ""
+    for perm := range Permutations(len(all)) {
+      doc := newTestArray(original)
+      var err error
+      var applied []Mutation
+      for i := 0; i < len(perm); i++ {
+        mut := all[perm[i]]
+        // Transform against all applied ops
+        for _, appliedmut := range applied {
+          _, mut, err = Transform(appliedmut, mut)
+          if err != nil {
+            t.Fatal(err.Error())
+          }
+        }
+        applied = append(applied, mut)
+        doc = executeArraySeq(t, doc, []Mutation{mut})
+      }
+      if counter == 0 {
+        prev = doc.String()
+      } else if prev != doc.String() {
+        t.Fatalf("Different docs:\n\tdoc1: %v\n\tdoc2: %v\n", prev, doc.String())
+      }
+      counter++
+    }
+  }
+}
+
+func TestArrayPruningAndComposing(t *testing.T) {
+  // Try many random operations
+  for test := 0; test < 2000; test++ {
+    original := 5
+    all := []Mutation{}
+    // Create concurrent mutations
+    for i := 0; i < 4; i++ {
+      name := fmt.Sprintf("m%v", i)
+      all = append(all, Mutation{DebugName: name, ID: hexHash(name), Operation: Operation{Kind: ArrayOp, Len: 1, Operations: RandomArrayOperations(original)}})
+    }
+
+    // Transform the mutations against each other
+    seq := []Mutation{}
+    for i := 0; i < len(all); i++ {
+      _, x, err := TransformSeq(seq, all[i])
+      if err != nil {
+        t.Fatalf("ERR: %v, i=%v\n", err.Error(), i)
+      }
+      seq = append(seq, x)
+    }
+
+    // Transform the mutations but this time skip mutation k
+    for k := 0; k < len(all); k++ {
+      seq2 := []Mutation{}
+      for i := 0; i < len(all); i++ {
+        if i == k {
+          continue
+        }
+        _, x, err := TransformSeq(seq2, all[i])
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        seq2 = append(seq2, x)
+      }
+
+      // Undo mutation k in seq
+      seq3, err := PruneMutationSeq(seq, map[string]bool{seq[k].ID: true})
+      if err != nil {
+        t.Fatalf("ERR: %v, k=%v", err.Error(), k)
+      }
+
+      // Check that seq2 and seq3 both generate the same document
+      doc2 := executeArraySeq(t, newTestArray(original), seq2)
+      doc3 := executeArraySeq(t, newTestArray(original), seq3)
+      if doc2.String() != doc3.String() {
+        t.Fatalf("Undo delivers different docs:\n\tdoc1: %v\n\tdoc2: %v\n", doc2.String(), doc3.String())
+      }
+
+      comp1, err := ComposeSeq(seq)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      comp2, err := ComposeSeq(seq2)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      comp3, err := ComposeSeq(seq3)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+
+      doc1 := executeArraySeq(t, newTestArray(original), seq)
+      cdoc1 := executeArraySeq(t, newTestArray(original), []Mutation{comp1})
+      cdoc2 := executeArraySeq(t, newTestArray(original), []Mutation{comp2})
+      cdoc3 := executeArraySeq(t, newTestArray(original), []Mutation{comp3})
+      if doc1.String() != cdoc1.String() {
+        t.Fatalf("doc1 != cdoc1:\n\tdoc1: %v\n\tcdoc1: %v\n", doc1.String(), cdoc1.String())
+      }
+      if doc2.String() != cdoc2.String() {
+        t.Fatal("doc2 != cdoc2")
+      }
+      if cdoc2.String() != cdoc3.String() {
+        t.Fatal("cdoc2 != cdoc3")
+      }
+    }
+  }
+}
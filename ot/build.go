@@ -2,6 +2,8 @@ package ot
 
 import (
   lst "container/list"
+  "errors"
+  "fmt"
   "log"
 )
 
@@ -44,6 +46,11 @@ type SimpleBuilder struct {
   // because they depend on mutations which are not yet applied.
   // The value is the number of unsatisfied dependencies.
   pendingMutations map[string]int
+  // The number of mutations which have been compacted or which have been applied before the snapshot
+  // from which the builder has been restored.
+  offset int
+  // The composition of all compacted mutations or nil
+  base *Mutation
 }
 
 func NewSimpleBuilder() *SimpleBuilder {
@@ -110,11 +117,16 @@ func (self *SimpleBuilder) Dequeue(waitFor string) (muts []Mutation) {
 
 // Implements the Builder interface
 func (self *SimpleBuilder) History(reverse bool) <-chan Mutation {
+  // Copy the mutations, because the reader might stop reading and continue applying mutations
+  muts := make([]Mutation, len(self.mutations))
+  for i, id := range self.mutations {
+    muts[i] = self.appliedBlobs[id]
+  }
   ch := make(chan Mutation)
   if reverse {
     f := func() {
-      for i := len(self.mutations) - 1; i >= 0; i-- {
-        ch <- self.appliedBlobs[self.mutations[i]]
+      for i := len(muts) - 1; i >= 0; i-- {
+        ch <- muts[i]
       }
       close(ch)
     }
@@ -122,8 +134,8 @@ func (self *SimpleBuilder) History(reverse bool) <-chan Mutation {
     return ch
   }
   f := func() {
-    for _, id := range self.mutations {
-      ch <- self.appliedBlobs[id]
+    for _, mut := range muts {
+      ch <- mut
     }
     close(ch)
   }
@@ -133,7 +145,7 @@ func (self *SimpleBuilder) History(reverse bool) <-chan Mutation {
 
 // Implements the Builder interface
 func (self *SimpleBuilder) Apply(mut *Mutation) {
-  mut.AppliedAt = len(self.mutations)
+  mut.AppliedAt = self.offset + len(self.mutations)
   self.appliedBlobs[mut.ID] = *mut
   self.mutations = append(self.mutations, mut.ID)
   self.mutationsByID[mut.ID] = true
@@ -182,6 +194,11 @@ func Build(builder Builder, mut Mutation) (applied bool, err error) {
         break
       }
     }
+    // The history has been compacted or restored from a snapshot and 'mut' is concurrent to a mutation
+    // which is no longer part of the history.
+    if !h.Test() {
+      return false, errors.New(fmt.Sprintf("Mutation %v is concurrent to a mutation which has been compacted", mut.ID))
+    }
   }
 
   // Reverse the mutation history, such that oldest are first in the list.
@@ -0,0 +1,433 @@
+package ot
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "math"
+  "sort"
+)
+
+// The binary encoding of a mutation looks like this:
+//
+// magic:byte flags:byte site:string at:uvarint [deps:uvarint dep*] op
+//
+// Strings are encoded as uvarint length followed by the bytes.
+// Dependencies are usually hex-encoded SHA256 hashes. These are stored as 32 raw bytes.
+//
+// An operation starts with a header byte. The lower 4 bits hold the kind of the operation.
+// The upper bits tell whether a length, a value and child operations follow.
+// The length is omitted if it is 1 or, in case of a string insert, the length of the inserted string.
+//
+// op := header:byte [len:uvarint] [value] [count:uvarint op*]
+
+const (
+  binaryMagic = 0xff
+  // Flags stored in the header of a binary mutation
+  binaryNoDependencies = 1
+  binaryJsonID         = 2
+  // Bits in the header of a binary operation
+  binaryHasLen   = 1 << 4
+  binaryHasValue = 1 << 5
+  binaryHasOps   = 1 << 6
+)
+
+// Type tags of values
+const (
+  binaryNil = iota
+  binaryFalse
+  binaryTrue
+  binaryInt
+  binaryFloat
+  binaryString
+  binaryArray
+  binaryMap
+)
+
+// Type tags of dependencies
+const (
+  binaryDepHash   = 0
+  binaryDepString = 1
+)
+
+func isBinaryMutation(blob []byte) bool {
+  return len(blob) > 0 && blob[0] == binaryMagic
+}
+
+// -------------------------------------------
+// Encoding
+
+type binaryEncoder struct {
+  buf []byte
+}
+
+func (self *binaryEncoder) writeUvarint(x uint64) {
+  var b [binary.MaxVarintLen64]byte
+  n := binary.PutUvarint(b[:], x)
+  self.buf = append(self.buf, b[:n]...)
+}
+
+func (self *binaryEncoder) writeString(str string) {
+  self.writeUvarint(uint64(len(str)))
+  self.buf = append(self.buf, str...)
+}
+
+func encodeBinaryMutation(mut Mutation, flags int) (result []byte, id string, err error) {
+  enc := &binaryEncoder{}
+  var mflags byte
+  if (flags & EncExcludeDependencies) != 0 {
+    mflags |= binaryNoDependencies
+  }
+  if (flags & EncJsonID) != 0 {
+    mflags |= binaryJsonID
+  }
+  enc.buf = append(enc.buf, binaryMagic, mflags)
+  enc.writeString(mut.Site)
+  enc.writeUvarint(uint64(mut.AppliedAt))
+  if (flags & EncExcludeDependencies) == 0 {
+    enc.writeUvarint(uint64(len(mut.Dependencies)))
+    for _, dep := range mut.Dependencies {
+      if hash, e := hex.DecodeString(dep); e == nil && len(hash) == sha256.Size && hex.EncodeToString(hash) == dep {
+        enc.buf = append(enc.buf, binaryDepHash)
+        enc.buf = append(enc.buf, hash...)
+      } else {
+        enc.buf = append(enc.buf, binaryDepString)
+        enc.writeString(dep)
+      }
+    }
+  }
+  if err = enc.writeOperation(mut.Operation); err != nil {
+    return
+  }
+  result = enc.buf
+  if (flags & EncJsonID) != 0 {
+    _, id, err = EncodeMutation(mut, flags&EncExcludeDependencies)
+    return
+  }
+  // Compute the hash and encode it as hex
+  h := sha256.New()
+  h.Write(result)
+  id = hex.EncodeToString(h.Sum(nil))
+  return
+}
+
+func (self *binaryEncoder) writeOperation(op Operation) (err error) {
+  if op.Kind < 0 || op.Kind >= 16 {
+    return errors.New("Unknown operation kind")
+  }
+  header := byte(op.Kind)
+  defaultLen := 1
+  if str, ok := op.Value.(string); ok && op.Kind == InsertOp {
+    defaultLen = len(str)
+  }
+  if op.Len != defaultLen {
+    header |= binaryHasLen
+  }
+  if op.Value != nil {
+    header |= binaryHasValue
+  }
+  if len(op.Operations) > 0 {
+    header |= binaryHasOps
+  }
+  self.buf = append(self.buf, header)
+  if (header & binaryHasLen) != 0 {
+    self.writeUvarint(uint64(op.Len))
+  }
+  if (header & binaryHasValue) != 0 {
+    if err = self.writeValue(op.Value); err != nil {
+      return
+    }
+  }
+  if (header & binaryHasOps) != 0 {
+    self.writeUvarint(uint64(len(op.Operations)))
+    for _, o := range op.Operations {
+      if err = self.writeOperation(o); err != nil {
+        return
+      }
+    }
+  }
+  return
+}
+
+func (self *binaryEncoder) writeValue(value interface{}) (err error) {
+  switch v := value.(type) {
+  case nil:
+    self.buf = append(self.buf, binaryNil)
+  case bool:
+    if v {
+      self.buf = append(self.buf, binaryTrue)
+    } else {
+      self.buf = append(self.buf, binaryFalse)
+    }
+  case int:
+    self.buf = append(self.buf, binaryInt)
+    self.writeUvarint(zigzag(int64(v)))
+  case int64:
+    self.buf = append(self.buf, binaryInt)
+    self.writeUvarint(zigzag(v))
+  case float64:
+    self.buf = append(self.buf, binaryFloat)
+    var b [8]byte
+    binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+    self.buf = append(self.buf, b[:]...)
+  case string:
+    self.buf = append(self.buf, binaryString)
+    self.writeString(v)
+  case []interface{}:
+    self.buf = append(self.buf, binaryArray)
+    self.writeUvarint(uint64(len(v)))
+    for _, x := range v {
+      if err = self.writeValue(x); err != nil {
+        return
+      }
+    }
+  case map[string]interface{}:
+    self.buf = append(self.buf, binaryMap)
+    self.writeUvarint(uint64(len(v)))
+    // Sort the keys to make the encoding deterministic
+    keys := make([]string, 0, len(v))
+    for key, _ := range v {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+      self.writeString(key)
+      if err = self.writeValue(v[key]); err != nil {
+        return
+      }
+    }
+  default:
+    err = errors.New("Value cannot be encoded")
+  }
+  return
+}
+
+func zigzag(x int64) uint64 {
+  return uint64((x << 1) ^ (x >> 63))
+}
+
+func unzigzag(x uint64) int64 {
+  return int64(x>>1) ^ -int64(x&1)
+}
+
+// -------------------------------------------
+// Decoding
+
+var errMalformedBinary = errors.New("Binary data is not a valid mutation")
+
+type binaryDecoder struct {
+  buf []byte
+  pos int
+}
+
+func (self *binaryDecoder) readByte() (b byte, err error) {
+  if self.pos >= len(self.buf) {
+    return 0, errMalformedBinary
+  }
+  b = self.buf[self.pos]
+  self.pos++
+  return
+}
+
+func (self *binaryDecoder) readBytes(n int) (b []byte, err error) {
+  if n < 0 || self.pos+n > len(self.buf) {
+    return nil, errMalformedBinary
+  }
+  b = self.buf[self.pos : self.pos+n]
+  self.pos += n
+  return
+}
+
+func (self *binaryDecoder) readUvarint() (x uint64, err error) {
+  x, n := binary.Uvarint(self.buf[self.pos:])
+  if n <= 0 {
+    return 0, errMalformedBinary
+  }
+  self.pos += n
+  return
+}
+
+// Reads a count or a length and checks that it is not larger than the remaining data
+func (self *binaryDecoder) readLen() (l int, err error) {
+  x, err := self.readUvarint()
+  if err != nil {
+    return
+  }
+  if x > uint64(len(self.buf)) {
+    return 0, errMalformedBinary
+  }
+  return int(x), nil
+}
+
+func (self *binaryDecoder) readString() (str string, err error) {
+  l, err := self.readLen()
+  if err != nil {
+    return
+  }
+  b, err := self.readBytes(l)
+  return string(b), err
+}
+
+func decodeBinaryMutation(blob []byte) (result Mutation, err error) {
+  dec := &binaryDecoder{buf: blob, pos: 1}
+  mflags, err := dec.readByte()
+  if err != nil {
+    return
+  }
+  if result.Site, err = dec.readString(); err != nil {
+    return
+  }
+  at, err := dec.readUvarint()
+  if err != nil {
+    return
+  }
+  result.AppliedAt = int(at)
+  if (mflags & binaryNoDependencies) == 0 {
+    var count int
+    if count, err = dec.readLen(); err != nil {
+      return
+    }
+    for i := 0; i < count; i++ {
+      var tag byte
+      if tag, err = dec.readByte(); err != nil {
+        return
+      }
+      switch tag {
+      case binaryDepHash:
+        var hash []byte
+        if hash, err = dec.readBytes(sha256.Size); err != nil {
+          return
+        }
+        result.Dependencies = append(result.Dependencies, hex.EncodeToString(hash))
+      case binaryDepString:
+        var dep string
+        if dep, err = dec.readString(); err != nil {
+          return
+        }
+        result.Dependencies = append(result.Dependencies, dep)
+      default:
+        return result, errMalformedBinary
+      }
+    }
+  }
+  if result.Operation, err = dec.readOperation(); err != nil {
+    return
+  }
+  if dec.pos != len(blob) {
+    return result, errMalformedBinary
+  }
+  if (mflags & binaryJsonID) != 0 {
+    flags := EncNormal
+    if (mflags & binaryNoDependencies) != 0 {
+      flags = EncExcludeDependencies
+    }
+    _, result.ID, err = EncodeMutation(result, flags)
+    return
+  }
+  // Compute the hash and encode it as hex
+  h := sha256.New()
+  h.Write(blob)
+  result.ID = hex.EncodeToString(h.Sum(nil))
+  return
+}
+
+func (self *binaryDecoder) readOperation() (op Operation, err error) {
+  header, err := self.readByte()
+  if err != nil {
+    return
+  }
+  op.Kind = int(header & 0x0f)
+  op.Len = 1
+  if (header & binaryHasLen) != 0 {
+    var l uint64
+    if l, err = self.readUvarint(); err != nil {
+      return
+    }
+    if l > math.MaxInt32 {
+      return op, errMalformedBinary
+    }
+    op.Len = int(l)
+  }
+  if (header & binaryHasValue) != 0 {
+    if op.Value, err = self.readValue(); err != nil {
+      return
+    }
+    if str, ok := op.Value.(string); ok && op.Kind == InsertOp && (header&binaryHasLen) == 0 {
+      op.Len = len(str)
+    }
+  }
+  if (header & binaryHasOps) != 0 {
+    var count int
+    if count, err = self.readLen(); err != nil {
+      return
+    }
+    op.Operations = make([]Operation, count)
+    for i := 0; i < count; i++ {
+      if op.Operations[i], err = self.readOperation(); err != nil {
+        return
+      }
+    }
+  }
+  return
+}
+
+func (self *binaryDecoder) readValue() (value interface{}, err error) {
+  tag, err := self.readByte()
+  if err != nil {
+    return
+  }
+  switch tag {
+  case binaryNil:
+    // Do nothing by intention
+  case binaryFalse:
+    value = false
+  case binaryTrue:
+    value = true
+  case binaryInt:
+    var x uint64
+    if x, err = self.readUvarint(); err != nil {
+      return
+    }
+    value = int(unzigzag(x))
+  case binaryFloat:
+    var b []byte
+    if b, err = self.readBytes(8); err != nil {
+      return
+    }
+    value = math.Float64frombits(binary.LittleEndian.Uint64(b))
+  case binaryString:
+    value, err = self.readString()
+  case binaryArray:
+    var count int
+    if count, err = self.readLen(); err != nil {
+      return
+    }
+    arr := make([]interface{}, count)
+    for i := 0; i < count; i++ {
+      if arr[i], err = self.readValue(); err != nil {
+        return
+      }
+    }
+    value = arr
+  case binaryMap:
+    var count int
+    if count, err = self.readLen(); err != nil {
+      return
+    }
+    m := make(map[string]interface{})
+    for i := 0; i < count; i++ {
+      var key string
+      if key, err = self.readString(); err != nil {
+        return
+      }
+      if m[key], err = self.readValue(); err != nil {
+        return
+      }
+    }
+    value = m
+  default:
+    err = errMalformedBinary
+  }
+  return
+}
@@ -0,0 +1,136 @@
+package ot
+
+import (
+  "bytes"
+  "fmt"
+  "math/rand"
+  "reflect"
+  "testing"
+)
+
+// Generates a random array mutation that uses all kinds of operations the JSON codec can encode
+func randomCodecOperation(n int) Operation {
+  ops := []Operation{}
+  for i := 0; i < n; i++ {
+    r := rand.Float64()
+    if r < 0.1 {
+      ops = append(ops, Operation{Kind: InsertOp, Len: 1, Value: rand.Intn(1000) - 500})
+    } else if r < 0.2 {
+      ops = append(ops, Operation{Kind: InsertOp, Len: 1, Value: map[string]interface{}{"x": rand.Float64(), "y": []interface{}{true, nil, "z"}}})
+    } else if r < 0.3 {
+      ops = append(ops, Operation{Kind: InsertOp, Len: 1, Operations: []Operation{
+        Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(0, []string{"bold"})}}})
+    } else if r < 0.4 {
+      ops = append(ops, Operation{Kind: OverwriteOp, Len: 1, Value: fmt.Sprintf("w%v", i)})
+    } else if r < 0.5 {
+      ops = append(ops, Operation{Kind: IncrementOp, Len: 1, Value: rand.Intn(10) - 5})
+    } else if r < 0.7 {
+      ops = append(ops, Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(len(originalElement), []string{"bold", "link"})})
+    } else if r < 0.8 {
+      ops = append(ops, Operation{Kind: DeleteOp, Len: rand.Intn(3) + 1})
+    } else {
+      ops = append(ops, Operation{Kind: SkipOp, Len: rand.Intn(300) + 1})
+    }
+  }
+  return Operation{Kind: ArrayOp, Len: 1, Operations: ops}
+}
+
+func TestBinaryCodec(t *testing.T) {
+  // Small mutations can be larger in binary. On average, the binary encoding must be smaller
+  binarySize, jsonSize := 0, 0
+  for test := 0; test < 1000; test++ {
+    mut := Mutation{Site: fmt.Sprintf("site%v", rand.Intn(10)), Dependencies: []string{}, AppliedAt: rand.Intn(3), Operation: randomCodecOperation(rand.Intn(8))}
+    for i := 0; i < rand.Intn(3); i++ {
+      mut.Dependencies = append(mut.Dependencies, hexHash(fmt.Sprintf("d%v", i)))
+    }
+    if rand.Float64() < 0.2 {
+      mut.Dependencies = append(mut.Dependencies, "not-a-hash")
+    }
+    // Normalize the mutation by passing it through the JSON codec once
+    j, _, err := EncodeMutation(mut, EncNormal)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    mj, err := DecodeMutation(j)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+
+    for _, flags := range []int{EncNormal, EncExcludeDependencies} {
+      j2, jid, err := EncodeMutation(mj, flags)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      b, bid, err := EncodeMutation(mj, flags|EncBinary)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      if bid == jid {
+        t.Fatal("Binary and JSON encoding must not share an ID unless EncJsonID is set")
+      }
+      binarySize += len(b)
+      jsonSize += len(j2)
+      mb, err := DecodeMutation(b)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      if mb.ID != bid {
+        t.Fatalf("Decoding yields a different ID: %v != %v", mb.ID, bid)
+      }
+      if !reflect.DeepEqual(mb.Operation, mj.Operation) || mb.Site != mj.Site || mb.AppliedAt != mj.AppliedAt {
+        t.Fatalf("Binary codec changed the mutation content:\n%v\n%v\n", mj.Operation, mb.Operation)
+      }
+      if flags == EncNormal && !reflect.DeepEqual(mb.Dependencies, mj.Dependencies) {
+        t.Fatalf("Binary codec changed the dependencies:\n%v\n%v\n", mj.Dependencies, mb.Dependencies)
+      }
+      // The JSON encoding of the binary-decoded mutation must be identical
+      j3, _, err := EncodeMutation(mb, flags)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      if !bytes.Equal(j2, j3) {
+        t.Fatalf("Binary round trip changed the JSON encoding:\n%v\n%v\n", string(j2), string(j3))
+      }
+
+      // With EncJsonID the IDs of both encodings are the same
+      b, bid, err = EncodeMutation(mj, flags|EncBinary|EncJsonID)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      if bid != jid {
+        t.Fatalf("IDs differ: %v != %v", bid, jid)
+      }
+      mb, err = DecodeMutation(b)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      if mb.ID != jid {
+        t.Fatalf("Decoded ID differs: %v != %v", mb.ID, jid)
+      }
+    }
+  }
+  if binarySize > jsonSize {
+    t.Fatalf("Binary encoding is larger than JSON: %v > %v", binarySize, jsonSize)
+  }
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+  mut := Mutation{Site: "xxx", Dependencies: []string{hexHash("a")}, Operation: randomCodecOperation(5)}
+  j, _, err := EncodeMutation(mut, EncNormal)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if mut, err = DecodeMutation(j); err != nil {
+    t.Fatal(err.Error())
+  }
+  b, _, err := EncodeMutation(mut, EncBinary)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  // Every truncation of the blob must be rejected
+  for i := 1; i < len(b); i++ {
+    if _, err := DecodeMutation(b[:i]); err == nil {
+      t.Fatalf("Truncated blob of length %v has been accepted", i)
+    }
+  }
+}
@@ -13,8 +13,15 @@ import (
 // {"site":"xxx", dep:["xxx","yyy"], "op":{"myattr":{"v":0, "s":{"$t":[ {"$i":"Hello World"}, {"$s":5}, {"$d":3} ] } } } }
 // {"site":"xxx", dep:["xxx","yyy"], "op":{"myattr":{"v":1, "v":"Some constant"} } }
 // {"site":"xxx", dep:["xxx","yyy"], "op":{"myattr":{"d":1} } }
+// {"site":"xxx", dep:["xxx","yyy"], "op":{"$t":[ {"$i":"Hello", "$m":{"bold":true}}, {"$f":5, "$m":{"bold":null}} ] } }
+// {"site":"xxx", dep:["xxx","yyy"], "op":{"$a":[ {"$s":2}, {"$w":42}, {"$c":-1}, {"$i":{"$t":["Hello"]}} ] } }
 
+// Decodes a mutation which has been encoded with EncodeMutation.
+// The encoding (JSON or binary) is detected automatically.
 func DecodeMutation(blob []byte) (result Mutation, err error) {
+  if isBinaryMutation(blob) {
+    return decodeBinaryMutation(blob)
+  }
   // Decode JSON
   j := make(map[string]interface{})
   if err = json.Unmarshal(blob, &j); err != nil {
@@ -130,7 +137,90 @@ func decodeOperation(operation interface{}) (result Operation, err error) {
     }
     return
   }
-  // TODO: Array
+  // ArrayOp ?
+  a, ok := op["$a"]
+  if ok {
+    arr, ok := a.([]interface{})
+    if !ok {
+      err = errors.New("Malformed mutation")
+      return
+    }
+    result.Kind = ArrayOp
+    result.Len = 1
+    for _, x := range arr {
+      var o Operation
+      o, err = decodeOperation(x)
+      if err != nil {
+        return
+      }
+      result.Operations = append(result.Operations, o)
+    }
+    return
+  }
+  // FormatOp ?
+  f, ok := op["$f"]
+  if ok {
+    format, ok := f.(float64)
+    attrs, ok2 := op["$m"].(map[string]interface{})
+    if !ok || !ok2 {
+      err = errors.New("Malformed mutation")
+      return
+    }
+    result.Kind = FormatOp
+    result.Len = int(format)
+    result.Value = attrs
+    return
+  }
+  // Insert formatted characters in a string ?
+  i, ok := op["$i"]
+  if str, isstr := i.(string); ok && isstr {
+    attrs, ok := op["$m"].(map[string]interface{})
+    if !ok {
+      err = errors.New("Malformed mutation: $i requires formatting attributes in $m")
+      return
+    }
+    result.Kind = InsertOp
+    result.Len = len(str)
+    result.Value = str
+    result.Operations = []Operation{Operation{Kind: FormatOp, Value: attrs}}
+    return
+  }
+  // Insert a mutable object in an array ?
+  if ok {
+    var o Operation
+    o, err = decodeOperation(i)
+    if err != nil {
+      return
+    }
+    if o.Kind != StringOp && o.Kind != ArrayOp && o.Kind != ObjectOp {
+      err = errors.New("Malformed mutation: $i requires a StringOp, ArrayOp or ObjectOp")
+      return
+    }
+    result.Kind = InsertOp
+    result.Len = 1
+    result.Operations = []Operation{o}
+    return
+  }
+  // OverwriteOp ?
+  w, ok := op["$w"]
+  if ok {
+    result.Kind = OverwriteOp
+    result.Len = 1
+    result.Value = w
+    return
+  }
+  // IncrementOp ?
+  c, ok := op["$c"]
+  if ok {
+    if _, ok := c.(float64); !ok {
+      err = errors.New("Malformed mutation: $c requires a number")
+      return
+    }
+    result.Kind = IncrementOp
+    result.Len = 1
+    result.Value = c
+    return
+  }
   // TODO ObjectOp ?
   result.Kind = InsertOp
   result.Len = 1
@@ -139,11 +229,21 @@ func decodeOperation(operation interface{}) (result Operation, err error) {
 }
 
 const (
-  EncNormal = iota
-  EncExcludeDependencies
+  EncNormal              = 0
+  EncExcludeDependencies = 1
+  // Use the compact binary encoding instead of JSON
+  EncBinary = 2
+  // Only in combination with EncBinary: The ID is computed from the JSON encoding of the mutation.
+  // Thus, the ID does not depend on whether a mutation has been transmitted as JSON or binary.
+  EncJsonID = 4
 )
 
+// Encodes a mutation as JSON or, if the EncBinary flag is set, in a compact binary format.
+// The returned ID is the hex-encoded SHA256 hash of the result (or of the JSON encoding if EncJsonID is set).
 func EncodeMutation(mut Mutation, flags int) (result []byte, id string, err error) {
+  if (flags & EncBinary) != 0 {
+    return encodeBinaryMutation(mut, flags)
+  }
   var op interface{}
   op, err = encodeOperation(mut.Operation)
   if err != nil {
@@ -167,7 +267,26 @@ func EncodeMutation(mut Mutation, flags int) (result []byte, id string, err erro
 func encodeOperation(op Operation) (result interface{}, err error) {
   switch op.Kind {
   case InsertOp:
-    result = op.Value
+    if attrs := formatAttributes(op); attrs != nil {
+      result = map[string]interface{}{"$i": op.Value, "$m": attrs}
+    } else if len(op.Operations) == 1 {
+      var x interface{}
+      x, err = encodeOperation(op.Operations[0])
+      if err != nil {
+        return
+      }
+      result = map[string]interface{}{"$i": x}
+    } else if isArrayTomb(op) {
+      err = errors.New("Tombs cannot be encoded")
+    } else {
+      result = op.Value
+    }
+  case OverwriteOp:
+    result = map[string]interface{}{"$w": op.Value}
+  case IncrementOp:
+    result = map[string]interface{}{"$c": op.Value}
+  case FormatOp:
+    result = map[string]interface{}{"$f": op.Len, "$m": op.Value}
   case DeleteOp:
     result = map[string]interface{}{"$d": op.Len}
   case SkipOp:
@@ -188,7 +307,16 @@ func encodeOperation(op Operation) (result interface{}, err error) {
   case AttributeOp:
     // TOOD
   case ArrayOp:
-    // TODO
+    arr := []interface{}{}
+    for _, o := range op.Operations {
+      var x interface{}
+      x, err = encodeOperation(o)
+      if err != nil {
+        return
+      }
+      arr = append(arr, x)
+    }
+    result = map[string]interface{}{"$a": arr}
   default:
     return nil, errors.New("Unknown operation kind")
   }
@@ -75,6 +75,9 @@ func TestJsonCodec2(t *testing.T) {
 }
 
 func compareJson(val1, val2 interface{}) bool {
+  if val1 == nil {
+    return val2 == nil
+  }
   if obj1, ok := val1.(map[string]interface{}); ok {
     obj2, ok := val2.(map[string]interface{})
     if !ok {
@@ -159,3 +162,85 @@ func compareJsonObject(obj1, obj2 map[string]interface{}) bool {
   }
   return true
 }
+
+func TestJsonCodecArray(t *testing.T) {
+  m1 := []byte(`{"site":"xxx", "dep":["abc"], "op":{"$a":[ "Hello", 42, {"$s":5}, {"$d":3}, {"$w":true}, {"$t":[ "Hi", {"$s":2} ]}, {"$i":{"$t":[ "World" ]}}, {"$c":2} ] } }`)
+  mut, err := DecodeMutation(m1)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+  if mut.Operation.Kind != ArrayOp || len(mut.Operation.Operations) != 8 {
+    t.Fatal("Decoding failed")
+  }
+  if op := mut.Operation.Operations[4]; op.Kind != OverwriteOp || op.Value != true {
+    t.Fatal("Decoding of OverwriteOp failed")
+  }
+  if op := mut.Operation.Operations[6]; op.Kind != InsertOp || len(op.Operations) != 1 || op.Operations[0].Kind != StringOp {
+    t.Fatal("Decoding of a mutable insert failed")
+  }
+  m1b, _, err := EncodeMutation(mut, EncNormal)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+
+  d1 := make(map[string]interface{})
+  d2 := make(map[string]interface{})
+  err = json.Unmarshal(m1, &d1)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+  err = json.Unmarshal(m1b, &d2)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+
+  if !compareJson(d1, d2) {
+    t.Fatalf("Decoding and Encoding changed the mutation content:\n%v\n%v\n", string(m1), string(m1b))
+    return
+  }
+}
+
+func TestJsonCodecFormat(t *testing.T) {
+  m1 := []byte(`{"site":"xxx", "dep":["abc"], "op":{"$t":[ {"$i":"Hello", "$m":{"bold":true}}, {"$s":2}, {"$f":5, "$m":{"bold":null, "color":"red"}}, {"$d":3} ] } }`)
+  mut, err := DecodeMutation(m1)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+  if mut.Operation.Kind != StringOp || len(mut.Operation.Operations) != 4 {
+    t.Fatal("Decoding failed")
+  }
+  if op := mut.Operation.Operations[0]; op.Kind != InsertOp || op.Value != "Hello" || len(op.Operations) != 1 || op.Operations[0].Kind != FormatOp {
+    t.Fatal("Decoding of a formatted insert failed")
+  }
+  if op := mut.Operation.Operations[2]; op.Kind != FormatOp || op.Len != 5 {
+    t.Fatal("Decoding of FormatOp failed")
+  }
+  m1b, _, err := EncodeMutation(mut, EncNormal)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+
+  d1 := make(map[string]interface{})
+  d2 := make(map[string]interface{})
+  err = json.Unmarshal(m1, &d1)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+  err = json.Unmarshal(m1b, &d2)
+  if err != nil {
+    t.Fatal(err.Error())
+    return
+  }
+
+  if !compareJson(d1, d2) {
+    t.Fatalf("Decoding and Encoding changed the mutation content:\n%v\n%v\n", string(m1), string(m1b))
+    return
+  }
+}
@@ -65,16 +65,29 @@ func Compose(first Mutation, second Mutation) (result Mutation, err error) {
 }
 
 func composeOp(first Operation, second Operation) (result Operation, err error) {
+  // An OverwriteOp replaces whatever the first operation did
+  if second.Kind == OverwriteOp || isOverwritten(first) {
+    return second, nil
+  }
+  if isOverwritten(second) {
+    return first, nil
+  }
+  if second.Kind == IncrementOp && (first.Kind == OverwriteOp || first.Kind == IncrementOp) {
+    result = first
+    result.Value, err = addNumbers(first.Value, second.Value)
+    return
+  }
   if first.Kind != second.Kind {
     err = errors.New("Operations of both streams operate on a different data type or they are not allowed in this place")
     return
   }
   result.Kind = first.Kind
+  result.Len = first.Len
   switch first.Kind {
   case StringOp:
     result.Operations, err = composeOps(first.Operations, second.Operations, composeStringOp)
   case ArrayOp:
-    // TODO
+    result.Operations, err = composeOps(first.Operations, second.Operations, composeArrayOp)
   case ObjectOp:
     result.Operations, err = composeObject(first.Operations, second.Operations)
   case NoOp:
@@ -109,28 +122,101 @@ func composeOps(first []Operation, second []Operation, f composeFunc) (result []
 }
 
 func composeStringOp(first Operation, second Operation) (result Operation, err error) {
-  if first.Kind != InsertOp && first.Kind != SkipOp && first.Kind != DeleteOp && first.Kind != NoOp {
+  if first.Kind != InsertOp && first.Kind != SkipOp && first.Kind != DeleteOp && first.Kind != FormatOp && first.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: first:%v", first.Kind))
     return
   }
-  if second.Kind != InsertOp && second.Kind != SkipOp && second.Kind != DeleteOp && second.Kind != NoOp {
+  if second.Kind != InsertOp && second.Kind != SkipOp && second.Kind != DeleteOp && second.Kind != FormatOp && second.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: second:%v", second.Kind))
     return
   }
   if first.Kind == InsertOp {
     if second.Kind == DeleteOp {
       result = Operation{Kind: InsertOp, Len: first.Len} // Insert a tomb in the composed op
+    } else if second.Kind == FormatOp {
+      result = first
+      if str, ok := first.Value.(string); ok && len(str) > 0 { // Insert formatted characters
+        attrs := mergeAttributes(formatAttributes(first), formatAttributes(second), false)
+        result.Operations = nil
+        if attrs != nil {
+          result.Operations = []Operation{Operation{Kind: FormatOp, Value: attrs}}
+        }
+      }
     } else {
       result = first
     }
   } else if first.Kind == DeleteOp {
     result = Operation{Kind: DeleteOp, Len: first.Len}
+  } else if first.Kind == FormatOp {
+    if second.Kind == DeleteOp {
+      result = second
+    } else if second.Kind == FormatOp {
+      result = Operation{Kind: FormatOp, Len: first.Len, Value: mergeAttributes(formatAttributes(first), formatAttributes(second), true)}
+    } else {
+      result = first
+    }
   } else {
     result = second
   }
   return
 }
 
+func composeArrayOp(first Operation, second Operation) (result Operation, err error) {
+  if first.Kind != InsertOp && first.Kind != SkipOp && first.Kind != DeleteOp && first.Kind != StringOp && first.Kind != ObjectOp && first.Kind != ArrayOp && first.Kind != OverwriteOp && first.Kind != IncrementOp && first.Kind != NoOp {
+    err = errors.New(fmt.Sprintf("Operation not allowed in an array: first:%v", first.Kind))
+    return
+  }
+  if second.Kind != InsertOp && second.Kind != SkipOp && second.Kind != DeleteOp && second.Kind != StringOp && second.Kind != ObjectOp && second.Kind != ArrayOp && second.Kind != OverwriteOp && second.Kind != IncrementOp && second.Kind != NoOp {
+    err = errors.New(fmt.Sprintf("Operation not allowed in an array: second:%v", second.Kind))
+    return
+  }
+  if second.Kind == InsertOp { // The first op is for sure NoOp
+    result = second
+  } else if first.Kind == InsertOp {
+    if second.Kind == DeleteOp {
+      result = Operation{Kind: InsertOp, Len: first.Len} // Insert a tomb in the composed op
+    } else if second.Kind == SkipOp || isArrayTomb(first) {
+      result = first
+    } else {
+      result, err = composeInsertOp(first, second)
+    }
+  } else if first.Kind == DeleteOp {
+    result = Operation{Kind: DeleteOp, Len: first.Len}
+  } else if second.Kind == SkipOp {
+    result = first
+  } else if first.Kind == SkipOp || second.Kind == DeleteOp {
+    result = second
+  } else {
+    result, err = composeOp(first, second)
+  }
+  return
+}
+
+// Compose an InsertOp with an operation that mutates or overwrites the inserted value.
+func composeInsertOp(first Operation, second Operation) (result Operation, err error) {
+  result = first
+  if second.Kind == OverwriteOp { // Insert the new value right away
+    result.Value = second.Value
+    result.Operations = nil
+    return
+  }
+  if second.Kind == IncrementOp { // Insert the incremented number right away
+    if len(first.Operations) != 0 {
+      err = errors.New("IncrementOp cannot be applied to a StringOp, ObjectOp or ArrayOp")
+      return
+    }
+    result.Value, err = addNumbers(first.Value, second.Value)
+    return
+  }
+  if len(first.Operations) != 1 {
+    err = errors.New("Insert operation must have one child operation when composed with StringOp, ObjectOp or ArrayOp")
+    return
+  }
+  result.Operations = make([]Operation, 1)
+  result.Operations[0], err = composeOp(first.Operations[0], second)
+  return
+}
+
 func composeObject(first []Operation, second []Operation) (result []Operation, err error) {
   attr_first := make(map[string]int)
   attr_second := make(map[string]int)
@@ -174,23 +260,19 @@ func composeObject(first []Operation, second []Operation) (result []Operation, e
 }
 
 func composeAttrOp(first Operation, second Operation) (result Operation, err error) {
-  if first.Kind != InsertOp && first.Kind != SkipOp && first.Kind != StringOp && first.Kind != ObjectOp && first.Kind != ArrayOp && first.Kind != NoOp {
+  if first.Kind != InsertOp && first.Kind != SkipOp && first.Kind != StringOp && first.Kind != ObjectOp && first.Kind != ArrayOp && first.Kind != OverwriteOp && first.Kind != IncrementOp && first.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: first:%v", first.Kind))
     return
   }
-  if second.Kind != InsertOp && second.Kind != SkipOp && second.Kind != StringOp && second.Kind != ObjectOp && second.Kind != ArrayOp && second.Kind != NoOp {
+  if second.Kind != InsertOp && second.Kind != SkipOp && second.Kind != StringOp && second.Kind != ObjectOp && second.Kind != ArrayOp && second.Kind != OverwriteOp && second.Kind != IncrementOp && second.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: second:%v", second.Kind))
     return
   }
   if second.Kind == InsertOp { // The first op is for sure NoOp
     result = second
   } else if first.Kind == InsertOp {
-    if second.Kind == StringOp || second.Kind == ObjectOp || second.Kind == ArrayOp {
-      if len(first.Operations) != 1 {
-        err = errors.New("Insert operation must have one child operation when composed with StringOp, ObjectOp or ArrayOp")
-      }
-      result = first
-      result.Operations[0], err = composeOp(first.Operations[0], second)
+    if second.Kind == StringOp || second.Kind == ObjectOp || second.Kind == ArrayOp || second.Kind == OverwriteOp || second.Kind == IncrementOp {
+      result, err = composeInsertOp(first, second)
     } else { // The second opeation is for sure SkipOp
       result = first
     }
@@ -0,0 +1,103 @@
+package ot
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+)
+
+func counterMutation(name string, delta int) Mutation {
+  return Mutation{DebugName: name, ID: hexHash(name), Site: name, Operation: Operation{Kind: ObjectOp, Len: 1, Operations: []Operation{
+    Operation{Kind: AttributeOp, Value: "votes", Operations: []Operation{
+      Operation{Kind: IncrementOp, Len: 1, Value: delta}}}}}}
+}
+
+func newCounterObject() *SimpleObject {
+  o := NewSimpleObject()
+  o.Set("votes", 0, 10)
+  return o
+}
+
+func executeObjectSeq(t *testing.T, obj *SimpleObject, muts []Mutation) *SimpleObject {
+  for _, mut := range muts {
+    if _, err := Execute(obj, mut); err != nil {
+      t.Fatal(err.Error())
+    }
+  }
+  return obj
+}
+
+func TestCounter(t *testing.T) {
+  for test := 0; test < 100; test++ {
+    all := []Mutation{}
+    sum := 10
+    for i := 0; i < 4; i++ {
+      delta := rand.Intn(11) - 5
+      sum += delta
+      all = append(all, counterMutation(fmt.Sprintf("m%v", i), delta))
+    }
+
+    // Execute the four operations in any possible order
+    for perm := range Permutations(len(all)) {
+      obj := newCounterObject()
+      var applied []Mutation
+      for i := 0; i < len(perm); i++ {
+        mut := all[perm[i]]
+        _, mut, err := TransformSeq(applied, mut)
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        applied = append(applied, mut)
+        executeObjectSeq(t, obj, []Mutation{mut})
+      }
+      if _, val := obj.Get("votes"); val != sum {
+        t.Fatalf("Wrong counter value: %v, expected %v", val, sum)
+      }
+
+      // Composing yields the same result
+      comp, err := ComposeSeq(applied)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      if _, val := executeObjectSeq(t, newCounterObject(), []Mutation{comp}).Get("votes"); val != sum {
+        t.Fatalf("Wrong counter value after composition: %v, expected %v", val, sum)
+      }
+
+      // Pruning a mutation removes its delta
+      pruned := applied[test%len(applied)]
+      seq, err := PruneMutationSeq(applied, map[string]bool{pruned.ID: true})
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      expected := sum - pruned.Operation.Operations[0].Operations[0].Value.(int)
+      if _, val := executeObjectSeq(t, newCounterObject(), seq).Get("votes"); val != expected {
+        t.Fatalf("Wrong counter value after pruning: %v, expected %v", val, expected)
+      }
+    }
+  }
+}
+
+func TestCounterOverwrite(t *testing.T) {
+  m1 := counterMutation("a", 5)
+  m2 := Mutation{ID: "m2", Site: "b", Operation: Operation{Kind: ObjectOp, Len: 1, Operations: []Operation{
+    Operation{Kind: AttributeOp, Value: "votes", Operations: []Operation{
+      Operation{Kind: OverwriteOp, Len: 1, Value: 0}}}}}}
+  tm1, tm2, err := Transform(m1, m2)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if _, val := executeObjectSeq(t, newCounterObject(), []Mutation{m1, tm2}).Get("votes"); val != 0 {
+    t.Fatalf("Wrong counter value: %v", val)
+  }
+  if _, val := executeObjectSeq(t, newCounterObject(), []Mutation{m2, tm1}).Get("votes"); val != 0 {
+    t.Fatalf("Wrong counter value: %v", val)
+  }
+  // Incrementing after an overwrite composes into a single overwrite
+  c, err := Compose(m2, counterMutation("c", 3))
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if _, val := executeObjectSeq(t, newCounterObject(), []Mutation{c}).Get("votes"); val != 3 {
+    t.Fatalf("Wrong counter value after composition: %v", val)
+  }
+}
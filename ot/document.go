@@ -3,6 +3,7 @@ package ot
 import (
   "errors"
   "fmt"
+  "reflect"
 )
 
 // Every data structure that can be mutated by string operations must implement
@@ -22,6 +23,16 @@ type Text interface {
   End()
 }
 
+// A Text that supports formatting (e.g. bold, italic or links) implements this interface as well.
+// If a Text does not implement this interface, then FormatOps are treated as SkipOps and inserted
+// characters are not formatted.
+// An attribute with a nil value removes the attribute from the formatted characters.
+type FormattedText interface {
+  Text
+  InsertFormattedChars(str string, attributes map[string]interface{})
+  Format(count int, attributes map[string]interface{}) (err error)
+}
+
 type Object interface {
   Begin()
   Get(key string) (version int, value interface{})
@@ -29,12 +40,23 @@ type Object interface {
   End()
 }
 
+// Every data structure that can be mutated by array operations must implement
+// this interface. It works like the Text interface, except that each element is
+// an arbitrary value instead of a character.
+// Get and Set access the element at the current position. They are used
+// to execute StringOp, ArrayOp and ObjectOp on a single element.
+// Get returns ok == false if the element at the current position is a tomb.
+//
+// For many purposes it is sufficient to use the SimpleArray struct which
+// implements the Array interface.
 type Array interface {
   Begin()
   Insert(data interface{})
   InsertTombs(count int)
   Delete(count int) (err error)
   Skip(count int) (err error)
+  Get() (value interface{}, ok bool, err error)
+  Set(value interface{})
   End()
 }
 
@@ -186,6 +208,25 @@ func (self *TombStream) Skip(n int) (chars int, err error) {
   return
 }
 
+// Tells whether the next element in the stream is a character (true) or a tomb (false).
+// The stream position does not move forward.
+func (self *TombStream) IsChar() (char bool, err error) {
+  for self.pos < self.seq.Len() {
+    x := self.seq.At(self.pos)
+    x2 := x
+    if x < 0 {
+      x2 = -x
+    }
+    if self.inside < x2 {
+      return x >= 0, nil
+    }
+    self.pos++
+    self.inside = 0
+  }
+  err = errors.New("TombStream reached EOF")
+  return
+}
+
 func (self *TombStream) SkipChars(n int) (skipped int, err error) {
   for n > 0 {
     if self.pos >= self.seq.Len() {
@@ -234,8 +275,12 @@ func Execute(input interface{}, mut Mutation) (output interface{}, err error) {
 
 func ExecuteOperation(input interface{}, op Operation) (output interface{}, err error) {
   switch op.Kind {
-  case NoOp:
+  case NoOp, SkipOp:
     return input, nil
+  case OverwriteOp:
+    return op.Value, nil
+  case IncrementOp:
+    return addNumbers(input, op.Value)
   case StringOp:
     if input == nil {
       input = NewSimpleText("")
@@ -248,7 +293,16 @@ func ExecuteOperation(input interface{}, op Operation) (output interface{}, err
     err = executeString(text, op.Operations)
     output = text
   case ArrayOp:
-    // TODO
+    if input == nil {
+      input = NewSimpleArray()
+    }
+    arr, ok := input.(Array)
+    if !ok {
+      err = errors.New("Type mismatch: Not an array")
+      return
+    }
+    err = executeArray(arr, op.Operations)
+    output = arr
   case ObjectOp:
     obj, ok := input.(Object)
     if !ok {
@@ -267,14 +321,26 @@ func ExecuteOperation(input interface{}, op Operation) (output interface{}, err
 func executeString(text Text, ops []Operation) (err error) {
   text.Begin()
   defer text.End()
+  ftext, formatted := text.(FormattedText)
   for _, op := range ops {
     switch op.Kind {
     case InsertOp:
-      str := op.Value.(string)
-      if len(str) > 0 {
+      str, _ := op.Value.(string)
+      if len(str) == 0 {
+        text.InsertTombs(op.Len)
+      } else if attrs := formatAttributes(op); formatted && attrs != nil {
+        ftext.InsertFormattedChars(str, attrs)
+      } else {
         text.InsertChars(str)
+      }
+    case FormatOp:
+      if formatted {
+        err = ftext.Format(op.Len, formatAttributes(op))
       } else {
-        text.InsertTombs(op.Len)
+        err = text.Skip(op.Len)
+      }
+      if err != nil {
+        return
       }
     case SkipOp:
       e := text.Skip(op.Len)
@@ -295,6 +361,117 @@ func executeString(text Text, ops []Operation) (err error) {
   return
 }
 
+func executeArray(arr Array, ops []Operation) (err error) {
+  arr.Begin()
+  defer arr.End()
+  for _, op := range ops {
+    switch op.Kind {
+    case InsertOp:
+      if isArrayTomb(op) {
+        arr.InsertTombs(op.Len)
+      } else {
+        var val interface{}
+        val, err = insertValue(op)
+        if err != nil {
+          return
+        }
+        arr.Insert(val)
+      }
+    case SkipOp:
+      err = arr.Skip(op.Len)
+      if err != nil {
+        return
+      }
+    case DeleteOp:
+      err = arr.Delete(op.Len)
+      if err != nil {
+        return
+      }
+    case StringOp, ObjectOp, ArrayOp, OverwriteOp, IncrementOp:
+      val, ok, e := arr.Get()
+      if e != nil {
+        return e
+      }
+      // Mutations of elements that have been deleted have no effect
+      if ok {
+        val, err = ExecuteOperation(val, op)
+        if err != nil {
+          return
+        }
+        arr.Set(val)
+      }
+      err = arr.Skip(1)
+      if err != nil {
+        return
+      }
+    case NoOp:
+      // Do nothing by intention
+    default:
+      err = errors.New(fmt.Sprintf("Operation not allowed in an array: %v", op.Kind))
+      return
+    }
+  }
+  return
+}
+
+// Adds two numbers. If both numbers are integers, the result is an integer.
+// Otherwise the result is a float64 (which is what the JSON decoder delivers).
+func addNumbers(a interface{}, b interface{}) (result interface{}, err error) {
+  ia, aIsInt := a.(int)
+  ib, bIsInt := b.(int)
+  if aIsInt && bIsInt {
+    return ia + ib, nil
+  }
+  var fa, fb float64
+  if fa, err = toFloat(a); err != nil {
+    return
+  }
+  if fb, err = toFloat(b); err != nil {
+    return
+  }
+  return fa + fb, nil
+}
+
+func toFloat(value interface{}) (f float64, err error) {
+  switch v := value.(type) {
+  case int:
+    f = float64(v)
+  case int64:
+    f = float64(v)
+  case float64:
+    f = v
+  case nil:
+    // A missing value counts as zero
+  default:
+    err = errors.New(fmt.Sprintf("Type mismatch: Not a number: %v", value))
+  }
+  return
+}
+
+// Computes the value inserted by an InsertOp in an array or object.
+// If the InsertOp has a child operation, it inserts a mutable object.
+// Otherwise it inserts a simple constant (Everything JSON supports).
+func insertValue(op Operation) (val interface{}, err error) {
+  if len(op.Operations) > 1 {
+    err = errors.New("InsertOp must have at most one child operation")
+    return
+  } else if len(op.Operations) == 0 {
+    return op.Value, nil
+  }
+  child := op.Operations[0]
+  switch child.Kind {
+  case StringOp:
+    val, err = ExecuteOperation(NewSimpleText(""), child)
+  case ObjectOp:
+    val, err = ExecuteOperation(NewSimpleObject(), child)
+  case ArrayOp:
+    val, err = ExecuteOperation(NewSimpleArray(), child)
+  default:
+    err = errors.New("InsertOp can only insert a StringOp, ObjectOp or ArrayOp")
+  }
+  return
+}
+
 func executeObject(obj Object, ops []Operation) (err error) {
   obj.Begin()
   defer obj.End()
@@ -319,7 +496,7 @@ func executeObject(obj Object, ops []Operation) (err error) {
         pos++
       case SkipOp:
         pos += op.Len
-      case StringOp, ObjectOp, ArrayOp:
+      case StringOp, ObjectOp, ArrayOp, OverwriteOp, IncrementOp:
         if pos == version {
           exec_op = op
         }
@@ -330,27 +507,12 @@ func executeObject(obj Object, ops []Operation) (err error) {
     }
     switch exec_op.Kind {
     case InsertOp:
-      if len(exec_op.Operations) > 1 {
-        err = errors.New("InsertOp must have at most one child operation")
+      val, err = insertValue(exec_op)
+      if err != nil {
         return
-      } else if len(exec_op.Operations) == 1 { // Insert a mutable object?
-        op := exec_op.Operations[0]
-        switch op.Kind {
-        case StringOp:
-          val, err = ExecuteOperation(NewSimpleText(""), op)
-        case ObjectOp:
-          val, err = ExecuteOperation(NewSimpleObject(), op)
-        case ArrayOp:
-          // TODO
-        }
-        if err != nil {
-          return
-        }
-      } else { // Insert a simple constant (Everything JSON supports)
-        val = exec_op.Value
       }
       version = pos - 1
-    case StringOp, ObjectOp, ArrayOp:
+    case StringOp, ObjectOp, ArrayOp, OverwriteOp, IncrementOp:
       val, err = ExecuteOperation(val, exec_op)
       if err != nil {
         return
@@ -399,19 +561,27 @@ func (self *TextRange) Delete(pos int, length int) {
 // --------------------------------------------
 // SimpleText
 
-// Plain text that can be edited concurrently.
-// Implements the Text interface.
+// Text that can be edited and formatted concurrently.
+// Implements the Text and FormattedText interfaces.
 type SimpleText struct {
   Text string // The string without any tombs
   // A positive number represents a sequence of visible characters.
   // A negative number represents a sequence of tombs.
-  tombs      IntVector
+  tombs IntVector
+  // The formatting attributes of each visible character or nil.
+  attributes []map[string]interface{}
   tombStream *TombStream // Used during a mutation
   pos        int         // Used during a mutation
 }
 
+// A sequence of characters which share the same formatting attributes
+type TextRun struct {
+  Text       string
+  Attributes map[string]interface{}
+}
+
 func NewSimpleText(text string) *SimpleText {
-  s := &SimpleText{Text: text}
+  s := &SimpleText{Text: text, attributes: make([]map[string]interface{}, len(text))}
   s.tombs.Push(len(text))
   return s
 }
@@ -421,7 +591,57 @@ func (self *SimpleText) String() string {
 }
 
 func (self *SimpleText) Clone() SimpleText {
-  return SimpleText{Text: self.Text, tombs: self.tombs.Copy()}
+  attributes := make([]map[string]interface{}, len(self.attributes))
+  copy(attributes, self.attributes)
+  return SimpleText{Text: self.Text, tombs: self.tombs.Copy(), attributes: attributes}
+}
+
+// Returns the formatting attributes of the character at position pos (not counting tombs)
+func (self *SimpleText) AttributesAt(pos int) map[string]interface{} {
+  return self.attributes[pos]
+}
+
+// Splits the text into runs of characters which share the same formatting attributes
+func (self *SimpleText) Runs() (runs []TextRun) {
+  start := 0
+  for i := 1; i <= len(self.Text); i++ {
+    if i < len(self.Text) && equalAttributes(self.attributes[start], self.attributes[i]) {
+      continue
+    }
+    runs = append(runs, TextRun{Text: self.Text[start:i], Attributes: self.attributes[start]})
+    start = i
+  }
+  return
+}
+
+// Computes a StringOp that applies the formatting attributes to all characters inside the range.
+// An attribute with a nil value removes the attribute.
+func (self *SimpleText) FormatRange(r TextRange, attributes map[string]interface{}) (op Operation, err error) {
+  start, end := r.Anchor.TextPos, r.Current.TextPos
+  if start > end {
+    start, end = end, start
+  }
+  // Translate the positions into positions that count tombs as well
+  ts := NewTombStream(&self.tombs)
+  var skip, format int
+  if skip, err = ts.SkipChars(start); err != nil {
+    return
+  }
+  if format, err = ts.SkipChars(end - start); err != nil {
+    return
+  }
+  rest := ts.SkipToEnd()
+  op = Operation{Kind: StringOp, Len: 1}
+  if skip > 0 {
+    op.Operations = append(op.Operations, Operation{Kind: SkipOp, Len: skip})
+  }
+  if format > 0 {
+    op.Operations = append(op.Operations, Operation{Kind: FormatOp, Len: format, Value: attributes})
+  }
+  if rest > 0 {
+    op.Operations = append(op.Operations, Operation{Kind: SkipOp, Len: rest})
+  }
+  return
 }
 
 func (self *SimpleText) Begin() {
@@ -430,11 +650,37 @@ func (self *SimpleText) Begin() {
 }
 
 func (self *SimpleText) InsertChars(str string) {
+  self.InsertFormattedChars(str, nil)
+}
+
+func (self *SimpleText) InsertFormattedChars(str string, attributes map[string]interface{}) {
   self.tombStream.InsertChars(len(str))
   self.Text = self.Text[:self.pos] + str + self.Text[self.pos:]
+  attrs := make([]map[string]interface{}, len(str), len(str)+len(self.attributes)-self.pos)
+  attributes = mergeAttributes(nil, attributes, false)
+  for i := range attrs {
+    attrs[i] = attributes
+  }
+  self.attributes = append(self.attributes[:self.pos], append(attrs, self.attributes[self.pos:]...)...)
   self.pos += len(str)
 }
 
+func (self *SimpleText) Format(count int, attributes map[string]interface{}) (err error) {
+  var chars int
+  chars, err = self.tombStream.Skip(count)
+  var prev, prevMerged map[string]interface{}
+  for i := self.pos; i < self.pos+chars; i++ {
+    // Neighbouring characters with the same attributes share the same map
+    if i == self.pos || !equalAttributes(prev, self.attributes[i]) {
+      prev = self.attributes[i]
+      prevMerged = mergeAttributes(prev, attributes, false)
+    }
+    self.attributes[i] = prevMerged
+  }
+  self.pos += chars
+  return
+}
+
 func (self *SimpleText) InsertTombs(count int) {
   self.tombStream.InsertTombs(count)
 }
@@ -446,6 +692,7 @@ func (self *SimpleText) Delete(count int) (err error) {
     return
   }
   self.Text = self.Text[:self.pos] + self.Text[self.pos+burried:]
+  self.attributes = append(self.attributes[:self.pos], self.attributes[self.pos+burried:]...)
   return
 }
 
@@ -504,11 +751,11 @@ func (self *SimpleObject) End() {
 // --------------------------------------------
 // SimpleArray
 
-// Plain text that can be edited concurrently.
-// Implements the Text interface.
+// An array that can be edited concurrently.
+// Implements the Array interface.
 type SimpleArray struct {
   array Vector
-  // A positive number represents a sequence of visible characters.
+  // A positive number represents a sequence of visible elements.
   // A negative number represents a sequence of tombs.
   tombs      IntVector
   tombStream *TombStream // Used during a mutation
@@ -526,7 +773,19 @@ func (self *SimpleArray) String() string {
 }
 
 func (self *SimpleArray) Clone() SimpleArray {
-  return SimpleArray{array: self.array, tombs: self.tombs.Copy()}
+  array := make(Vector, len(self.array))
+  copy(array, self.array)
+  return SimpleArray{array: array, tombs: self.tombs.Copy()}
+}
+
+// The number of visible elements
+func (self *SimpleArray) Len() int {
+  return len(self.array)
+}
+
+// Returns the i-th visible element
+func (self *SimpleArray) At(i int) interface{} {
+  return self.array[i]
 }
 
 func (self *SimpleArray) Begin() {
@@ -561,6 +820,31 @@ func (self *SimpleArray) Skip(count int) (err error) {
   return
 }
 
+func (self *SimpleArray) Get() (value interface{}, ok bool, err error) {
+  ok, err = self.tombStream.IsChar()
+  if err != nil || !ok {
+    return
+  }
+  value = self.array[self.pos]
+  return
+}
+
+func (self *SimpleArray) Set(value interface{}) {
+  self.array[self.pos] = value
+}
+
 func (self *SimpleArray) End() {
   self.tombStream = nil
 }
+
+func equalAttributes(a map[string]interface{}, b map[string]interface{}) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for key, val := range a {
+    if val2, ok := b[key]; !ok || !reflect.DeepEqual(val, val2) {
+      return false
+    }
+  }
+  return true
+}
@@ -0,0 +1,197 @@
+package ot
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+)
+
+// Adds FormatOps and formatted inserts to a random string mutation.
+// Each mutation uses the attribute keys in 'keys'.
+func RandomFormattedOperations(n int, keys []string) (ops []Operation) {
+  for _, op := range randomElementOperations(n) {
+    attrs := map[string]interface{}{keys[rand.Intn(len(keys))]: rand.Intn(3)}
+    if rand.Float64() < 0.2 {
+      attrs[keys[rand.Intn(len(keys))]] = nil
+    }
+    if op.Kind == SkipOp && rand.Float64() < 0.5 {
+      op.Kind = FormatOp
+      op.Value = attrs
+    } else if op.Kind == InsertOp && len(op.Value.(string)) > 0 && rand.Float64() < 0.5 {
+      op.Operations = []Operation{Operation{Kind: FormatOp, Value: attrs}}
+    }
+    ops = append(ops, op)
+  }
+  return
+}
+
+func renderRuns(text *SimpleText) (result string) {
+  for _, run := range text.Runs() {
+    result += fmt.Sprintf("[%v %v]", run.Text, run.Attributes)
+  }
+  return
+}
+
+func TestFormatTransform(t *testing.T) {
+  for test := 0; test < 2000; test++ {
+    original := "abcdefghijk"
+    all := []Mutation{}
+    for i := 0; i < 4; i++ {
+      all = append(all, Mutation{ID: fmt.Sprintf("m%v", i), Operation: Operation{Kind: StringOp, Operations: RandomFormattedOperations(len(original), []string{"bold", "link"})}})
+    }
+
+    // Execute the four operations in any possible order
+    counter := 0
+    prev := ""
+    for perm := range Permutations(len(all)) {
+      doc := NewSimpleText(original)
+      var applied []Mutation
+      for i := 0; i < len(perm); i++ {
+        _, mut, err := TransformSeq(applied, all[perm[i]])
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        applied = append(applied, mut)
+        if _, err = Execute(doc, mut); err != nil {
+          t.Fatal(err.Error())
+        }
+      }
+      if counter == 0 {
+        prev = renderRuns(doc)
+      } else if prev != renderRuns(doc) {
+        t.Fatalf("Different docs:\n\tdoc1: %v\n\tdoc2: %v\n", prev, renderRuns(doc))
+      }
+      counter++
+    }
+  }
+}
+
+func TestFormatPruningAndComposing(t *testing.T) {
+  for test := 0; test < 200; test++ {
+    original := "abcdefghijk"
+    all := []Mutation{}
+    for i := 0; i < 4; i++ {
+      name := fmt.Sprintf("m%v", i)
+      // All mutations format the same attributes
+      all = append(all, Mutation{DebugName: name, ID: hexHash(name), Operation: Operation{Kind: StringOp, Operations: RandomFormattedOperations(len(original), []string{"bold", "link"})}})
+    }
+
+    // Apply the mutations in any possible order
+    for perm := range Permutations(len(all)) {
+      seq := []Mutation{}
+      for _, i := range perm {
+        _, x, err := TransformSeq(seq, all[i])
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        seq = append(seq, x)
+      }
+
+      // Prune any subset of the mutations
+      for subset := range Subsets(len(all)) {
+        skip := make(map[string]bool)
+        for _, i := range subset {
+          skip[all[i].ID] = true
+        }
+        seq2 := []Mutation{}
+        for _, i := range perm {
+          if skip[all[i].ID] {
+            continue
+          }
+          _, x, err := TransformSeq(seq2, all[i])
+          if err != nil {
+            t.Fatal(err.Error())
+          }
+          seq2 = append(seq2, x)
+        }
+
+        seq3, err := PruneMutationSeq(seq, skip)
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+
+        docs := []*SimpleText{NewSimpleText(original), NewSimpleText(original)}
+        for i, s := range [][]Mutation{seq2, seq3} {
+          for _, mut := range s {
+            if _, err = Execute(docs[i], mut); err != nil {
+              t.Fatal(err.Error())
+            }
+          }
+        }
+        if renderRuns(docs[0]) != renderRuns(docs[1]) {
+          t.Fatalf("Pruning %v in order %v delivers different docs:\n\tdoc1: %v\n\tdoc2: %v\n", subset, perm, renderRuns(docs[0]), renderRuns(docs[1]))
+        }
+
+        if len(seq2) == 0 {
+          continue
+        }
+        comp, err := ComposeSeq(seq2)
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        cdoc := NewSimpleText(original)
+        if _, err = Execute(cdoc, comp); err != nil {
+          t.Fatal(err.Error())
+        }
+        if renderRuns(docs[0]) != renderRuns(cdoc) {
+          t.Fatalf("Composing delivers different docs:\n\tdoc1: %v\n\tdoc2: %v\n", renderRuns(docs[0]), renderRuns(cdoc))
+        }
+      }
+    }
+  }
+}
+
+func TestFormatPruneThreeWriters(t *testing.T) {
+  all := []Mutation{}
+  for _, site := range []string{"a", "b", "c"} {
+    all = append(all, Mutation{ID: "m" + site, Site: site, Operation: Operation{Kind: StringOp, Operations: []Operation{
+      Operation{Kind: FormatOp, Len: 3, Value: map[string]interface{}{"color": site}}}}})
+  }
+  for perm := range Permutations(len(all)) {
+    seq := []Mutation{}
+    for _, i := range perm {
+      _, x, err := TransformSeq(seq, all[i])
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      seq = append(seq, x)
+    }
+    // Prune each writer. The largest remaining writer must win
+    for pruned, expected := range map[string]string{"ma": "c", "mb": "c", "mc": "b"} {
+      pseq, err := PruneMutationSeq(seq, map[string]bool{pruned: true})
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      doc := NewSimpleText("abc")
+      for _, m := range pseq {
+        if _, err = Execute(doc, m); err != nil {
+          t.Fatal(err.Error())
+        }
+      }
+      if runs := renderRuns(doc); runs != fmt.Sprintf("[abc map[color:%v]]", expected) {
+        t.Fatalf("Pruning %v in order %v yields %v", pruned, perm, runs)
+      }
+    }
+  }
+}
+
+func TestFormatRange(t *testing.T) {
+  text := NewSimpleText("Hello World")
+  // Delete " W" to have some tombs in the text
+  _, err := ExecuteOperation(text, Operation{Kind: StringOp, Operations: []Operation{
+    Operation{Kind: SkipOp, Len: 5}, Operation{Kind: DeleteOp, Len: 2}, Operation{Kind: SkipOp, Len: 4}}})
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  r := TextRange{Current: TextMarker{2}, Anchor: TextMarker{7}}
+  op, err := text.FormatRange(r, map[string]interface{}{"bold": true})
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if _, err = ExecuteOperation(text, op); err != nil {
+    t.Fatal(err.Error())
+  }
+  if renderRuns(text) != "[He map[]][lloor map[bold:true]][ld map[]]" {
+    t.Fatalf("Wrong runs: %v", renderRuns(text))
+  }
+}
@@ -13,6 +13,9 @@ const (
   ArrayOp     // Used as root or in ArrayOp or in ObjectOp and AttributeOp
   ObjectOp    // Used as root or in ArrayOp or in ObjectOp and AttributeOp
   AttributeOp // Used in ObjectOp
+  OverwriteOp // Used as root or in ArrayOp or AttributeOp
+  IncrementOp // Used as root or in ArrayOp or AttributeOp
+  FormatOp    // Used in StringOp
 )
 
 type Operation struct {
@@ -21,10 +24,12 @@ type Operation struct {
   Len int "l"
   // The sub-operations. For example a StringOp will store in this field all the insert, skip and delete
   // operations it wants to apply to a string.
-  // This field is empty for InsertOp, DeleteOp, SkipOp and OverwriteOp.
+  // This field is empty for InsertOp, DeleteOp, SkipOp, OverwriteOp and IncrementOp.
   Operations []Operation "o"
   // A simple value, e.g. string or int or float etc.
-  // This value is used in case of InsertOp and OverwriteOp.
+  // This value is used in case of InsertOp, OverwriteOp and IncrementOp.
+  // In case of IncrementOp it stores the number to add.
+  // In case of FormatOp it stores the formatting attributes as a map[string]interface{}.
   // In case of InsertOp it stores the string value to insert.
   // However, with InsertOp the Value might be an empty string while the Len field is larger than 0.
   // This indicates that the operation wants to insert a number of tombs as specified by the Len field. 
@@ -34,7 +39,6 @@ type Operation struct {
 type Mutation struct {
   // The root of a tree of operations.
   // This is eithr StringOp, ArrayOp, ObjectOp or OverwriteOp.
-  // Currently, only StringOp is supported.
   Operation Operation "o"
   // A globally unique ID. This ID is used to break a tie if two operations are in conflict.
   ID string "id"
@@ -60,6 +64,8 @@ func (self Operation) String() string {
   case InsertOp:
     if str, ok := self.Value.(string); ok && len(str) == 0 && self.Len > 0 {
       return fmt.Sprintf("t:%v", self.Len)
+    } else if isArrayTomb(self) {
+      return fmt.Sprintf("t:%v", self.Len)
     } else {
       return fmt.Sprintf("i:%v", self.Value)
     }
@@ -75,8 +81,82 @@ func (self Operation) String() string {
     return fmt.Sprintf("obj:%v", self.Operations)
   case AttributeOp:
     return fmt.Sprintf("attr[key:%v ops:%v]", self.Value.(string), self.Operations)
+  case OverwriteOp:
+    return fmt.Sprintf("w:%v", self.Value)
+  case IncrementOp:
+    return fmt.Sprintf("inc:%v", self.Value)
+  case FormatOp:
+    return fmt.Sprintf("f:%v%v", self.Len, self.Value)
   default:
     panic("Unsupported op")
   }
   return ""
 }
+
+// Inside an array, an InsertOp without a value and without child operations
+// inserts a number of tombs as specified by the Len field.
+func isArrayTomb(op Operation) bool {
+  return op.Kind == InsertOp && op.Value == nil && len(op.Operations) == 0
+}
+
+// An OverwriteOp that lost against a concurrent OverwriteOp is turned into a SkipOp.
+// The original operation is kept as the only child of the SkipOp, because it is required
+// again if the winning OverwriteOp is pruned. An operation that lost against several OverwriteOps
+// is wrapped once for each of them.
+func overwrittenOp(op Operation) Operation {
+  return Operation{Kind: SkipOp, Len: 1, Operations: []Operation{op}}
+}
+
+func isOverwritten(op Operation) bool {
+  return op.Kind == SkipOp && len(op.Operations) == 1
+}
+
+// Returns the original operation of an operation that has been overwritten once or several times
+func overwrittenBase(op Operation) Operation {
+  for isOverwritten(op) {
+    op = op.Operations[0]
+  }
+  return op
+}
+
+// Replaces the original operation of an operation that has been overwritten once or several times
+func replaceOverwrittenBase(op Operation, base Operation) Operation {
+  if !isOverwritten(op) {
+    return base
+  }
+  return overwrittenOp(replaceOverwrittenBase(op.Operations[0], base))
+}
+
+// Returns the formatting attributes of a FormatOp or of an InsertOp that inserts formatted characters.
+// Inside a StringOp, an InsertOp with a FormatOp as its only child inserts formatted characters.
+func formatAttributes(op Operation) map[string]interface{} {
+  if op.Kind == InsertOp {
+    if len(op.Operations) == 1 && op.Operations[0].Kind == FormatOp {
+      return formatAttributes(op.Operations[0])
+    }
+    return nil
+  }
+  attrs, _ := op.Value.(map[string]interface{})
+  return attrs
+}
+
+// Merges two sets of formatting attributes. The attributes in 'second' win.
+// An attribute with a nil value in 'second' removes the attribute.
+// If 'keepNil' is true, nil values are kept in the result, because the result is used to format text.
+func mergeAttributes(first map[string]interface{}, second map[string]interface{}, keepNil bool) (result map[string]interface{}) {
+  result = make(map[string]interface{})
+  for key, val := range first {
+    result[key] = val
+  }
+  for key, val := range second {
+    if val == nil && !keepNil {
+      delete(result, key)
+    } else {
+      result[key] = val
+    }
+  }
+  if len(result) == 0 {
+    return nil
+  }
+  return
+}
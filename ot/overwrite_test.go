@@ -0,0 +1,242 @@
+package ot
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+)
+
+// n is the length of the array
+func randomOverwriteOperations(n int, site string) (ops []Operation) {
+  for i := 0; i < n; i++ {
+    r := rand.Float64()
+    if r < 0.5 {
+      ops = append(ops, Operation{Kind: OverwriteOp, Len: 1, Value: fmt.Sprintf("%v%v", site, i)})
+    } else if r < 0.6 {
+      ops = append(ops, Operation{Kind: DeleteOp, Len: 1})
+    } else if r < 0.7 {
+      ops = append(ops, Operation{Kind: StringOp, Len: 1, Operations: randomElementOperations(len(originalElement))})
+    } else {
+      ops = append(ops, Operation{Kind: SkipOp, Len: 1})
+    }
+  }
+  return
+}
+
+func TestOverwriteTransform(t *testing.T) {
+  for test := 0; test < 2000; test++ {
+    original := 5
+    all := []Mutation{}
+    for i := 0; i < 4; i++ {
+      site := fmt.Sprintf("s%v", i)
+      all = append(all, Mutation{ID: fmt.Sprintf("m%v", i), Site: site, Operation: Operation{Kind: ArrayOp, Len: 1, Operations: randomOverwriteOperations(original, site)}})
+    }
+
+    // Execute the four operations in any possible order
+    counter := 0
+    prev := ""
+    for perm := range Permutations(len(all)) {
+      doc := newTestArray(original)
+      var err error
+      var applied []Mutation
+      for i := 0; i < len(perm); i++ {
+        mut := all[perm[i]]
+        // Transform against all applied ops
+        for _, appliedmut := range applied {
+          _, mut, err = Transform(appliedmut, mut)
+          if err != nil {
+            t.Fatal(err.Error())
+          }
+        }
+        applied = append(applied, mut)
+        doc = executeArraySeq(t, doc, []Mutation{mut})
+      }
+      if counter == 0 {
+        prev = doc.String()
+      } else if prev != doc.String() {
+        t.Fatalf("Different docs:\n\tdoc1: %v\n\tdoc2: %v\n", prev, doc.String())
+      }
+      counter++
+    }
+  }
+}
+
+func TestOverwriteLastWriterWins(t *testing.T) {
+  m1 := Mutation{ID: "m1", Site: "a", Operation: Operation{Kind: ObjectOp, Len: 1, Operations: []Operation{
+    Operation{Kind: AttributeOp, Value: "a1", Operations: []Operation{
+      Operation{Kind: OverwriteOp, Len: 1, Value: 1}}}}}}
+  m2 := Mutation{ID: "m2", Site: "b", Operation: Operation{Kind: ObjectOp, Len: 1, Operations: []Operation{
+    Operation{Kind: AttributeOp, Value: "a1", Operations: []Operation{
+      Operation{Kind: OverwriteOp, Len: 1, Value: 2}}}}}}
+  tm1, tm2, err := Transform(m1, m2)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+
+  o1 := NewSimpleObject()
+  o1.Set("a1", 0, 0)
+  o2 := NewSimpleObject()
+  o2.Set("a1", 0, 0)
+  for _, m := range []Mutation{m1, tm2} {
+    if _, err = Execute(o1, m); err != nil {
+      t.Fatal(err.Error())
+    }
+  }
+  for _, m := range []Mutation{m2, tm1} {
+    if _, err = Execute(o2, m); err != nil {
+      t.Fatal(err.Error())
+    }
+  }
+  if _, val := o1.Get("a1"); val != 2 {
+    t.Fatalf("Object o1 attribute has wrong value: %v", val)
+  }
+  if _, val := o2.Get("a1"); val != 2 {
+    t.Fatalf("Object o2 attribute has wrong value: %v", val)
+  }
+
+  // Compose
+  c, err := Compose(m1, tm2)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  o3 := NewSimpleObject()
+  o3.Set("a1", 0, 0)
+  if _, err = Execute(o3, c); err != nil {
+    t.Fatal(err.Error())
+  }
+  if _, val := o3.Get("a1"); val != 2 {
+    t.Fatalf("Object o3 attribute has wrong value after composition: %v", val)
+  }
+
+  // Prune the winner. The value of the loser must become visible again
+  seq, err := PruneMutationSeq([]Mutation{m2, tm1}, map[string]bool{"m2": true})
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  o4 := NewSimpleObject()
+  o4.Set("a1", 0, 0)
+  for _, m := range seq {
+    if _, err = Execute(o4, m); err != nil {
+      t.Fatal(err.Error())
+    }
+  }
+  if _, val := o4.Get("a1"); val != 1 {
+    t.Fatalf("Object o4 attribute has wrong value after pruning: %v", val)
+  }
+}
+
+func TestOverwriteMutation(t *testing.T) {
+  // The overwrite wins against a concurrent mutation of the same element
+  m1 := Mutation{ID: "m1", Site: "b", Operation: Operation{Kind: ArrayOp, Len: 1, Operations: []Operation{
+    Operation{Kind: OverwriteOp, Len: 1, Value: 42}}}}
+  m2 := Mutation{ID: "m2", Site: "a", Operation: Operation{Kind: ArrayOp, Len: 1, Operations: []Operation{
+    Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+      Operation{Kind: InsertOp, Len: 1, Value: "X"},
+      Operation{Kind: SkipOp, Len: len(originalElement)}}}}}}
+  tm1, tm2, err := Transform(m1, m2)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  doc1 := executeArraySeq(t, newTestArray(1), []Mutation{m1, tm2})
+  doc2 := executeArraySeq(t, newTestArray(1), []Mutation{m2, tm1})
+  if doc1.String() != "[42]" || doc2.String() != "[42]" {
+    t.Fatalf("Wrong array content: %v %v", doc1.String(), doc2.String())
+  }
+
+  // Prune the overwrite
+  seq, err := PruneMutationSeq([]Mutation{m1, tm2}, map[string]bool{"m1": true})
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  doc3 := executeArraySeq(t, newTestArray(1), seq)
+  if doc3.String() != "[Xabcdef]" {
+    t.Fatalf("Wrong array content after pruning: %v", doc3.String())
+  }
+}
+
+func TestOverwritePruning(t *testing.T) {
+  for test := 0; test < 200; test++ {
+    original := 5
+    all := []Mutation{}
+    for i := 0; i < 4; i++ {
+      site := fmt.Sprintf("s%v", i)
+      all = append(all, Mutation{ID: fmt.Sprintf("m%v", i), Site: site, Operation: Operation{Kind: ArrayOp, Len: 1, Operations: randomOverwriteOperations(original, site)}})
+    }
+
+    // Apply the mutations in any possible order
+    for perm := range Permutations(len(all)) {
+      seq := []Mutation{}
+      for _, i := range perm {
+        _, x, err := TransformSeq(seq, all[i])
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        seq = append(seq, x)
+      }
+
+      // Prune any subset of the mutations. The result must equal the document built without them
+      for subset := range Subsets(len(all)) {
+        skip := make(map[string]bool)
+        for _, i := range subset {
+          skip[all[i].ID] = true
+        }
+        seq2 := []Mutation{}
+        for _, i := range perm {
+          if skip[all[i].ID] {
+            continue
+          }
+          _, x, err := TransformSeq(seq2, all[i])
+          if err != nil {
+            t.Fatal(err.Error())
+          }
+          seq2 = append(seq2, x)
+        }
+        seq3, err := PruneMutationSeq(seq, skip)
+        if err != nil {
+          t.Fatal(err.Error())
+        }
+        doc2 := executeArraySeq(t, newTestArray(original), seq2)
+        doc3 := executeArraySeq(t, newTestArray(original), seq3)
+        if doc2.String() != doc3.String() {
+          t.Fatalf("Pruning %v in order %v delivers different docs:\n\tdoc1: %v\n\tdoc2: %v\n", subset, perm, doc2.String(), doc3.String())
+        }
+      }
+    }
+  }
+}
+
+func TestOverwritePruneThreeWriters(t *testing.T) {
+  all := []Mutation{}
+  for _, site := range []string{"a", "b", "c"} {
+    all = append(all, Mutation{ID: "m" + site, Site: site, Operation: Operation{Kind: ObjectOp, Len: 1, Operations: []Operation{
+      Operation{Kind: AttributeOp, Value: "a1", Operations: []Operation{
+        Operation{Kind: OverwriteOp, Len: 1, Value: site}}}}}})
+  }
+  for perm := range Permutations(len(all)) {
+    seq := []Mutation{}
+    for _, i := range perm {
+      _, x, err := TransformSeq(seq, all[i])
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      seq = append(seq, x)
+    }
+    // Prune each writer. The largest remaining writer must win
+    for pruned, expected := range map[string]string{"ma": "c", "mb": "c", "mc": "b"} {
+      pseq, err := PruneMutationSeq(seq, map[string]bool{pruned: true})
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      o := NewSimpleObject()
+      o.Set("a1", 0, 0)
+      for _, m := range pseq {
+        if _, err = Execute(o, m); err != nil {
+          t.Fatal(err.Error())
+        }
+      }
+      if _, val := o.Get("a1"); val != expected {
+        t.Fatalf("Pruning %v in order %v yields %v instead of %v", pruned, perm, val, expected)
+      }
+    }
+  }
+}
@@ -5,29 +5,25 @@ import (
   "fmt"
 )
 
+// Removes the mutations listed in 'prune' from the sequence.
+// The remaining mutations are changed as if the pruned mutations had never been applied.
+// The pruned mutations are not composed but pruned one after the other, because pruning an OverwriteOp
+// depends on the Site (or ID) of the pruned mutation.
 func PruneMutationSeq(muts []Mutation, prune map[string]bool) (result []Mutation, err error) {
-  started := false
-  var u Mutation
+  // The pruned mutations. Each is transformed such that it follows the mutations seen so far
+  var pruned []Mutation
   for _, mut := range muts {
-    if _, isundo := prune[mut.ID]; !isundo {
-      if started {
-        mut, u, err = PruneMutation(mut, u)
-        if err != nil {
-          return
-        }
-      }
-      result = append(result, mut)
-      continue
-    }
-    if !started {
-      started = true
-      u = mut
-    } else {
-      u, err = Compose(u, mut)
+    for i, p := range pruned {
+      mut, pruned[i], err = PruneMutation(mut, p)
       if err != nil {
         return
       }
     }
+    if _, isundo := prune[mut.ID]; isundo {
+      pruned = append(pruned, mut)
+    } else {
+      result = append(result, mut)
+    }
   }
   return
 }
@@ -35,24 +31,60 @@ func PruneMutationSeq(muts []Mutation, prune map[string]bool) (result []Mutation
 func PruneMutation(mut Mutation, prune Mutation) (tmut Mutation, tprune Mutation, err error) {
   tmut = mut
   tprune = prune
-  tmut.Operation, tprune.Operation, err = pruneOp(tmut.Operation, prune.Operation)
+  // The pruned mutation has won against 'mut' in Transform?
+  wins := prune.Site > mut.Site || (prune.Site == mut.Site && prune.ID > mut.ID)
+  tmut.Operation, tprune.Operation, err = pruneOp(tmut.Operation, prune.Operation, wins)
   return
 }
 
-func pruneOp(op Operation, prune Operation) (top Operation, tprune Operation, err error) {
+// 'wins' tells whether the mutation of 'prune' has won against the mutation of 'op'
+// when they have been transformed, i.e. whether 'op' has been overwritten by 'prune'.
+func pruneOp(op Operation, prune Operation, wins bool) (top Operation, tprune Operation, err error) {
   top = op
   tprune = prune
+  if overwrittenBase(prune).Kind == OverwriteOp {
+    if !isOverwritten(op) {
+      if op.Kind == OverwriteOp {
+        // 'op' is applied after the pruned OverwriteOp. Hence, 'op' wins
+        tprune = overwrittenOp(prune)
+      }
+    } else if overwrittenBase(op).Kind == OverwriteOp && !wins {
+      // 'op' has been overwritten by other OverwriteOps only. It has won against the pruned OverwriteOp
+      tprune = overwrittenOp(prune)
+    } else {
+      // The pruned OverwriteOp has been overwriting 'op'. Therefore, 'op' becomes visible again
+      // unless other OverwriteOps have been overwriting it, too
+      top = op.Operations[0]
+    }
+    return
+  }
+  if isOverwritten(op) || isOverwritten(prune) {
+    // Mutations that have been overwritten have been transformed nonetheless. See transformElementOp
+    var base, basePrune Operation
+    base, basePrune, err = pruneOp(overwrittenBase(op), overwrittenBase(prune), wins)
+    top = replaceOverwrittenBase(op, base)
+    tprune = replaceOverwrittenBase(prune, basePrune)
+    return
+  }
+  // Increments commute with all other operations. Nothing to do
+  if op.Kind == OverwriteOp || op.Kind == IncrementOp || prune.Kind == IncrementOp {
+    return
+  }
   if op.Kind != prune.Kind {
     err = errors.New("Operations of both streams operate on a different data type or they are not allowed in this place")
     return
   }
   switch op.Kind {
   case StringOp:
-    top.Operations, tprune.Operations, err = pruneOps(op.Operations, prune.Operations, pruneStringOp)
+    top.Operations, tprune.Operations, err = pruneOps(op.Operations, prune.Operations, func(op Operation, prune Operation) (Operation, Operation, error) {
+      return pruneStringOp(op, prune, wins)
+    })
   case ArrayOp:
-    // TODO
+    top.Operations, tprune.Operations, err = pruneOps(op.Operations, prune.Operations, func(op Operation, prune Operation) (Operation, Operation, error) {
+      return pruneArrayOp(op, prune, wins)
+    })
   case ObjectOp:
-    top.Operations, tprune.Operations, err = pruneObject(op.Operations, prune.Operations)
+    top.Operations, tprune.Operations, err = pruneObject(op.Operations, prune.Operations, wins)
   case NoOp:
     // Do nothing by intention
   default:
@@ -84,12 +116,12 @@ func pruneOps(ops []Operation, prune []Operation, f transformFunc) (tops []Opera
   return
 }
 
-func pruneStringOp(op Operation, prune Operation) (top Operation, tprune Operation, err error) {
-  if op.Kind != InsertOp && op.Kind != SkipOp && op.Kind != DeleteOp && op.Kind != NoOp {
+func pruneStringOp(op Operation, prune Operation, wins bool) (top Operation, tprune Operation, err error) {
+  if op.Kind != InsertOp && op.Kind != SkipOp && op.Kind != DeleteOp && op.Kind != FormatOp && op.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: op:%v", op.Kind))
     return
   }
-  if prune.Kind != InsertOp && prune.Kind != SkipOp && prune.Kind != DeleteOp && prune.Kind != NoOp {
+  if prune.Kind != InsertOp && prune.Kind != SkipOp && prune.Kind != DeleteOp && prune.Kind != FormatOp && prune.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: undo:%v", prune.Kind))
     return
   }
@@ -99,11 +131,34 @@ func pruneStringOp(op Operation, prune Operation) (top Operation, tprune Operati
     tprune = Operation{Kind: SkipOp, Len: op.Len}
   } else if prune.Kind == InsertOp {
     top = Operation{}
+  } else if prune.Kind == FormatOp && op.Kind == FormatOp && len(op.Operations) > 0 && wins {
+    top = restoreFormatOp(op, prune)
+  }
+  return
+}
+
+func pruneArrayOp(op Operation, prune Operation, wins bool) (top Operation, tprune Operation, err error) {
+  if op.Kind != InsertOp && op.Kind != SkipOp && op.Kind != DeleteOp && op.Kind != ObjectOp && op.Kind != ArrayOp && op.Kind != StringOp && op.Kind != OverwriteOp && op.Kind != IncrementOp && op.Kind != NoOp {
+    err = errors.New(fmt.Sprintf("Operation not allowed in an array: op:%v", op.Kind))
+    return
+  }
+  if prune.Kind != InsertOp && prune.Kind != SkipOp && prune.Kind != DeleteOp && prune.Kind != ObjectOp && prune.Kind != ArrayOp && prune.Kind != StringOp && prune.Kind != OverwriteOp && prune.Kind != IncrementOp && prune.Kind != NoOp {
+    err = errors.New(fmt.Sprintf("Operation not allowed in an array: undo:%v", prune.Kind))
+    return
+  }
+  top = op
+  tprune = prune
+  if op.Kind == InsertOp {
+    tprune = Operation{Kind: SkipOp, Len: op.Len}
+  } else if prune.Kind == InsertOp {
+    top = Operation{}
+  } else if base, basePrune := overwrittenBase(op), overwrittenBase(prune); basePrune.Kind == OverwriteOp || ((basePrune.Kind == ObjectOp || basePrune.Kind == StringOp || basePrune.Kind == ArrayOp) && (base.Kind == ObjectOp || base.Kind == StringOp || base.Kind == ArrayOp)) {
+    top, tprune, err = pruneOp(op, prune, wins)
   }
   return
 }
 
-func pruneObject(ops1 []Operation, ops2 []Operation) (tops1 []Operation, tops2 []Operation, err error) {
+func pruneObject(ops1 []Operation, ops2 []Operation, wins bool) (tops1 []Operation, tops2 []Operation, err error) {
   attr1 := make(map[string]int)
   attr2 := make(map[string]int)
   pos := 0
@@ -133,7 +188,9 @@ func pruneObject(ops1 []Operation, ops2 []Operation) (tops1 []Operation, tops2 [
     if !ok {
       continue
     }
-    tops1[pos1].Operations, tops2[pos2].Operations, err = pruneOps(tops1[pos1].Operations, tops2[pos2].Operations, pruneAttrOp)
+    tops1[pos1].Operations, tops2[pos2].Operations, err = pruneOps(tops1[pos1].Operations, tops2[pos2].Operations, func(op Operation, prune Operation) (Operation, Operation, error) {
+      return pruneAttrOp(op, prune, wins)
+    })
     if err != nil {
       return
     }
@@ -141,12 +198,12 @@ func pruneObject(ops1 []Operation, ops2 []Operation) (tops1 []Operation, tops2 [
   return
 }
 
-func pruneAttrOp(op Operation, prune Operation) (top Operation, tprune Operation, err error) {
-  if op.Kind != InsertOp && op.Kind != SkipOp && op.Kind != ObjectOp && op.Kind != ArrayOp && op.Kind != StringOp && op.Kind != NoOp {
+func pruneAttrOp(op Operation, prune Operation, wins bool) (top Operation, tprune Operation, err error) {
+  if op.Kind != InsertOp && op.Kind != SkipOp && op.Kind != ObjectOp && op.Kind != ArrayOp && op.Kind != StringOp && op.Kind != OverwriteOp && op.Kind != IncrementOp && op.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in an object context: %v", op.Kind))
     return
   }
-  if prune.Kind != InsertOp && prune.Kind != SkipOp && prune.Kind != ObjectOp && prune.Kind != ArrayOp && prune.Kind != StringOp && prune.Kind != NoOp {
+  if prune.Kind != InsertOp && prune.Kind != SkipOp && prune.Kind != ObjectOp && prune.Kind != ArrayOp && prune.Kind != StringOp && prune.Kind != OverwriteOp && prune.Kind != IncrementOp && prune.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in an object context: %v", prune.Kind))
     return
   }
@@ -156,8 +213,36 @@ func pruneAttrOp(op Operation, prune Operation) (top Operation, tprune Operation
     tprune = Operation{Kind: SkipOp, Len: op.Len}
   } else if prune.Kind == InsertOp {
     top = Operation{}
-  } else if (prune.Kind == ObjectOp || prune.Kind == StringOp || prune.Kind == ArrayOp) && (op.Kind == ObjectOp || op.Kind == StringOp || op.Kind == ArrayOp) {
-    top, tprune, err = pruneOp(op, prune)
+  } else if base, basePrune := overwrittenBase(op), overwrittenBase(prune); basePrune.Kind == OverwriteOp || ((basePrune.Kind == ObjectOp || basePrune.Kind == StringOp || basePrune.Kind == ArrayOp) && (base.Kind == ObjectOp || base.Kind == StringOp || base.Kind == ArrayOp)) {
+    top, tprune, err = pruneOp(op, prune, wins)
   }
   return
 }
+
+// 'op' might have lost some attributes against the pruned FormatOp. Restore them unless
+// other FormatOps have won them, too. See transformFormatOp
+func restoreFormatOp(op Operation, prune Operation) (top Operation) {
+  lost := make(map[string]bool)
+  pruneAttrs := formatAttributes(formatOriginal(prune))
+  for key, _ := range formatAttributes(op.Operations[0]) {
+    if _, ok := pruneAttrs[key]; ok {
+      lost[key] = true
+    }
+  }
+  // Remove the attributes 'op' lost against the pruned FormatOp
+  for i := 1; i < len(op.Operations); i++ {
+    attrs := formatAttributes(op.Operations[i])
+    if len(attrs) != len(lost) {
+      continue
+    }
+    equal := true
+    for key, _ := range attrs {
+      equal = equal && lost[key]
+    }
+    if equal {
+      ops := append([]Operation{}, op.Operations[:i]...)
+      return lostFormatOp(op.Len, append(ops, op.Operations[i+1:]...))
+    }
+  }
+  return op
+}
@@ -0,0 +1,345 @@
+package ot
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+)
+
+// A snapshot stores the materialized document at some point in the history.
+// Replaying a long history is slow. Instead, an application can restore the document
+// from the latest snapshot and apply only the mutations which have been applied after it.
+type Snapshot struct {
+  // A *SimpleText, *SimpleArray, *SimpleObject or any constant value
+  Document interface{}
+  // The frontier of the builder at the time the snapshot has been taken
+  Frontier Frontier
+  // The IDs of all mutations applied before the snapshot. A builder restored from the snapshot needs them
+  // to detect mutations that depend on a mutation before the snapshot. Otherwise, such mutations would wait forever.
+  Applied []string
+  // The number of mutations applied to the document, i.e. the AppliedAt of the next mutation
+  SequenceNumber int
+}
+
+// {"seq":42, "frontier":["xxx","yyy"], "applied":["www","xxx","yyy"], "doc":{"$t":"Hello", "tombs":[2,-3,3], "attrs":[[2,null],[3,{"bold":true}]]}}
+// {"seq":42, "frontier":["xxx"], "doc":{"$a":[{"$v":1}, {"$t":"abc", "tombs":[3]}], "tombs":[1,-5,1]}}
+// {"seq":42, "frontier":["xxx"], "doc":{"$o":{"myattr":{"v":0, "d":{"$v":"Some constant"}}}}}
+
+// Takes a snapshot of the document. 'doc' must reflect all mutations applied by the builder.
+func (self *SimpleBuilder) Snapshot(doc interface{}) Snapshot {
+  frontier := make(Frontier)
+  for id, _ := range self.frontier {
+    frontier[id] = true
+  }
+  applied := make([]string, 0, len(self.mutationsByID))
+  for id, _ := range self.mutationsByID {
+    applied = append(applied, id)
+  }
+  return Snapshot{Document: doc, Frontier: frontier, Applied: applied, SequenceNumber: self.offset + len(self.mutations)}
+}
+
+// Creates a builder which continues where the snapshot has been taken.
+// Mutations applied before the snapshot are not part of the history of the new builder.
+// Thus, the snapshot should only be taken at a frontier which all sites have acknowledged (see Compact).
+// Build rejects mutations which are concurrent to a mutation before the snapshot.
+func NewSimpleBuilderFromSnapshot(snap Snapshot) *SimpleBuilder {
+  b := NewSimpleBuilder()
+  b.offset = snap.SequenceNumber
+  for id, _ := range snap.Frontier {
+    b.frontier[id] = true
+    b.mutationsByID[id] = true
+  }
+  for _, id := range snap.Applied {
+    b.mutationsByID[id] = true
+  }
+  return b
+}
+
+// Compacts the history below the given frontier. All mutations which belong to the history of the
+// frontier and which have been applied before any mutation that does not, are composed into a single mutation
+// and removed from the history (see Base).
+// After compaction, the builder can no longer transform mutations that are concurrent to one of the
+// compacted mutations. Therefore, the frontier should be one which every site has acknowledged.
+func (self *SimpleBuilder) Compact(frontier Frontier) (compacted int, err error) {
+  for id, _ := range frontier {
+    if !self.HasApplied(id) {
+      return 0, errors.New(fmt.Sprintf("Mutation %v has not been applied", id))
+    }
+  }
+  // Go back in history until all remaining mutations belong to the history of the frontier
+  h := NewHistoryGraph(self.frontier, frontier.IDs())
+  keep := 0
+  for i := len(self.mutations) - 1; i >= 0 && !h.Test(); i-- {
+    h.Substitute(self.appliedBlobs[self.mutations[i]])
+    keep++
+  }
+  compacted = len(self.mutations) - keep
+  if compacted == 0 {
+    return
+  }
+  muts := make([]Mutation, 0, compacted+1)
+  if self.base != nil {
+    muts = append(muts, *self.base)
+  }
+  for _, id := range self.mutations[:compacted] {
+    muts = append(muts, self.appliedBlobs[id])
+    delete(self.appliedBlobs, id)
+  }
+  base, err := ComposeSeq(muts)
+  if err != nil {
+    return 0, err
+  }
+  self.base = &base
+  self.mutations = append([]string{}, self.mutations[compacted:]...)
+  self.offset += compacted
+  return
+}
+
+// Returns the composition of all compacted mutations or nil if nothing has been compacted.
+// Applying the base and then all mutations of the history to the original document yields the current document.
+func (self *SimpleBuilder) Base() *Mutation {
+  return self.base
+}
+
+// -------------------------------------------
+// Encoding
+
+// Encodes the snapshot as JSON. Tombs and formatting attributes are preserved.
+func EncodeSnapshot(snap Snapshot) (result []byte, err error) {
+  doc, err := encodeSnapshotValue(snap.Document)
+  if err != nil {
+    return
+  }
+  ids := snap.Frontier.IDs()
+  if ids == nil {
+    ids = []string{}
+  }
+  applied := snap.Applied
+  if applied == nil {
+    applied = []string{}
+  }
+  return json.Marshal(map[string]interface{}{"seq": snap.SequenceNumber, "frontier": ids, "applied": applied, "doc": doc})
+}
+
+func encodeSnapshotValue(value interface{}) (result interface{}, err error) {
+  switch v := value.(type) {
+  case *SimpleText:
+    var attrs []interface{}
+    for i := 0; i < len(v.attributes); {
+      j := i + 1
+      for j < len(v.attributes) && equalAttributes(v.attributes[i], v.attributes[j]) {
+        j++
+      }
+      attrs = append(attrs, []interface{}{j - i, v.attributes[i]})
+      i = j
+    }
+    if attrs == nil {
+      attrs = []interface{}{}
+    }
+    result = map[string]interface{}{"$t": v.Text, "tombs": []int(v.tombs), "attrs": attrs}
+  case *SimpleArray:
+    arr := []interface{}{}
+    for _, x := range v.array {
+      var e interface{}
+      if e, err = encodeSnapshotValue(x); err != nil {
+        return
+      }
+      arr = append(arr, e)
+    }
+    result = map[string]interface{}{"$a": arr, "tombs": []int(v.tombs)}
+  case *SimpleObject:
+    obj := make(map[string]interface{})
+    for key, val := range v.values {
+      var e interface{}
+      if e, err = encodeSnapshotValue(val); err != nil {
+        return
+      }
+      obj[key] = map[string]interface{}{"v": v.versions[key], "d": e}
+    }
+    result = map[string]interface{}{"$o": obj}
+  case nil, bool, int, int64, float64, string, []interface{}, map[string]interface{}:
+    result = map[string]interface{}{"$v": v}
+  default:
+    err = errors.New(fmt.Sprintf("Snapshot cannot encode a value of type %T", value))
+  }
+  return
+}
+
+// -------------------------------------------
+// Decoding
+
+// Decodes a snapshot which has been encoded with EncodeSnapshot
+func DecodeSnapshot(blob []byte) (snap Snapshot, err error) {
+  j := make(map[string]interface{})
+  if err = json.Unmarshal(blob, &j); err != nil {
+    return
+  }
+  seq, ok := j["seq"].(float64)
+  if !ok {
+    err = errors.New("JSON data is not a valid snapshot: Missing 'seq' property")
+    return
+  }
+  snap.SequenceNumber = int(seq)
+  ids, ok := j["frontier"].([]interface{})
+  if !ok {
+    err = errors.New("JSON data is not a valid snapshot: Missing 'frontier' property")
+    return
+  }
+  snap.Frontier = make(Frontier)
+  for _, id := range ids {
+    str, ok := id.(string)
+    if !ok {
+      err = errors.New("JSON data is not a valid snapshot: 'frontier' must be a list of strings")
+      return
+    }
+    snap.Frontier[str] = true
+  }
+  // Older snapshots do not list the applied mutations
+  if applied, ok := j["applied"]; ok {
+    ids, ok := applied.([]interface{})
+    if !ok {
+      err = errors.New("JSON data is not a valid snapshot: 'applied' must be a list of strings")
+      return
+    }
+    for _, id := range ids {
+      str, ok := id.(string)
+      if !ok {
+        err = errors.New("JSON data is not a valid snapshot: 'applied' must be a list of strings")
+        return
+      }
+      snap.Applied = append(snap.Applied, str)
+    }
+  }
+  snap.Document, err = decodeSnapshotValue(j["doc"])
+  return
+}
+
+func decodeSnapshotTombs(value interface{}) (tombs IntVector, err error) {
+  arr, ok := value.([]interface{})
+  if !ok {
+    err = errors.New("Malformed snapshot: 'tombs' must be a list of numbers")
+    return
+  }
+  for _, x := range arr {
+    n, ok := x.(float64)
+    if !ok {
+      err = errors.New("Malformed snapshot: 'tombs' must be a list of numbers")
+      return
+    }
+    tombs.Push(int(n))
+  }
+  return
+}
+
+// Returns the number of visible characters or elements
+func countChars(tombs IntVector) (n int) {
+  for _, x := range tombs {
+    if x > 0 {
+      n += x
+    }
+  }
+  return
+}
+
+func decodeSnapshotValue(value interface{}) (result interface{}, err error) {
+  j, ok := value.(map[string]interface{})
+  if !ok {
+    err = errors.New("Malformed snapshot")
+    return
+  }
+  if v, ok := j["$v"]; ok {
+    result = v
+    return
+  }
+  if t, ok := j["$t"]; ok {
+    str, ok := t.(string)
+    if !ok {
+      err = errors.New("Malformed snapshot: '$t' must be a string")
+      return
+    }
+    text := &SimpleText{Text: str}
+    if text.tombs, err = decodeSnapshotTombs(j["tombs"]); err != nil {
+      return
+    }
+    runs, ok := j["attrs"].([]interface{})
+    if !ok {
+      err = errors.New("Malformed snapshot: Missing 'attrs' property")
+      return
+    }
+    for _, r := range runs {
+      run, ok := r.([]interface{})
+      if !ok || len(run) != 2 {
+        err = errors.New("Malformed snapshot: Malformed run of attributes")
+        return
+      }
+      count, ok := run[0].(float64)
+      attrs, ok2 := run[1].(map[string]interface{})
+      if !ok || count < 0 || count > float64(len(str)) || (!ok2 && run[1] != nil) {
+        err = errors.New("Malformed snapshot: Malformed run of attributes")
+        return
+      }
+      for i := 0; i < int(count); i++ {
+        text.attributes = append(text.attributes, attrs)
+      }
+    }
+    if len(text.attributes) != len(str) || countChars(text.tombs) != len(str) {
+      err = errors.New("Malformed snapshot: Text, tombs and attributes do not match")
+      return
+    }
+    result = text
+    return
+  }
+  if a, ok := j["$a"]; ok {
+    elements, ok := a.([]interface{})
+    if !ok {
+      err = errors.New("Malformed snapshot: '$a' must be a list")
+      return
+    }
+    arr := &SimpleArray{}
+    if arr.tombs, err = decodeSnapshotTombs(j["tombs"]); err != nil {
+      return
+    }
+    for _, e := range elements {
+      var x interface{}
+      if x, err = decodeSnapshotValue(e); err != nil {
+        return
+      }
+      arr.array = append(arr.array, x)
+    }
+    if countChars(arr.tombs) != len(arr.array) {
+      err = errors.New("Malformed snapshot: Array and tombs do not match")
+      return
+    }
+    result = arr
+    return
+  }
+  if o, ok := j["$o"]; ok {
+    attrs, ok := o.(map[string]interface{})
+    if !ok {
+      err = errors.New("Malformed snapshot: '$o' must be an object")
+      return
+    }
+    obj := NewSimpleObject()
+    for key, a := range attrs {
+      attr, ok := a.(map[string]interface{})
+      if !ok {
+        err = errors.New("Malformed snapshot: Malformed attribute")
+        return
+      }
+      version, ok := attr["v"].(float64)
+      if !ok {
+        err = errors.New("Malformed snapshot: Malformed attribute version")
+        return
+      }
+      var x interface{}
+      if x, err = decodeSnapshotValue(attr["d"]); err != nil {
+        return
+      }
+      obj.Set(key, int(version), x)
+    }
+    result = obj
+    return
+  }
+  err = errors.New("Malformed snapshot: Unknown kind of value")
+  return
+}
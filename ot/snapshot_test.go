@@ -0,0 +1,175 @@
+package ot
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestSnapshotCodec(t *testing.T) {
+  arr := newTestArray(3)
+  obj := NewSimpleObject()
+  obj.Set("x", 2, "constant")
+  obj.Set("y", 0, NewSimpleText("abc"))
+  for test := 0; test < 100; test++ {
+    b := NewSimpleBuilder()
+    var doc interface{} = NewSimpleText("abcdefghijk")
+    for i := 0; i < 5; i++ {
+      op := Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc.(*SimpleText)), []string{"bold", "link"})}
+      doc = applyLocal(t, nil, b, doc, localMutation("a", b, op))
+    }
+    blob, err := EncodeSnapshot(b.Snapshot(doc))
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    snap, err := DecodeSnapshot(blob)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if snap.SequenceNumber != 5 || len(snap.Frontier) != 1 || !snap.Frontier[b.AppliedMutationIDs()[4]] {
+      t.Fatalf("Wrong sequence number or frontier: %v %v", snap.SequenceNumber, snap.Frontier)
+    }
+    text := snap.Document.(*SimpleText)
+    if renderRuns(text) != renderRuns(doc.(*SimpleText)) || fmt.Sprintf("%v", text.tombs) != fmt.Sprintf("%v", doc.(*SimpleText).tombs) {
+      t.Fatalf("Snapshot changed the text:\n\t%v %v\n\t%v %v", renderRuns(doc.(*SimpleText)), doc.(*SimpleText).tombs, renderRuns(text), text.tombs)
+    }
+  }
+  // Arrays and objects
+  for _, doc := range []interface{}{arr, obj} {
+    blob, err := EncodeSnapshot(Snapshot{Document: doc, Frontier: make(Frontier)})
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    snap, err := DecodeSnapshot(blob)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    blob2, err := EncodeSnapshot(snap)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if string(blob) != string(blob2) {
+      t.Fatalf("Snapshot round trip failed:\n\t%v\n\t%v", string(blob), string(blob2))
+    }
+  }
+  if _, err := DecodeSnapshot([]byte(`{"seq":1, "frontier":[], "doc":{"$t":"abc", "tombs":[2,-3], "attrs":[[3,null]]}}`)); err == nil {
+    t.Fatal("Malformed snapshot has been accepted")
+  }
+}
+
+// Passes the mutation through the JSON codec, such that all numbers are float64 like in a snapshot
+func jsonMutation(t *testing.T, mut Mutation) Mutation {
+  if mut.Dependencies == nil {
+    mut.Dependencies = []string{}
+  }
+  blob, _, err := EncodeMutation(mut, EncNormal)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if mut, err = DecodeMutation(blob); err != nil {
+    t.Fatal(err.Error())
+  }
+  return mut
+}
+
+func TestSnapshotBuild(t *testing.T) {
+  for test := 0; test < 100; test++ {
+    b := NewSimpleBuilder()
+    var doc interface{} = NewSimpleText("abcdefghijk")
+    for i := 0; i < 5; i++ {
+      op := Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc.(*SimpleText)), []string{"bold"})}
+      doc = applyLocal(t, nil, b, doc, jsonMutation(t, localMutation("a", b, op)))
+    }
+    old := b.Frontier().IDs()
+    blob, err := EncodeSnapshot(b.Snapshot(doc))
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc = applyLocal(t, nil, b, doc, jsonMutation(t, localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc.(*SimpleText)), []string{"bold"})})))
+    // Restore a second builder and document from the snapshot
+    snap, err := DecodeSnapshot(blob)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    b2 := NewSimpleBuilderFromSnapshot(snap)
+    doc2 := snap.Document
+    // Site b edits concurrently to the last mutation of site a
+    m := Mutation{Site: "b", Dependencies: old, Operation: Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc2.(*SimpleText)), []string{"bold"})}}
+    m = jsonMutation(t, m)
+    // Apply all mutations after the snapshot in a different order to the two builders
+    for _, x := range []struct {
+      b   *SimpleBuilder
+      doc *interface{}
+      muts []Mutation
+    }{{b, &doc, []Mutation{m}}, {b2, &doc2, []Mutation{m, b.AppliedMutation(b.AppliedMutationIDs()[5])}}} {
+      for _, mut := range x.muts {
+        if _, err := Build(x.b, mut); err != nil {
+          t.Fatal(err.Error())
+        }
+        if *x.doc, err = Execute(*x.doc, x.b.AppliedMutation(mut.ID)); err != nil {
+          t.Fatal(err.Error())
+        }
+      }
+    }
+    if renderRuns(doc.(*SimpleText)) != renderRuns(doc2.(*SimpleText)) {
+      t.Fatalf("Documents differ:\n\t%v\n\t%v", renderRuns(doc.(*SimpleText)), renderRuns(doc2.(*SimpleText)))
+    }
+    if b2.AppliedMutation(m.ID).AppliedAt != 5 {
+      t.Fatalf("Wrong AppliedAt: %v", b2.AppliedMutation(m.ID).AppliedAt)
+    }
+    // A mutation which is concurrent to a mutation before the snapshot cannot be applied
+    m = Mutation{Site: "c", Dependencies: []string{}, Operation: Operation{Kind: StringOp, Len: 1, Operations: []Operation{Operation{Kind: InsertOp, Len: 1, Value: "x"}}}}
+    _, m.ID, _ = EncodeMutation(m, EncNormal)
+    if _, err := Build(b2, m); err == nil {
+      t.Fatal("Build must fail for mutations concurrent to the snapshot")
+    }
+    // The same holds if the mutation depends on a mutation before the snapshot which is not part of its frontier
+    m = jsonMutation(t, Mutation{Site: "c", Dependencies: []string{b.AppliedMutationIDs()[1]}, Operation: Operation{Kind: StringOp, Len: 1, Operations: []Operation{Operation{Kind: InsertOp, Len: 1, Value: "x"}}}})
+    if _, err := Build(b2, m); err == nil {
+      t.Fatal("Build must fail for mutations depending on a mutation before the snapshot")
+    }
+  }
+}
+
+func TestCompact(t *testing.T) {
+  for test := 0; test < 100; test++ {
+    b := NewSimpleBuilder()
+    var doc interface{} = NewSimpleText("abcdefghijk")
+    var frontier Frontier
+    for i := 0; i < 8; i++ {
+      op := Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc.(*SimpleText)), []string{"bold"})}
+      doc = applyLocal(t, nil, b, doc, localMutation("a", b, op))
+      if i == 4 {
+        frontier = Frontier{b.AppliedMutationIDs()[4]: true}
+      }
+    }
+    compacted, err := b.Compact(frontier)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if compacted != 5 || len(b.AppliedMutationIDs()) != 3 {
+      t.Fatalf("Wrong number of compacted mutations: %v", compacted)
+    }
+    // Replaying the base and the remaining history yields the same document
+    var replay interface{} = NewSimpleText("abcdefghijk")
+    if replay, err = Execute(replay, *b.Base()); err != nil {
+      t.Fatal(err.Error())
+    }
+    for mut := range b.History(false) {
+      if replay, err = Execute(replay, mut); err != nil {
+        t.Fatal(err.Error())
+      }
+    }
+    if renderRuns(replay.(*SimpleText)) != renderRuns(doc.(*SimpleText)) {
+      t.Fatalf("Replay differs:\n\t%v\n\t%v", renderRuns(replay.(*SimpleText)), renderRuns(doc.(*SimpleText)))
+    }
+    // Compacted mutations are still known and AppliedAt keeps counting
+    if !b.HasApplied(frontier.IDs()[0]) {
+      t.Fatal("Compacted mutation is unknown")
+    }
+    mut := localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc.(*SimpleText)), []string{"bold"})})
+    doc = applyLocal(t, nil, b, doc, mut)
+    if b.AppliedMutation(mut.ID).AppliedAt != 8 {
+      t.Fatalf("Wrong AppliedAt: %v", b.AppliedMutation(mut.ID).AppliedAt)
+    }
+  }
+}
@@ -35,14 +35,14 @@ func (self *stream) Read(length int) (op Operation) {
   if op.Kind == InsertOp {
     if self.inside == 0 && length == op.Len {
       // Do nothing by intention
-    } else {
-      str := op.Value.(string)
+    } else if str, ok := op.Value.(string); ok {
       if len(str) > 0 {
         op.Value = str[self.inside : self.inside+length]
       } else {
         op.Value = ""
       }
     }
+    // Otherwise the InsertOp inserts tombs in an array. Only the Len field needs to be adjusted
   }
   self.inside += length
   if self.inside == op.Len {
@@ -144,7 +144,13 @@ func transformOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation,
   if op1.Kind == NoOp || op2.Kind == NoOp {
     return
   }
+  if isOverwritten(op1) || isOverwritten(op2) {
+    return transformElementOp(op1, op2)
+  }
   if op1.Kind != op2.Kind {
+    if op1.Kind == OverwriteOp || op2.Kind == OverwriteOp {
+      return transformElementOp(op1, op2)
+    }
     err = errors.New("Operations of both streams operate on a different data type or they are not allowed in this place")
     return
   }
@@ -152,9 +158,14 @@ func transformOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation,
   case StringOp:
     top1.Operations, top2.Operations, err = transformOps(op1.Operations, op2.Operations, transformStringOp)
   case ArrayOp:
-    // TODO
+    top1.Operations, top2.Operations, err = transformOps(op1.Operations, op2.Operations, transformArrayOp)
   case ObjectOp:
     top1.Operations, top2.Operations, err = transformObject(op1.Operations, op2.Operations)
+  case IncrementOp:
+    // Increments commute. Nothing to do
+  case OverwriteOp:
+    // Last writer wins. op2 belongs to the mutation with the larger Site (or ID) and therefore it wins.
+    top1 = overwrittenOp(op1)
   default:
     err = errors.New("Operation kind not allowed in this place")
   }
@@ -189,11 +200,11 @@ func transformOps(ops1 []Operation, ops2 []Operation, f transformFunc) (tops1 []
 
 // Transform a pair of operations that works on a string
 func transformStringOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation, err error) {
-  if op1.Kind != InsertOp && op1.Kind != SkipOp && op1.Kind != DeleteOp && op1.Kind != NoOp {
+  if op1.Kind != InsertOp && op1.Kind != SkipOp && op1.Kind != DeleteOp && op1.Kind != FormatOp && op1.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: %v", op1.Kind))
     return
   }
-  if op2.Kind != InsertOp && op2.Kind != SkipOp && op2.Kind != DeleteOp && op2.Kind != NoOp {
+  if op2.Kind != InsertOp && op2.Kind != SkipOp && op2.Kind != DeleteOp && op2.Kind != FormatOp && op2.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in a string: %v", op2.Kind))
     return
   }
@@ -203,6 +214,112 @@ func transformStringOp(op1 Operation, op2 Operation) (top1 Operation, top2 Opera
     top2 = Operation{Kind: SkipOp, Len: op1.Len}
   } else if op2.Kind == InsertOp {
     top1 = Operation{Kind: SkipOp, Len: op2.Len}
+  } else if op1.Kind == FormatOp && op2.Kind == FormatOp {
+    top1 = transformFormatOp(op1, op2)
+  }
+  return
+}
+
+// Two FormatOps format the same characters. If both set the same attribute, op2 wins, because it belongs
+// to the mutation with the larger Site (or ID). The attributes of op1 are removed accordingly.
+// The original op1 is kept as the first child of the transformed op1, because it is required
+// again if op2 is pruned. Each further child lists the attributes which op1 lost against one FormatOp.
+// An attribute is restored only if all FormatOps that won it are pruned.
+func transformFormatOp(op1 Operation, op2 Operation) (top1 Operation) {
+  original := formatOriginal(op1)
+  lost := make(map[string]interface{})
+  attrs2 := formatAttributes(formatOriginal(op2))
+  for key, val := range formatAttributes(original) {
+    if _, ok := attrs2[key]; ok {
+      lost[key] = val
+    }
+  }
+  if len(lost) == 0 {
+    return op1
+  }
+  ops := []Operation{original}
+  if len(op1.Operations) > 0 {
+    ops = append(ops, op1.Operations[1:]...)
+  }
+  ops = append(ops, Operation{Kind: FormatOp, Len: op1.Len, Value: lost})
+  return lostFormatOp(op1.Len, ops)
+}
+
+// Returns the FormatOp which has not been transformed against any concurrent FormatOp
+func formatOriginal(op Operation) Operation {
+  if op.Kind == FormatOp && len(op.Operations) > 0 {
+    return op.Operations[0]
+  }
+  return op
+}
+
+// Computes a FormatOp from its original and the attributes it lost.
+// 'ops' holds the original FormatOp followed by the attributes lost against each winning FormatOp.
+func lostFormatOp(length int, ops []Operation) Operation {
+  if len(ops) == 1 {
+    return Operation{Kind: FormatOp, Len: length, Value: formatAttributes(ops[0])}
+  }
+  attrs := make(map[string]interface{})
+  for key, val := range formatAttributes(ops[0]) {
+    attrs[key] = val
+  }
+  for _, lost := range ops[1:] {
+    for key, _ := range formatAttributes(lost) {
+      delete(attrs, key)
+    }
+  }
+  return Operation{Kind: FormatOp, Len: length, Value: attrs, Operations: ops}
+}
+
+// Transform a pair of operations that works on an array.
+// Inside an array, StringOp, ArrayOp and ObjectOp have a length of 1 and mutate the element at the current position.
+func transformArrayOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation, err error) {
+  if op1.Kind != InsertOp && op1.Kind != SkipOp && op1.Kind != DeleteOp && op1.Kind != StringOp && op1.Kind != ArrayOp && op1.Kind != ObjectOp && op1.Kind != OverwriteOp && op1.Kind != IncrementOp && op1.Kind != NoOp {
+    err = errors.New(fmt.Sprintf("Operation not allowed in an array: %v", op1.Kind))
+    return
+  }
+  if op2.Kind != InsertOp && op2.Kind != SkipOp && op2.Kind != DeleteOp && op2.Kind != StringOp && op2.Kind != ArrayOp && op2.Kind != ObjectOp && op2.Kind != OverwriteOp && op2.Kind != IncrementOp && op2.Kind != NoOp {
+    err = errors.New(fmt.Sprintf("Operation not allowed in an array: %v", op2.Kind))
+    return
+  }
+  top1 = op1
+  top2 = op2
+  if op1.Kind == InsertOp {
+    top2 = Operation{Kind: SkipOp, Len: op1.Len}
+  } else if op2.Kind == InsertOp {
+    top1 = Operation{Kind: SkipOp, Len: op2.Len}
+  } else {
+    top1, top2, err = transformElementOp(op1, op2)
+  }
+  // A DeleteOp paired with a StringOp, ArrayOp, ObjectOp, OverwriteOp or IncrementOp requires no changes.
+  // The mutation is kept and executed on a tomb, which has no effect. This is required for pruning.
+  return
+}
+
+// Transform two operations that mutate the same array element or the same version of an attribute.
+// An operation that has already been overwritten is overwritten once more by each further OverwriteOp
+// that wins against it, even if that OverwriteOp has been overwritten itself.
+// Hence, the operation becomes visible again only if all the OverwriteOps that won against it are pruned.
+func transformElementOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation, err error) {
+  top1 = op1
+  top2 = op2
+  base1 := overwrittenBase(op1)
+  base2 := overwrittenBase(op2)
+  if base1.Kind == OverwriteOp && base2.Kind == OverwriteOp {
+    // Last writer wins. op2 belongs to the mutation with the larger Site (or ID) and therefore it wins.
+    top1 = overwrittenOp(op1)
+  } else if base1.Kind == OverwriteOp && (base2.Kind == StringOp || base2.Kind == ArrayOp || base2.Kind == ObjectOp || base2.Kind == IncrementOp) {
+    // The overwrite replaces the value that op2 wants to mutate
+    top2 = overwrittenOp(op2)
+  } else if base2.Kind == OverwriteOp && (base1.Kind == StringOp || base1.Kind == ArrayOp || base1.Kind == ObjectOp || base1.Kind == IncrementOp) {
+    top1 = overwrittenOp(op1)
+  } else if (base1.Kind == StringOp || base1.Kind == ArrayOp || base1.Kind == ObjectOp || base1.Kind == OverwriteOp || base1.Kind == IncrementOp) && (base2.Kind == StringOp || base2.Kind == ArrayOp || base2.Kind == ObjectOp || base2.Kind == OverwriteOp || base2.Kind == IncrementOp) {
+    // Mutations that have been overwritten are transformed nonetheless, because they become visible again
+    // if the OverwriteOps are pruned
+    var tbase1, tbase2 Operation
+    tbase1, tbase2, err = transformOp(base1, base2)
+    top1 = replaceOverwrittenBase(op1, tbase1)
+    top2 = replaceOverwrittenBase(op2, tbase2)
   }
   return
 }
@@ -247,11 +364,11 @@ func transformObject(ops1 []Operation, ops2 []Operation) (tops1 []Operation, top
 }
 
 func transformAttrOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operation, err error) {
-  if op1.Kind != InsertOp && op1.Kind != SkipOp && op1.Kind != ObjectOp && op1.Kind != ArrayOp && op1.Kind != StringOp && op1.Kind != NoOp {
+  if op1.Kind != InsertOp && op1.Kind != SkipOp && op1.Kind != ObjectOp && op1.Kind != ArrayOp && op1.Kind != StringOp && op1.Kind != OverwriteOp && op1.Kind != IncrementOp && op1.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in an object context: %v", op1.Kind))
     return
   }
-  if op2.Kind != InsertOp && op2.Kind != SkipOp && op2.Kind != ObjectOp && op2.Kind != ArrayOp && op2.Kind != StringOp && op2.Kind != NoOp {
+  if op2.Kind != InsertOp && op2.Kind != SkipOp && op2.Kind != ObjectOp && op2.Kind != ArrayOp && op2.Kind != StringOp && op2.Kind != OverwriteOp && op2.Kind != IncrementOp && op2.Kind != NoOp {
     err = errors.New(fmt.Sprintf("Operation not allowed in an object context: %v", op2.Kind))
     return
   }
@@ -261,8 +378,8 @@ func transformAttrOp(op1 Operation, op2 Operation) (top1 Operation, top2 Operati
     top2 = Operation{Kind: SkipOp, Len: 1}
   } else if op2.Kind == InsertOp {
     top1 = Operation{Kind: SkipOp, Len: 1}
-  } else if (op1.Kind == StringOp || op1.Kind == ArrayOp || op1.Kind == ObjectOp) && (op2.Kind == StringOp || op2.Kind == ArrayOp || op2.Kind == ObjectOp) {
-    top1, top2, err = transformOp(op1, op2)
+  } else {
+    top1, top2, err = transformElementOp(op1, op2)
   }
   return
 }
@@ -0,0 +1,553 @@
+package ot
+
+import (
+  "errors"
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// -------------------------------------------
+// Inversion of operations
+
+// Computes an operation that reverts the effect of 'op'.
+// The input must be the document before 'op' is executed on it, because
+// the inverse of a DeleteOp or OverwriteOp needs to know the deleted or overwritten content.
+// The inverse operation applies to the document after 'op' has been executed.
+//
+// Deleted characters and elements cannot be revived, because they are tombs now.
+// Instead, the inverse inserts them again in front of their tombs.
+// Inverting a StringOp requires a SimpleText and inverting an ArrayOp requires a SimpleArray.
+func Invert(input interface{}, op Operation) (inverse Operation, err error) {
+  switch op.Kind {
+  case NoOp, SkipOp:
+    return op, nil
+  case OverwriteOp:
+    switch input.(type) {
+    case *SimpleText, *SimpleArray, *SimpleObject:
+      err = errors.New("An OverwriteOp of a mutable object cannot be inverted")
+      return
+    }
+    return Operation{Kind: OverwriteOp, Len: 1, Value: input}, nil
+  case IncrementOp:
+    var val interface{}
+    if val, err = addNumbers(0, op.Value); err != nil {
+      return
+    }
+    if i, ok := val.(int); ok {
+      return Operation{Kind: IncrementOp, Len: 1, Value: -i}, nil
+    }
+    return Operation{Kind: IncrementOp, Len: 1, Value: -val.(float64)}, nil
+  case StringOp:
+    if input == nil {
+      input = NewSimpleText("")
+    }
+    text, ok := input.(*SimpleText)
+    if !ok {
+      err = errors.New("Inverting a StringOp requires a SimpleText")
+      return
+    }
+    inverse = Operation{Kind: StringOp, Len: 1}
+    inverse.Operations, err = invertString(text, op.Operations)
+  case ArrayOp:
+    if input == nil {
+      input = NewSimpleArray()
+    }
+    arr, ok := input.(*SimpleArray)
+    if !ok {
+      err = errors.New("Inverting an ArrayOp requires a SimpleArray")
+      return
+    }
+    inverse = Operation{Kind: ArrayOp, Len: 1}
+    inverse.Operations, err = invertArray(arr, op.Operations)
+  case ObjectOp:
+    obj, ok := input.(Object)
+    if !ok {
+      err = errors.New("Type mismatch: Not an object")
+      return
+    }
+    inverse = Operation{Kind: ObjectOp, Len: 1}
+    inverse.Operations, err = invertObject(obj, op.Operations)
+  default:
+    err = errors.New("Operation not allowed in this place")
+  }
+  return
+}
+
+// Appends an operation and merges it with the previous one if both are SkipOps or DeleteOps
+func appendInverse(ops []Operation, op Operation) []Operation {
+  if len(ops) > 0 && (op.Kind == SkipOp || op.Kind == DeleteOp) && ops[len(ops)-1].Kind == op.Kind {
+    ops[len(ops)-1].Len += op.Len
+    return ops
+  }
+  return append(ops, op)
+}
+
+func invertString(text *SimpleText, ops []Operation) (inverse []Operation, err error) {
+  // Do not modify the tombs of the text
+  tombs := IntVector(text.tombs.Copy())
+  ts := NewTombStream(&tombs)
+  pos := 0
+  for _, op := range ops {
+    switch op.Kind {
+    case InsertOp:
+      if str, _ := op.Value.(string); len(str) == 0 {
+        inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: op.Len})
+      } else {
+        inverse = appendInverse(inverse, Operation{Kind: DeleteOp, Len: op.Len})
+      }
+    case SkipOp:
+      var chars int
+      if chars, err = ts.Skip(op.Len); err != nil {
+        return
+      }
+      pos += chars
+      inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: op.Len})
+    case DeleteOp, FormatOp:
+      attrs := formatAttributes(op)
+      for i := 0; i < op.Len; i++ {
+        var char bool
+        if char, err = ts.IsChar(); err != nil {
+          return
+        }
+        if _, err = ts.Skip(1); err != nil {
+          return
+        }
+        if !char {
+          inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: 1})
+          continue
+        }
+        if op.Kind == DeleteOp {
+          // Insert the character again in front of its tomb
+          ins := Operation{Kind: InsertOp, Len: 1, Value: text.Text[pos : pos+1]}
+          if a := text.attributes[pos]; len(a) > 0 {
+            ins.Operations = []Operation{Operation{Kind: FormatOp, Value: a}}
+          }
+          inverse = append(inverse, ins)
+          inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: 1})
+        } else {
+          // Restore the previous value of all attributes changed by the FormatOp
+          old := make(map[string]interface{})
+          for key, _ := range attrs {
+            old[key] = text.attributes[pos][key]
+          }
+          if l := len(inverse); l > 0 && inverse[l-1].Kind == FormatOp && equalAttributes(inverse[l-1].Value.(map[string]interface{}), old) {
+            inverse[l-1].Len++
+          } else {
+            inverse = append(inverse, Operation{Kind: FormatOp, Len: 1, Value: old})
+          }
+        }
+        pos++
+      }
+    case NoOp:
+      // Do nothing by intention
+    default:
+      err = errors.New(fmt.Sprintf("Operation not allowed in a string: %v", op.Kind))
+      return
+    }
+  }
+  return
+}
+
+func invertArray(arr *SimpleArray, ops []Operation) (inverse []Operation, err error) {
+  // Do not modify the tombs of the array
+  tombs := IntVector(arr.tombs.Copy())
+  ts := NewTombStream(&tombs)
+  pos := 0
+  for _, op := range ops {
+    switch op.Kind {
+    case InsertOp:
+      if isArrayTomb(op) {
+        inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: op.Len})
+      } else {
+        inverse = appendInverse(inverse, Operation{Kind: DeleteOp, Len: 1})
+      }
+    case SkipOp:
+      var chars int
+      if chars, err = ts.Skip(op.Len); err != nil {
+        return
+      }
+      pos += chars
+      inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: op.Len})
+    case DeleteOp:
+      for i := 0; i < op.Len; i++ {
+        var char bool
+        if char, err = ts.IsChar(); err != nil {
+          return
+        }
+        if _, err = ts.Skip(1); err != nil {
+          return
+        }
+        if char {
+          // Insert the element again in front of its tomb
+          var ins Operation
+          if ins, err = insertOperationOf(arr.array[pos]); err != nil {
+            return
+          }
+          inverse = append(inverse, ins)
+          pos++
+        }
+        inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: 1})
+      }
+    case StringOp, ObjectOp, ArrayOp, OverwriteOp, IncrementOp:
+      var char bool
+      if char, err = ts.IsChar(); err != nil {
+        return
+      }
+      if _, err = ts.Skip(1); err != nil {
+        return
+      }
+      // Mutations of elements that have been deleted have no effect
+      if !char {
+        inverse = appendInverse(inverse, Operation{Kind: SkipOp, Len: 1})
+        continue
+      }
+      var inv Operation
+      if inv, err = Invert(arr.array[pos], op); err != nil {
+        return
+      }
+      inverse = append(inverse, inv)
+      pos++
+    case NoOp:
+      // Do nothing by intention
+    default:
+      err = errors.New(fmt.Sprintf("Operation not allowed in an array: %v", op.Kind))
+      return
+    }
+  }
+  return
+}
+
+func invertObject(obj Object, ops []Operation) (inverse []Operation, err error) {
+  for _, attr := range ops {
+    if attr.Kind != AttributeOp {
+      err = errors.New("Expected an AttributeOp as child of ObjectOp")
+      return
+    }
+    // Find out which operation is executed on the current version (see executeObject)
+    version, val := obj.Get(attr.Value.(string))
+    pos := 0
+    var exec_op Operation
+    for _, op := range attr.Operations {
+      switch op.Kind {
+      case InsertOp:
+        if pos <= version {
+          version++
+        } else {
+          exec_op = op
+        }
+        pos++
+      case SkipOp:
+        pos += op.Len
+      case StringOp, ObjectOp, ArrayOp, OverwriteOp, IncrementOp:
+        if pos == version {
+          exec_op = op
+        }
+        pos++
+      }
+    }
+    var ops []Operation
+    switch exec_op.Kind {
+    case InsertOp:
+      // Insert the old value as the latest version
+      var ins Operation
+      if ins, err = insertOperationOf(val); err != nil {
+        return
+      }
+      ops = appendInverse(ops, Operation{Kind: SkipOp, Len: pos})
+      ops = append(ops, ins)
+    case StringOp, ObjectOp, ArrayOp, OverwriteOp, IncrementOp:
+      var inv Operation
+      if inv, err = Invert(val, exec_op); err != nil {
+        return
+      }
+      if version > 0 {
+        ops = append(ops, Operation{Kind: SkipOp, Len: version})
+      }
+      ops = append(ops, inv)
+      if pos-version-1 > 0 {
+        ops = append(ops, Operation{Kind: SkipOp, Len: pos - version - 1})
+      }
+    default:
+      ops = append(ops, Operation{Kind: SkipOp, Len: pos})
+    }
+    inverse = append(inverse, Operation{Kind: AttributeOp, Value: attr.Value, Operations: ops})
+  }
+  return
+}
+
+// Computes an InsertOp that inserts a copy of the value.
+// Mutable objects are copied by InsertOps that have a StringOp, ArrayOp or ObjectOp as child.
+func insertOperationOf(value interface{}) (op Operation, err error) {
+  op = Operation{Kind: InsertOp, Len: 1}
+  var child Operation
+  switch val := value.(type) {
+  case *SimpleText:
+    child = Operation{Kind: StringOp, Len: 1}
+    for _, run := range val.Runs() {
+      ins := Operation{Kind: InsertOp, Len: len(run.Text), Value: run.Text}
+      if len(run.Attributes) > 0 {
+        ins.Operations = []Operation{Operation{Kind: FormatOp, Value: run.Attributes}}
+      }
+      child.Operations = append(child.Operations, ins)
+    }
+  case *SimpleArray:
+    child = Operation{Kind: ArrayOp, Len: 1}
+    for _, element := range val.array {
+      var ins Operation
+      if ins, err = insertOperationOf(element); err != nil {
+        return
+      }
+      child.Operations = append(child.Operations, ins)
+    }
+  case *SimpleObject:
+    child = Operation{Kind: ObjectOp, Len: 1}
+    // Sort the keys to make the operation deterministic
+    keys := []string{}
+    for key, _ := range val.values {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+      var ins Operation
+      if ins, err = insertOperationOf(val.values[key]); err != nil {
+        return
+      }
+      child.Operations = append(child.Operations, Operation{Kind: AttributeOp, Value: key, Operations: []Operation{ins}})
+    }
+  default:
+    op.Value = value
+    return
+  }
+  op.Operations = []Operation{child}
+  return
+}
+
+// -------------------------------------------
+// UndoManager
+
+// An entry in the undo or redo stack.
+// It reverts one or more mutations of the local site.
+type undoStep struct {
+  // The IDs of the mutations that are reverted by this step in the order in which they have been applied
+  ids []string
+  // The inverse operations of these mutations
+  inverses []Operation
+}
+
+// The UndoManager reverts and restores mutations of the local site.
+//
+// Undoing a mutation in a collaborative setting means that the inverse of the mutation
+// must be transformed against all mutations which have been applied after it.
+// Otherwise the inverse would revert changes of other sites as well.
+// The UndoManager finds these mutations in the history of the Builder.
+//
+// The application must call Record before it executes a local mutation on the document.
+// Undo and Redo return a new local mutation which the application must pass to Build and Execute, too.
+// Record must not be called for these mutations.
+type UndoManager struct {
+  site    string
+  builder Builder
+  // Flags passed to EncodeMutation to compute the ID of undo and redo mutations
+  EncodingFlags int
+  undoStack     []*undoStep
+  redoStack     []*undoStep
+  // The number of nested BeginGroup calls
+  groupLevel int
+  // True if the next recorded mutation starts a new undo step
+  newStep bool
+  // The IDs of all undo and redo mutations computed by the manager
+  reincarnations map[string]bool
+}
+
+func NewUndoManager(site string, builder Builder) *UndoManager {
+  return &UndoManager{site: site, builder: builder, newStep: true, reincarnations: make(map[string]bool)}
+}
+
+// All mutations recorded until the matching call to EndGroup are reverted in one undo step.
+// Groups can be nested.
+func (self *UndoManager) BeginGroup() {
+  if self.groupLevel == 0 {
+    self.newStep = true
+  }
+  self.groupLevel++
+}
+
+func (self *UndoManager) EndGroup() {
+  if self.groupLevel == 0 {
+    return
+  }
+  self.groupLevel--
+  if self.groupLevel == 0 {
+    self.newStep = true
+  }
+}
+
+// Records a mutation of the local site. 'input' must be the document before the mutation is executed on it.
+// The mutation must have an ID and it must be passed to Build.
+func (self *UndoManager) Record(input interface{}, mut Mutation) (err error) {
+  if mut.Site != self.site {
+    return errors.New("Only mutations of the local site can be undone")
+  }
+  inverse, err := Invert(input, mut.Operation)
+  if err != nil {
+    return
+  }
+  if self.newStep || len(self.undoStack) == 0 {
+    self.undoStack = append(self.undoStack, &undoStep{})
+    self.newStep = self.groupLevel == 0
+  }
+  step := self.undoStack[len(self.undoStack)-1]
+  step.ids = append(step.ids, mut.ID)
+  step.inverses = append(step.inverses, inverse)
+  // A new edit invalidates everything that could be redone
+  self.redoStack = nil
+  return
+}
+
+func (self *UndoManager) CanUndo() bool {
+  return len(self.undoStack) > 0
+}
+
+func (self *UndoManager) CanRedo() bool {
+  return len(self.redoStack) > 0
+}
+
+// Computes a mutation that reverts the latest undo step.
+// 'input' is the current document.
+func (self *UndoManager) Undo(input interface{}) (mut Mutation, err error) {
+  if len(self.undoStack) == 0 {
+    err = errors.New("Nothing to undo")
+    return
+  }
+  step := self.undoStack[len(self.undoStack)-1]
+  var inverse Operation
+  if mut, inverse, err = self.revert(input, step); err != nil {
+    return
+  }
+  self.undoStack = self.undoStack[:len(self.undoStack)-1]
+  self.redoStack = append(self.redoStack, &undoStep{ids: []string{mut.ID}, inverses: []Operation{inverse}})
+  self.newStep = true
+  return
+}
+
+// Computes a mutation that restores what the latest Undo has reverted.
+// 'input' is the current document.
+func (self *UndoManager) Redo(input interface{}) (mut Mutation, err error) {
+  if len(self.redoStack) == 0 {
+    err = errors.New("Nothing to redo")
+    return
+  }
+  step := self.redoStack[len(self.redoStack)-1]
+  var inverse Operation
+  if mut, inverse, err = self.revert(input, step); err != nil {
+    return
+  }
+  self.redoStack = self.redoStack[:len(self.redoStack)-1]
+  self.undoStack = append(self.undoStack, &undoStep{ids: []string{mut.ID}, inverses: []Operation{inverse}})
+  self.newStep = true
+  return
+}
+
+// Computes a mutation that reverts all mutations of the step.
+// Furthermore, it computes the inverse of this mutation, such that it can be reverted, too.
+func (self *UndoManager) revert(input interface{}, step *undoStep) (mut Mutation, inverse Operation, err error) {
+  // Read the history. The oldest mutation comes first.
+  history := []Mutation{}
+  index := make(map[string]int)
+  for m := range self.builder.History(false) {
+    index[m.ID] = len(history)
+    history = append(history, m)
+  }
+  // Revert the mutations of the step in reverse order
+  var reverted []Mutation
+  for i := len(step.ids) - 1; i >= 0; i-- {
+    pos, ok := index[step.ids[i]]
+    if !ok {
+      err = errors.New(fmt.Sprintf("Mutation %v has not been applied", step.ids[i]))
+      return
+    }
+    // The inverse applies to the document right after the mutation has been applied.
+    // Transform it against all mutations applied later and against the inverses computed so far.
+    // Transform uses the ID to break ties. The ID of the inverse is larger than any hex-encoded ID,
+    // such that the inverse wins against the (earlier) mutations of the local site.
+    m := Mutation{ID: fmt.Sprintf("~%v", len(reverted)), Site: self.site, Operation: step.inverses[i]}
+    for _, h := range append(history[pos+1:len(history):len(history)], reverted...) {
+      if _, m, err = Transform(h, m); err != nil {
+        return
+      }
+      if self.reincarnations[h.ID] || strings.HasPrefix(h.ID, "~") {
+        m.Operation = forwardToReincarnations(m.Operation, h.Operation)
+      }
+    }
+    reverted = append(reverted, m)
+  }
+  if mut, err = ComposeSeq(reverted); err != nil {
+    return
+  }
+  if inverse, err = Invert(input, mut.Operation); err != nil {
+    return
+  }
+  mut = Mutation{Site: self.site, Dependencies: self.builder.Frontier().IDs(), Operation: mut.Operation}
+  if _, mut.ID, err = EncodeMutation(mut, self.EncodingFlags); err != nil {
+    return
+  }
+  self.reincarnations[mut.ID] = true
+  return
+}
+
+// Reads operations from the stream until 'length' characters or elements have been read.
+// InsertOps are read as well, but they do not count.
+func readOps(s *stream, length int) (ops []Operation) {
+  for !s.IsEOF() && (length > 0 || s.ops[s.pos].Kind == InsertOp) {
+    if s.ops[s.pos].Kind == InsertOp {
+      ops = append(ops, s.Read(-1))
+      continue
+    }
+    l := min(length, s.ops[s.pos].Len-s.inside)
+    ops = append(ops, s.Read(l))
+    length -= l
+  }
+  return
+}
+
+// The inverse of a DeleteOp cannot revive a tomb. Instead, it inserts a reincarnation in front of the tomb (see Invert).
+// 'h' is an undo or redo mutation of the local site and 'op' applies to the document after 'h'.
+// All operations of 'op' that delete, format or mutate a reincarnated tomb are applied to the reincarnation as well.
+// Without this, undoing an insertion after undoing a later deletion would leave the reincarnated characters behind.
+func forwardToReincarnations(op Operation, h Operation) Operation {
+  if op.Kind != h.Kind || (op.Kind != StringOp && op.Kind != ArrayOp) {
+    return op
+  }
+  s := &stream{ops: op.Operations}
+  var ops []Operation
+  for i, hop := range h.Operations {
+    if hop.Kind != InsertOp {
+      pieces := readOps(s, hop.Len)
+      // Forward to reincarnations inside of array elements
+      if len(pieces) == 1 && pieces[0].Kind == hop.Kind && hop.Len == 1 {
+        pieces[0] = forwardToReincarnations(pieces[0], hop)
+      }
+      for _, piece := range pieces {
+        ops = appendInverse(ops, piece)
+      }
+      continue
+    }
+    inserted := readOps(s, hop.Len)
+    // A reincarnation inserts a single character or element in front of its tomb
+    if hop.Len == 1 && len(inserted) == 1 && inserted[0].Kind == SkipOp && i+1 < len(h.Operations) && h.Operations[i+1].Kind != InsertOp {
+      peek := *s
+      if next := readOps(&peek, 1); len(next) > 0 && next[0].Kind != SkipOp && next[0].Kind != InsertOp {
+        inserted[0] = next[0]
+      }
+    }
+    for _, piece := range inserted {
+      ops = appendInverse(ops, piece)
+    }
+  }
+  for !s.IsEOF() {
+    ops = appendInverse(ops, s.Read(-1))
+  }
+  op.Operations = ops
+  return op
+}
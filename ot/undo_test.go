@@ -0,0 +1,216 @@
+package ot
+
+import (
+  "math/rand"
+  "testing"
+)
+
+// The length of the text including tombs
+func textLen(text *SimpleText) (n int) {
+  for _, x := range text.tombs {
+    if x < 0 {
+      x = -x
+    }
+    n += x
+  }
+  return
+}
+
+// Records the mutation, applies it to the builder and executes it on the document
+func applyLocal(t *testing.T, um *UndoManager, b *SimpleBuilder, doc interface{}, mut Mutation) interface{} {
+  if um != nil {
+    if err := um.Record(doc, mut); err != nil {
+      t.Fatal(err.Error())
+    }
+  }
+  if _, err := Build(b, mut); err != nil {
+    t.Fatal(err.Error())
+  }
+  doc, err := Execute(doc, mut)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  return doc
+}
+
+func localMutation(site string, b *SimpleBuilder, op Operation) (mut Mutation) {
+  mut = Mutation{Site: site, Dependencies: b.Frontier().IDs(), Operation: op}
+  _, mut.ID, _ = EncodeMutation(mut, EncNormal)
+  return
+}
+
+func TestUndoText(t *testing.T) {
+  for test := 0; test < 200; test++ {
+    b := NewSimpleBuilder()
+    um := NewUndoManager("a", b)
+    var doc interface{} = NewSimpleText("abcdefghijk")
+    states := []string{renderRuns(doc.(*SimpleText))}
+    // Apply random local mutations
+    for i := 0; i < 5; i++ {
+      op := Operation{Kind: StringOp, Len: 1, Operations: RandomFormattedOperations(textLen(doc.(*SimpleText)), []string{"bold", "link"})}
+      doc = applyLocal(t, um, b, doc, localMutation("a", b, op))
+      states = append(states, renderRuns(doc.(*SimpleText)))
+    }
+    // Undo all of them
+    for i := len(states) - 2; i >= 0; i-- {
+      mut, err := um.Undo(doc)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      doc = applyLocal(t, nil, b, doc, mut)
+      if renderRuns(doc.(*SimpleText)) != states[i] {
+        t.Fatalf("Undo failed:\n\t%v\n\t%v", renderRuns(doc.(*SimpleText)), states[i])
+      }
+    }
+    if um.CanUndo() {
+      t.Fatal("Undo stack should be empty")
+    }
+    // Redo all of them
+    for i := 1; i < len(states); i++ {
+      mut, err := um.Redo(doc)
+      if err != nil {
+        t.Fatal(err.Error())
+      }
+      doc = applyLocal(t, nil, b, doc, mut)
+      if renderRuns(doc.(*SimpleText)) != states[i] {
+        t.Fatalf("Redo failed:\n\t%v\n\t%v", renderRuns(doc.(*SimpleText)), states[i])
+      }
+    }
+  }
+}
+
+func TestUndoConcurrent(t *testing.T) {
+  b := NewSimpleBuilder()
+  um := NewUndoManager("a", b)
+  var doc interface{} = NewSimpleText("Hello World")
+  // Site a inserts "Brave " and deletes "World"
+  m1 := localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+    Operation{Kind: SkipOp, Len: 6}, Operation{Kind: InsertOp, Len: 6, Value: "Brave "}, Operation{Kind: SkipOp, Len: 5}}})
+  doc = applyLocal(t, um, b, doc, m1)
+  // Site b inserts "!" at the end concurrently to the following mutation of site a
+  deps := b.Frontier().IDs()
+  m2 := localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+    Operation{Kind: SkipOp, Len: 12}, Operation{Kind: DeleteOp, Len: 5}}})
+  doc = applyLocal(t, um, b, doc, m2)
+  m3 := Mutation{Site: "b", Dependencies: deps, Operation: Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+    Operation{Kind: SkipOp, Len: 17}, Operation{Kind: InsertOp, Len: 1, Value: "!"}}}}
+  _, m3.ID, _ = EncodeMutation(m3, EncNormal)
+  if _, err := Build(b, m3); err != nil {
+    t.Fatal(err.Error())
+  }
+  doc, _ = Execute(doc, b.AppliedMutation(m3.ID))
+  if doc.(*SimpleText).String() != "Hello Brave !" {
+    t.Fatalf("Wrong text: %v", doc.(*SimpleText).String())
+  }
+  // Undo the deletion. The insertion of site b remains
+  mut, err := um.Undo(doc)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  doc = applyLocal(t, nil, b, doc, mut)
+  if doc.(*SimpleText).String() != "Hello Brave World!" {
+    t.Fatalf("Wrong text after undo: %v", doc.(*SimpleText).String())
+  }
+  // Undo the insertion
+  if mut, err = um.Undo(doc); err != nil {
+    t.Fatal(err.Error())
+  }
+  doc = applyLocal(t, nil, b, doc, mut)
+  if doc.(*SimpleText).String() != "Hello World!" {
+    t.Fatalf("Wrong text after second undo: %v", doc.(*SimpleText).String())
+  }
+  if mut, err = um.Redo(doc); err != nil {
+    t.Fatal(err.Error())
+  }
+  doc = applyLocal(t, nil, b, doc, mut)
+  if doc.(*SimpleText).String() != "Hello Brave World!" {
+    t.Fatalf("Wrong text after redo: %v", doc.(*SimpleText).String())
+  }
+}
+
+func TestUndoGroup(t *testing.T) {
+  b := NewSimpleBuilder()
+  um := NewUndoManager("a", b)
+  var doc interface{} = NewSimpleText("")
+  um.BeginGroup()
+  for i, c := range []string{"a", "b", "c"} {
+    doc = applyLocal(t, um, b, doc, localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+      Operation{Kind: SkipOp, Len: i}, Operation{Kind: InsertOp, Len: 1, Value: c}}}))
+  }
+  um.EndGroup()
+  doc = applyLocal(t, um, b, doc, localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+    Operation{Kind: SkipOp, Len: 3}, Operation{Kind: InsertOp, Len: 1, Value: "d"}}}))
+  for _, expected := range []string{"abc", ""} {
+    mut, err := um.Undo(doc)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc = applyLocal(t, nil, b, doc, mut)
+    if doc.(*SimpleText).String() != expected {
+      t.Fatalf("Wrong text after undo: %v", doc.(*SimpleText).String())
+    }
+  }
+  // A new edit clears the redo stack
+  doc = applyLocal(t, um, b, doc, localMutation("a", b, Operation{Kind: StringOp, Len: 1, Operations: []Operation{
+    Operation{Kind: SkipOp, Len: 4}, Operation{Kind: InsertOp, Len: 1, Value: "x"}}}))
+  if um.CanRedo() {
+    t.Fatal("Redo stack should be empty")
+  }
+}
+
+func TestUndoArray(t *testing.T) {
+  b := NewSimpleBuilder()
+  um := NewUndoManager("a", b)
+  var doc interface{} = newTestArray(3)
+  ops := []Operation{
+    // Delete a mutable string
+    Operation{Kind: ArrayOp, Len: 1, Operations: []Operation{Operation{Kind: DeleteOp, Len: 1}, Operation{Kind: SkipOp, Len: 2}}},
+    // Insert a counter and a constant
+    Operation{Kind: ArrayOp, Len: 1, Operations: []Operation{Operation{Kind: SkipOp, Len: 3}, Operation{Kind: InsertOp, Len: 1, Value: 1}, Operation{Kind: InsertOp, Len: 1, Value: "c"}}},
+    // Edit a string, increment the counter and overwrite the constant
+    Operation{Kind: ArrayOp, Len: 1, Operations: []Operation{Operation{Kind: SkipOp, Len: 1},
+      Operation{Kind: StringOp, Len: 1, Operations: []Operation{Operation{Kind: DeleteOp, Len: 3}, Operation{Kind: SkipOp, Len: 3}}},
+      Operation{Kind: SkipOp, Len: 1}, Operation{Kind: IncrementOp, Len: 1, Value: 41}, Operation{Kind: OverwriteOp, Len: 1, Value: "d"}}},
+  }
+  states := []string{doc.(*SimpleArray).String()}
+  for _, op := range ops {
+    doc = applyLocal(t, um, b, doc, localMutation("a", b, op))
+    states = append(states, doc.(*SimpleArray).String())
+  }
+  if states[3] != "[def abcdef 42 d]" {
+    t.Fatalf("Wrong array: %v", states[3])
+  }
+  for i := len(ops) - 1; i >= 0; i-- {
+    mut, err := um.Undo(doc)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    doc = applyLocal(t, nil, b, doc, mut)
+    if doc.(*SimpleArray).String() != states[i] {
+      t.Fatalf("Wrong array after undo: %v != %v", doc.(*SimpleArray).String(), states[i])
+    }
+  }
+}
+
+func TestUndoObject(t *testing.T) {
+  b := NewSimpleBuilder()
+  um := NewUndoManager("a", b)
+  obj := NewSimpleObject()
+  obj.Set("x", 0, 1)
+  var doc interface{} = obj
+  // Insert a new version of x and a new attribute y
+  doc = applyLocal(t, um, b, doc, localMutation("a", b, Operation{Kind: ObjectOp, Len: 1, Operations: []Operation{
+    Operation{Kind: AttributeOp, Value: "x", Operations: []Operation{Operation{Kind: SkipOp, Len: 1}, Operation{Kind: InsertOp, Len: 1, Value: rand.Intn(100) + 2}}},
+    Operation{Kind: AttributeOp, Value: "y", Operations: []Operation{Operation{Kind: InsertOp, Len: 1, Value: "y"}}}}}))
+  mut, err := um.Undo(doc)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  doc = applyLocal(t, nil, b, doc, mut)
+  if _, val := obj.Get("x"); val != 1 {
+    t.Fatalf("Wrong value of x after undo: %v", val)
+  }
+  if _, val := obj.Get("y"); val != nil {
+    t.Fatalf("Wrong value of y after undo: %v", val)
+  }
+}
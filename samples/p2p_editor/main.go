@@ -8,6 +8,7 @@ import (
   grapher "lightwavegrapher"
   tf "lightwavetransformer"
   api "lightwaveapi"
+  "crypto/rsa"
   "flag"
   "os"
   "http"
@@ -31,6 +32,10 @@ func (self *dummyNameService) Lookup(identity string) (url string, err os.Error)
   return "", os.NewError("Unknown identity")
 }
 
+func (self *dummyNameService) PublicKey(domain string) (key *rsa.PublicKey, err os.Error) {
+  return nil, os.NewError("Authentication is not used")
+}
+
 func main() {
   // Parse the command line
   var userid string
@@ -57,6 +62,8 @@ func main() {
   if port != 0 {
     ns := &dummyNameService{}
     federation = fed.NewFederation(userid, "localhost", port, http.DefaultServeMux, ns, s)
+    // The editor runs on localhost only and has no server key
+    federation.DisableAuthentication()
     go http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
   }
   grapher := grapher.NewGrapher(userid, s, federation)
@@ -9,41 +9,34 @@ import (
 )
 
 type Connection struct {
-  // The userID of the remote server
+  // The userID of the remote server. If the connection is authenticated, this is the identity of the remote replica.
   userID             string
+  authenticated      bool
   replication        *Replication
   conn               net.Conn
   enc                *json.Encoder
   dec                *json.Decoder
   mutex              sync.Mutex
-  errChannel         chan<- error
-  receivedBlobs      [100]string
-  receivedBlobsIndex int
+  // Closed when the connection is closed
+  done chan bool
+  // The network address of the remote server
+  addr string
+  // The blobs to which the remote replica has subscribed and to which this replica has subscribed.
+  // Nil means all blobs. Protected by the mutex of the Replication.
+  filter       *blobFilter
+  subscription *blobFilter
 }
 
-func newConnection(conn net.Conn, replication *Replication, errChannel chan<- error) *Connection {
-  c := &Connection{conn: conn, replication: replication, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+// 'identity' is the authenticated identity of the remote replica or empty if the connection is not authenticated
+func newConnection(conn net.Conn, replication *Replication, identity string) *Connection {
+  c := &Connection{conn: conn, replication: replication, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn), userID: identity, authenticated: identity != "", done: make(chan bool), addr: conn.RemoteAddr().String()}
   go c.read()
   return c
 }
 
-func (self *Connection) addReceivedBlock(blobref string) {
-  self.receivedBlobs[self.receivedBlobsIndex] = blobref
-  self.receivedBlobsIndex = (self.receivedBlobsIndex + 1) % len(self.receivedBlobs)
-}
-
-func (self *Connection) hasReceivedBlob(blobref string) bool {
-  for _, b := range self.receivedBlobs {
-    if b == blobref {
-      return true
-    }
-  }
-  return false
-}
-
 // Sends a message that does not require a response
 func (self *Connection) Send(cmd string, data interface{}) (err error) {
-  println("Sending", cmd, "to", self.conn.RemoteAddr().String())
+  println("Sending", cmd, "to", self.addr)
   if cmd == "" {
     return errors.New("Must specify a cmd")
   }
@@ -55,15 +48,19 @@ func (self *Connection) Send(cmd string, data interface{}) (err error) {
     return
   }
   self.mutex.Lock()
-  defer self.mutex.Unlock()
+  if self.conn == nil {
+    self.mutex.Unlock()
+    return errors.New("Connection is closed")
+  }
   if msg.Payload == nil {
     m := messageWithoutPayload{msg.Cmd}
     err = self.enc.Encode(m)
   } else {
     err = self.enc.Encode(msg)
   }
-  if err != nil && self.errChannel != nil {
-    self.errChannel <- err
+  self.mutex.Unlock()
+  if err != nil {
+    self.Close()
   }
   return
 }
@@ -75,13 +72,10 @@ func (self *Connection) read() {
     msg.connection = self
     if err != nil {
       log.Printf("ERR READ JSON: %v\n", err)
-      if self.errChannel != nil {
-        self.errChannel <- err
-      }
       self.Close()
       return
     }
-    println("Received", msg.Cmd, "from", self.conn.RemoteAddr().String())
+    println("Received", msg.Cmd, "from", self.addr)
 
     self.replication.HandleMessage(msg)
   }
@@ -95,5 +89,6 @@ func (self *Connection) Close() {
   }
   self.conn.Close()
   self.conn = nil
+  close(self.done)
   self.replication.unregisterConnection(self)
 }
@@ -0,0 +1,314 @@
+package store
+
+import (
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// DiskBlobStore stores each blob in a file named after its blobref.
+// The files are sharded in two levels of directories by the first four characters of the blobref,
+// i.e. the blob "abcdef..." is stored in "dir/ab/cd/abcdef...".
+//
+// A blob is first written to a temporary file which is synced and then renamed to its final name.
+// Thus, a crash can only leave temporary files behind, but never a partially written blob.
+// The HashTree is rebuilt from the directory when the store is opened.
+//
+// Deleting a blob leaves an empty file named after the blobref in "dir/tombstones".
+// Its modification time is the time of deletion. Expired tombstones are removed when the store is opened.
+type DiskBlobStore struct {
+  dir       string
+  listeners []BlobStoreListener
+  hashTree  *SimpleHashTree
+  channel   chan blobStruct
+  // The time of deletion of deleted blobs
+  tombstones map[string]time.Time
+  // Protects hashTree, tombstones and the files in dir
+  mutex sync.Mutex
+}
+
+const (
+  diskStoreTmpDir       = "tmp"
+  diskStoreTombstoneDir = "tombstones"
+)
+
+// Opens the store located in the directory 'dir'. The directory is created if required.
+func NewDiskBlobStore(dir string) (s *DiskBlobStore, err error) {
+  s = &DiskBlobStore{dir: dir, hashTree: NewSimpleHashTree(), tombstones: make(map[string]time.Time)}
+  // Remove temporary files left behind by a crash
+  if err = os.RemoveAll(filepath.Join(dir, diskStoreTmpDir)); err != nil {
+    return nil, err
+  }
+  if err = os.MkdirAll(filepath.Join(dir, diskStoreTmpDir), 0700); err != nil {
+    return nil, err
+  }
+  if err = s.loadTombstones(); err != nil {
+    return nil, err
+  }
+  // Rebuild the hash tree
+  err = s.walk("", func(blobref string) error {
+    return s.hashTree.Add(blobref)
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  s.channel = make(chan blobStruct, 1000)
+  f := func() {
+    for {
+      var b blobStruct
+      b = <-s.channel
+      s.notify(b)
+    }
+  }
+  go f()
+
+  return s, nil
+}
+
+// A blobref must be a hex-encoded SHA256 hash. Otherwise it cannot be used as a file name safely.
+func isValidBlobRef(blobref string) bool {
+  if len(blobref) != HashTree_Depth || strings.ToLower(blobref) != blobref {
+    return false
+  }
+  _, err := hex.DecodeString(blobref)
+  return err == nil
+}
+
+func (self *DiskBlobStore) path(blobref string) string {
+  return filepath.Join(self.dir, blobref[0:2], blobref[2:4], blobref)
+}
+
+func (self *DiskBlobStore) StoreBlob(blob []byte, blobref string) (finalBlobRef string, err error) {
+  // Empty blob reference?
+  if len(blobref) == 0 {
+    blobref = NewBlobRef(blob)
+  }
+  if !isValidBlobRef(blobref) {
+    return "", errors.New("Malformed blob ID")
+  }
+  self.mutex.Lock()
+  // The blob is already known?
+  p := self.path(blobref)
+  if _, e := os.Stat(p); e == nil {
+    self.mutex.Unlock()
+    log.Printf("Blob is already known\n")
+    return blobref, nil
+  }
+  if deleted, ok := self.tombstones[blobref]; ok {
+    if time.Since(deleted) < TombstoneTTL {
+      self.mutex.Unlock()
+      return "", ErrBlobDeleted
+    }
+    delete(self.tombstones, blobref)
+    os.Remove(self.tombstonePath(blobref))
+  }
+  if err = self.writeFile(p, blob); err != nil {
+    self.mutex.Unlock()
+    return
+  }
+  self.hashTree.Add(blobref)
+  self.mutex.Unlock()
+  // Allow for further processing of the blob
+  self.channel <- blobStruct{data: blob, ref: blobref}
+  return blobref, nil
+}
+
+func (self *DiskBlobStore) writeFile(p string, blob []byte) (err error) {
+  // Write the blob to a temporary file and make sure it is on disk before renaming it
+  f, err := ioutil.TempFile(filepath.Join(self.dir, diskStoreTmpDir), filepath.Base(p))
+  if err != nil {
+    return
+  }
+  if _, err = f.Write(blob); err == nil {
+    err = f.Sync()
+  }
+  if e := f.Close(); err == nil {
+    err = e
+  }
+  if err == nil {
+    if err = os.MkdirAll(filepath.Dir(p), 0700); err == nil {
+      err = os.Rename(f.Name(), p)
+    }
+  }
+  if err != nil {
+    os.Remove(f.Name())
+    return
+  }
+  // Make the rename durable
+  if d, e := os.Open(filepath.Dir(p)); e == nil {
+    d.Sync()
+    d.Close()
+  }
+  return
+}
+
+func (self *DiskBlobStore) HashTree() HashTree {
+  return self.hashTree
+}
+
+func (self *DiskBlobStore) GetBlob(blobref string) (blob []byte, err error) {
+  if !isValidBlobRef(blobref) {
+    return nil, errors.New("Unknown Blob ID")
+  }
+  blob, err = ioutil.ReadFile(self.path(blobref))
+  if os.IsNotExist(err) {
+    err = errors.New("Unknown Blob ID")
+  }
+  return
+}
+
+// The tombstone is written before the blob is removed. Thus, after a crash the blob is either
+// still there or it cannot come back.
+// Deleting an unknown blob leaves a tombstone as well, such that the blob cannot arrive later.
+func (self *DiskBlobStore) DeleteBlob(blobref string) (err error) {
+  if !isValidBlobRef(blobref) {
+    return errors.New("Malformed blob ID")
+  }
+  self.mutex.Lock()
+  if err = self.writeFile(self.tombstonePath(blobref), nil); err != nil {
+    self.mutex.Unlock()
+    return
+  }
+  self.tombstones[blobref] = time.Now()
+  err = os.Remove(self.path(blobref))
+  if err != nil {
+    self.mutex.Unlock()
+    if os.IsNotExist(err) {
+      return nil
+    }
+    return
+  }
+  self.hashTree.Remove(blobref)
+  self.mutex.Unlock()
+  self.channel <- blobStruct{ref: blobref, deleted: true}
+  return nil
+}
+
+func (self *DiskBlobStore) tombstonePath(blobref string) string {
+  return filepath.Join(self.dir, diskStoreTombstoneDir, blobref)
+}
+
+func (self *DiskBlobStore) loadTombstones() error {
+  dir := filepath.Join(self.dir, diskStoreTombstoneDir)
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+  names, err := readDirNames(dir)
+  if err != nil {
+    return err
+  }
+  for _, name := range names {
+    if !isValidBlobRef(name) {
+      continue
+    }
+    info, err := os.Stat(filepath.Join(dir, name))
+    if err != nil {
+      return err
+    }
+    if time.Since(info.ModTime()) >= TombstoneTTL {
+      os.Remove(filepath.Join(dir, name))
+      continue
+    }
+    self.tombstones[name] = info.ModTime()
+  }
+  return nil
+}
+
+// Only the shard directories matching the prefix are read.
+// The blobs are delivered in the order of their blobrefs.
+func (self *DiskBlobStore) GetBlobs(prefix string) (channel <-chan Blob, err error) {
+  ch := make(chan Blob)
+  f := func() {
+    // TODO: The sending on the channel might fail if the underlying
+    // connection is broken
+    err := self.walk(prefix, func(blobref string) error {
+      blob, err := ioutil.ReadFile(self.path(blobref))
+      // The blob has been deleted since the directory has been read
+      if os.IsNotExist(err) {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      ch <- Blob{Data: blob, BlobRef: blobref}
+      return nil
+    })
+    if err != nil {
+      log.Printf("Err: %v", err)
+    }
+    close(ch)
+  }
+  go f()
+  return ch, nil
+}
+
+func (self *DiskBlobStore) notify(b blobStruct) {
+  for _, l := range self.listeners {
+    var err error
+    if !b.deleted {
+      err = l.HandleBlob(b.data, b.ref)
+    } else if dl, ok := l.(BlobStoreDeleteListener); ok {
+      err = dl.HandleDeletedBlob(b.ref)
+    }
+    if err != nil {
+      log.Printf("Err: %v", err)
+    }
+  }
+}
+
+func (self *DiskBlobStore) AddListener(l BlobStoreListener) {
+  self.listeners = append(self.listeners, l)
+}
+
+// Calls f for all blobrefs starting with prefix in ascending order.
+// Directories which cannot contain matching blobs are not read at all.
+func (self *DiskBlobStore) walk(prefix string, f func(blobref string) error) error {
+  var walkDir func(dir string, level int) error
+  walkDir = func(dir string, level int) error {
+    names, err := readDirNames(dir)
+    if err != nil {
+      return err
+    }
+    for _, name := range names {
+      // Shard directories
+      if level < 2 {
+        // The part of the prefix which must match the shard directory on this level
+        part := prefix[min(len(prefix), level*2):min(len(prefix), level*2+2)]
+        if len(name) != 2 || !strings.HasPrefix(name, part) {
+          continue
+        }
+        if err = walkDir(filepath.Join(dir, name), level+1); err != nil {
+          return err
+        }
+        continue
+      }
+      if !isValidBlobRef(name) || !strings.HasPrefix(name, prefix) {
+        continue
+      }
+      if err = f(name); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+  return walkDir(self.dir, 0)
+}
+
+func readDirNames(dir string) (names []string, err error) {
+  d, err := os.Open(dir)
+  if err != nil {
+    return
+  }
+  names, err = d.Readdirnames(-1)
+  d.Close()
+  sort.Strings(names)
+  return
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestDiskBlobStore(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavestore")
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  defer os.RemoveAll(dir)
+  s, err := NewDiskBlobStore(dir)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  tree := NewSimpleHashTree()
+  blobs := make(map[string][]byte)
+  for i := 0; i < 500; i++ {
+    blob := []byte(fmt.Sprintf("{\"z\":\"m%v\"}", i))
+    blobref, err := s.StoreBlob(blob, "")
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    blobs[blobref] = blob
+    tree.Add(blobref)
+  }
+  // Storing a blob twice is harmless
+  for blobref, blob := range blobs {
+    if _, err = s.StoreBlob(blob, blobref); err != nil {
+      t.Fatal(err.Error())
+    }
+    break
+  }
+  if _, err = s.StoreBlob([]byte("x"), "../../evil"); err == nil {
+    t.Fatal("Malformed blobref has been accepted")
+  }
+  // Simulate a crash that left a temporary file behind
+  if err = ioutil.WriteFile(filepath.Join(dir, diskStoreTmpDir, "partial"), []byte("{\"z\""), 0600); err != nil {
+    t.Fatal(err.Error())
+  }
+
+  // Reopen the store. The hash tree must be rebuilt
+  s, err = NewDiskBlobStore(dir)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if s.HashTree().Hash() != tree.Hash() {
+    t.Fatal("Hash tree has not been restored")
+  }
+  if _, err = os.Stat(filepath.Join(dir, diskStoreTmpDir, "partial")); err == nil {
+    t.Fatal("Temporary file has not been removed")
+  }
+  for blobref, blob := range blobs {
+    b, err := s.GetBlob(blobref)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    if !bytes.Equal(b, blob) {
+      t.Fatal("Blobs are different")
+    }
+  }
+  if _, err = s.GetBlob(NewBlobRef([]byte("unknown"))); err == nil {
+    t.Fatal("Unknown blob has been found")
+  }
+
+  // Enumerate with prefixes of different lengths
+  for _, prefix := range []string{"", "a", "ab", "abc", "abcd", "abcde"} {
+    count := 0
+    for blobref, _ := range blobs {
+      if len(blobref) >= len(prefix) && blobref[:len(prefix)] == prefix {
+        count++
+      }
+    }
+    ch, err := s.GetBlobs(prefix)
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    last := ""
+    for b := range ch {
+      if !bytes.Equal(b.Data, blobs[b.BlobRef]) || b.BlobRef <= last {
+        t.Fatalf("Wrong blob or order for prefix %v", prefix)
+      }
+      last = b.BlobRef
+      count--
+    }
+    if count != 0 {
+      t.Fatalf("Wrong number of blobs for prefix %v", prefix)
+    }
+  }
+
+  // Deleted blobs cannot be stored again, not even after reopening
+  var deleted string
+  for blobref, _ := range blobs {
+    deleted = blobref
+    break
+  }
+  if err = s.DeleteBlob(deleted); err != nil {
+    t.Fatal(err.Error())
+  }
+  tree.Remove(deleted)
+  if _, err = s.GetBlob(deleted); err == nil {
+    t.Fatal("Deleted blob has been found")
+  }
+  if _, err = s.StoreBlob(blobs[deleted], deleted); err != ErrBlobDeleted {
+    t.Fatal("Deleted blob has been stored again")
+  }
+  s, err = NewDiskBlobStore(dir)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  if s.HashTree().Hash() != tree.Hash() {
+    t.Fatal("Hash tree contains the deleted blob")
+  }
+  if _, err = s.StoreBlob(blobs[deleted], deleted); err != ErrBlobDeleted {
+    t.Fatal("Tombstone has not been restored")
+  }
+}
+
+func TestDiskBlobStoreDeleteWhileEnumerating(t *testing.T) {
+  dir, err := ioutil.TempDir("", "lightwavestore")
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  defer os.RemoveAll(dir)
+  s, err := NewDiskBlobStore(dir)
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  // Three blobs share a shard directory and one blob is stored elsewhere
+  blobrefs := []string{"abcd01", "abcd02", "abcd03", "ef01"}
+  for i, prefix := range blobrefs {
+    blobrefs[i] = prefix + strings.Repeat("0", HashTree_Depth - len(prefix))
+    if _, err = s.StoreBlob([]byte(fmt.Sprintf(`{"n":%v}`, i)), blobrefs[i]); err != nil {
+      t.Fatal(err.Error())
+    }
+  }
+  count := len(blobrefs)
+  first, deleted := blobrefs[0], blobrefs[2]
+  ch, err := s.GetBlobs("")
+  if err != nil {
+    t.Fatal(err.Error())
+  }
+  // The third blob is deleted after its directory has been read. The other blobs are delivered nevertheless.
+  // The enumeration reads at most one blob ahead, hence the third blob has not been read when the first arrives.
+  received := 0
+  for b := range ch {
+    if b.BlobRef == first {
+      if err = s.DeleteBlob(deleted); err != nil {
+        t.Fatal(err.Error())
+      }
+    }
+    if b.BlobRef == deleted {
+      t.Fatal("Deleted blob has been delivered")
+    }
+    received++
+  }
+  if received != count - 1 {
+    t.Fatalf("Wrong number of blobs: %v instead of %v", received, count - 1)
+  }
+}
@@ -0,0 +1,255 @@
+package store
+
+import (
+  "encoding/json"
+  "log"
+  "sort"
+  "sync"
+)
+
+// A replica can subscribe to a subset of the blobs of its peers, for example a mobile client which
+// only wants the documents its user has kept. The subscription is sent with the FILTER command
+// before OPEN. Afterwards, the peer streams and serves only blobs matching the filter.
+// For reconciliation, both sides maintain a hash tree over the matching blobs of their store.
+// Hence, the comparison of hash trees works on the subset just like on the full store.
+// Blobs which do not match the filter are not affected by reconciliation. The subscriber still
+// streams them to the peer, but blobs stored while disconnected reach the peer only if they match.
+
+// Selects blobs for replication. All criteria which are not empty must hold.
+// Blobs which are not JSON objects, for example binary data, match only an empty filter.
+type Filter struct {
+  // The perma nodes themselves and all blobs whose "perma" is one of them
+  Perma []string `json:"perma"`
+  // Blobs whose "signer" is one of these users
+  Signers []string `json:"signers"`
+  // Blobs whose "type" is one of these schema types
+  Types []string `json:"types"`
+}
+
+// A Filter prepared for matching
+type blobFilter struct {
+  filter  Filter
+  perma   map[string]bool
+  signers map[string]bool
+  types   map[string]bool
+  // Equal filters have equal keys
+  key string
+}
+
+// The hash tree over the blobs of the store which match a filter
+type filteredTree struct {
+  filter *blobFilter
+  tree   *SimpleHashTree
+  // The blobrefs in the tree, because blobs may be added while the tree is filled
+  members map[string]bool
+  mutex   sync.Mutex
+  // Fills the tree from the store once
+  fill sync.Once
+}
+
+// Returns nil if the filter is nil or matches everything
+func compileFilter(filter *Filter) *blobFilter {
+  if filter == nil || (len(filter.Perma) == 0 && len(filter.Signers) == 0 && len(filter.Types) == 0) {
+    return nil
+  }
+  f := &blobFilter{filter: *filter, perma: stringSet(filter.Perma), signers: stringSet(filter.Signers), types: stringSet(filter.Types)}
+  key := Filter{sortedKeys(f.perma), sortedKeys(f.signers), sortedKeys(f.types)}
+  data, _ := json.Marshal(&key)
+  f.key = string(data)
+  return f
+}
+
+func stringSet(list []string) map[string]bool {
+  set := make(map[string]bool)
+  for _, s := range list {
+    set[s] = true
+  }
+  return set
+}
+
+func sortedKeys(set map[string]bool) (keys []string) {
+  for key, _ := range set {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return
+}
+
+// Returns nil if the blob is not a JSON object
+func parseBlobSchema(blob []byte) *blobSchema {
+  var schema blobSchema
+  if json.Unmarshal(blob, &schema) != nil {
+    return nil
+  }
+  return &schema
+}
+
+// 'schema' is nil if the blob is not a JSON object
+func (self *blobFilter) match(blobref string, schema *blobSchema) bool {
+  if self == nil {
+    return true
+  }
+  if schema == nil {
+    return false
+  }
+  if len(self.perma) > 0 && !self.perma[blobref] && !self.perma[schema.Perma] {
+    return false
+  }
+  if len(self.signers) > 0 && !self.signers[schema.Signer] {
+    return false
+  }
+  if len(self.types) > 0 && !self.types[schema.Type] {
+    return false
+  }
+  return true
+}
+
+func (self *filteredTree) add(blobref string) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if !self.members[blobref] {
+    self.members[blobref] = true
+    self.tree.Add(blobref)
+  }
+}
+
+func (self *filteredTree) remove(blobref string) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.members[blobref] {
+    delete(self.members, blobref)
+    self.tree.Remove(blobref)
+  }
+}
+
+// Subscribes to the blobs matching the filter on all connections which this replica dials.
+// A nil filter subscribes to all blobs.
+func (self *Replication) SetFilter(filter *Filter) {
+  f := compileFilter(filter)
+  self.mutex.Lock()
+  self.subscription = f
+  var conns []*Connection
+  for conn, kind := range self.connections {
+    if kind&connClient == connClient {
+      conn.subscription = f
+      conns = append(conns, conn)
+    }
+  }
+  self.mutex.Unlock()
+  for _, conn := range conns {
+    self.sendFilter(conn, f)
+    self.startRound(conn)
+  }
+}
+
+func (self *Replication) sendFilter(conn *Connection, f *blobFilter) {
+  if f == nil {
+    conn.Send("FILTER", nil)
+  } else {
+    conn.Send("FILTER", &f.filter)
+  }
+}
+
+// Handles the 'FILTER' command. A FILTER without payload cancels the subscription.
+func (self *Replication) filterHandler(msg Message) {
+  var f *blobFilter
+  if msg.Payload != nil {
+    var filter Filter
+    if msg.DecodePayload(&filter) != nil {
+      log.Printf("Error in FILTER request")
+      return
+    }
+    f = compileFilter(&filter)
+  }
+  self.mutex.Lock()
+  msg.connection.filter = f
+  self.mutex.Unlock()
+  self.pruneTrees()
+}
+
+// Returns the filter to which the peer has subscribed and the filter to which this replica has subscribed
+func (self *Replication) connectionFilters(conn *Connection) (filter, subscription *blobFilter) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return conn.filter, conn.subscription
+}
+
+// Returns the hash tree over the blobs matching the filter
+func (self *Replication) treeFor(f *blobFilter) HashTree {
+  if f == nil {
+    return self.store.HashTree()
+  }
+  self.mutex.Lock()
+  ft, ok := self.filteredTrees[f.key]
+  if !ok {
+    ft = &filteredTree{filter: f, tree: NewSimpleHashTree(), members: make(map[string]bool)}
+    self.filteredTrees[f.key] = ft
+  }
+  self.mutex.Unlock()
+  // Blobs which arrive meanwhile are added by updateTrees
+  ft.fill.Do(func() {
+    channel, err := self.store.GetBlobs("")
+    if err != nil {
+      log.Printf("Error while talking to store: %v\n", err)
+      return
+    }
+    for blob := range channel {
+      if f.match(blob.BlobRef, parseBlobSchema(blob.Data)) {
+        ft.add(blob.BlobRef)
+      }
+    }
+  })
+  return ft.tree
+}
+
+// Adds a new blob to the filtered hash trees
+func (self *Replication) updateTrees(blobref string, schema *blobSchema) {
+  self.mutex.Lock()
+  var trees []*filteredTree
+  for _, ft := range self.filteredTrees {
+    trees = append(trees, ft)
+  }
+  self.mutex.Unlock()
+  for _, ft := range trees {
+    if ft.filter.match(blobref, schema) {
+      ft.add(blobref)
+    }
+  }
+}
+
+// Called from the store when a blob has been deleted
+func (self *Replication) HandleDeletedBlob(blobref string) error {
+  self.mutex.Lock()
+  var trees []*filteredTree
+  for _, ft := range self.filteredTrees {
+    trees = append(trees, ft)
+  }
+  self.mutex.Unlock()
+  for _, ft := range trees {
+    ft.remove(blobref)
+  }
+  return nil
+}
+
+// Drops the filtered hash trees which no connection uses any more
+func (self *Replication) pruneTrees() {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  used := make(map[string]bool)
+  if self.subscription != nil {
+    used[self.subscription.key] = true
+  }
+  for conn, _ := range self.connections {
+    if conn.filter != nil {
+      used[conn.filter.key] = true
+    }
+    if conn.subscription != nil {
+      used[conn.subscription.key] = true
+    }
+  }
+  for key, _ := range self.filteredTrees {
+    if !used[key] {
+      delete(self.filteredTrees, key)
+    }
+  }
+}
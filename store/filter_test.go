@@ -0,0 +1,80 @@
+package store
+
+import (
+  "fmt"
+  "testing"
+  "time"
+)
+
+func TestFilteredReplication(t *testing.T) {
+  reconnectBackoff = 100000000
+  reconcileInterval = 200000000
+  _, storeA, addrA := newMeshReplica(t)
+  b, storeB, _ := newMeshReplica(t)
+  store := func(s *SimpleBlobStore, blob string) string {
+    blobref, err := s.StoreBlob([]byte(blob), "")
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    return blobref
+  }
+  kept := store(storeA, `{"type":"permanode","signer":"a@alice","random":"1"}`)
+  other := store(storeA, `{"type":"permanode","signer":"a@alice","random":"2"}`)
+  var keptBlobs []string
+  for i := 0; i < 40; i++ {
+    keptBlobs = append(keptBlobs, store(storeA, fmt.Sprintf(`{"type":"mutation","perma":"%v","seq":%v}`, kept, i)))
+    store(storeA, fmt.Sprintf(`{"type":"mutation","perma":"%v","seq":%v}`, other, i))
+  }
+  store(storeA, "binary data")
+  // The mobile replica has a mutation of the kept document which the other replica lacks
+  offline := store(storeB, fmt.Sprintf(`{"type":"mutation","perma":"%v","seq":"offline"}`, kept))
+
+  b.SetFilter(&Filter{Perma: []string{kept}})
+  b.AddPeer(addrA)
+  if !waitForBlob(storeA, offline) || !waitForBlob(storeB, kept) {
+    t.Fatal("Filtered blobs have not been reconciled")
+  }
+  for _, blobref := range keptBlobs {
+    if !waitForBlob(storeB, blobref) {
+      t.Fatal("Blob of the kept document is missing")
+    }
+  }
+  // Wait for a round which finds both filtered hash trees equal
+  var stats ReconcileStats
+  for i := 0; i < 50; i++ {
+    if stats = b.ReconcileStats()[addrA]; stats.InSync > 0 && stats.Pending == 0 {
+      break
+    }
+    time.Sleep(100000000)
+  }
+  if stats.InSync == 0 {
+    t.Fatalf("Filtered hash trees differ: %+v", stats)
+  }
+  if len(storeB.Enumerate()) != 42 {
+    t.Fatalf("Wrong number of blobs: %v", len(storeB.Enumerate()))
+  }
+
+  // Only matching blobs are streamed
+  store(storeA, fmt.Sprintf(`{"type":"mutation","perma":"%v","seq":"new"}`, other))
+  streamed := store(storeA, fmt.Sprintf(`{"type":"mutation","perma":"%v","seq":"new"}`, kept))
+  if !waitForBlob(storeB, streamed) {
+    t.Fatal("Matching blob has not been streamed")
+  }
+  if len(storeB.Enumerate()) != 43 {
+    t.Fatalf("Blob not matching the filter has been streamed: %v", len(storeB.Enumerate()))
+  }
+
+  // Changing the filter reconciles the blobs which match now
+  b.SetFilter(&Filter{Perma: []string{kept, other}})
+  if !waitForBlob(storeB, other) {
+    t.Fatal("Blobs matching the new filter have not been reconciled")
+  }
+  // All blobs except the binary one
+  for i := 0; i < 50 && len(storeB.Enumerate()) != len(storeA.Enumerate())-1; i++ {
+    time.Sleep(100000000)
+  }
+  if len(storeB.Enumerate()) != len(storeA.Enumerate())-1 {
+    t.Fatalf("Wrong number of blobs: %v %v", len(storeB.Enumerate()), len(storeA.Enumerate()))
+  }
+}
+
@@ -0,0 +1,141 @@
+package store
+
+import (
+  "encoding/json"
+  "sync"
+  "time"
+)
+
+// The garbage collector deletes blobs which no kept perma node can reach.
+// A perma node is kept if there is a keep blob for it, i.e. a blob with "type":"keep" whose
+// "perma" is the perma node, or a permission blob which names a local user in "user".
+// Thus, an invitation which the local user has not accepted yet keeps the perma node.
+// A kept perma node reaches itself, all blobs whose "perma" is the
+// perma node and every blob whose blobref appears as a string in a reachable blob,
+// for example in "dep" or "entity".
+//
+// Blobs can arrive in any order. For example, the mutations of a perma node may arrive before the
+// keep blob. Therefore, a blob is only deleted when it has been unreachable in all collections
+// during the grace period. Deleted blobs leave tombstones in the store, such that replication
+// does not bring them back.
+type GarbageCollector struct {
+  store BlobStore
+  // The local users. Only keep blobs of these signers and permission blobs naming these users make perma nodes kept.
+  // If empty, all keep blobs and permission blobs count.
+  Signers []string
+  // Nanoseconds a blob must stay unreachable before it is deleted
+  GracePeriod time.Duration
+  // The time when a blob has been found unreachable for the first time
+  candidates map[string]time.Time
+  // Collections must not run concurrently
+  mutex sync.Mutex
+}
+
+// The fields of a blob which the garbage collector and replication filters look at
+type blobSchema struct {
+  Type   string `json:"type"`
+  Signer string `json:"signer"`
+  Perma  string `json:"perma"`
+  User   string `json:"user"`
+}
+
+func NewGarbageCollector(store BlobStore, gracePeriod time.Duration) *GarbageCollector {
+  return &GarbageCollector{store: store, GracePeriod: gracePeriod, candidates: make(map[string]time.Time)}
+}
+
+// Runs one collection and returns the blobrefs of the deleted blobs
+func (self *GarbageCollector) Collect() (deleted []string, err error) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  ch, err := self.store.GetBlobs("")
+  if err != nil {
+    return
+  }
+  signers := make(map[string]bool)
+  for _, signer := range self.Signers {
+    signers[signer] = true
+  }
+  // Decoded blobs. Blobs which are no JSON objects are nil.
+  blobs := make(map[string]map[string]interface{})
+  // Blobrefs of blobs by the perma node they belong to
+  byPerma := make(map[string][]string)
+  var roots []string
+  for b := range ch {
+    var m map[string]interface{}
+    var schema blobSchema
+    if json.Unmarshal(b.Data, &m) != nil || json.Unmarshal(b.Data, &schema) != nil {
+      blobs[b.BlobRef] = nil
+      continue
+    }
+    blobs[b.BlobRef] = m
+    if schema.Perma != "" {
+      byPerma[schema.Perma] = append(byPerma[schema.Perma], b.BlobRef)
+    }
+    if schema.Type == "keep" && schema.Perma != "" && (len(signers) == 0 || signers[schema.Signer]) {
+      roots = append(roots, schema.Perma)
+    }
+    if schema.Type == "permission" && schema.Perma != "" && (len(signers) == 0 || signers[schema.User]) {
+      roots = append(roots, schema.Perma)
+    }
+  }
+
+  // Mark
+  reachable := make(map[string]bool)
+  stack := roots
+  for len(stack) > 0 {
+    blobref := stack[len(stack)-1]
+    stack = stack[:len(stack)-1]
+    if reachable[blobref] {
+      continue
+    }
+    reachable[blobref] = true
+    stack = append(stack, byPerma[blobref]...)
+    if m, ok := blobs[blobref]; ok && m != nil {
+      stack = appendBlobRefs(stack, m)
+    }
+  }
+
+  // Sweep
+  now := time.Now()
+  candidates := make(map[string]time.Time)
+  for blobref, _ := range blobs {
+    if reachable[blobref] {
+      continue
+    }
+    first, ok := self.candidates[blobref]
+    if !ok {
+      first = now
+    }
+    if now.Sub(first) < self.GracePeriod {
+      candidates[blobref] = first
+      continue
+    }
+    if e := self.store.DeleteBlob(blobref); e != nil {
+      err = e
+      candidates[blobref] = first
+      continue
+    }
+    deleted = append(deleted, blobref)
+  }
+  self.candidates = candidates
+  return
+}
+
+// Appends all strings in the decoded JSON value which look like blobrefs
+func appendBlobRefs(blobrefs []string, value interface{}) []string {
+  switch v := value.(type) {
+  case string:
+    if isValidBlobRef(v) {
+      blobrefs = append(blobrefs, v)
+    }
+  case []interface{}:
+    for _, x := range v {
+      blobrefs = appendBlobRefs(blobrefs, x)
+    }
+  case map[string]interface{}:
+    for _, x := range v {
+      blobrefs = appendBlobRefs(blobrefs, x)
+    }
+  }
+  return blobrefs
+}
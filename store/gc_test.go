@@ -0,0 +1,75 @@
+package store
+
+import (
+  "fmt"
+  "testing"
+  "time"
+)
+
+func TestGarbageCollector(t *testing.T) {
+  s := NewSimpleBlobStore()
+  store := func(blob string) string {
+    blobref, err := s.StoreBlob([]byte(blob), "")
+    if err != nil {
+      t.Fatal(err.Error())
+    }
+    return blobref
+  }
+  // A perma node kept by alice with a mutation that depends on a binary blob
+  kept := store(`{"type":"permanode","signer":"a@alice","random":"1"}`)
+  binary := store("binary data")
+  mutation := store(fmt.Sprintf(`{"type":"mutation","signer":"a@alice","perma":"%v","dep":["%v"]}`, kept, binary))
+  keep := store(fmt.Sprintf(`{"type":"keep","signer":"a@alice","perma":"%v"}`, kept))
+  // A perma node kept by bob only and one which nobody keeps
+  bobs := store(`{"type":"permanode","signer":"b@bob","random":"2"}`)
+  bobsKeep := store(fmt.Sprintf(`{"type":"keep","signer":"b@bob","perma":"%v"}`, bobs))
+  abandoned := store(`{"type":"permanode","signer":"a@alice","random":"3"}`)
+  abandonedMutation := store(fmt.Sprintf(`{"type":"mutation","signer":"a@alice","perma":"%v"}`, abandoned))
+  // A perma node to which alice has been invited but which she does not keep yet, and one to which bob has been invited
+  invited := store(`{"type":"permanode","signer":"c@carol","random":"5"}`)
+  invitation := store(fmt.Sprintf(`{"type":"permission","signer":"c@carol","perma":"%v","action":"invite","user":"a@alice"}`, invited))
+  bobsInvited := store(`{"type":"permanode","signer":"c@carol","random":"6"}`)
+  bobsInvitation := store(fmt.Sprintf(`{"type":"permission","signer":"c@carol","perma":"%v","action":"invite","user":"b@bob"}`, bobsInvited))
+
+  gc := NewGarbageCollector(s, 200000000)
+  gc.Signers = []string{"a@alice"}
+  // Within the grace period nothing is deleted
+  deleted, err := gc.Collect()
+  if err != nil || len(deleted) != 0 {
+    t.Fatalf("Blobs deleted during the grace period: %v %v", deleted, err)
+  }
+  time.Sleep(300000000)
+  deleted, err = gc.Collect()
+  if err != nil || len(deleted) != 6 {
+    t.Fatalf("Wrong blobs deleted: %v %v", deleted, err)
+  }
+  for _, blobref := range []string{kept, binary, mutation, keep, invited, invitation} {
+    if _, err := s.GetBlob(blobref); err != nil {
+      t.Fatal("Reachable blob has been deleted")
+    }
+  }
+  for _, blobref := range []string{bobs, bobsKeep, abandoned, abandonedMutation, bobsInvited, bobsInvitation} {
+    if _, err := s.GetBlob(blobref); err == nil {
+      t.Fatal("Unreachable blob has not been deleted")
+    }
+  }
+  // Replication must not bring back collected blobs
+  if _, err = s.StoreBlob([]byte(`{"type":"permanode","signer":"a@alice","random":"3"}`), ""); err != ErrBlobDeleted {
+    t.Fatal("Deleted blob has been stored again")
+  }
+
+  // A blob which becomes reachable during the grace period survives
+  orphan := store(fmt.Sprintf(`{"type":"mutation","signer":"a@alice","perma":"%v","random":"4"}`, NewBlobRef([]byte("late"))))
+  if deleted, _ = gc.Collect(); len(deleted) != 0 {
+    t.Fatal("Blob deleted during the grace period")
+  }
+  late := store("late")
+  store(fmt.Sprintf(`{"type":"keep","signer":"a@alice","perma":"%v"}`, late))
+  time.Sleep(300000000)
+  if deleted, _ = gc.Collect(); len(deleted) != 0 {
+    t.Fatalf("Reachable blobs have been deleted: %v", deleted)
+  }
+  if _, err := s.GetBlob(orphan); err != nil {
+    t.Fatal("Blob has been deleted")
+  }
+}
@@ -6,6 +6,7 @@ import (
   "encoding/hex"
   "errors"
   "sort"
+  "sync"
 )
 
 const (
@@ -38,6 +39,9 @@ type HashTree interface {
   Hash() (hash string)
   // Adds a BLOB id to the tree. The id is a hex encoded SHA256 hash.
   Add(id string) error
+  // Removes a BLOB id from the tree.
+  // Afterwards the tree is the same as if the id had never been added.
+  Remove(id string) error
   // Returns the children of some inner node.
   // The kind return value determines whether the children are in turn
   // inner nodes or rather IDs added via Add().
@@ -47,14 +51,19 @@ type HashTree interface {
 
 // An implementation of the HashTree interface.
 // SimpleHashTree holds the entire tree in RAM.
+// It is safe to use from several goroutines, because replicas can sync with several peers at once.
 type SimpleHashTree struct {
   hashTreeNode
+  // Hash modifies the tree as well, because it caches the hashes of the nodes
+  mutex sync.Mutex
 }
 
 type hashTreeNode struct {
   hash       []byte
   childIDs   [][]byte
   childNodes []*hashTreeNode
+  // The number of IDs in this node and all nodes below
+  size int
 }
 
 func NewSimpleHashTree() *SimpleHashTree {
@@ -62,6 +71,8 @@ func NewSimpleHashTree() *SimpleHashTree {
 }
 
 func (self *SimpleHashTree) Hash() (hash string) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
   return hex.EncodeToString(self.binaryHash())
 }
 
@@ -73,10 +84,28 @@ func (self *SimpleHashTree) Add(id string) error {
   if e != nil {
     return errors.New("Malformed ID")
   }
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
   self.add(bin_id, 0)
   return nil
 }
 
+func (self *SimpleHashTree) Remove(id string) error {
+  if len(id) != HashTree_Depth {
+    return errors.New("ID has the wrong length.")
+  }
+  bin_id, e := hex.DecodeString(id)
+  if e != nil {
+    return errors.New("Malformed ID")
+  }
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if !self.remove(bin_id, 0) {
+    return errors.New("Unknown ID")
+  }
+  return nil
+}
+
 func (self *SimpleHashTree) Children(prefix string) (kind int, children []string, err error) {
   depth := len(prefix)
   if depth >= HashTree_Depth {
@@ -89,6 +118,9 @@ func (self *SimpleHashTree) Children(prefix string) (kind int, children []string
   if e != nil {
     return HashTree_NIL, nil, errors.New("Prefix must be a hex encoding")
   }
+  // The children are shared with the tree. Hence, they are encoded while holding the lock.
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
   kind, bin_children, err := self.children(bin_prefix, 0, depth)
   for _, bin_child := range bin_children {
     children = append(children, hex.EncodeToString(bin_child))
@@ -132,6 +164,7 @@ func (self *hashTreeNode) children(prefix []byte, level int, depth int) (kind in
 
 func (self *hashTreeNode) add(id []byte, level int) {
   self.hash = nil
+  self.size++
   index := id[level/2]
   if level%2 == 0 {
     index = index >> 4
@@ -169,6 +202,55 @@ func (self *hashTreeNode) add(id []byte, level int) {
   }
 }
 
+// Returns false if the id is not in the tree.
+// An inner node which holds no more than HashTree_NodeDegree IDs is turned back into a leaf,
+// such that the shape of the tree depends only on the IDs it contains.
+func (self *hashTreeNode) remove(id []byte, level int) bool {
+  if self.childNodes == nil {
+    for i, child := range self.childIDs {
+      if bytes.Equal(child, id) {
+        self.childIDs = append(self.childIDs[:i], self.childIDs[i+1:]...)
+        self.size--
+        self.hash = nil
+        return true
+      }
+    }
+    return false
+  }
+  index := id[level/2]
+  if level%2 == 0 {
+    index = index >> 4
+  } else {
+    index = index & 0xf
+  }
+  ch := self.childNodes[index]
+  if ch == nil || !ch.remove(id, level+1) {
+    return false
+  }
+  if ch.size == 0 {
+    self.childNodes[index] = nil
+  }
+  self.size--
+  self.hash = nil
+  if self.size <= HashTree_NodeDegree {
+    self.childIDs = self.collectIDs(nil)
+    self.childNodes = nil
+  }
+  return true
+}
+
+func (self *hashTreeNode) collectIDs(ids [][]byte) [][]byte {
+  if self.childNodes == nil {
+    return append(ids, self.childIDs...)
+  }
+  for _, ch := range self.childNodes {
+    if ch != nil {
+      ids = ch.collectIDs(ids)
+    }
+  }
+  return ids
+}
+
 func (self *hashTreeNode) binaryHash() []byte {
   if len(self.hash) != 0 {
     return self.hash
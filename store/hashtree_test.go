@@ -35,3 +35,47 @@ func TestHashTree1(t *testing.T) {
     }
   }
 }
+
+// Removing IDs must yield the same tree as never adding them
+func TestHashTreeRemove(t *testing.T) {
+  var ids []string
+  for i := 0; i < 500; i++ {
+    h := sha256.New()
+    h.Write([]byte(fmt.Sprintf("r%v", i)))
+    ids = append(ids, hex.EncodeToString(h.Sum([]byte{})))
+  }
+  empty := NewSimpleHashTree().Hash()
+  for test := 0; test < 20; test++ {
+    tree := NewSimpleHashTree()
+    for _, id := range ids {
+      tree.Add(id)
+    }
+    expected := NewSimpleHashTree()
+    keep := len(ids) * test / 20
+    for _, id := range ids[:keep] {
+      expected.Add(id)
+    }
+    for _, i := range rand.Perm(len(ids) - keep) {
+      if err := tree.Remove(ids[keep+i]); err != nil {
+        t.Fatal(err.Error())
+      }
+    }
+    if tree.Hash() != expected.Hash() {
+      t.Fatalf("Hashes are not the same after removing %v IDs", len(ids)-keep)
+    }
+    kind, children, _ := tree.Children("")
+    ekind, echildren, _ := expected.Children("")
+    if kind != ekind || len(children) != len(echildren) {
+      t.Fatal("Trees have a different shape")
+    }
+  }
+  tree := NewSimpleHashTree()
+  tree.Add(ids[0])
+  if err := tree.Remove(ids[1]); err == nil {
+    t.Fatal("Unknown ID has been removed")
+  }
+  tree.Remove(ids[0])
+  if tree.Hash() != empty {
+    t.Fatal("Tree is not empty")
+  }
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+  "fmt"
+  "net"
+  "testing"
+  "time"
+)
+
+func newMeshReplica(t *testing.T) (rep *Replication, store *SimpleBlobStore, addr string) {
+  store = NewSimpleBlobStore()
+  rep = NewReplication("a@alice", store, "", "")
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go rep.serve(l)
+  return rep, store, l.Addr().String()
+}
+
+// Waits until the store holds the blob
+func waitForBlob(store BlobStore, blobref string) bool {
+  for i := 0; i < 50; i++ {
+    if _, err := store.GetBlob(blobref); err == nil {
+      return true
+    }
+    time.Sleep(100000000)
+  }
+  return false
+}
+
+func TestMesh(t *testing.T) {
+  reconnectBackoff = 100000000
+  a, storeA, addrA := newMeshReplica(t)
+  b, storeB, addrB := newMeshReplica(t)
+  c, storeC, addrC := newMeshReplica(t)
+  // A triangle contains a loop
+  a.AddPeer(addrB)
+  b.AddPeer(addrC)
+  c.AddPeer(addrA)
+  // Adding a peer twice has no effect
+  a.AddPeer(addrB)
+  if peers := a.Peers(); len(peers) != 1 || peers[0] != addrB {
+    t.Fatalf("Wrong peers: %v", peers)
+  }
+
+  stores := []*SimpleBlobStore{storeA, storeB, storeC}
+  for i, s := range stores {
+    blobref, _ := s.StoreBlob([]byte(fmt.Sprintf(`{"mesh":%v}`, i)), "")
+    for j, s2 := range stores {
+      if !waitForBlob(s2, blobref) {
+        t.Fatalf("Blob of replica %v did not reach replica %v", i, j)
+      }
+    }
+  }
+
+  // Without the link between A and C, blobs travel via B
+  c.RemovePeer(addrA)
+  if len(c.Peers()) != 0 {
+    t.Fatal("Peer has not been removed")
+  }
+  blobref, _ := storeC.StoreBlob([]byte(`{"mesh":"via b"}`), "")
+  if !waitForBlob(storeA, blobref) {
+    t.Fatal("Blob has not been forwarded")
+  }
+
+  // A new replica catches up with the blobs stored before it joined
+  d, storeD, _ := newMeshReplica(t)
+  d.AddPeer(addrB)
+  for _, s := range stores {
+    for blobref, _ := range s.Enumerate() {
+      if !waitForBlob(storeD, blobref) {
+        t.Fatal("New replica did not catch up")
+      }
+    }
+  }
+  if len(storeD.Enumerate()) != len(storeA.Enumerate()) {
+    t.Fatalf("Wrong number of blobs: %v %v", len(storeD.Enumerate()), len(storeA.Enumerate()))
+  }
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+  "time"
+)
+
+// The reconciler repairs divergence between replicas which streaming alone cannot prevent,
+// for example blobs stored while a peer was disconnected or lost in a broken connection.
+// In each round it asks the peer for the root hash of its hash tree (THASH).
+// If the hashes differ, it compares the children of the root (TCHLD) and descends only into
+// subtrees whose hashes differ. Where the trees diverge it requests the missing blobs
+// (GET, GETN, GETNX) and sends the blobs which the peer lacks.
+// Rounds are driven on the connections which this replica has dialed. A round that is interrupted
+// by a disconnect simply starts again after reconnecting. Subtrees which have been repaired in the
+// meantime have equal hashes and are skipped. The statistics of a peer survive reconnects.
+// A round which does not complete within reconcileTimeout is abandoned. The peer answers THASH and TCHLD
+// requests in order. Hence, the responses of an abandoned round arrive before those of the next round and are dropped.
+
+var (
+  // Nanoseconds between two rounds. A variable such that tests can change it.
+  reconcileInterval time.Duration = 60 * 1000000000
+  // Nanoseconds after which a round which has not completed is abandoned and started again
+  reconcileTimeout time.Duration = 300 * 1000000000
+)
+
+// Progress and divergence statistics of the reconciliation with one peer
+type ReconcileStats struct {
+  // The number of rounds started
+  Rounds int64
+  // The number of rounds in which both replicas had the same root hash
+  InSync int64
+  // The number of differing subtrees which have been compared
+  Subtrees int64
+  // The number of requests for blobs which are missing locally
+  Requested int64
+  // The number of blobs sent because the peer lacked them
+  Pushed int64
+  // The number of comparisons of the current round which are waiting for the peer.
+  // Zero if no round is in progress.
+  Pending int
+  // The time when the root hashes have been equal the last time
+  LastInSync time.Time
+}
+
+// The state of the reconciliation on one connection
+type reconcileState struct {
+  stats *ReconcileStats
+  // The time when the current round has started
+  started time.Time
+  // The number of responses of abandoned rounds which have not arrived yet
+  stale int
+}
+
+// Returns the statistics of all peers. The key is the network address of the peer.
+func (self *Replication) ReconcileStats() (result map[string]ReconcileStats) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  result = make(map[string]ReconcileStats)
+  for addr, stats := range self.reconcileStats {
+    result[addr] = *stats
+  }
+  return
+}
+
+// Starts reconciling with the peer at 'addr' on the connection
+func (self *Replication) startReconcile(conn *Connection, addr string) {
+  self.mutex.Lock()
+  stats, ok := self.reconcileStats[addr]
+  if !ok {
+    stats = &ReconcileStats{}
+    self.reconcileStats[addr] = stats
+  }
+  // Whatever has been pending on the previous connection will not arrive
+  stats.Pending = 0
+  self.reconciles[conn] = &reconcileState{stats: stats}
+  self.mutex.Unlock()
+  self.startRound(conn)
+}
+
+func (self *Replication) stopReconcile(conn *Connection) {
+  self.mutex.Lock()
+  if st, ok := self.reconciles[conn]; ok {
+    st.stats.Pending = 0
+    delete(self.reconciles, conn)
+  }
+  self.mutex.Unlock()
+}
+
+// Starts a new round unless one is in progress
+func (self *Replication) startRound(conn *Connection) {
+  self.mutex.Lock()
+  st, ok := self.reconciles[conn]
+  if !ok || (st.stats.Pending > 0 && time.Since(st.started) < reconcileTimeout) {
+    self.mutex.Unlock()
+    return
+  }
+  // The responses which the abandoned round is still waiting for must not be counted for the new round
+  st.stale += st.stats.Pending
+  st.started = time.Now()
+  st.stats.Rounds++
+  st.stats.Pending = 1
+  self.mutex.Unlock()
+  conn.Send("THASH", nil)
+}
+
+// Starts a round on all connections every 'interval' nanoseconds until the replication is closed
+func (self *Replication) reconcileLoop(interval time.Duration) {
+  for {
+    select {
+    case <-self.stop:
+      return
+    case <-time.After(interval):
+    }
+    self.mutex.Lock()
+    var conns []*Connection
+    for conn, _ := range self.reconciles {
+      conns = append(conns, conn)
+    }
+    self.mutex.Unlock()
+    for _, conn := range conns {
+      self.startRound(conn)
+    }
+  }
+}
+
+// Returns true if a response to a comparison belongs to an abandoned round. The caller drops the response.
+func (self *Replication) staleResponse(conn *Connection) bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  st, ok := self.reconciles[conn]
+  if !ok || st.stale == 0 {
+    return false
+  }
+  st.stale--
+  return true
+}
+
+// Updates the statistics of the connection if this replica reconciles on it.
+// 'responses' is the number of responses received, 'requests' the number of comparisons requested.
+func (self *Replication) countReconcile(conn *Connection, responses, requests int, inSync bool, subtrees, requested, pushed int) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  st, ok := self.reconciles[conn]
+  if !ok {
+    return
+  }
+  s := st.stats
+  s.Pending += requests - responses
+  if s.Pending < 0 {
+    s.Pending = 0
+  }
+  if inSync {
+    s.InSync++
+    s.LastInSync = time.Now()
+  }
+  s.Subtrees += int64(subtrees)
+  s.Requested += int64(requested)
+  s.Pushed += int64(pushed)
+}
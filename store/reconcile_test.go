@@ -0,0 +1,140 @@
+package store
+
+import (
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "testing"
+  "time"
+)
+
+// Waits until both stores hold the same number of blobs
+func waitForEqual(s1, s2 *SimpleBlobStore) bool {
+  for i := 0; i < 100; i++ {
+    if len(s1.Enumerate()) == len(s2.Enumerate()) {
+      return true
+    }
+    time.Sleep(100000000)
+  }
+  return false
+}
+
+func TestReconcile(t *testing.T) {
+  reconcileInterval = 200000000
+  a, storeA, addrA := newMeshReplica(t)
+  b, storeB, _ := newMeshReplica(t)
+  // Both stores diverge before they are connected
+  for i := 0; i < 300; i++ {
+    blob := []byte(fmt.Sprintf(`{"common":%v}`, i))
+    storeA.StoreBlob(blob, "")
+    storeB.StoreBlob(blob, "")
+  }
+  for i := 0; i < 40; i++ {
+    storeA.StoreBlob([]byte(fmt.Sprintf(`{"a":%v}`, i)), "")
+    storeB.StoreBlob([]byte(fmt.Sprintf(`{"b":%v}`, i)), "")
+  }
+  storeA.StoreBlob([]byte(`{"only":"a"}`), "")
+  b.AddPeer(addrA)
+  if !waitForEqual(storeA, storeB) || len(storeA.Enumerate()) != 381 {
+    t.Fatalf("Stores have not been reconciled: %v %v", len(storeA.Enumerate()), len(storeB.Enumerate()))
+  }
+  if storeA.HashTree().Hash() != storeB.HashTree().Hash() {
+    t.Fatal("Hash trees differ")
+  }
+  // Wait for a round which finds both replicas in sync
+  var stats ReconcileStats
+  for i := 0; i < 50; i++ {
+    stats = b.ReconcileStats()[addrA]
+    if stats.InSync > 0 && stats.Pending == 0 {
+      break
+    }
+    time.Sleep(100000000)
+  }
+  if stats.InSync == 0 || stats.Pending != 0 || stats.Subtrees == 0 || stats.Requested == 0 || stats.Pushed == 0 {
+    t.Fatalf("Wrong statistics: %+v", stats)
+  }
+  // Only the replica which dialed reconciles
+  if len(a.ReconcileStats()) != 0 {
+    t.Fatalf("Wrong statistics: %v", a.ReconcileStats())
+  }
+
+  // Blobs stored while the connection is broken are reconciled after reconnecting
+  b.mutex.Lock()
+  var conns []*Connection
+  for conn, _ := range b.connections {
+    conns = append(conns, conn)
+  }
+  b.mutex.Unlock()
+  for _, conn := range conns {
+    conn.Close()
+  }
+  storeB.StoreBlob([]byte(`{"offline":"b"}`), "")
+  if !waitForEqual(storeA, storeB) || len(storeA.Enumerate()) != 382 {
+    t.Fatalf("Stores have not been reconciled after reconnecting: %v %v", len(storeA.Enumerate()), len(storeB.Enumerate()))
+  }
+  if after := b.ReconcileStats()[addrA]; after.Rounds <= stats.Rounds {
+    t.Fatalf("Statistics have not been kept: %+v %+v", stats, after)
+  }
+}
+
+func TestReconcileStaleResponses(t *testing.T) {
+  rep := NewReplication("a@alice", NewSimpleBlobStore(), "", "")
+  defer rep.Close()
+  c1, c2 := net.Pipe()
+  go io.Copy(ioutil.Discard, c2)
+  conn := newConnection(c1, rep, "")
+  conn.userID = "a@alice"
+  rep.registerConnection(conn, connClient)
+  rep.startReconcile(conn, "peer")
+  // The first round is abandoned before the peer has answered
+  defer func(old time.Duration) {
+    reconcileTimeout = old
+  }(reconcileTimeout)
+  reconcileTimeout = 0
+  rep.startRound(conn)
+  respond := func() {
+    msg := Message{Cmd: "THASH", connection: conn}
+    msg.EncodePayload(rep.treeFor(nil).Hash())
+    rep.HandleMessage(msg)
+  }
+  // The response of the abandoned round does not end the current round
+  respond()
+  if stats := rep.ReconcileStats()["peer"]; stats.Rounds != 2 || stats.Pending != 1 || stats.InSync != 0 {
+    t.Fatalf("Stale response has been counted: %+v", stats)
+  }
+  respond()
+  if stats := rep.ReconcileStats()["peer"]; stats.Pending != 0 || stats.InSync != 1 {
+    t.Fatalf("Response has not been counted: %+v", stats)
+  }
+
+  // Closing the replication closes its connections and listeners
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  served := make(chan bool)
+  go func() {
+    rep.serve(l)
+    close(served)
+  }()
+  rep.AddPeer(l.Addr().String())
+  rep.Close()
+  select {
+  case <-served:
+  case <-time.After(2000000000):
+    t.Fatal("The replication is still listening")
+  }
+  select {
+  case <-conn.done:
+  default:
+    t.Fatal("The connection has not been closed")
+  }
+  if len(rep.Peers()) != 0 {
+    t.Fatal("The replication still connects to its peers")
+  }
+  rep.AddPeer(l.Addr().String())
+  if len(rep.Peers()) != 0 {
+    t.Fatal("Peer has been added after closing")
+  }
+}
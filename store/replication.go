@@ -1,6 +1,7 @@
 package store
 
 import (
+  "crypto/tls"
   "encoding/json"
   "log"
   "net"
@@ -15,9 +16,19 @@ const (
 )
 
 const (
+  // Maximum number of seconds between two attempts to connect to a peer
   ReconnectDelay = 20
 )
 
+// Nanoseconds to wait before the first attempt to reconnect. The delay doubles up to ReconnectDelay seconds.
+// A variable such that tests can change it.
+var reconnectBackoff time.Duration = 1000000000
+
+// Replicas form a mesh. Each replica connects to the peers which have been added to it
+// and accepts connections from other replicas. Any topology is possible as long as it is connected.
+// A blob received from one connection is sent on all other connections.
+// Stores notify their listeners only about blobs they did not know before.
+// Hence, a blob which comes back via another path is not sent again and forwarding is loop-free.
 type Replication struct {
   userID string
   mutex  sync.Mutex
@@ -25,17 +36,44 @@ type Replication struct {
   // by the conn* constants.
   connections map[*Connection]int
   store       BlobStore
-  // The empty string or the network address of a master
-  masterAddr string
-  laddr      string
+  // The key is the network address of a peer
+  peers map[string]*meshPeer
+  // The connection from which a blob has been received. Entries live until the store has processed the blob.
+  origins map[string]*Connection
+  // The connections on which this replica reconciles
+  reconciles map[*Connection]*reconcileState
+  // The key is the network address of a peer
+  reconcileStats map[string]*ReconcileStats
+  // Closed by Close
+  stop chan bool
+  // The listeners passed to serve. They are closed by Close.
+  listeners []net.Listener
+  // Hash trees over the blobs matching the filters in use. The key is the key of the filter.
+  filteredTrees map[string]*filteredTree
+  // The filter sent on the connections which this replica dials. Nil to replicate all blobs.
+  subscription *blobFilter
+  laddr   string
+  // Nil if connections do not use TLS
+  serverTLS *tls.Config
+  clientTLS *tls.Config
+  // The pre-shared keys. Empty if replicas authenticate with certificates.
+  psk map[string][]byte
+  // The identity of this replica when using pre-shared keys
+  identity string
+  // The identities which may replicate the store
+  authorized map[string]bool
+}
+
+// A peer to which this replica connects
+type meshPeer struct {
+  // Closed when the peer is removed
+  stop chan bool
 }
 
+// Connections use plain TCP and the remote replica is not authenticated.
+// 'masterAddr' is the network address of a peer or empty. Further peers can be added with AddPeer.
 func NewReplication(userID string, store BlobStore, laddr string, masterAddr string) *Replication {
-  rep := &Replication{store: store, connections: make(map[*Connection]int), userID: userID, masterAddr: masterAddr, laddr: laddr}
-  store.AddListener(rep)
-  if masterAddr != "" {
-    go rep.dialMaster(masterAddr)
-  }
+  rep, _ := NewSecureReplication(userID, store, laddr, masterAddr, nil)
   return rep
 }
 
@@ -49,6 +87,8 @@ func (self *Replication) unregisterConnection(conn *Connection) {
   self.mutex.Lock()
   delete(self.connections, conn)
   self.mutex.Unlock()
+  self.stopReconcile(conn)
+  self.pruneTrees()
 }
 
 func (self *Replication) Listen() (err error) {
@@ -56,56 +96,215 @@ func (self *Replication) Listen() (err error) {
   if err != nil {
     return
   }
+  return self.serve(l)
+}
+
+func (self *Replication) serve(l net.Listener) (err error) {
+  self.mutex.Lock()
+  if self.closed() {
+    // Accept fails right away
+    l.Close()
+  } else {
+    self.listeners = append(self.listeners, l)
+  }
+  self.mutex.Unlock()
   for {
     c, err := l.Accept()
     if err != nil {
+      if self.closed() {
+        return err
+      }
       log.Printf("ERR ACCEPT: %v", err)
       continue
     }
-    conn := newConnection(c, self, nil)
-    self.registerConnection(conn, connServer)
-    conn.Send("HELO", self.userID)
-    // This tells the other side to start sending BLOBs as they come in
-    conn.Send("OPEN", nil)
+    if self.serverTLS == nil {
+      self.accept(c, "")
+      continue
+    }
+    // A slow handshake must not block other replicas
+    go func(c net.Conn) {
+      tc, identity, err := self.handshake(c, true, "")
+      if err != nil {
+        log.Printf("ERR: Refused replica %v: %v\n", c.RemoteAddr(), err)
+        return
+      }
+      self.accept(tc, identity)
+    }(c)
+  }
+  return
+}
+
+// 'identity' is the authenticated identity of the remote replica or empty
+func (self *Replication) accept(c net.Conn, identity string) {
+  conn := newConnection(c, self, identity)
+  self.registerConnection(conn, connServer)
+  conn.Send("HELO", self.userID)
+  // This tells the other side to start sending BLOBs as they come in
+  conn.Send("OPEN", nil)
+}
+
+// Connects to the replica at 'addr' and keeps reconnecting until the peer is removed.
+func (self *Replication) AddPeer(addr string) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if _, ok := self.peers[addr]; ok || self.closed() {
+    return
+  }
+  p := &meshPeer{stop: make(chan bool)}
+  self.peers[addr] = p
+  go self.dialPeer(addr, p.stop)
+}
+
+// Closes the connection to the replica at 'addr' and stops reconnecting.
+// Connections which the peer has opened itself are not affected.
+func (self *Replication) RemovePeer(addr string) {
+  self.mutex.Lock()
+  p, ok := self.peers[addr]
+  delete(self.peers, addr)
+  self.mutex.Unlock()
+  if ok {
+    close(p.stop)
+  }
+}
+
+// Stops reconciling and reconnecting, stops listening and closes all connections.
+// The replication cannot be used any more afterwards.
+func (self *Replication) Close() {
+  self.mutex.Lock()
+  if self.closed() {
+    self.mutex.Unlock()
+    return
+  }
+  close(self.stop)
+  peers := self.peers
+  self.peers = make(map[string]*meshPeer)
+  listeners := self.listeners
+  self.listeners = nil
+  var conns []*Connection
+  for conn, _ := range self.connections {
+    conns = append(conns, conn)
+  }
+  self.mutex.Unlock()
+  for _, p := range peers {
+    close(p.stop)
+  }
+  for _, l := range listeners {
+    l.Close()
+  }
+  for _, conn := range conns {
+    conn.Close()
+  }
+}
+
+// Returns true if Close has been called
+func (self *Replication) closed() bool {
+  select {
+  case <-self.stop:
+    return true
+  default:
+  }
+  return false
+}
+
+// Returns the network addresses of the peers
+func (self *Replication) Peers() (addrs []string) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  for addr, _ := range self.peers {
+    addrs = append(addrs, addr)
   }
   return
 }
 
+// Waits before reconnecting. Returns false if the peer has been removed in the meantime.
+func waitReconnect(stop chan bool, delay time.Duration) bool {
+  select {
+  case <-stop:
+    return false
+  case <-time.After(delay):
+  }
+  return true
+}
+
 // Creates a connection to another peer
-func (self *Replication) dialMaster(raddr string) (err error) {
-  ch := make(chan error)
+func (self *Replication) dialPeer(raddr string, stop chan bool) {
+  delay := reconnectBackoff
   for {
     c, err := net.Dial("tcp", raddr)
-    if err != nil {
-      log.Printf("Failed connecting to %v, will retry ...\n", raddr)
-      time.Sleep(1000000000 * ReconnectDelay)
-      continue
+    identity := ""
+    if err == nil && self.clientTLS != nil {
+      c, identity, err = self.handshake(c, false, raddr)
+    }
+    if err == nil {
+      log.Printf("Connection established")
+      conn := newConnection(c, self, identity)
+      self.registerConnection(conn, connClient)
+      conn.Send("HELO", self.userID)
+      self.mutex.Lock()
+      conn.subscription = self.subscription
+      self.mutex.Unlock()
+      // The peer must know the filter before it starts sending
+      if conn.subscription != nil {
+        self.sendFilter(conn, conn.subscription)
+      }
+      // This tells the other side to start sending BLOBs as they come in
+      conn.Send("OPEN", nil)
+      // This initiates the syncing
+      self.startReconcile(conn, raddr)
+      select {
+      case <-conn.done:
+      case <-stop:
+        conn.Close()
+        return
+      }
+      log.Printf("Connection to %v is broken. Will retry ...\n", raddr)
+      delay = reconnectBackoff
+    } else {
+      log.Printf("Failed connecting to %v: %v, will retry ...\n", raddr, err)
+    }
+    if !waitReconnect(stop, delay) {
+      return
+    }
+    if delay *= 2; delay > ReconnectDelay*time.Second {
+      delay = ReconnectDelay * time.Second
     }
-    log.Printf("Connection established")
-    conn := newConnection(c, self, ch)
-    self.registerConnection(conn, connClient)
-    conn.Send("HELO", self.userID)
-    // This tells the other side to start sending BLOBs as they come in
-    conn.Send("OPEN", nil)
-    // This initiates the syncing
-    conn.Send("THASH", nil)
-    // Wait for some error
-    <-ch
-    log.Printf("Connection is broken. Will retry ...\n")
-    time.Sleep(1000000000 * ReconnectDelay)
   }
-  return
 }
 
 // Called from the store when a new blob has been stored
 func (self *Replication) HandleBlob(blob []byte, blobref string) error {
+  // The blob is parsed only if a filter needs its schema
+  var schema *blobSchema
+  parsed := false
+  parse := func() *blobSchema {
+    if !parsed {
+      schema = parseBlobSchema(blob)
+      parsed = true
+    }
+    return schema
+  }
+  self.mutex.Lock()
+  trees := len(self.filteredTrees) > 0
+  origin := self.origins[blobref]
+  delete(self.origins, blobref)
+  var connections []*Connection
+  var filters []*blobFilter
   for connection, flags := range self.connections {
-    if flags&connStreaming == connStreaming {
-      // Do not send the blob on the same connection on which it has been received
-      if !connection.hasReceivedBlob(blobref) {
-        connection.Send("BLOB", json.RawMessage(blob))
-      }
+    // Do not send the blob on the same connection on which it has been received
+    if flags&connStreaming == connStreaming && connection != origin {
+      connections = append(connections, connection)
+      filters = append(filters, connection.filter)
+    }
+  }
+  self.mutex.Unlock()
+  if trees {
+    self.updateTrees(blobref, parse())
+  }
+  for i, connection := range connections {
+    if filters[i] != nil && !filters[i].match(blobref, parse()) {
+      continue
     }
+    connection.Send("BLOB", json.RawMessage(blob))
   }
   return nil
 }
@@ -120,6 +319,8 @@ func (self *Replication) HandleMessage(msg Message) {
     self.openHandler(msg)
   case "CLOSE":
     self.closeHandler(msg)
+  case "FILTER":
+    self.filterHandler(msg)
   case "THASH":
     self.treeHashHandler(msg)
   case "TCHLD":
@@ -142,7 +343,7 @@ func (self *Replication) HandleMessage(msg Message) {
 
 // Handles the 'HELO' command
 func (self *Replication) heloHandler(msg Message) {
-  if msg.connection.userID != "" {
+  if msg.connection.userID != "" && !msg.connection.authenticated {
     log.Printf("Error: Second HELO is being sent")
   }
   var userID string
@@ -155,6 +356,10 @@ func (self *Replication) heloHandler(msg Message) {
     msg.connection.Close()
     return
   }
+  // The userID of an authenticated connection is its identity
+  if msg.connection.authenticated {
+    return
+  }
   println("HELO", userID)
   msg.connection.userID = userID
 }
@@ -167,8 +372,18 @@ func (self *Replication) blobHandler(msg Message) {
   }
   blob := []byte(*msg.Payload)
   blobref := NewBlobRef(blob)
-  msg.connection.addReceivedBlock(blobref)
-  self.store.StoreBlob(blob, blobref)
+  // The store does not notify the listeners about blobs it knows already
+  if _, err := self.store.GetBlob(blobref); err == nil {
+    return
+  }
+  self.mutex.Lock()
+  self.origins[blobref] = msg.connection
+  self.mutex.Unlock()
+  if _, err := self.store.StoreBlob(blob, blobref); err != nil {
+    self.mutex.Lock()
+    delete(self.origins, blobref)
+    self.mutex.Unlock()
+  }
 }
 
 // Handles the 'OPEN' command
@@ -176,8 +391,9 @@ func (self *Replication) openHandler(msg Message) {
   self.mutex.Lock()
   defer self.mutex.Unlock()
   i, ok := self.connections[msg.connection]
+  // The connection has been closed in the meantime?
   if !ok {
-    panic("Unknown connection")
+    return
   }
   self.connections[msg.connection] = i | connStreaming
 }
@@ -187,8 +403,9 @@ func (self *Replication) closeHandler(msg Message) {
   self.mutex.Lock()
   defer self.mutex.Unlock()
   i, ok := self.connections[msg.connection]
+  // The connection has been closed in the meantime?
   if !ok {
-    panic("Unknown connection")
+    return
   }
   self.connections[msg.connection] = i &^ connStreaming
 }
@@ -205,6 +422,10 @@ func (self *Replication) getHandler(msg Message) {
     log.Printf("Error while talking to store: %v\n", err)
     return
   }
+  if filter, _ := self.connectionFilters(msg.connection); !filter.match(blobref, parseBlobSchema(blob)) {
+    log.Printf("Blob %v does not match the filter of the peer\n", blobref)
+    return
+  }
   // TODO: If this is not a JSON blob ...
   err = msg.connection.Send("BLOB", json.RawMessage(blob))
   if err != nil {
@@ -219,19 +440,26 @@ func (self *Replication) getnHandler(msg Message) {
     log.Printf("Error in GETN request")
     return
   }
-  self.getnHandlerIntern(prefix, msg.connection)
+  filter, _ := self.connectionFilters(msg.connection)
+  self.getnHandlerIntern(prefix, filter, msg.connection)
 }
 
-func (self *Replication) getnHandlerIntern(prefix string, conn *Connection) {
+// Sends all blobs with the prefix which match the filter and returns their number
+func (self *Replication) getnHandlerIntern(prefix string, filter *blobFilter, conn *Connection) (count int) {
   channel, err := self.store.GetBlobs(prefix)
   if err != nil {
     log.Printf("Error while talking to store: %v\n", err)
     return
   }
   for blob := range channel {
+    if filter != nil && !filter.match(blob.BlobRef, parseBlobSchema(blob.Data)) {
+      continue
+    }
     log.Printf("sendblob %v\n", blob.BlobRef)
     conn.Send("BLOB", json.RawMessage(blob.Data))
+    count++
   }
+  return
 }
 
 // Handles the 'GETNX' command
@@ -248,10 +476,12 @@ func (self *Replication) getnxHandler(msg Message) {
   for _, e := range query.Except {
     except[e] = true
   }
-  go self.getnxHandlerIntern(query.Prefix, except, msg.connection)
+  filter, _ := self.connectionFilters(msg.connection)
+  go self.getnxHandlerIntern(query.Prefix, except, filter, msg.connection)
 }
 
-func (self *Replication) getnxHandlerIntern(prefix string, except map[string]bool, conn *Connection) {
+// Sends all blobs with the prefix which match the filter except those listed and returns their number
+func (self *Replication) getnxHandlerIntern(prefix string, except map[string]bool, filter *blobFilter, conn *Connection) (count int) {
   channel, err := self.store.GetBlobs(prefix)
   if err != nil {
     log.Printf("Error while talking to store: %v\n", err)
@@ -261,25 +491,39 @@ func (self *Replication) getnxHandlerIntern(prefix string, except map[string]boo
     if _, ok := except[blob.BlobRef]; ok {
       continue
     }
+    if filter != nil && !filter.match(blob.BlobRef, parseBlobSchema(blob.Data)) {
+      continue
+    }
     conn.Send("BLOB", json.RawMessage(blob.Data))
+    count++
   }
+  return
 }
 
-// Handles the 'THASH' command
+// Handles the 'THASH' command.
+// Requests are answered with the hash tree of the peer's filter, responses are compared with the hash tree of
+// this replica's subscription. Both are the same filter.
 func (self *Replication) treeHashHandler(msg Message) {
+  filter, subscription := self.connectionFilters(msg.connection)
   // This is a request?
   if msg.Payload == nil || len(*msg.Payload) == 0 {
-    msg.connection.Send("THASH", self.store.HashTree().Hash())
+    msg.connection.Send("THASH", self.treeFor(filter).Hash())
   } else {
+    if self.staleResponse(msg.connection) {
+      return
+    }
     var hash string
     if msg.DecodePayload(&hash) != nil {
       log.Printf("Error in THASH response")
+      self.countReconcile(msg.connection, 1, 0, false, 0, 0, 0)
       return
     }
     // Both computers agree on the root hash? -> Done
-    if hash == self.store.HashTree().Hash() {
+    if hash == self.treeFor(subscription).Hash() {
+      self.countReconcile(msg.connection, 1, 0, true, 0, 0, 0)
       return
     }
+    self.countReconcile(msg.connection, 1, 1, false, 0, 0, 0)
     msg.connection.Send("TCHLD", "")
   }
 }
@@ -291,23 +535,29 @@ func (self *Replication) treeHashChildrenHandler(msg Message) {
     Kind     int      "kind"
     Children []string "chld"
   }{}
+  filter, subscription := self.connectionFilters(msg.connection)
   var prefix string
   // This is a request?
   if msg.DecodePayload(&prefix) == nil {
-    req.Kind, req.Children, _ = self.store.HashTree().Children(prefix)
+    req.Kind, req.Children, _ = self.treeFor(filter).Children(prefix)
     req.Prefix = prefix
     msg.connection.Send("TCHLD", &req)
     return
   }
+  if self.staleResponse(msg.connection) {
+    return
+  }
   if msg.DecodePayload(&req) != nil {
     log.Printf("Error in TCHL message")
+    self.countReconcile(msg.connection, 1, 0, false, 0, 0, 0)
     return
   }
 
   kind1, children1, prefix := req.Kind, req.Children, req.Prefix
-  kind2, children2, err := self.store.HashTree().Children(prefix)
+  kind2, children2, err := self.treeFor(subscription).Children(prefix)
   if kind1 == HashTree_NIL || kind2 == HashTree_NIL || err != nil {
     log.Printf("Comparison of hash trees failed: prefix=%v, kind1=%v, kind2=%v, err=%v\n", prefix, kind1, kind2, err)
+    self.countReconcile(msg.connection, 1, 0, false, 0, 0, 0)
     return
   }
 
@@ -321,59 +571,87 @@ func (self *Replication) treeHashChildrenHandler(msg Message) {
     map2[ch] = true
   }
 
+  // The blobs which are missing locally are requested first. Then the blobs which the other side lacks are sent.
+  type request struct {
+    cmd  string
+    data interface{}
+  }
+  var requests []request
+  add := func(cmd string, data interface{}) {
+    requests = append(requests, request{cmd, data})
+  }
+  var push func() int
+  // The number of subtrees which are compared further
+  recursions := 0
   if kind1 == HashTree_IDs && kind2 == HashTree_IDs {
     // Both returned hashes. Compare the two sets of hashes
     for key, _ := range map1 {
       if _, ok := map2[key]; !ok {
-        msg.connection.Send("GET", key)
+        add("GET", key)
       }
     }
-    for key, _ := range map2 {
-      if _, ok := map1[key]; !ok {
-        blob, err := self.store.GetBlob(key)
-        if err != nil {
-          log.Printf("Retrieving block %v failed\n", key)
-        } else {
-          msg.connection.Send("BLOB", json.RawMessage(blob))
+    push = func() (count int) {
+      for key, _ := range map2 {
+        if _, ok := map1[key]; !ok {
+          blob, err := self.store.GetBlob(key)
+          if err != nil {
+            log.Printf("Retrieving block %v failed\n", key)
+          } else {
+            msg.connection.Send("BLOB", json.RawMessage(blob))
+            count++
+          }
         }
       }
+      return
     }
   } else if kind1 == HashTree_InnerNodes && kind2 == HashTree_InnerNodes {
-    // Both returned subtree nodes? Recursion into the sub tree nodes
+    // Both returned subtree nodes? Recursion into the sub tree nodes which differ
+    var missing []string
     for i := 0; i < HashTree_NodeDegree; i++ {
       if children1[i] == children2[i] {
         continue
       }
       p := prefix + string(hextable[i])
       if children1[i] == "" {
-        self.getnHandlerIntern(p, msg.connection)
+        missing = append(missing, p)
       } else if children2[i] == "" {
         // Get all blobs with this prefix
-        msg.connection.Send("GETN", p)
+        add("GETN", p)
       } else {
         // Recursion
-        msg.connection.Send("TCHLD", p)
+        add("TCHLD", p)
+        recursions++
       }
     }
-  } else if kind1 == HashTree_InnerNodes && kind2 == HashTree_IDs {
-    for i := 0; i < HashTree_NodeDegree; i++ {
-      // Get all blox with this prefix (except those in map1) from the other side
-      p := prefix + string(hextable[i])
-      lst := []string{}
-      for key, _ := range map1 {
-        lst = append(lst, key)
+    push = func() (count int) {
+      for _, p := range missing {
+        count += self.getnHandlerIntern(p, subscription, msg.connection)
       }
-      r := struct {
-        Prefix string   "prefix"
-        Except []string "except"
-      }{p, lst}
-      msg.connection.Send("GETNX", &r)
+      return
     }
+  } else if kind1 == HashTree_InnerNodes && kind2 == HashTree_IDs {
+    // Get all blobs with this prefix from the other side except those which are known locally
+    lst := []string{}
+    for key, _ := range map2 {
+      lst = append(lst, key)
+    }
+    r := struct {
+      Prefix string   "prefix"
+      Except []string "except"
+    }{prefix, lst}
+    add("GETNX", &r)
   } else {
-    for i := 0; i < HashTree_NodeDegree; i++ {
-      // Send all blobs with this prefix (except those in map2) to the other side
-      p := prefix + string(hextable[i])
-      self.getnxHandlerIntern(p, map2, msg.connection)
+    // Send all blobs with this prefix to the other side except those which it knows already
+    push = func() int {
+      return self.getnxHandlerIntern(prefix, map1, subscription, msg.connection)
     }
   }
+  // Count the recursions before sending them, such that the round does not end prematurely
+  self.countReconcile(msg.connection, 1, recursions, false, 1, len(requests)-recursions, 0)
+  for _, r := range requests {
+    msg.connection.Send(r.cmd, r.data)
+  }
+  if push != nil {
+    self.countReconcile(msg.connection, 0, 0, false, 0, 0, push())
+  }
 }
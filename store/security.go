@@ -0,0 +1,280 @@
+package store
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "io"
+  "math/big"
+  "net"
+  "time"
+)
+
+// Replicas can protect their connections with TLS and authenticate each other
+// either with certificates or with pre-shared keys.
+// With certificates, the identity of a replica is the first email address in its certificate
+// or, if there is none, its common name.
+// With pre-shared keys, TLS serves for encryption only. Afterwards, each side proves that it knows
+// the key of the identity it claims. The proof covers keying material exported from the TLS session.
+// Hence, it cannot be relayed by a man in the middle.
+// The authenticated identity becomes the userID of the connection. Only the owner of the store
+// and the identities listed in ReplicationConfig.Authorized may replicate the store.
+
+const (
+  // Nanoseconds until the TLS handshake and the authentication must be complete
+  handshakeTimeout = 10 * 1000000000
+  // Maximum size of a message exchanged during the pre-shared key handshake
+  maxHandshakeFrame = 4096
+  pskLabel          = "lightwave-replication"
+)
+
+type ReplicationConfig struct {
+  // The TLS settings. For certificate authentication, Certificates holds the certificate of this replica,
+  // RootCAs and ClientCAs hold the CAs which issue the certificates of replicas.
+  // With pre-shared keys, a self-signed certificate is generated if there is none.
+  TLS *tls.Config
+  // If not empty, replicas authenticate with pre-shared keys instead of certificates.
+  // The key of the map is the identity of a replica.
+  PSK map[string][]byte
+  // The identity of this replica when using pre-shared keys. The default is the userID.
+  Identity string
+  // Identities which may replicate the store in addition to the owner of the store
+  Authorized []string
+}
+
+// Sent by both sides during the pre-shared key handshake. The client sends no proof.
+type pskMessage struct {
+  ID    string `json:"id"`
+  Nonce []byte `json:"nonce"`
+  Proof []byte `json:"proof"`
+}
+
+// Like NewReplication, but connections use TLS and replicas must authenticate.
+func NewSecureReplication(userID string, store BlobStore, laddr string, masterAddr string, config *ReplicationConfig) (rep *Replication, err error) {
+  rep = &Replication{store: store, connections: make(map[*Connection]int), userID: userID, peers: make(map[string]*meshPeer), origins: make(map[string]*Connection), reconciles: make(map[*Connection]*reconcileState), reconcileStats: make(map[string]*ReconcileStats), filteredTrees: make(map[string]*filteredTree), stop: make(chan bool), laddr: laddr}
+  if config != nil {
+    if err = rep.configure(config); err != nil {
+      return nil, err
+    }
+  }
+  store.AddListener(rep)
+  go rep.reconcileLoop(reconcileInterval)
+  if masterAddr != "" {
+    rep.AddPeer(masterAddr)
+  }
+  return rep, nil
+}
+
+func (self *Replication) configure(config *ReplicationConfig) (err error) {
+  base := &tls.Config{}
+  if config.TLS != nil {
+    base = config.TLS.Clone()
+  }
+  psk := len(config.PSK) > 0
+  self.identity = self.userID
+  if psk {
+    if config.Identity != "" {
+      self.identity = config.Identity
+    }
+    if _, ok := config.PSK[self.identity]; !ok {
+      return errors.New("No pre-shared key for " + self.identity)
+    }
+    if len(base.Certificates) == 0 {
+      cert, err := selfSignedCertificate()
+      if err != nil {
+        return err
+      }
+      base.Certificates = []tls.Certificate{cert}
+    }
+  } else if len(base.Certificates) == 0 {
+    return errors.New("TLS certificate missing")
+  }
+  self.authorized = map[string]bool{self.userID: true}
+  for _, id := range config.Authorized {
+    self.authorized[id] = true
+  }
+  self.psk = config.PSK
+  server := base.Clone()
+  client := base.Clone()
+  if psk {
+    // The pre-shared key handshake authenticates both sides
+    server.ClientAuth = tls.NoClientCert
+    client.InsecureSkipVerify = true
+  } else {
+    server.ClientAuth = tls.RequireAndVerifyClientCert
+  }
+  self.serverTLS = server
+  self.clientTLS = client
+  return nil
+}
+
+// Performs the TLS handshake and authenticates the remote replica.
+// Returns the connection to use from now on and the identity of the remote replica.
+func (self *Replication) handshake(c net.Conn, server bool, raddr string) (conn net.Conn, identity string, err error) {
+  var tc *tls.Conn
+  if server {
+    tc = tls.Server(c, self.serverTLS)
+  } else {
+    config := self.clientTLS.Clone()
+    if config.ServerName == "" {
+      config.ServerName = "localhost"
+      if host, _, err := net.SplitHostPort(raddr); err == nil && host != "" {
+        config.ServerName = host
+      }
+    }
+    tc = tls.Client(c, config)
+  }
+  tc.SetDeadline(time.Now().Add(handshakeTimeout))
+  if err = tc.Handshake(); err != nil {
+    tc.Close()
+    return nil, "", err
+  }
+  if len(self.psk) > 0 {
+    identity, err = self.pskHandshake(tc, server)
+  } else {
+    identity, err = certificateIdentity(tc.ConnectionState())
+  }
+  if err == nil && !self.authorized[identity] {
+    err = errors.New("Replica " + identity + " is not authorized")
+  }
+  if err != nil {
+    tc.Close()
+    return nil, "", err
+  }
+  tc.SetDeadline(time.Time{})
+  return tc, identity, nil
+}
+
+func certificateIdentity(state tls.ConnectionState) (identity string, err error) {
+  if len(state.PeerCertificates) == 0 {
+    return "", errors.New("No certificate")
+  }
+  cert := state.PeerCertificates[0]
+  if len(cert.EmailAddresses) > 0 {
+    return cert.EmailAddresses[0], nil
+  }
+  if cert.Subject.CommonName == "" {
+    return "", errors.New("Certificate without identity")
+  }
+  return cert.Subject.CommonName, nil
+}
+
+// The client sends its identity and a nonce. The server answers with its identity, a nonce and its proof.
+// Then the client sends its proof. Each proof is computed with the key of the sender over the nonce of the receiver.
+func (self *Replication) pskHandshake(tc *tls.Conn, server bool) (identity string, err error) {
+  state := tc.ConnectionState()
+  secret, err := state.ExportKeyingMaterial(pskLabel, nil, 32)
+  if err != nil {
+    return "", err
+  }
+  nonce := make([]byte, 32)
+  if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+    return "", err
+  }
+  var peer pskMessage
+  if server {
+    if err = readFrame(tc, &peer); err != nil {
+      return "", err
+    }
+    proof := pskProof(self.psk[self.identity], secret, "S", self.identity, peer.Nonce)
+    if err = writeFrame(tc, &pskMessage{self.identity, nonce, proof}); err != nil {
+      return "", err
+    }
+    var answer pskMessage
+    if err = readFrame(tc, &answer); err != nil {
+      return "", err
+    }
+    peer.Proof = answer.Proof
+  } else {
+    if err = writeFrame(tc, &pskMessage{ID: self.identity, Nonce: nonce}); err != nil {
+      return "", err
+    }
+    if err = readFrame(tc, &peer); err != nil {
+      return "", err
+    }
+  }
+  role := "C"
+  if !server {
+    role = "S"
+  }
+  key, ok := self.psk[peer.ID]
+  if !ok || !hmac.Equal(peer.Proof, pskProof(key, secret, role, peer.ID, nonce)) {
+    return "", errors.New("Pre-shared key authentication failed")
+  }
+  if !server {
+    proof := pskProof(self.psk[self.identity], secret, "C", self.identity, peer.Nonce)
+    if err = writeFrame(tc, &pskMessage{ID: self.identity, Proof: proof}); err != nil {
+      return "", err
+    }
+  }
+  return peer.ID, nil
+}
+
+// 'role' distinguishes client and server, such that a proof cannot be reflected
+func pskProof(key []byte, secret []byte, role string, identity string, nonce []byte) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(pskLabel + "\n" + role + "\n" + identity + "\n"))
+  mac.Write(nonce)
+  mac.Write(secret)
+  return mac.Sum(nil)
+}
+
+// Frames are length-prefixed, such that nothing is read beyond the handshake
+func writeFrame(w io.Writer, msg *pskMessage) error {
+  data, err := json.Marshal(msg)
+  if err != nil {
+    return err
+  }
+  if len(data) > maxHandshakeFrame {
+    return errors.New("Handshake message too large")
+  }
+  buf := make([]byte, 2+len(data))
+  binary.BigEndian.PutUint16(buf, uint16(len(data)))
+  copy(buf[2:], data)
+  _, err = w.Write(buf)
+  return err
+}
+
+func readFrame(r io.Reader, msg *pskMessage) error {
+  var size [2]byte
+  if _, err := io.ReadFull(r, size[:]); err != nil {
+    return err
+  }
+  n := int(binary.BigEndian.Uint16(size[:]))
+  if n > maxHandshakeFrame {
+    return errors.New("Handshake message too large")
+  }
+  data := make([]byte, n)
+  if _, err := io.ReadFull(r, data); err != nil {
+    return err
+  }
+  return json.Unmarshal(data, msg)
+}
+
+func selfSignedCertificate() (cert tls.Certificate, err error) {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return
+  }
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject:      pkix.Name{CommonName: "lightwave replica"},
+    NotBefore:    time.Now().Add(-time.Hour),
+    NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+    KeyUsage:     x509.KeyUsageDigitalSignature,
+    ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    return
+  }
+  return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
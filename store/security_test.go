@@ -0,0 +1,142 @@
+package store
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "math/big"
+  "net"
+  "testing"
+  "time"
+)
+
+func newTestReplication(t *testing.T, config *ReplicationConfig) *Replication {
+  rep := &Replication{userID: "a@alice", connections: make(map[*Connection]int)}
+  if err := rep.configure(config); err != nil {
+    t.Fatal(err)
+  }
+  return rep
+}
+
+// Connects the client to the server and returns the identity which each side has authenticated
+func connectReplicas(t *testing.T, server, client *Replication) (serverSees, clientSees string, serverErr, clientErr error) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  done := make(chan bool)
+  go func() {
+    c, err := l.Accept()
+    if err == nil {
+      var conn net.Conn
+      if conn, serverSees, serverErr = server.handshake(c, true, ""); serverErr == nil {
+        conn.Close()
+      }
+    }
+    done <- true
+  }()
+  c, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  var conn net.Conn
+  if conn, clientSees, clientErr = client.handshake(c, false, l.Addr().String()); clientErr == nil {
+    // Wait for the server before closing
+    <-done
+    conn.Close()
+  } else {
+    <-done
+  }
+  return
+}
+
+func TestPreSharedKey(t *testing.T) {
+  keys := map[string][]byte{"a@alice": []byte("key of alice"), "a@alice/laptop": []byte("key of laptop"), "b@bob": []byte("key of bob")}
+  server := newTestReplication(t, &ReplicationConfig{PSK: keys})
+  laptop := newTestReplication(t, &ReplicationConfig{PSK: keys, Identity: "a@alice/laptop"})
+  authorized := newTestReplication(t, &ReplicationConfig{PSK: keys, Authorized: []string{"a@alice/laptop"}})
+
+  // The laptop is not authorized by the server, but it accepts the server
+  s, c, serr, cerr := connectReplicas(t, server, laptop)
+  if serr == nil || cerr != nil || c != "a@alice" {
+    t.Fatalf("Unauthorized replica has been accepted: %v %v %v %v", s, c, serr, cerr)
+  }
+  s, c, serr, cerr = connectReplicas(t, authorized, laptop)
+  if serr != nil || cerr != nil || s != "a@alice/laptop" || c != "a@alice" {
+    t.Fatalf("Authentication failed: %v %v %v %v", s, c, serr, cerr)
+  }
+
+  // Bob knows a different key for the laptop and is not authorized anyway
+  forged := map[string][]byte{"a@alice/laptop": []byte("guessed"), "b@bob": []byte("key of bob")}
+  bob := newTestReplication(t, &ReplicationConfig{PSK: forged, Identity: "b@bob"})
+  _, _, serr, cerr = connectReplicas(t, authorized, bob)
+  if serr == nil || cerr == nil {
+    t.Fatal("Replica with the wrong key has been accepted")
+  }
+  mallory := newTestReplication(t, &ReplicationConfig{PSK: forged, Identity: "a@alice/laptop"})
+  if _, _, serr, _ = connectReplicas(t, authorized, mallory); serr == nil {
+    t.Fatal("Replica with the wrong key has been accepted")
+  }
+}
+
+func TestCertificates(t *testing.T) {
+  caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  caTemplate := &x509.Certificate{
+    SerialNumber:          big.NewInt(1),
+    Subject:               pkix.Name{CommonName: "lightwave CA"},
+    NotBefore:             time.Now().Add(-time.Hour),
+    NotAfter:              time.Now().Add(time.Hour),
+    IsCA:                  true,
+    BasicConstraintsValid: true,
+    KeyUsage:              x509.KeyUsageCertSign,
+  }
+  der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  ca, _ := x509.ParseCertificate(der)
+  pool := x509.NewCertPool()
+  pool.AddCert(ca)
+  issue := func(serial int64, email string) tls.Certificate {
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    template := &x509.Certificate{
+      SerialNumber:   big.NewInt(serial),
+      Subject:        pkix.Name{CommonName: "replica"},
+      EmailAddresses: []string{email},
+      IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+      NotBefore:      time.Now().Add(-time.Hour),
+      NotAfter:       time.Now().Add(time.Hour),
+      KeyUsage:       x509.KeyUsageDigitalSignature,
+      ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+  }
+  config := func(cert tls.Certificate) *ReplicationConfig {
+    return &ReplicationConfig{TLS: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ClientCAs: pool}}
+  }
+  server := newTestReplication(t, config(issue(2, "a@alice")))
+  client := newTestReplication(t, config(issue(3, "a@alice")))
+  s, c, serr, cerr := connectReplicas(t, server, client)
+  if serr != nil || cerr != nil || s != "a@alice" || c != "a@alice" {
+    t.Fatalf("Authentication failed: %v %v %v %v", s, c, serr, cerr)
+  }
+  // Carol has a valid certificate but is not authorized
+  carol := newTestReplication(t, config(issue(4, "c@carol")))
+  if _, _, serr, _ = connectReplicas(t, server, carol); serr == nil {
+    t.Fatal("Unauthorized replica has been accepted")
+  }
+  // A certificate from another CA is refused
+  selfSigned, _ := selfSignedCertificate()
+  stranger := newTestReplication(t, config(selfSigned))
+  if _, _, serr, _ = connectReplicas(t, server, stranger); serr == nil {
+    t.Fatal("Replica with an unknown certificate has been accepted")
+  }
+}
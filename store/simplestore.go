@@ -6,6 +6,8 @@ import (
   "errors"
   "log"
   "strings"
+  "sync"
+  "time"
 )
 
 func NewBlobRef(blob []byte) string {
@@ -17,6 +19,8 @@ func NewBlobRef(blob []byte) string {
 type blobStruct struct {
   data []byte
   ref  string
+  // The blob has been deleted
+  deleted bool
 }
 
 type SimpleBlobStore struct {
@@ -24,22 +28,21 @@ type SimpleBlobStore struct {
   blobs     map[string][]byte
   hashTree  *SimpleHashTree
   channel   chan blobStruct
+  // The time of deletion of deleted blobs
+  tombstones map[string]time.Time
+  // Protects blobs, tombstones and hashTree. Blobs can arrive concurrently from several sources.
+  mutex sync.Mutex
 }
 
 func NewSimpleBlobStore() *SimpleBlobStore {
-  s := &SimpleBlobStore{blobs: make(map[string][]byte), hashTree: NewSimpleHashTree()}
+  s := &SimpleBlobStore{blobs: make(map[string][]byte), tombstones: make(map[string]time.Time), hashTree: NewSimpleHashTree()}
 
   s.channel = make(chan blobStruct, 1000)
   f := func() {
     for {
       var b blobStruct
       b = <-s.channel
-      for _, l := range s.listeners {
-        err := l.HandleBlob(b.data, b.ref)
-        if err != nil {
-          log.Printf("Err: %v", err)
-        }
-      }
+      s.notify(b)
     }
   }
   go f()
@@ -47,8 +50,15 @@ func NewSimpleBlobStore() *SimpleBlobStore {
   return s
 }
 
+// Returns a copy of all blobs, such that blobs can be stored concurrently
 func (self *SimpleBlobStore) Enumerate() (result map[string][]byte) {
-  return self.blobs
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  result = make(map[string][]byte, len(self.blobs))
+  for blobref, blob := range self.blobs {
+    result[blobref] = blob
+  }
+  return
 }
 
 func (self *SimpleBlobStore) StoreBlob(blob []byte, blobref string) (finalBlobRef string, err error) {
@@ -56,18 +66,28 @@ func (self *SimpleBlobStore) StoreBlob(blob []byte, blobref string) (finalBlobRe
   if len(blobref) == 0 {
     blobref = NewBlobRef(blob)
   }
+  self.mutex.Lock()
   // The blob is already known?
   if _, ok := self.blobs[blobref]; ok {
+    self.mutex.Unlock()
     log.Printf("Blob is already known\n")
     return blobref, nil
   }
+  if deleted, ok := self.tombstones[blobref]; ok {
+    if time.Since(deleted) < TombstoneTTL {
+      self.mutex.Unlock()
+      return "", ErrBlobDeleted
+    }
+    delete(self.tombstones, blobref)
+  }
   self.hashTree.Add(blobref)
   // Store the blob and allow for its further processing
   self.blobs[blobref] = blob
+  self.mutex.Unlock()
   //  for _, l := range self.listeners {
   //    l.HandleBlob(blob, blobref)
   //  }
-  self.channel <- blobStruct{blob, blobref}
+  self.channel <- blobStruct{data: blob, ref: blobref}
   return blobref, nil
 }
 
@@ -77,13 +97,32 @@ func (self *SimpleBlobStore) HashTree() HashTree {
 
 func (self *SimpleBlobStore) GetBlob(blobref string) (blob []byte, err error) {
   var ok bool
-  if blob, ok = self.blobs[blobref]; ok {
+  self.mutex.Lock()
+  blob, ok = self.blobs[blobref]
+  self.mutex.Unlock()
+  if ok {
     return
   }
   err = errors.New("Unknown Blob ID")
   return
 }
 
+// Deleting an unknown blob leaves a tombstone as well, such that the blob cannot arrive later.
+func (self *SimpleBlobStore) DeleteBlob(blobref string) error {
+  self.mutex.Lock()
+  _, ok := self.blobs[blobref]
+  if ok {
+    delete(self.blobs, blobref)
+    self.hashTree.Remove(blobref)
+  }
+  self.tombstones[blobref] = time.Now()
+  self.mutex.Unlock()
+  if ok {
+    self.channel <- blobStruct{ref: blobref, deleted: true}
+  }
+  return nil
+}
+
 func (self *SimpleBlobStore) GetBlobs(prefix string) (channel <-chan Blob, err error) {
   ch := make(chan Blob)
   go self.getBlobs(prefix, ch)
@@ -93,14 +132,34 @@ func (self *SimpleBlobStore) GetBlobs(prefix string) (channel <-chan Blob, err e
 func (self *SimpleBlobStore) getBlobs(prefix string, channel chan Blob) {
   // TODO: The sending on the channel might fail if the underlying
   // connection is broken
+  var blobs []Blob
+  self.mutex.Lock()
   for blobref, blob := range self.blobs {
     if strings.HasPrefix(blobref, prefix) {
-      channel <- Blob{Data: blob, BlobRef: blobref}
+      blobs = append(blobs, Blob{Data: blob, BlobRef: blobref})
     }
   }
+  self.mutex.Unlock()
+  for _, b := range blobs {
+    channel <- b
+  }
   close(channel)
 }
 
+func (self *SimpleBlobStore) notify(b blobStruct) {
+  for _, l := range self.listeners {
+    var err error
+    if !b.deleted {
+      err = l.HandleBlob(b.data, b.ref)
+    } else if dl, ok := l.(BlobStoreDeleteListener); ok {
+      err = dl.HandleDeletedBlob(b.ref)
+    }
+    if err != nil {
+      log.Printf("Err: %v", err)
+    }
+  }
+}
+
 func (self *SimpleBlobStore) AddListener(l BlobStoreListener) {
   self.listeners = append(self.listeners, l)
 }
@@ -1,17 +1,39 @@
 package store
 
+import (
+  "errors"
+  "time"
+)
+
+// Returned by StoreBlob for blobs which have been deleted recently.
+// Otherwise replication would resurrect them from replicas which still have them.
+var ErrBlobDeleted = errors.New("Blob has been deleted")
+
+// How long a deleted blob cannot be stored again.
+// Replicas must collect the blob within this period, or they will bring it back.
+var TombstoneTTL time.Duration = 30 * 24 * time.Hour
+
 type BlobStore interface {
   StoreBlob(blob []byte, blobref string) (finalBlobRef string, err error)
   AddListener(listener BlobStoreListener)
   HashTree() HashTree
   GetBlob(blobref string) (blob []byte, err error)
   GetBlobs(prefix string) (channel <-chan Blob, err error)
+  // Removes the blob from the store and its hash tree and leaves a tombstone,
+  // such that StoreBlob rejects the blob with ErrBlobDeleted until TombstoneTTL has passed.
+  DeleteBlob(blobref string) error
 }
 
 type BlobStoreListener interface {
   HandleBlob(blob []byte, blobref string) error
 }
 
+// Listeners which implement this interface are told about deleted blobs as well.
+// Notifications are delivered in the same order as those about new blobs.
+type BlobStoreDeleteListener interface {
+  HandleDeletedBlob(blobref string) error
+}
+
 type Blob struct {
   Data    []byte
   BlobRef string
@@ -0,0 +1,163 @@
+package lightwavetransformer
+
+import (
+  "fmt"
+  grapher "lightwavegrapher"
+  "log"
+  "os"
+  "json"
+)
+
+// minMaxTransformer implements TransformationMax and TransformationMin.
+// Each mutation sets the field to a new value and thereby overwrites the values of all mutations
+// it depends on. Concurrent branches are resolved by taking the largest (or smallest) value among
+// the heads of all branches, i.e. the value each branch ends with. Thus, all sites end up
+// with the same value regardless of the order in which the mutations arrive.
+// The epsilon operation "null" does not set any value.
+type minMaxTransformer struct {
+  grapher *grapher.Grapher
+  kind int
+  dataType int
+}
+
+// Registers a transformer for fields of type TypeInt64, TypeFloat64 or TypeString
+// which converge to the maximum of concurrent writes.
+func NewMaxTransformer(g *grapher.Grapher, dataType int) (t grapher.Transformer, err os.Error) {
+  return newMinMaxTransformer(g, grapher.TransformationMax, dataType)
+}
+
+// Registers a transformer for fields of type TypeInt64, TypeFloat64 or TypeString
+// which converge to the minimum of concurrent writes.
+func NewMinTransformer(g *grapher.Grapher, dataType int) (t grapher.Transformer, err os.Error) {
+  return newMinMaxTransformer(g, grapher.TransformationMin, dataType)
+}
+
+func newMinMaxTransformer(g *grapher.Grapher, kind int, dataType int) (t grapher.Transformer, err os.Error) {
+  switch dataType {
+  case grapher.TypeInt64, grapher.TypeFloat64, grapher.TypeString:
+  default:
+    return nil, os.NewError(fmt.Sprintf("Unsupported data type %v", dataType))
+  }
+  t = &minMaxTransformer{grapher: g, kind: kind, dataType: dataType}
+  g.AddTransformer(t)
+  return t, nil
+}
+
+func (self *minMaxTransformer) Kind() int {
+  return self.kind
+}
+
+func (self *minMaxTransformer) DataType() int {
+  return self.dataType
+}
+
+// Returns nil if the mutation is the epsilon operation
+func (self *minMaxTransformer) decodeValue(mutation grapher.MutationNode) (value interface{}, err os.Error) {
+  op, ok := mutation.Operation().([]byte)
+  if !ok {
+    return mutation.Operation(), nil
+  }
+  if string(op) == "null" {
+    return nil, nil
+  }
+  switch self.dataType {
+  case grapher.TypeInt64:
+    var v int64
+    err = json.Unmarshal(op, &v)
+    value = v
+  case grapher.TypeFloat64:
+    var v float64
+    err = json.Unmarshal(op, &v)
+    value = v
+  case grapher.TypeString:
+    var v string
+    err = json.Unmarshal(op, &v)
+    value = v
+  }
+  return
+}
+
+// Returns true if 'value' must be discarded because 'other' wins
+func (self *minMaxTransformer) loses(value interface{}, other interface{}) bool {
+  var less, greater bool
+  switch v := value.(type) {
+  case int64:
+    o, ok := other.(int64)
+    if !ok {
+      return false
+    }
+    less, greater = v < o, v > o
+  case float64:
+    o, ok := other.(float64)
+    if !ok {
+      return false
+    }
+    less, greater = v < o, v > o
+  case string:
+    o, ok := other.(string)
+    if !ok {
+      return false
+    }
+    less, greater = v < o, v > o
+  default:
+    return false
+  }
+  if self.kind == grapher.TransformationMax {
+    return less
+  }
+  return greater
+}
+
+// Interface towards the Grapher.
+// The value of the field after 'mutation' is the largest (or smallest) of the value of 'mutation'
+// and the values of the heads. The operation of 'mutation' is transformed into this value.
+func (self *minMaxTransformer) TransformMutationBranches(mutation grapher.MutationNode, heads []grapher.MutationNode) (err os.Error) {
+  value, err := self.decodeValue(mutation)
+  if err != nil {
+    log.Printf("Err: Decoding mutation %v: %v\n", mutation.BlobRef(), err)
+    return err
+  }
+  op := mutation.Operation()
+  for _, head := range heads {
+    other, e := self.decodeValue(head)
+    if e != nil {
+      log.Printf("Err: Decoding mutation %v: %v\n", head.BlobRef(), e)
+      return e
+    }
+    if other != nil && (value == nil || self.loses(value, other)) {
+      value = other
+      op = head.Operation()
+    }
+  }
+  mutation.SetOperation(op)
+  return
+}
+
+// Interface towards the Grapher.
+// The Grapher calls TransformMutationBranches instead. Here, each concurrent mutation counts as the head of a branch.
+func (self *minMaxTransformer) TransformClientMutation(mutation grapher.MutationNode, concurrent <-chan grapher.MutationNode) (err os.Error) {
+  // The channel is read until the end, because otherwise its sender would block forever.
+  var heads []grapher.MutationNode
+  for m := range concurrent {
+    heads = append(heads, m)
+  }
+  return self.TransformMutationBranches(mutation, heads)
+}
+
+// Interface towards the Grapher.
+// The Grapher calls TransformMutationBranches instead. Here, each concurrent mutation counts as the head of a branch.
+func (self *minMaxTransformer) TransformMutation(mutation grapher.MutationNode, rollback <-chan grapher.MutationNode, concurrent []string) (err os.Error) {
+  // Get a list of all concurrent mutations
+  conc := make(map[string]bool)
+  for _, id := range concurrent {
+    conc[id] = true
+  }
+  var heads []grapher.MutationNode
+  for m := range rollback {
+    // Skip those which are not concurrent
+    if _, ok := conc[m.BlobRef()]; ok {
+      heads = append(heads, m)
+    }
+  }
+  return self.TransformMutationBranches(mutation, heads)
+}
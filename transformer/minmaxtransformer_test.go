@@ -0,0 +1,215 @@
+package lightwavetransformer
+
+import (
+  "fmt"
+  grapher "lightwavegrapher"
+  "testing"
+)
+
+type dummyMutation struct {
+  blobref string
+  op interface{}
+}
+
+func (self *dummyMutation) BlobRef() string { return self.blobref }
+func (self *dummyMutation) Signer() string { return "a@b" }
+func (self *dummyMutation) PermaBlobRef() string { return "perma" }
+func (self *dummyMutation) ToMap() map[string]interface{} { return nil }
+func (self *dummyMutation) FromMap(perma_blobref string, data map[string]interface{}) { }
+func (self *dummyMutation) Time() int64 { return 0 }
+func (self *dummyMutation) Dependencies() []string { return nil }
+func (self *dummyMutation) SetSequenceNumber(seq int64) { }
+func (self *dummyMutation) SequenceNumber() int64 { return 0 }
+func (self *dummyMutation) Operation() interface{} { return self.op }
+func (self *dummyMutation) SetOperation(op interface{}) { self.op = op }
+func (self *dummyMutation) EntityBlobRef() string { return "entity" }
+func (self *dummyMutation) Field() string { return "field" }
+
+// Applies the values as concurrent mutations in the given order and returns the resulting value
+func applyConcurrent(t *testing.T, tr grapher.Transformer, values []string) string {
+  var applied []grapher.MutationNode
+  var ids []string
+  result := "null"
+  for i, v := range values {
+    m := &dummyMutation{blobref: fmt.Sprintf("m%v", i), op: []byte(v)}
+    ch := make(chan grapher.MutationNode)
+    go func() {
+      for _, a := range applied {
+        ch <- a
+      }
+      close(ch)
+    }()
+    if err := tr.TransformMutation(m, ch, ids); err != nil {
+      t.Fatal(err.String())
+    }
+    if op := string(m.op.([]byte)); op != "null" {
+      result = op
+    }
+    applied = append(applied, m)
+    ids = append(ids, m.blobref)
+  }
+  return result
+}
+
+func newTransformer(t *testing.T, g *grapher.Grapher, kind int, dataType int) grapher.Transformer {
+  tr, err := newMinMaxTransformer(g, kind, dataType)
+  if err != nil {
+    t.Fatal(err.String())
+  }
+  return tr
+}
+
+func TestMinMaxTransformer(t *testing.T) {
+  g := grapher.NewGrapher("a@b", nil, nil, nil, nil, grapher.NoVerification)
+  tests := []struct {
+    tr grapher.Transformer
+    values []string
+    result string
+  }{
+    {newTransformer(t, g, grapher.TransformationMax, grapher.TypeInt64), []string{"5", "3", "12", "-1"}, "12"},
+    {newTransformer(t, g, grapher.TransformationMin, grapher.TypeInt64), []string{"5", "3", "12", "-1"}, "-1"},
+    {newTransformer(t, g, grapher.TransformationMax, grapher.TypeFloat64), []string{"0.5", "2.25", "-7"}, "2.25"},
+    {newTransformer(t, g, grapher.TransformationMin, grapher.TypeFloat64), []string{"0.5", "2.25", "-7"}, "-7"},
+    {newTransformer(t, g, grapher.TransformationMax, grapher.TypeString), []string{`"2011-10-01"`, `"2011-12-24"`, `"2011-11-11"`}, `"2011-12-24"`},
+    {newTransformer(t, g, grapher.TransformationMin, grapher.TypeString), []string{`"2011-10-01"`, `"2011-12-24"`, `"2011-11-11"`}, `"2011-10-01"`},
+  }
+  for _, test := range tests {
+    // Try all rotations of the order in which the mutations arrive
+    for i := 0; i < len(test.values); i++ {
+      values := append(append([]string{}, test.values[i:]...), test.values[:i]...)
+      if result := applyConcurrent(t, test.tr, values); result != test.result {
+        t.Fatalf("Expected %v but got %v for %v", test.result, result, values)
+      }
+    }
+  }
+  // Mutations which are not concurrent simply overwrite the value
+  tr := newTransformer(t, g, grapher.TransformationMax, grapher.TypeInt64)
+  m1 := &dummyMutation{blobref: "m1", op: []byte("5")}
+  m2 := &dummyMutation{blobref: "m2", op: []byte("3")}
+  ch := make(chan grapher.MutationNode, 1)
+  ch <- m1
+  close(ch)
+  if err := tr.TransformMutation(m2, ch, []string{}); err != nil {
+    t.Fatal(err.String())
+  }
+  if string(m2.op.([]byte)) != "3" {
+    t.Fatal("A later mutation has been discarded")
+  }
+}
+
+func TestMinMaxUnsupportedType(t *testing.T) {
+  g := grapher.NewGrapher("a@b", nil, nil, nil, nil, grapher.NoVerification)
+  if _, err := NewMaxTransformer(g, grapher.TypeMap); err == nil {
+    t.Fatal("Max transformer for maps has been created")
+  }
+  if _, err := NewMinTransformer(g, grapher.TypeArray); err == nil {
+    t.Fatal("Min transformer for arrays has been created")
+  }
+}
+
+// A mutation in a DAG. 'deps' are the indices of the mutations it depends on
+type dagMutation struct {
+  value string
+  deps []int
+}
+
+// Returns all orders in which the mutations of the DAG can arrive
+func dagOrders(dag []dagMutation, order []int) (orders [][]int) {
+  if len(order) == len(dag) {
+    return [][]int{order}
+  }
+  applied := make(map[int]bool)
+  for _, i := range order {
+    applied[i] = true
+  }
+  for i, m := range dag {
+    if applied[i] {
+      continue
+    }
+    ready := true
+    for _, dep := range m.deps {
+      ready = ready && applied[dep]
+    }
+    if ready {
+      orders = append(orders, dagOrders(dag, append(append([]int{}, order...), i))...)
+    }
+  }
+  return
+}
+
+// Applies the mutations of the DAG in the given order like the Grapher does and returns the resulting value
+func applyDAG(t *testing.T, tr grapher.Transformer, dag []dagMutation, order []int) string {
+  // past[i] contains all mutations on which mutation i depends, directly or indirectly
+  past := make([]map[int]bool, len(dag))
+  for _, i := range order {
+    past[i] = make(map[int]bool)
+    for _, dep := range dag[i].deps {
+      past[i][dep] = true
+      for p, _ := range past[dep] {
+        past[i][p] = true
+      }
+    }
+  }
+  result := "null"
+  var applied []int
+  for _, i := range order {
+    // The heads of the concurrent branches
+    var heads []grapher.MutationNode
+    for _, a := range applied {
+      if past[i][a] {
+        continue
+      }
+      head := true
+      for _, b := range applied {
+        if !past[i][b] && past[b][a] {
+          head = false
+        }
+      }
+      if head {
+        heads = append(heads, &dummyMutation{blobref: fmt.Sprintf("m%v", a), op: []byte(dag[a].value)})
+      }
+    }
+    m := &dummyMutation{blobref: fmt.Sprintf("m%v", i), op: []byte(dag[i].value)}
+    if err := tr.(grapher.BranchTransformer).TransformMutationBranches(m, heads); err != nil {
+      t.Fatal(err.String())
+    }
+    if op := string(m.op.([]byte)); op != "null" {
+      result = op
+    }
+    applied = append(applied, i)
+  }
+  return result
+}
+
+func TestMinMaxDAG(t *testing.T) {
+  g := grapher.NewGrapher("a@b", nil, nil, nil, nil, grapher.NoVerification)
+  max := newTransformer(t, g, grapher.TransformationMax, grapher.TypeInt64)
+  min := newTransformer(t, g, grapher.TransformationMin, grapher.TypeInt64)
+  tests := []struct {
+    tr grapher.Transformer
+    dag []dagMutation
+    result string
+  }{
+    // 3 overwrites 10. Hence, 5 wins against the branch which ends with 3
+    {max, []dagMutation{{"5", nil}, {"10", nil}, {"3", []int{1}}}, "5"},
+    {min, []dagMutation{{"5", nil}, {"10", nil}, {"3", []int{1}}}, "3"},
+    // Both branches overwrite their first value
+    {max, []dagMutation{{"5", nil}, {"10", nil}, {"3", []int{1}}, {"1", []int{0}}}, "3"},
+    {min, []dagMutation{{"5", nil}, {"10", nil}, {"3", []int{1}}, {"1", []int{0}}}, "1"},
+    // A mutation which depends on both branches overwrites both
+    {max, []dagMutation{{"5", nil}, {"10", nil}, {"2", []int{0, 1}}}, "2"},
+    {max, []dagMutation{{"5", nil}, {"10", nil}, {"2", []int{0, 1}}, {"7", nil}}, "7"},
+    // Branches which fork from a common mutation
+    {max, []dagMutation{{"1", nil}, {"8", []int{0}}, {"4", []int{0}}, {"6", []int{1}}}, "6"},
+    {min, []dagMutation{{"1", nil}, {"8", []int{0}}, {"4", []int{0}}, {"6", []int{1}}}, "4"},
+    // The epsilon operation does not set a value
+    {max, []dagMutation{{"5", nil}, {"10", nil}, {"null", []int{1}}}, "5"},
+  }
+  for _, test := range tests {
+    for _, order := range dagOrders(test.dag, nil) {
+      if result := applyDAG(t, test.tr, test.dag, order); result != test.result {
+        t.Fatalf("Expected %v but got %v in order %v", test.result, result, order)
+      }
+    }
+  }
+}
@@ -29,6 +29,18 @@ func (self *dummyAPI) Blob_Permission(perma grapher.PermaNode, perm grapher.Perm
 func (self *dummyAPI) Blob_Entity(perma grapher.PermaNode, entity grapher.EntityNode) {
 }
 
+func (self *dummyAPI) Blob_Snapshot(perma grapher.PermaNode, snapshot grapher.SnapshotNode) {
+  snap, err := ot.DecodeSnapshot(snapshot.Content())
+  if err != nil {
+    self.t.Fatal(err.String())
+  }
+  var ok bool
+  self.text, ok = snap.Document.(*ot.SimpleText)
+  if !ok {
+    self.t.Fatal("Snapshot does not contain a text")
+  }
+}
+
 func (self *dummyAPI) Blob_Mutation(perma grapher.PermaNode, mutation grapher.MutationNode) {
   if mutation.Field() != "text" {
     self.t.Fatal("Expected 'text' as the field in all mutations")